@@ -1,25 +1,51 @@
 package api
 
+import "time"
+
+// ChallengeResponse is the JSON response returned by the challenge endpoint. The
+// nonce must be signed and sent back in a RegisterRequest.
+type ChallengeResponse struct {
+	Status string `json:"status"`
+	Nonce  string `json:"nonce"`
+	Error  string `json:"error,omitempty"`
+}
+
 // RegisterRequest is the payload sent by a client when registering with the signalling server.
+// PublicKey is a base64-encoded PKIX (DER) public key and Signature is the base64-encoded
+// signature over the nonce issued by the challenge endpoint, made with the matching private key.
+// Groups lists the sync groups the client wants to join; a client only discovers peers
+// that share at least one group with it. ReflexiveIP and ReflexivePort are the client's
+// UDP address as seen by the STUN service, if it could be determined.
 type RegisterRequest struct {
-	LocalIP   string `json:"localIp"`
-	LocalPort int    `json:"localPort"`
+	Groups        []string `json:"groups,omitempty"`
+	LocalIP       string   `json:"localIp"`
+	LocalPort     int      `json:"localPort"`
+	ReflexiveIP   string   `json:"reflexiveIp,omitempty"`
+	ReflexivePort int      `json:"reflexivePort,omitempty"`
+	PublicKey     string   `json:"publicKey"`
+	Nonce         string   `json:"nonce"`
+	Signature     string   `json:"signature"`
 }
 
-// RegisterResponse is the JSON response returned by the register endpoint.
+// RegisterResponse is the JSON response returned by the register endpoint. Token must be
+// presented as a bearer token on every subsequent request made on behalf of ClientID.
 type RegisterResponse struct {
 	Status   string `json:"status"`
 	ClientID string `json:"clientId"`
+	Token    string `json:"token"`
 	Error    string `json:"error,omitempty"`
 }
 
 // ClientSnapshot describes a peer's contact information as returned by discovery.
 type ClientSnapshot struct {
-	ClientID   string `json:"clientId"`
-	PublicIP   string `json:"publicIp"`
-	PublicPort int    `json:"publicPort"`
-	LocalIP    string `json:"localIp,omitempty"`
-	LocalPort  int    `json:"localPort,omitempty"`
+	ClientID      string   `json:"clientId"`
+	Groups        []string `json:"groups,omitempty"`
+	PublicIP      string   `json:"publicIp"`
+	PublicPort    int      `json:"publicPort"`
+	LocalIP       string   `json:"localIp,omitempty"`
+	LocalPort     int      `json:"localPort,omitempty"`
+	ReflexiveIP   string   `json:"reflexiveIp,omitempty"`
+	ReflexivePort int      `json:"reflexivePort,omitempty"`
 }
 
 // DiscoverResponse is the JSON response returned by the discover endpoint.
@@ -28,3 +54,59 @@ type DiscoverResponse struct {
 	Clients []ClientSnapshot `json:"clients"`
 	Error   string           `json:"error,omitempty"`
 }
+
+// Peer event types pushed by the events endpoint.
+const (
+	PeerJoined         = "peer-joined"
+	PeerLeft           = "peer-left"
+	PeerAddressChanged = "peer-address-changed"
+	PunchRequested     = "punch-requested"
+	RelayRequested     = "relay-requested"
+)
+
+// PeerEvent is pushed to subscribers of the events endpoint when a peer sharing a group
+// with them joins, leaves (including TTL expiry), or changes its contact information.
+// A punch-requested event asks the subscriber to start a UDP hole punch towards Client
+// at StartAt, and a relay-requested event asks it to meet Client at the relay described
+// by Relay. StartAt and Relay are only set for those types.
+type PeerEvent struct {
+	Type    string         `json:"type"`
+	Client  ClientSnapshot `json:"client"`
+	StartAt time.Time      `json:"startAt,omitzero"`
+	Relay   *RelayTicket   `json:"relay,omitempty"`
+}
+
+// PunchRequest is the payload sent to the punch endpoint to be introduced to a peer
+// for UDP hole punching.
+type PunchRequest struct {
+	PeerID string `json:"peerId"`
+}
+
+// PunchResponse is the JSON response returned by the punch endpoint. Both sides should
+// start sending probes to each other's reflexive address at StartAt.
+type PunchResponse struct {
+	Status  string         `json:"status"`
+	Peer    ClientSnapshot `json:"peer"`
+	StartAt time.Time      `json:"startAt"`
+	Error   string         `json:"error,omitempty"`
+}
+
+// RelayRequest is the payload sent to the relay endpoint to reach a peer through the
+// server's relay.
+type RelayRequest struct {
+	PeerID string `json:"peerId"`
+}
+
+// RelayTicket tells a client where the relay is and which ticket to present, as the
+// first line sent on its connection, to join a relay session.
+type RelayTicket struct {
+	Address string `json:"address"`
+	Ticket  string `json:"ticket"`
+}
+
+// RelayResponse is the JSON response returned by the relay endpoint.
+type RelayResponse struct {
+	Status string      `json:"status"`
+	Relay  RelayTicket `json:"relay"`
+	Error  string      `json:"error,omitempty"`
+}
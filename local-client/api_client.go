@@ -2,32 +2,142 @@ package main
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net"
 	"net/http"
 	"net/url"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-func register(logger *log.Logger, baseURL, localIP string, localPort int) (string, error) {
-	body, err := json.Marshal(registerRequest{
+// defaultSignallingTimeout bounds each request to the signalling server until
+// the config sets signallingTimeout.
+const defaultSignallingTimeout = 5 * time.Second
+
+// signallingTimeout bounds each request to the signalling server, in
+// nanoseconds, or is zero for defaultSignallingTimeout. It changes when the
+// config file is reloaded.
+var signallingTimeout atomic.Int64
+
+// signallingClient returns an HTTP client for a request to the signalling
+// server.
+func signallingClient() *http.Client {
+	timeout := time.Duration(signallingTimeout.Load())
+	if timeout == 0 {
+		timeout = defaultSignallingTimeout
+	}
+	return &http.Client{Timeout: timeout}
+}
+
+// errUnauthorized is returned when the signalling server no longer accepts our
+// token, as happens when it restarts without a persistent registry.
+var errUnauthorized = errors.New("signalling server rejected the token")
+
+// credentials holds the bearer token the signalling server issued us. It is
+// replaced whenever the client registers again.
+type credentials struct {
+	mu    sync.Mutex
+	token string
+}
+
+func newCredentials(token string) *credentials {
+	return &credentials{token: token}
+}
+
+func (c *credentials) get() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.token
+}
+
+func (c *credentials) set(token string) {
+	c.mu.Lock()
+	c.token = token
+	c.mu.Unlock()
+}
+
+// register signs up with the signalling server. reflexive is our UDP address as
+// reported by its STUN service, or nil if that couldn't be determined.
+func register(logger *log.Logger, baseURL string, id *identity, groups []string, localIP string, localPort int, reflexive *net.UDPAddr) (string, string, error) {
+	nonce, err := fetchChallenge(baseURL)
+	if err != nil {
+		return "", "", err
+	}
+
+	publicKey, err := id.publicKeyDER()
+	if err != nil {
+		return "", "", err
+	}
+
+	signature, err := id.sign([]byte(nonce))
+	if err != nil {
+		return "", "", err
+	}
+
+	payload := registerRequest{
+		Groups:    groups,
 		LocalIP:   localIP,
 		LocalPort: localPort,
-	})
+		PublicKey: base64.StdEncoding.EncodeToString(publicKey),
+		Nonce:     nonce,
+		Signature: base64.StdEncoding.EncodeToString(signature),
+	}
+	if reflexive != nil {
+		payload.ReflexiveIP = reflexive.IP.String()
+		payload.ReflexivePort = reflexive.Port
+	}
+
+	body, err := json.Marshal(payload)
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 
 	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/register", baseURL), bytes.NewReader(body))
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{Timeout: 5 * time.Second}
+	client := signallingClient()
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("register failed: status %s", resp.Status)
+	}
+
+	var registered registerResponse
+	if err := json.NewDecoder(resp.Body).Decode(&registered); err != nil {
+		return "", "", err
+	}
+
+	if registered.ClientID == "" || registered.Token == "" {
+		return "", "", fmt.Errorf("register failed: %s", registered.Error)
+	}
+
+	if expected := clientIDForKey(publicKey); registered.ClientID != expected {
+		return "", "", fmt.Errorf("register failed: server assigned clientId %s, expected %s", registered.ClientID, expected)
+	}
+
+	return registered.ClientID, registered.Token, nil
+}
+
+func fetchChallenge(baseURL string) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/challenge", baseURL), nil)
+	if err != nil {
+		return "", err
+	}
+
+	client := signallingClient()
 	resp, err := client.Do(req)
 	if err != nil {
 		return "", err
@@ -35,101 +145,162 @@ func register(logger *log.Logger, baseURL, localIP string, localPort int) (strin
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("register failed: status %s", resp.Status)
+		return "", fmt.Errorf("challenge failed: status %s", resp.Status)
 	}
 
-	var payload registerResponse
+	var payload challengeResponse
 	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
 		return "", err
 	}
 
-	if payload.ClientID == "" {
-		return "", fmt.Errorf("register failed: %s", payload.Error)
+	if payload.Nonce == "" {
+		return "", fmt.Errorf("challenge failed: %s", payload.Error)
 	}
 
-	return payload.ClientID, nil
+	return payload.Nonce, nil
 }
 
-func connectToPeer(logger *log.Logger, baseURL, selfID string) error {
+func discoverPeers(baseURL, token string) ([]clientSnapshot, error) {
 	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/discover", baseURL), nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	req.Header.Set("Authorization", "Bearer "+token)
 
-	client := &http.Client{Timeout: 5 * time.Second}
+	client := signallingClient()
 	resp, err := client.Do(req)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("discover failed: status %s", resp.Status)
+		return nil, fmt.Errorf("discover failed: status %s", resp.Status)
 	}
 
 	var payload discoverResponse
 	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
-		return err
+		return nil, err
 	}
 
-	for _, peer := range payload.Clients {
-		if peer.ClientID == selfID {
-			continue
-		}
+	return payload.Clients, nil
+}
 
-		addr := pickPeerAddress(peer)
-		if addr == "" {
-			continue
-		}
+// requestPunch asks the signalling server to introduce us to peerID for hole
+// punching, returning the peer's contact details and when to start probing.
+func requestPunch(baseURL, token, peerID string) (clientSnapshot, time.Time, error) {
+	body, err := json.Marshal(punchRequest{PeerID: peerID})
+	if err != nil {
+		return clientSnapshot{}, time.Time{}, err
+	}
 
-		logger.Printf("attempting connection to %s (%s)", peer.ClientID, addr)
-		conn, err := net.DialTimeout("tcp", addr, 3*time.Second)
-		if err != nil {
-			logger.Printf("connect failed to %s: %v", addr, err)
-			continue
-		}
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/punch", baseURL), bytes.NewReader(body))
+	if err != nil {
+		return clientSnapshot{}, time.Time{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	client := signallingClient()
+	resp, err := client.Do(req)
+	if err != nil {
+		return clientSnapshot{}, time.Time{}, err
+	}
+	defer resp.Body.Close()
 
-		_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
-		_, _ = conn.Write([]byte("hello from client\n"))
+	var payload punchResponse
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		return clientSnapshot{}, time.Time{}, err
+	}
 
-		buf := make([]byte, 1024)
-		n, err := conn.Read(buf)
-		if err != nil && err != io.EOF {
-			logger.Printf("read error: %v", err)
-		} else if n > 0 {
-			logger.Printf("received: %q", string(bytes.TrimSpace(buf[:n])))
-		}
-		_ = conn.Close()
-		return nil
+	if resp.StatusCode != http.StatusOK {
+		return clientSnapshot{}, time.Time{}, fmt.Errorf("punch failed: status %s: %s", resp.Status, payload.Error)
+	}
+
+	return payload.Peer, payload.StartAt, nil
+}
+
+// requestRelay asks the signalling server for a relay session with peerID,
+// returning our ticket to join it.
+func requestRelay(baseURL, token, peerID string) (relayTicket, error) {
+	body, err := json.Marshal(relayRequest{PeerID: peerID})
+	if err != nil {
+		return relayTicket{}, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/relay", baseURL), bytes.NewReader(body))
+	if err != nil {
+		return relayTicket{}, err
 	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	client := signallingClient()
+	resp, err := client.Do(req)
+	if err != nil {
+		return relayTicket{}, err
+	}
+	defer resp.Body.Close()
 
-	return fmt.Errorf("no other clients discovered")
+	var payload relayResponse
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		return relayTicket{}, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return relayTicket{}, fmt.Errorf("relay failed: status %s: %s", resp.Status, payload.Error)
+	}
+
+	return payload.Relay, nil
 }
 
-func heartbeatLoop(logger *log.Logger, baseURL, clientID string, interval time.Duration) {
+// heartbeatLoop sends a heartbeat every interval, switching to each new
+// interval received from intervals. If the server has forgotten our token, the
+// client registers again through reregister and carries on with the new token.
+func heartbeatLoop(logger *log.Logger, baseURL, clientID string, auth *credentials, interval time.Duration, intervals <-chan time.Duration, reregister func() (string, error)) {
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
-	for range ticker.C {
-		if err := sendHeartbeat(baseURL, clientID); err != nil {
+	for {
+		select {
+		case interval := <-intervals:
+			ticker.Reset(interval)
+			continue
+		case <-ticker.C:
+		}
+
+		err := sendHeartbeat(baseURL, clientID, auth.get())
+		if errors.Is(err, errUnauthorized) {
+			logger.Printf("heartbeat rejected, registering again")
+			var token string
+			if token, err = reregister(); err == nil {
+				auth.set(token)
+				logger.Printf("registered again with clientId=%s", clientID)
+			}
+		}
+		if err != nil {
 			logger.Printf("heartbeat failed: %v", err)
 		}
 	}
 }
 
-func sendHeartbeat(baseURL, clientID string) error {
+func sendHeartbeat(baseURL, clientID, token string) error {
 	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/heartbeat?clientId=%s", baseURL, url.QueryEscape(clientID)), nil)
 	if err != nil {
 		return err
 	}
+	req.Header.Set("Authorization", "Bearer "+token)
 
-	client := &http.Client{Timeout: 5 * time.Second}
+	client := signallingClient()
 	resp, err := client.Do(req)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusUnauthorized {
+		return errUnauthorized
+	}
 	if resp.StatusCode != http.StatusOK {
 		return fmt.Errorf("heartbeat failed: status %s", resp.Status)
 	}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHeartbeatRegistersAgainWhenTokenIsRejected(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	var accepted atomic.Int32
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer new-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		accepted.Add(1)
+	}))
+	t.Cleanup(api.Close)
+
+	auth := newCredentials("old-token")
+	var registered atomic.Int32
+	reregister := func() (string, error) {
+		registered.Add(1)
+		return "new-token", nil
+	}
+	go heartbeatLoop(logger, api.URL, "self", auth, 10*time.Millisecond, nil, reregister)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for accepted.Load() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for heartbeats with the new token")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := registered.Load(); n != 1 {
+		t.Fatalf("expected to register again once, registered %d times", n)
+	}
+	if auth.get() != "new-token" {
+		t.Fatalf("expected the new token to be kept, got %q", auth.get())
+	}
+}
+
+func TestHeartbeatFollowsIntervalChanges(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	var beats atomic.Int32
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		beats.Add(1)
+	}))
+	t.Cleanup(api.Close)
+
+	intervals := make(chan time.Duration, 1)
+	reregister := func() (string, error) { return "token", nil }
+	go heartbeatLoop(logger, api.URL, "self", newCredentials("token"), time.Hour, intervals, reregister)
+
+	intervals <- 10 * time.Millisecond
+	deadline := time.Now().Add(5 * time.Second)
+	for beats.Load() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for heartbeats at the new interval")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
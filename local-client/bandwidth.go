@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// Traffic with peers is rate limited by token buckets: a global pair, one for
+// sending and one for receiving, shared by every peer, and optionally a pair
+// for a single peer, which that peer's connection uses instead of the global
+// pair. Peers on the local network can be exempted, since the limits are there
+// to spare shared internet links. Changed limits apply straight away, to
+// connections already open as well as new ones.
+
+// throttleChunk is the most that is read or written at once on a rate limited
+// connection, and the smallest burst a bucket allows. It bounds how long a
+// connection keeps to a limit after the limit is changed.
+const throttleChunk = 16 * 1024
+
+// rateLimits are send and receive limits in KiB/s, where 0 is unlimited.
+type rateLimits struct {
+	SendKiBps    int `json:"sendKiBps"`
+	ReceiveKiBps int `json:"receiveKiBps"`
+}
+
+// bandwidthConfig sets the rate limits on peer connections.
+type bandwidthConfig struct {
+	rateLimits
+	// ExemptLAN leaves peers on the local network unlimited.
+	ExemptLAN bool `json:"exemptLan"`
+	// Peers holds limits for single peers, by client ID, which replace the
+	// global limits for them.
+	Peers map[string]rateLimits `json:"peers,omitempty"`
+}
+
+func (l rateLimits) validate() error {
+	if l.SendKiBps < 0 {
+		return fmt.Errorf("sendKiBps must not be negative, got %d", l.SendKiBps)
+	}
+	if l.ReceiveKiBps < 0 {
+		return fmt.Errorf("receiveKiBps must not be negative, got %d", l.ReceiveKiBps)
+	}
+	return nil
+}
+
+func (c bandwidthConfig) validate() error {
+	if err := c.rateLimits.validate(); err != nil {
+		return err
+	}
+	for id, limits := range c.Peers {
+		if err := limits.validate(); err != nil {
+			return fmt.Errorf("peer %s: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// limiterPair holds the buckets for one direction each.
+type limiterPair struct {
+	send    *rate.Limiter
+	receive *rate.Limiter
+}
+
+func newLimiterPair(limits rateLimits) limiterPair {
+	p := limiterPair{
+		send:    rate.NewLimiter(rate.Inf, throttleChunk),
+		receive: rate.NewLimiter(rate.Inf, throttleChunk),
+	}
+	p.set(limits)
+	return p
+}
+
+func (p limiterPair) set(limits rateLimits) {
+	setLimit(p.send, limits.SendKiBps)
+	setLimit(p.receive, limits.ReceiveKiBps)
+}
+
+// setLimit sets l to kibps KiB/s, allowing bursts of a tenth of a second's
+// worth of traffic.
+func setLimit(l *rate.Limiter, kibps int) {
+	if kibps == 0 {
+		l.SetLimit(rate.Inf)
+		return
+	}
+	l.SetLimit(rate.Limit(kibps * 1024))
+	l.SetBurst(max(throttleChunk, kibps*1024/10))
+}
+
+// bandwidth enforces a bandwidthConfig on peer connections.
+type bandwidth struct {
+	mu     sync.Mutex
+	config bandwidthConfig
+	global limiterPair
+	peers  map[string]limiterPair
+}
+
+func newBandwidth(config bandwidthConfig) *bandwidth {
+	b := &bandwidth{
+		global: newLimiterPair(rateLimits{}),
+		peers:  make(map[string]limiterPair),
+	}
+	b.setConfig(config)
+	return b
+}
+
+// currentConfig returns the limits in force.
+func (b *bandwidth) currentConfig() bandwidthConfig {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	config := b.config
+	config.Peers = maps.Clone(b.config.Peers)
+	return config
+}
+
+// setConfig replaces the limits in force. config must be valid.
+func (b *bandwidth) setConfig(config bandwidthConfig) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.config = config
+	b.config.Peers = maps.Clone(config.Peers)
+	b.global.set(config.rateLimits)
+	for id, limits := range config.Peers {
+		if p, ok := b.peers[id]; ok {
+			p.set(limits)
+		} else {
+			b.peers[id] = newLimiterPair(limits)
+		}
+	}
+	for id := range b.peers {
+		if _, ok := config.Peers[id]; !ok {
+			delete(b.peers, id)
+		}
+	}
+}
+
+// limiters returns the buckets for the connection to the peer with the given
+// client ID, reporting false if the connection isn't limited.
+func (b *bandwidth) limiters(clientID string, lan bool) (limiterPair, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if lan && b.config.ExemptLAN {
+		return limiterPair{}, false
+	}
+	if p, ok := b.peers[clientID]; ok {
+		return p, true
+	}
+	return b.global, true
+}
+
+// wrap rate limits conn, the connection to the peer with the given client ID.
+// lan reports whether the peer was reached on the local network.
+func (b *bandwidth) wrap(conn net.Conn, clientID string, lan bool) net.Conn {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &throttledConn{Conn: conn, bw: b, clientID: clientID, lan: lan, ctx: ctx, cancel: cancel}
+}
+
+// throttledConn is a peer connection held to the bandwidth limits. A read
+// takes tokens for what it returned, which holds up the next read, and a
+// write waits for tokens before it goes out.
+type throttledConn struct {
+	net.Conn
+	bw       *bandwidth
+	clientID string
+	lan      bool
+
+	// ctx is cancelled when the connection is closed, to stop any wait.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (c *throttledConn) Read(p []byte) (int, error) {
+	limiters, limited := c.bw.limiters(c.clientID, c.lan)
+	if !limited {
+		return c.Conn.Read(p)
+	}
+
+	if len(p) > throttleChunk {
+		p = p[:throttleChunk]
+	}
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		// A failed wait means the connection has been closed, which the
+		// next read reports.
+		_ = limiters.receive.WaitN(c.ctx, n)
+	}
+	return n, err
+}
+
+func (c *throttledConn) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		limiters, limited := c.bw.limiters(c.clientID, c.lan)
+		if !limited {
+			n, err := c.Conn.Write(p)
+			return written + n, err
+		}
+
+		chunk := p[:min(len(p), throttleChunk)]
+		if err := limiters.send.WaitN(c.ctx, len(chunk)); err != nil {
+			return written, net.ErrClosed
+		}
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (c *throttledConn) Close() error {
+	c.cancel()
+	return c.Conn.Close()
+}
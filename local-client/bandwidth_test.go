@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// timedWrite writes n bytes to conn, drained on the other end of a pipe, and
+// returns how long it took.
+func timedWrite(t *testing.T, conn net.Conn, peer net.Conn, n int) time.Duration {
+	t.Helper()
+
+	go io.Copy(io.Discard, peer)
+
+	start := time.Now()
+	if _, err := conn.Write(make([]byte, n)); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	return time.Since(start)
+}
+
+func TestThrottledConnLimitsSending(t *testing.T) {
+	bw := newBandwidth(bandwidthConfig{rateLimits: rateLimits{SendKiBps: 256}})
+
+	conn, peer := net.Pipe()
+	t.Cleanup(func() {
+		conn.Close()
+		peer.Close()
+	})
+	throttled := bw.wrap(conn, "peer", false)
+
+	// Past the first burst, 128 KiB at 256 KiB/s takes half a second.
+	if took := timedWrite(t, throttled, peer, 160*1024); took < 400*time.Millisecond {
+		t.Fatalf("expected the write to be held to the limit, took %v", took)
+	}
+}
+
+func TestThrottledConnLimitsReceiving(t *testing.T) {
+	bw := newBandwidth(bandwidthConfig{rateLimits: rateLimits{ReceiveKiBps: 256}})
+
+	conn, peer := net.Pipe()
+	t.Cleanup(func() {
+		conn.Close()
+		peer.Close()
+	})
+	throttled := bw.wrap(conn, "peer", false)
+
+	go peer.Write(make([]byte, 160*1024))
+	start := time.Now()
+	if _, err := io.ReadFull(throttled, make([]byte, 160*1024)); err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if took := time.Since(start); took < 400*time.Millisecond {
+		t.Fatalf("expected the reads to be held to the limit, took %v", took)
+	}
+}
+
+func TestBandwidthOverridesAndLANExemption(t *testing.T) {
+	bw := newBandwidth(bandwidthConfig{
+		rateLimits: rateLimits{SendKiBps: 64},
+		ExemptLAN:  true,
+		Peers:      map[string]rateLimits{"fast": {}},
+	})
+
+	if _, limited := bw.limiters("peer", true); limited {
+		t.Fatal("expected a LAN peer to be exempt")
+	}
+	if _, limited := bw.limiters("peer", false); !limited {
+		t.Fatal("expected a peer elsewhere to be limited")
+	}
+
+	conn, peer := net.Pipe()
+	t.Cleanup(func() {
+		conn.Close()
+		peer.Close()
+	})
+	fast := bw.wrap(conn, "fast", false)
+	if took := timedWrite(t, fast, peer, 256*1024); took > 200*time.Millisecond {
+		t.Fatalf("expected the peer's own unlimited setting to replace the global limit, took %v", took)
+	}
+
+	// Changes apply to open connections.
+	bw.setConfig(bandwidthConfig{rateLimits: rateLimits{SendKiBps: 64}})
+	if took := timedWrite(t, fast, peer, 48*1024); took < 400*time.Millisecond {
+		t.Fatalf("expected the global limit once the override was removed, took %v", took)
+	}
+
+	if err := (bandwidthConfig{Peers: map[string]rateLimits{"peer": {ReceiveKiBps: -1}}}).validate(); err == nil {
+		t.Fatal("expected a negative limit to be rejected")
+	}
+}
+
+func TestReachedLocally(t *testing.T) {
+	peer := clientSnapshot{LocalIP: "192.168.1.20", LocalPort: 4000, PublicIP: "203.0.113.7", PublicPort: 4000}
+
+	if !reachedLocally(peer, &net.TCPAddr{IP: net.ParseIP("192.168.1.20"), Port: 51000}) {
+		t.Fatal("expected a connection from the local address to be local")
+	}
+	if reachedLocally(peer, &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 4000}) {
+		t.Fatal("expected a connection from the public address not to be local")
+	}
+	if reachedLocally(clientSnapshot{}, &net.TCPAddr{IP: net.ParseIP("192.168.1.20"), Port: 4000}) {
+		t.Fatal("expected a peer without a local address never to be local")
+	}
+}
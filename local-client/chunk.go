@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+// Files are split into blocks with FastCDC, a content-defined chunking scheme:
+// block boundaries fall where a rolling hash of the last few dozen bytes
+// matches a pattern, rather than at fixed offsets. An edit therefore only
+// changes the blocks it touches, and every block after an insertion or
+// deletion keeps its hash even though its offset has moved, so peers only
+// transfer the blocks around the edit.
+//
+// Peers must agree on the block boundaries of a file for its blocks to match,
+// so the parameters and gear table below are part of the protocol.
+
+const (
+	minBlockSize = 64 * 1024
+	avgBlockSize = 256 * 1024
+	maxBlockSize = 1024 * 1024
+
+	// avgBlockBits is log2(avgBlockSize).
+	avgBlockBits = 18
+)
+
+var (
+	// Normalised chunking: a boundary is harder to find before the average
+	// block size and easier after it, which narrows the spread of block sizes.
+	// The masks test the top bits of the hash, which depend on the most bytes.
+	maskHard = ^(^uint64(0) >> (avgBlockBits + 2))
+	maskEasy = ^(^uint64(0) >> (avgBlockBits - 2))
+
+	gearTable = newGearTable(0x5359_4e43_4d45_5348) // "SYNCMESH"
+)
+
+// newGearTable fills the gear table with pseudo-random values from splitmix64,
+// so that every build derives the same table from seed.
+func newGearTable(seed uint64) [256]uint64 {
+	var table [256]uint64
+	for i := range table {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}
+
+// cutPoint returns the length of the block at the start of data, which holds
+// either at least maxBlockSize bytes or the rest of the file.
+func cutPoint(data []byte) int {
+	n := len(data)
+	if n <= minBlockSize {
+		return n
+	}
+	n = min(n, maxBlockSize)
+	normal := min(n, avgBlockSize)
+
+	var hash uint64
+	i := minBlockSize
+	for ; i < normal; i++ {
+		hash = hash<<1 + gearTable[data[i]]
+		if hash&maskHard == 0 {
+			return i
+		}
+	}
+	for ; i < n; i++ {
+		hash = hash<<1 + gearTable[data[i]]
+		if hash&maskEasy == 0 {
+			return i
+		}
+	}
+	return n
+}
+
+// chunker splits a stream into content-defined blocks.
+type chunker struct {
+	r          io.Reader
+	buf        []byte
+	start, end int
+	eof        bool
+}
+
+func newChunker(r io.Reader) *chunker {
+	return &chunker{r: r, buf: make([]byte, maxBlockSize)}
+}
+
+// next returns the next block, which is only valid until the following call,
+// or io.EOF once the stream is exhausted.
+func (c *chunker) next() ([]byte, error) {
+	if c.end-c.start < maxBlockSize && !c.eof {
+		c.end = copy(c.buf, c.buf[c.start:c.end])
+		c.start = 0
+
+		n, err := io.ReadFull(c.r, c.buf[c.end:])
+		c.end += n
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			c.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+
+	n := cutPoint(c.buf[c.start:c.end])
+	block := c.buf[c.start : c.start+n]
+	c.start += n
+	return block, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math/rand/v2"
+	"testing"
+)
+
+// randomBytes returns n bytes that are the same on every run.
+func randomBytes(t *testing.T, n int) []byte {
+	t.Helper()
+
+	rng := rand.New(rand.NewPCG(1, 2))
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(rng.Uint32())
+	}
+	return data
+}
+
+func chunkSizes(t *testing.T, data []byte) []int {
+	t.Helper()
+
+	var sizes []int
+	c := newChunker(bytes.NewReader(data))
+	for {
+		block, err := c.next()
+		if err == io.EOF {
+			return sizes
+		}
+		if err != nil {
+			t.Fatalf("next returned error: %v", err)
+		}
+		sizes = append(sizes, len(block))
+	}
+}
+
+func TestChunkerBlockSizes(t *testing.T) {
+	data := randomBytes(t, 16*maxBlockSize)
+	sizes := chunkSizes(t, data)
+
+	total := 0
+	for i, size := range sizes {
+		total += size
+		if size > maxBlockSize {
+			t.Fatalf("block %d is %d bytes, over the maximum", i, size)
+		}
+		if size < minBlockSize && i != len(sizes)-1 {
+			t.Fatalf("block %d is %d bytes, under the minimum", i, size)
+		}
+	}
+	if total != len(data) {
+		t.Fatalf("expected blocks to cover %d bytes, got %d", len(data), total)
+	}
+
+	// Random data should average out near the target size.
+	if avg := total / len(sizes); avg < avgBlockSize/2 || avg > 2*avgBlockSize {
+		t.Fatalf("expected an average block size near %d, got %d", avgBlockSize, avg)
+	}
+}
+
+func TestChunkerHandlesSmallAndEmptyInput(t *testing.T) {
+	if sizes := chunkSizes(t, nil); len(sizes) != 0 {
+		t.Fatalf("expected no blocks for empty input, got %v", sizes)
+	}
+	if sizes := chunkSizes(t, []byte("hello")); len(sizes) != 1 || sizes[0] != 5 {
+		t.Fatalf("expected a single 5-byte block, got %v", sizes)
+	}
+}
+
+func TestChunkerBoundariesSurviveInsertion(t *testing.T) {
+	data := randomBytes(t, 8*maxBlockSize)
+	_, before, err := hashContent(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("hashContent returned error: %v", err)
+	}
+
+	// Insert a few bytes near the start, shifting everything after them.
+	edited := append(append(append([]byte{}, data[:1000]...), []byte("inserted")...), data[1000:]...)
+	_, after, err := hashContent(bytes.NewReader(edited))
+	if err != nil {
+		t.Fatalf("hashContent returned error: %v", err)
+	}
+
+	known := make(map[string]bool)
+	for _, b := range before {
+		known[b.Hash] = true
+	}
+	shared := 0
+	for _, b := range after {
+		if known[b.Hash] {
+			shared++
+		}
+	}
+
+	// Only the block containing the insertion should differ.
+	if shared < len(after)-2 {
+		t.Fatalf("expected all but the edited block to be unchanged, only %d of %d match", shared, len(after))
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"path"
+	"strings"
+)
+
+// compressedExtensions lists the extensions of file formats that are
+// compressed already, whose blocks are sent as they are even on connections
+// that compress file data.
+var compressedExtensions = map[string]bool{
+	// Archives.
+	".7z": true, ".br": true, ".bz2": true, ".gz": true, ".jar": true, ".lz4": true,
+	".rar": true, ".tgz": true, ".xz": true, ".zip": true, ".zst": true,
+	// Images.
+	".avif": true, ".gif": true, ".heic": true, ".jpeg": true, ".jpg": true, ".png": true, ".webp": true,
+	// Audio and video.
+	".aac": true, ".flac": true, ".m4a": true, ".m4v": true, ".mkv": true, ".mov": true,
+	".mp3": true, ".mp4": true, ".ogg": true, ".opus": true, ".webm": true,
+	// Documents and packages that are zip files underneath.
+	".apk": true, ".docx": true, ".epub": true, ".odt": true, ".pptx": true, ".xlsx": true,
+}
+
+// compressedFormat reports whether the file at p is in a compressed format,
+// judging by its extension.
+func compressedFormat(p string) bool {
+	return compressedExtensions[strings.ToLower(path.Ext(p))]
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dantdj/syncmesh/local-client/protocol"
+)
+
+func TestCompressedFormat(t *testing.T) {
+	if !compressedFormat("photos/IMG_0001.JPG") {
+		t.Fatal("expected a JPEG to be a compressed format")
+	}
+	if !compressedFormat("backup.tar.gz") {
+		t.Fatal("expected a gzip file to be a compressed format")
+	}
+	if compressedFormat("logs/service.log") || compressedFormat("Makefile") {
+		t.Fatal("expected text files not to be compressed formats")
+	}
+}
+
+func TestSyncSessionCompressesFileData(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	rootA := t.TempDir()
+	rootB := t.TempDir()
+
+	text := bytes.Repeat([]byte("2026-02-03T20:03:11Z INFO request served in 12ms path=/api/v1/items\n"), 32*1024)
+	random := randomBytes(t, 512*1024)
+	if err := os.WriteFile(filepath.Join(rootA, "service.log"), text, 0o644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(rootA, "random.bin"), random, 0o644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	a, err := newSyncer(logger, testIndexDB(t), "AAAAAAAA", rootA, folderSendReceive)
+	if err != nil {
+		t.Fatalf("newSyncer returned error: %v", err)
+	}
+	b, err := newSyncer(logger, testIndexDB(t), "BBBBBBBB", rootB, folderSendReceive)
+	if err != nil {
+		t.Fatalf("newSyncer returned error: %v", err)
+	}
+	a.setCompression(protocol.CompressionAlways)
+	b.setCompression(protocol.CompressionAlways)
+
+	pipeA, connB := net.Pipe()
+	connA := &countingConn{Conn: pipeA}
+	go a.runSession(connA, remotePeer{deviceID: "device-b", clientID: "client-b"})
+	go b.runSession(connB, remotePeer{deviceID: "device-a", clientID: "client-a"})
+	t.Cleanup(func() {
+		connA.Close()
+		connB.Close()
+	})
+
+	waitForFile(t, filepath.Join(rootB, "service.log"), string(text))
+	waitForFile(t, filepath.Join(rootB, "random.bin"), string(random))
+
+	// The random file goes across as it is, the log file in a fraction of its
+	// size.
+	if sent := connA.written.Load(); sent > int64(len(random)+len(text)/4) {
+		t.Fatalf("expected the text to be compressed, sent %d bytes for %d of text and %d random", sent, len(text), len(random))
+	}
+}
+
+func TestSyncSessionNegotiatesCompression(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	a, err := newSyncer(logger, testIndexDB(t), "AAAAAAAA", t.TempDir(), folderSendReceive)
+	if err != nil {
+		t.Fatalf("newSyncer returned error: %v", err)
+	}
+	b, err := newSyncer(logger, testIndexDB(t), "BBBBBBBB", t.TempDir(), folderSendReceive)
+	if err != nil {
+		t.Fatalf("newSyncer returned error: %v", err)
+	}
+	a.setCompression(protocol.CompressionAlways)
+	b.setCompression(protocol.CompressionNone)
+
+	connA, connB := net.Pipe()
+	go a.runSession(connA, remotePeer{deviceID: "device-b", clientID: "client-b"})
+	go b.runSession(connB, remotePeer{deviceID: "device-a", clientID: "client-a"})
+	t.Cleanup(func() {
+		connA.Close()
+		connB.Close()
+	})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(a.activeSessions()) == 0 || len(b.activeSessions()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the sessions to start")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	for _, s := range []*syncer{a, b} {
+		if c := s.activeSessions()[0].compression; c != protocol.CompressionNone {
+			t.Fatalf("expected the two to settle on no compression, got %q", c)
+		}
+	}
+}
@@ -0,0 +1,744 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"maps"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dantdj/syncmesh/local-client/protocol"
+	"github.com/fsnotify/fsnotify"
+)
+
+// The client's settings live in a JSON config file, written with the settings
+// from the command line the first time the client runs. Flags given on the
+// command line take precedence over the file. The file is reloaded when it
+// changes, or when asked to through the control API: folders, bandwidth
+// limits, compression, trusted peers, the heartbeat interval and the
+// signalling timeout change straight away, and anything else is reported as
+// needing a restart.
+
+// configReloadDelay is how long the config file must go unchanged before it is
+// reloaded, so that an editor's save is read once and whole.
+const configReloadDelay = 500 * time.Millisecond
+
+var (
+	errConfigSyntax        = errors.New("config file is not valid JSON")
+	errConfigPartlyApplied = errors.New("config only partly applied")
+)
+
+// clientConfig holds every setting of the client.
+type clientConfig struct {
+	// Home is the directory holding the device's identity, trusted peers and
+	// file index.
+	Home string `json:"home"`
+	// Server is the signalling server's base URL.
+	Server string `json:"server"`
+	// STUN is the STUN server's address. It defaults to the signalling
+	// server's host, port 3478.
+	STUN string `json:"stun,omitempty"`
+	// ListenPort is the TCP and UDP port peers connect to.
+	ListenPort int `json:"listenPort"`
+	// API is the loopback address of the control API.
+	API string `json:"api"`
+	// Groups are the sync groups joined on the signalling server.
+	Groups []string `json:"groups"`
+	// Trusted lists the device IDs of trusted peers, besides those in the
+	// trust file and the peers of each folder.
+	Trusted     []string             `json:"trusted,omitempty"`
+	Folders     []folderConfig       `json:"folders"`
+	Bandwidth   bandwidthConfig      `json:"bandwidth"`
+	Compression protocol.Compression `json:"compression"`
+	// ScanInterval is the interval between full rescans of each folder.
+	ScanInterval duration `json:"scanInterval"`
+	// HeartbeatInterval is the interval between heartbeats to the
+	// signalling server.
+	HeartbeatInterval duration `json:"heartbeatInterval"`
+	// SignallingTimeout bounds each request to the signalling server.
+	SignallingTimeout duration `json:"signallingTimeout"`
+}
+
+// folderConfig is a synced folder.
+type folderConfig struct {
+	ID         string           `json:"id"`
+	Path       string           `json:"path"`
+	Mode       folderMode       `json:"mode,omitempty"`
+	Versioning versioningConfig `json:"versioning"`
+	// Peers lists the device IDs the folder is shared with. It is shared
+	// with every peer if there are none.
+	Peers []string `json:"peers,omitempty"`
+}
+
+// duration is a time.Duration written as a string such as "30s".
+type duration time.Duration
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(parsed)
+	return nil
+}
+
+// configError is a problem with the setting at Key, such as folders[1].mode.
+type configError struct {
+	Key string
+	Err error
+}
+
+func (e *configError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Key, e.Err)
+}
+
+func (e *configError) Unwrap() error {
+	return e.Err
+}
+
+// configErrors lists every problem found in a config.
+type configErrors []*configError
+
+func (e configErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// byKey returns the problems' messages by key.
+func (e configErrors) byKey() map[string]string {
+	problems := make(map[string]string, len(e))
+	for _, err := range e {
+		if prev, ok := problems[err.Key]; ok {
+			problems[err.Key] = prev + "; " + err.Err.Error()
+			continue
+		}
+		problems[err.Key] = err.Err.Error()
+	}
+	return problems
+}
+
+// defaultConfig returns the settings used where neither the config file nor
+// the command line says otherwise.
+func defaultConfig() clientConfig {
+	return clientConfig{
+		Home:       ".syncmesh",
+		Server:     "http://localhost:8089",
+		ListenPort: 4000,
+		API:        "127.0.0.1:8385",
+		Groups:     []string{"default"},
+		Folders: []folderConfig{
+			{ID: defaultFolderID, Path: "sync", Mode: folderSendReceive, Versioning: versioningConfig{Type: versioningNone}},
+		},
+		Bandwidth:         bandwidthConfig{ExemptLAN: true},
+		Compression:       protocol.CompressionMetadata,
+		ScanInterval:      duration(time.Hour),
+		HeartbeatInterval: duration(30 * time.Second),
+		SignallingTimeout: duration(5 * time.Second),
+	}
+}
+
+// loadConfig reads the config file at path. Settings it leaves out keep their
+// defaults.
+func loadConfig(path string) (clientConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return clientConfig{}, err
+	}
+	return parseConfig(data)
+}
+
+// parseConfig parses and validates a config file.
+func parseConfig(data []byte) (clientConfig, error) {
+	var raw any
+	if err := json.Unmarshal(data, &raw); err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			line, col := position(data, syntaxErr.Offset)
+			return clientConfig{}, fmt.Errorf("%w: line %d, column %d: %v", errConfigSyntax, line, col, err)
+		}
+		return clientConfig{}, err
+	}
+	if err := checkValue("", raw, reflect.TypeFor[clientConfig]()); err != nil {
+		return clientConfig{}, configErrors{err}
+	}
+
+	config := defaultConfig()
+	if fields, _ := raw.(map[string]any); fields["folders"] != nil {
+		config.Folders = nil
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return clientConfig{}, err
+	}
+	if err := config.validate(); err != nil {
+		return clientConfig{}, err
+	}
+	return config, nil
+}
+
+// position returns the line and column of the byte at offset in data.
+func position(data []byte, offset int64) (int, int) {
+	offset = min(offset, int64(len(data)))
+	before := data[:offset]
+	line := 1 + strings.Count(string(before), "\n")
+	col := int(offset) - strings.LastIndex(string(before), "\n")
+	return line, col
+}
+
+// writeConfig writes config to the file at path, creating its directory if
+// needed.
+func writeConfig(path string, config clientConfig) error {
+	data, err := marshalConfig(config)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o600)
+}
+
+// marshalConfig encodes config as it is written to the config file.
+func marshalConfig(config clientConfig) ([]byte, error) {
+	data, err := json.MarshalIndent(config, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+var durationType = reflect.TypeFor[duration]()
+
+// checkValue checks that v, decoded from JSON at key, fits t: that objects
+// have no keys without a field and that every value has the right type. It
+// catches what decoding straight into t would reject or silently drop, but
+// names the offending key.
+func checkValue(key string, v any, t reflect.Type) *configError {
+	if v == nil {
+		return nil
+	}
+	if t == durationType {
+		s, ok := v.(string)
+		if !ok {
+			return &configError{Key: key, Err: errors.New(`must be a duration such as "30s"`)}
+		}
+		if _, err := time.ParseDuration(s); err != nil {
+			return &configError{Key: key, Err: err}
+		}
+		return nil
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		if _, ok := v.(string); !ok {
+			return &configError{Key: key, Err: errors.New("must be a string")}
+		}
+	case reflect.Bool:
+		if _, ok := v.(bool); !ok {
+			return &configError{Key: key, Err: errors.New("must be true or false")}
+		}
+	case reflect.Int:
+		if n, ok := v.(float64); !ok || n != float64(int(n)) {
+			return &configError{Key: key, Err: errors.New("must be a whole number")}
+		}
+	case reflect.Slice:
+		items, ok := v.([]any)
+		if !ok {
+			return &configError{Key: key, Err: errors.New("must be a list")}
+		}
+		for i, item := range items {
+			if err := checkValue(fmt.Sprintf("%s[%d]", key, i), item, t.Elem()); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		entries, ok := v.(map[string]any)
+		if !ok {
+			return &configError{Key: key, Err: errors.New("must be an object")}
+		}
+		for _, name := range slices.Sorted(maps.Keys(entries)) {
+			if err := checkValue(joinKey(key, name), entries[name], t.Elem()); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		entries, ok := v.(map[string]any)
+		if !ok {
+			return &configError{Key: key, Err: errors.New("must be an object")}
+		}
+		fields := jsonFields(t)
+		for _, name := range slices.Sorted(maps.Keys(entries)) {
+			field, ok := fields[name]
+			if !ok {
+				return &configError{Key: joinKey(key, name), Err: errors.New("unknown setting")}
+			}
+			if err := checkValue(joinKey(key, name), entries[name], field); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// jsonFields returns the types of the fields of struct t by their JSON names,
+// including those of embedded structs.
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := range t.NumField() {
+		field := t.Field(i)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			for name, ft := range jsonFields(field.Type) {
+				fields[name] = ft
+			}
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" || !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fields[name] = field.Type
+	}
+	return fields
+}
+
+func joinKey(key, name string) string {
+	if key == "" {
+		return name
+	}
+	return key + "." + name
+}
+
+// validate checks every setting, returning all the problems found as
+// configErrors.
+func (c clientConfig) validate() error {
+	var errs configErrors
+	add := func(key, format string, args ...any) {
+		errs = append(errs, &configError{Key: key, Err: fmt.Errorf(format, args...)})
+	}
+
+	if c.Home == "" {
+		add("home", "must not be empty")
+	}
+	if u, err := url.Parse(c.Server); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		add("server", "must be an http or https URL, got %q", c.Server)
+	}
+	if c.STUN != "" {
+		if _, _, err := net.SplitHostPort(c.STUN); err != nil {
+			add("stun", "must be a host and port, got %q", c.STUN)
+		}
+	}
+	if c.ListenPort < 1 || c.ListenPort > 65535 {
+		add("listenPort", "must be between 1 and 65535, got %d", c.ListenPort)
+	}
+	if host, _, err := net.SplitHostPort(c.API); err != nil {
+		add("api", "must be a host and port, got %q", c.API)
+	} else if !isLoopbackHost(host) {
+		add("api", "must be a loopback address, got %q", c.API)
+	}
+	for i, group := range c.Groups {
+		if strings.TrimSpace(group) == "" {
+			add(fmt.Sprintf("groups[%d]", i), "must not be empty")
+		}
+	}
+	for i, id := range c.Trusted {
+		if normalizeDeviceID(id) == "" {
+			add(fmt.Sprintf("trusted[%d]", i), "must not be empty")
+		}
+	}
+
+	ids := make(map[string]bool)
+	paths := make(map[string]bool)
+	for i, f := range c.Folders {
+		key := fmt.Sprintf("folders[%d]", i)
+		switch {
+		case f.ID == "":
+			add(key+".id", "must not be empty")
+		case ids[f.ID]:
+			add(key+".id", "folder %s is configured twice", f.ID)
+		}
+		ids[f.ID] = true
+
+		switch {
+		case f.Path == "":
+			add(key+".path", "must not be empty")
+		case paths[filepath.Clean(f.Path)]:
+			add(key+".path", "%s is synced by another folder already", f.Path)
+		}
+		paths[filepath.Clean(f.Path)] = true
+
+		if _, err := parseFolderMode(string(f.Mode)); err != nil {
+			add(key+".mode", "%v", err)
+		}
+		if f.Versioning.Keep < 0 {
+			add(key+".versioning.keep", "must not be negative, got %d", f.Versioning.Keep)
+		}
+		if f.Versioning.MaxAgeDays < 0 {
+			add(key+".versioning.maxAgeDays", "must not be negative, got %d", f.Versioning.MaxAgeDays)
+		}
+		if _, err := (versioningConfig{Type: f.Versioning.Type}).normalize(); err != nil {
+			add(key+".versioning.type", "%v", err)
+		}
+		for j, id := range f.Peers {
+			if normalizeDeviceID(id) == "" {
+				add(fmt.Sprintf("%s.peers[%d]", key, j), "must not be empty")
+			}
+		}
+	}
+
+	checkLimits := func(key string, limits rateLimits) {
+		if limits.SendKiBps < 0 {
+			add(key+".sendKiBps", "must not be negative, got %d", limits.SendKiBps)
+		}
+		if limits.ReceiveKiBps < 0 {
+			add(key+".receiveKiBps", "must not be negative, got %d", limits.ReceiveKiBps)
+		}
+	}
+	checkLimits("bandwidth", c.Bandwidth.rateLimits)
+	for _, id := range slices.Sorted(maps.Keys(c.Bandwidth.Peers)) {
+		checkLimits("bandwidth.peers."+id, c.Bandwidth.Peers[id])
+	}
+
+	if _, err := protocol.ParseCompression(string(c.Compression)); err != nil {
+		add("compression", "%v", err)
+	}
+	for key, d := range map[string]duration{
+		"scanInterval":      c.ScanInterval,
+		"heartbeatInterval": c.HeartbeatInterval,
+		"signallingTimeout": c.SignallingTimeout,
+	} {
+		if d <= 0 {
+			add(key, "must be positive, got %s", time.Duration(d))
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	slices.SortStableFunc(errs, func(a, b *configError) int { return strings.Compare(a.Key, b.Key) })
+	return errs
+}
+
+// trustedIDs returns every device ID the config trusts: those listed as
+// trusted and the peers of every folder.
+func (c clientConfig) trustedIDs() []string {
+	ids := slices.Clone(c.Trusted)
+	for _, f := range c.Folders {
+		ids = append(ids, f.Peers...)
+	}
+	return ids
+}
+
+// configManager keeps the running client in line with its config file.
+type configManager struct {
+	logger *log.Logger
+	path   string
+	// override applies the settings given on the command line to a config
+	// loaded from the file.
+	override func(*clientConfig)
+	syncer   *syncer
+	conns    *connManager
+	trust    *trustStore
+	// heartbeat passes a new heartbeat interval to the heartbeat loop. It
+	// holds at most the latest one.
+	heartbeat chan time.Duration
+
+	// mu serialises reloads and changes, and guards current and written.
+	mu      sync.Mutex
+	current clientConfig
+	// written is the config file as the client last wrote it.
+	written []byte
+}
+
+// config returns the config the client is running with.
+func (m *configManager) config() clientConfig {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.current
+}
+
+// reload reads the config file and applies it, returning the keys of the
+// changed settings that only take effect after a restart. Nothing is applied
+// if the file is invalid. If only some of it can be applied, the running
+// config records what was, so that the next reload tries the rest again.
+func (m *configManager) reload() ([]string, error) {
+	config, err := loadConfig(m.path)
+	if err != nil {
+		return nil, err
+	}
+	if m.override != nil {
+		m.override(&config)
+	}
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	restart, applied, err := m.apply(m.current, config)
+	m.current = applied
+	if err != nil {
+		return restart, fmt.Errorf("%w: %w", errConfigPartlyApplied, err)
+	}
+	return restart, nil
+}
+
+// change makes a change requested while running, such as through the control
+// API. edit makes it to a copy of the running config, which must still be
+// valid, and apply to the client. The config is then written to the file, so
+// that the change lasts and a later reload is compared with it.
+func (m *configManager) change(edit func(*clientConfig), apply func() error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	config := m.current
+	config.Folders = slices.Clone(m.current.Folders)
+	edit(&config)
+	if err := config.validate(); err != nil {
+		return err
+	}
+
+	// As in apply, peers a folder is newly shared with are trusted first.
+	m.trust.setStatic(config.trustedIDs())
+	if err := apply(); err != nil {
+		m.trust.setStatic(m.current.trustedIDs())
+		return err
+	}
+	m.current = config
+
+	if err := writeConfig(m.path, config); err != nil {
+		m.logger.Printf("saving the change to config file %s failed: %v", m.path, err)
+		return nil
+	}
+	m.written, _ = marshalConfig(config)
+	return nil
+}
+
+// apply makes the changes from old to config that can be made while running,
+// and returns the keys of those that can't along with the config now in
+// effect. That keeps the old values of settings needing a restart, and the old
+// settings of any folder that couldn't be changed.
+func (m *configManager) apply(old, config clientConfig) ([]string, clientConfig, error) {
+	var restart []string
+	for key, changed := range map[string]bool{
+		"home":         old.Home != config.Home,
+		"server":       old.Server != config.Server,
+		"stun":         old.STUN != config.STUN,
+		"listenPort":   old.ListenPort != config.ListenPort,
+		"api":          old.API != config.API,
+		"groups":       !slices.Equal(old.Groups, config.Groups),
+		"scanInterval": old.ScanInterval != config.ScanInterval,
+	} {
+		if changed {
+			restart = append(restart, key)
+		}
+	}
+	slices.Sort(restart)
+	// Until then the client keeps running with the old values.
+	config.Home = old.Home
+	config.Server = old.Server
+	config.STUN = old.STUN
+	config.ListenPort = old.ListenPort
+	config.API = old.API
+	config.Groups = old.Groups
+	config.ScanInterval = old.ScanInterval
+
+	if !reflect.DeepEqual(old.Bandwidth, config.Bandwidth) {
+		m.conns.bandwidth.setConfig(config.Bandwidth)
+		m.logger.Printf("bandwidth limits set: send %d KiB/s, receive %d KiB/s, %d peer overrides", config.Bandwidth.SendKiBps, config.Bandwidth.ReceiveKiBps, len(config.Bandwidth.Peers))
+	}
+	if old.HeartbeatInterval != config.HeartbeatInterval && m.heartbeat != nil {
+		interval := time.Duration(config.HeartbeatInterval)
+		select {
+		case <-m.heartbeat:
+		default:
+		}
+		m.heartbeat <- interval
+		m.logger.Printf("heartbeat interval set to %s", interval)
+	}
+	if old.SignallingTimeout != config.SignallingTimeout {
+		signallingTimeout.Store(int64(config.SignallingTimeout))
+		m.logger.Printf("signalling timeout set to %s", time.Duration(config.SignallingTimeout))
+	}
+	if old.Compression != config.Compression {
+		compression, _ := protocol.ParseCompression(string(config.Compression))
+		m.syncer.setCompression(compression)
+		m.logger.Printf("compression set to %s for new connections", compression)
+	}
+	// Peers a folder is newly shared with are trusted before the folder is
+	// offered to them.
+	m.trust.setStatic(config.trustedIDs())
+
+	folders, err := m.applyFolders(old.Folders, config.Folders)
+	config.Folders = folders
+	return restart, config, err
+}
+
+// applyFolders adds, removes and updates folders to go from old to folders,
+// and returns the folders now synced. A folder that couldn't be changed keeps
+// its old settings there, and one that couldn't be added is left out.
+func (m *configManager) applyFolders(old, folders []folderConfig) ([]folderConfig, error) {
+	prev := make(map[string]folderConfig, len(old))
+	for _, f := range old {
+		prev[f.ID] = f
+	}
+	var applied []folderConfig
+	var errs []error
+
+	for _, f := range old {
+		if !slices.ContainsFunc(folders, func(n folderConfig) bool { return n.ID == f.ID }) {
+			if err := m.syncer.removeFolder(f.ID); err != nil {
+				errs = append(errs, fmt.Errorf("removing folder %s: %w", f.ID, err))
+				applied = append(applied, f)
+				continue
+			}
+			m.logger.Printf("removed folder %s", f.ID)
+		}
+	}
+
+	for _, f := range folders {
+		mode, _ := parseFolderMode(string(f.Mode))
+		versioning, _ := f.Versioning.normalize()
+
+		was, ok := prev[f.ID]
+		if ok && filepath.Clean(was.Path) != filepath.Clean(f.Path) {
+			if err := m.syncer.removeFolder(f.ID); err != nil {
+				errs = append(errs, fmt.Errorf("moving folder %s: %w", f.ID, err))
+				applied = append(applied, was)
+				continue
+			}
+			ok = false
+		}
+		if !ok {
+			if err := m.syncer.addFolder(f.ID, f.Path, mode, versioning, f.Peers); err != nil {
+				errs = append(errs, fmt.Errorf("cannot sync %s: %w", f.Path, err))
+				continue
+			}
+			m.logger.Printf("added %s folder %s at %s", mode, f.ID, f.Path)
+			applied = append(applied, f)
+			continue
+		}
+
+		wasMode, _ := parseFolderMode(string(was.Mode))
+		if wasMode != mode {
+			if err := m.syncer.setFolderMode(f.ID, mode); err != nil {
+				errs = append(errs, fmt.Errorf("folder %s: %w", f.ID, err))
+				f.Mode = was.Mode
+			}
+		}
+		if wasVersioning, _ := was.Versioning.normalize(); wasVersioning != versioning {
+			if err := m.syncer.setVersioning(f.ID, versioning); err != nil {
+				errs = append(errs, fmt.Errorf("folder %s: %w", f.ID, err))
+				f.Versioning = was.Versioning
+			}
+		}
+		if !slices.Equal(was.Peers, f.Peers) {
+			if err := m.syncer.setFolderPeers(f.ID, f.Peers); err != nil {
+				errs = append(errs, fmt.Errorf("folder %s: %w", f.ID, err))
+				f.Peers = was.Peers
+			}
+		}
+		applied = append(applied, f)
+	}
+	return applied, errors.Join(errs...)
+}
+
+// watch reloads the config file whenever it changes, until stop is closed.
+// The file's directory is watched rather than the file, since editors often
+// save by replacing it.
+func (m *configManager) watch(stop <-chan struct{}) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(filepath.Dir(m.path)); err != nil {
+		watcher.Close()
+		return err
+	}
+
+	go func() {
+		defer watcher.Close()
+
+		var timer *time.Timer
+		for {
+			select {
+			case <-stop:
+				if timer != nil {
+					timer.Stop()
+				}
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) != filepath.Clean(m.path) || event.Op == fsnotify.Chmod {
+					continue
+				}
+				if timer != nil {
+					timer.Stop()
+				}
+				timer = time.AfterFunc(configReloadDelay, m.reloadFromWatch)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				m.logger.Printf("watching config file failed: %v", err)
+			}
+		}
+	}()
+	return nil
+}
+
+func (m *configManager) reloadFromWatch() {
+	// The client's own changes are applied already. Reloading them would
+	// also put back any setting given on the command line that was changed
+	// since.
+	if data, err := os.ReadFile(m.path); err == nil {
+		m.mu.Lock()
+		written := bytes.Equal(data, m.written)
+		m.mu.Unlock()
+		if written {
+			return
+		}
+	}
+
+	restart, err := m.reload()
+	if errors.Is(err, fs.ErrNotExist) {
+		// Removed, or half way through being replaced.
+		return
+	}
+	if err != nil {
+		m.logger.Printf("config file %s not reloaded: %v", m.path, err)
+		return
+	}
+	m.logger.Printf("reloaded config file %s", m.path)
+	if len(restart) > 0 {
+		m.logger.Printf("restart to apply changes to %s", strings.Join(restart, ", "))
+	}
+}
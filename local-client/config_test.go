@@ -0,0 +1,297 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dantdj/syncmesh/local-client/protocol"
+)
+
+// newTestConfigManager returns a manager for a config file in a temp
+// directory, running with current, along with the syncer it drives.
+func newTestConfigManager(t *testing.T, current clientConfig) (*configManager, *syncer) {
+	t.Helper()
+
+	logger := log.New(io.Discard, "", 0)
+	s := newEmptySyncer(logger, testIndexDB(t), "AAAAAAAA")
+	for _, f := range current.Folders {
+		if err := s.addFolder(f.ID, f.Path, folderSendReceive, versioningConfig{Type: versioningNone}, f.Peers); err != nil {
+			t.Fatalf("addFolder returned error: %v", err)
+		}
+	}
+	dir := t.TempDir()
+	m := &configManager{
+		logger:    logger,
+		path:      filepath.Join(dir, "config.json"),
+		syncer:    s,
+		conns:     newConnManager(logger, "self", nil, s, newBandwidth(current.Bandwidth)),
+		trust:     newTrustStore(filepath.Join(dir, "trusted_peers"), nil),
+		heartbeat: make(chan time.Duration, 1),
+		current:   current,
+	}
+	return m, s
+}
+
+// configKeys returns the keys of the problems in err.
+func configKeys(t *testing.T, err error) []string {
+	t.Helper()
+
+	var invalid configErrors
+	if !errors.As(err, &invalid) {
+		t.Fatalf("expected configErrors, got %v", err)
+	}
+	var keys []string
+	for _, e := range invalid {
+		keys = append(keys, e.Key)
+	}
+	return keys
+}
+
+func TestParseConfigKeepsDefaults(t *testing.T) {
+	config, err := parseConfig([]byte(`{
+		"server": "https://signal.example.com",
+		"heartbeatInterval": "1m",
+		"bandwidth": {"sendKiBps": 512, "peers": {"client-b": {"receiveKiBps": 64}}}
+	}`))
+	if err != nil {
+		t.Fatalf("parseConfig returned error: %v", err)
+	}
+
+	if config.Server != "https://signal.example.com" || config.HeartbeatInterval != duration(time.Minute) {
+		t.Fatalf("expected the file's settings, got %+v", config)
+	}
+	if config.Bandwidth.SendKiBps != 512 || config.Bandwidth.Peers["client-b"].ReceiveKiBps != 64 {
+		t.Fatalf("expected the file's bandwidth limits, got %+v", config.Bandwidth)
+	}
+	if config.ListenPort != 4000 || config.SignallingTimeout != duration(5*time.Second) || config.Compression != protocol.CompressionMetadata {
+		t.Fatalf("expected defaults for settings the file leaves out, got %+v", config)
+	}
+	if len(config.Folders) != 1 || config.Folders[0].ID != defaultFolderID {
+		t.Fatalf("expected the default folder, got %+v", config.Folders)
+	}
+
+	config, err = parseConfig([]byte(`{"folders": []}`))
+	if err != nil {
+		t.Fatalf("parseConfig returned error: %v", err)
+	}
+	if len(config.Folders) != 0 {
+		t.Fatalf("expected an empty folder list to be kept, got %+v", config.Folders)
+	}
+}
+
+func TestParseConfigNamesOffendingKey(t *testing.T) {
+	_, err := parseConfig([]byte(`{"folders": [{"id": "a", "path": "a", "mdoe": "send-only"}]}`))
+	if keys := configKeys(t, err); !slices.Equal(keys, []string{"folders[0].mdoe"}) {
+		t.Fatalf("expected the unknown key to be named, got %v", keys)
+	}
+
+	_, err = parseConfig([]byte(`{"listenPort": "4000"}`))
+	if keys := configKeys(t, err); !slices.Equal(keys, []string{"listenPort"}) {
+		t.Fatalf("expected the mistyped key to be named, got %v", keys)
+	}
+
+	_, err = parseConfig([]byte(`{"scanInterval": "an hour"}`))
+	if keys := configKeys(t, err); !slices.Equal(keys, []string{"scanInterval"}) {
+		t.Fatalf("expected the bad duration to be named, got %v", keys)
+	}
+
+	_, err = parseConfig([]byte(`{
+		"api": "0.0.0.0:8385",
+		"folders": [
+			{"id": "a", "path": "a"},
+			{"id": "a", "path": "b", "mode": "mirror", "versioning": {"type": "simple", "keep": -1}}
+		],
+		"bandwidth": {"peers": {"client-b": {"sendKiBps": -5}}},
+		"heartbeatInterval": "0s"
+	}`))
+	want := []string{"api", "bandwidth.peers.client-b.sendKiBps", "folders[1].id", "folders[1].mode", "folders[1].versioning.keep", "heartbeatInterval"}
+	if keys := configKeys(t, err); !slices.Equal(keys, want) {
+		t.Fatalf("expected every invalid setting to be named, got %v", keys)
+	}
+
+	_, err = parseConfig([]byte("{\n\t\"server\": \"http://localhost:8089\"\n\t\"listenPort\": 4000\n}"))
+	if !errors.Is(err, errConfigSyntax) || !strings.Contains(err.Error(), "line 3") {
+		t.Fatalf("expected a syntax error on line 3, got %v", err)
+	}
+}
+
+func TestWriteConfigRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "home", "config.json")
+	config := defaultConfig()
+	config.Trusted = []string{"BBBBBBBB"}
+	config.Folders[0].Peers = []string{"BBBBBBBB"}
+	config.Bandwidth.Peers = map[string]rateLimits{"client-b": {SendKiBps: 128}}
+
+	if err := writeConfig(path, config); err != nil {
+		t.Fatalf("writeConfig returned error: %v", err)
+	}
+	loaded, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("loadConfig returned error: %v", err)
+	}
+	if loaded.Trusted[0] != "BBBBBBBB" || loaded.Folders[0].Peers[0] != "BBBBBBBB" || loaded.Bandwidth.Peers["client-b"].SendKiBps != 128 {
+		t.Fatalf("expected the config to survive a round trip, got %+v", loaded)
+	}
+	if loaded.ScanInterval != config.ScanInterval {
+		t.Fatalf("expected the scan interval to survive a round trip, got %s", time.Duration(loaded.ScanInterval))
+	}
+}
+
+func TestConfigReloadAppliesChanges(t *testing.T) {
+	current := defaultConfig()
+	current.Folders = []folderConfig{
+		{ID: "docs", Path: t.TempDir()},
+		{ID: "old", Path: t.TempDir()},
+	}
+	m, s := newTestConfigManager(t, current)
+
+	next := current
+	next.Server = "http://signal.example.com:8089"
+	next.Bandwidth = bandwidthConfig{rateLimits: rateLimits{SendKiBps: 256}}
+	next.Compression = protocol.CompressionAlways
+	next.HeartbeatInterval = duration(time.Minute)
+	next.SignallingTimeout = duration(2 * time.Second)
+	t.Cleanup(func() { signallingTimeout.Store(0) })
+	next.Folders = []folderConfig{
+		{ID: "docs", Path: current.Folders[0].Path, Mode: folderReceiveOnly, Peers: []string{"BBBBBBBB"}},
+		{ID: "photos", Path: t.TempDir()},
+	}
+	if err := writeConfig(m.path, next); err != nil {
+		t.Fatalf("writeConfig returned error: %v", err)
+	}
+
+	restart, err := m.reload()
+	if err != nil {
+		t.Fatalf("reload returned error: %v", err)
+	}
+	if !slices.Equal(restart, []string{"server"}) {
+		t.Fatalf("expected only the server to need a restart, got %v", restart)
+	}
+	if server := m.config().Server; server != current.Server {
+		t.Fatalf("expected the client to keep running with server %s, got %s", current.Server, server)
+	}
+	// The restart is still needed after reloading again.
+	if restart, err := m.reload(); err != nil || !slices.Equal(restart, []string{"server"}) {
+		t.Fatalf("expected the server to still need a restart, got %v, %v", restart, err)
+	}
+
+	if ids := s.folderIDs(); !slices.Equal(ids, []string{"docs", "photos"}) {
+		t.Fatalf("expected folders docs and photos, got %v", ids)
+	}
+	docs, _ := s.folderStatus("docs")
+	if docs.Mode != folderReceiveOnly || !slices.Equal(docs.Peers, []string{"BBBBBBBB"}) {
+		t.Fatalf("expected docs to be receive-only and shared with one peer, got %+v", docs)
+	}
+	if !m.trust.isTrusted("BBBBBBBB") {
+		t.Fatal("expected a folder's peers to be trusted")
+	}
+	if bw := m.conns.bandwidth.currentConfig(); bw.SendKiBps != 256 {
+		t.Fatalf("expected the new bandwidth limits, got %+v", bw)
+	}
+	if s.compression != protocol.CompressionAlways {
+		t.Fatalf("expected the new compression, got %q", s.compression)
+	}
+	select {
+	case interval := <-m.heartbeat:
+		if interval != time.Minute {
+			t.Fatalf("expected the heartbeat interval to be set to a minute, got %s", interval)
+		}
+	default:
+		t.Fatal("expected the new heartbeat interval to be passed on")
+	}
+	if timeout := signallingClient().Timeout; timeout != 2*time.Second {
+		t.Fatalf("expected the new signalling timeout, got %s", timeout)
+	}
+
+	// An invalid file changes nothing.
+	if err := os.WriteFile(m.path, []byte(`{"folders": [{"id": "docs"}]}`), 0o600); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	if _, err := m.reload(); !slices.Equal(configKeys(t, err), []string{"folders[0].path"}) {
+		t.Fatalf("expected the missing path to be named, got %v", err)
+	}
+	if ids := s.folderIDs(); len(ids) != 2 || m.config().Server != current.Server {
+		t.Fatalf("expected an invalid file to be ignored, got folders %v", ids)
+	}
+}
+
+func TestConfigReloadKeepsWhatFailedToApply(t *testing.T) {
+	current := defaultConfig()
+	current.Folders = []folderConfig{{ID: "docs", Path: t.TempDir()}}
+	m, s := newTestConfigManager(t, current)
+
+	notDir := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(notDir, []byte("not a folder"), 0o644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	next := current
+	next.Bandwidth = bandwidthConfig{rateLimits: rateLimits{SendKiBps: 64}}
+	next.Folders = []folderConfig{
+		current.Folders[0],
+		{ID: "broken", Path: notDir},
+	}
+	if err := writeConfig(m.path, next); err != nil {
+		t.Fatalf("writeConfig returned error: %v", err)
+	}
+
+	if _, err := m.reload(); !errors.Is(err, errConfigPartlyApplied) {
+		t.Fatalf("expected the config to be partly applied, got %v", err)
+	}
+	applied := m.config()
+	if applied.Bandwidth.SendKiBps != 64 {
+		t.Fatalf("expected the bandwidth limit to be applied, got %+v", applied.Bandwidth)
+	}
+	if len(applied.Folders) != 1 || applied.Folders[0].ID != "docs" {
+		t.Fatalf("expected only the folder that is synced to be recorded, got %+v", applied.Folders)
+	}
+
+	// Once the folder can be synced, reloading the same file adds it.
+	if err := os.Remove(notDir); err != nil {
+		t.Fatalf("failed to remove file: %v", err)
+	}
+	if err := os.Mkdir(notDir, 0o755); err != nil {
+		t.Fatalf("failed to create dir: %v", err)
+	}
+	if _, err := m.reload(); err != nil {
+		t.Fatalf("reload returned error: %v", err)
+	}
+	if ids := s.folderIDs(); !slices.Equal(ids, []string{"broken", "docs"}) {
+		t.Fatalf("expected the folder to be added on the next reload, got %v", ids)
+	}
+}
+
+func TestConfigWatchReloadsOnChange(t *testing.T) {
+	current := defaultConfig()
+	current.Folders = nil
+	m, _ := newTestConfigManager(t, current)
+	if err := writeConfig(m.path, current); err != nil {
+		t.Fatalf("writeConfig returned error: %v", err)
+	}
+
+	stop := make(chan struct{})
+	t.Cleanup(func() { close(stop) })
+	if err := m.watch(stop); err != nil {
+		t.Fatalf("watch returned error: %v", err)
+	}
+
+	next := current
+	next.Bandwidth = bandwidthConfig{rateLimits: rateLimits{ReceiveKiBps: 100}}
+	if err := writeConfig(m.path, next); err != nil {
+		t.Fatalf("writeConfig returned error: %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for m.conns.bandwidth.currentConfig().ReceiveKiBps != 100 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the config file to be reloaded")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
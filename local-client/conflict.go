@@ -0,0 +1,198 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// When two devices change a file independently, neither version descends from
+// the other. Every device settles the conflict the same way, with
+// winsConflict, so they agree on the winner without having to negotiate. The
+// winner keeps the file's name. The device holding the loser moves it aside to
+// a conflict copy named after the date and the device that made it, which then
+// syncs like any other file until the user resolves it.
+
+const (
+	conflictMarker     = ".sync-conflict-"
+	conflictTimeFormat = "20060102-150405"
+)
+
+var errConflictNotFound = errors.New("conflict not found")
+
+// conflictNamePattern matches the name of a conflict copy, capturing the stem
+// of the original name, the date, the device and the original extension.
+var conflictNamePattern = regexp.MustCompile(`^(.*)\.sync-conflict-(\d{8}-\d{6})-([^.]+)(.*)$`)
+
+// conflict is a conflict copy waiting for the user to resolve it.
+type conflict struct {
+	Folder string `json:"folder"`
+	// Path is the conflict copy and Original the file it conflicted with.
+	Path     string    `json:"path"`
+	Original string    `json:"original"`
+	Device   string    `json:"device"`
+	Time     time.Time `json:"time"`
+	Size     int64     `json:"size"`
+}
+
+// winsConflict reports whether a wins a conflict with b. A change beats a
+// deletion, and otherwise the later modification wins, with ties broken by
+// device and then by hash so that every device picks the same winner.
+func winsConflict(a, b fileInfo) bool {
+	if a.Deleted != b.Deleted {
+		return b.Deleted
+	}
+	if !a.ModTime.Equal(b.ModTime) {
+		return a.ModTime.After(b.ModTime)
+	}
+	if a.ModifiedBy != b.ModifiedBy {
+		return a.ModifiedBy > b.ModifiedBy
+	}
+	return a.Hash > b.Hash
+}
+
+// conflictName returns the name for the conflict copy of the file at p, a
+// slash-separated path, made by device and moved aside at t.
+func conflictName(p string, t time.Time, device string) string {
+	dir, name := path.Split(p)
+	ext := path.Ext(name)
+	if ext == name {
+		// A dotfile such as .bashrc has no extension to preserve.
+		ext = ""
+	}
+	stem := strings.TrimSuffix(name, ext)
+	return dir + stem + conflictMarker + t.UTC().Format(conflictTimeFormat) + "-" + device + ext
+}
+
+// parseConflictName reports whether p names a conflict copy and, if so, the
+// path of the original file, the device that made the copy and when it was
+// moved aside.
+func parseConflictName(p string) (string, string, time.Time, bool) {
+	dir, name := path.Split(p)
+	m := conflictNamePattern.FindStringSubmatch(name)
+	if m == nil {
+		return "", "", time.Time{}, false
+	}
+	t, err := time.Parse(conflictTimeFormat, m[2])
+	if err != nil {
+		return "", "", time.Time{}, false
+	}
+	return dir + m[1] + m[4], m[3], t, true
+}
+
+// keepConflictCopy moves the local copy of a file aside before the version
+// that beat it in a conflict replaces it, and records the copy in the index as
+// a new file. It returns the copy's path, or "" if there was no file to move.
+// The folder's writeMu must be held.
+func (s *syncer) keepConflictCopy(f *folder, loser fileInfo) (string, error) {
+	device := loser.ModifiedBy
+	if device == "" {
+		device = s.device
+	}
+	name := conflictName(loser.Path, time.Now(), device)
+
+	err := os.Rename(filepath.Join(f.root, filepath.FromSlash(loser.Path)), filepath.Join(f.root, filepath.FromSlash(name)))
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	entry := loser
+	entry.Path = name
+	entry.Version = versionVector(nil).update(s.device)
+	entry.ModifiedBy = s.device
+	if err := s.db.saveFiles(f.id, f.root, []fileInfo{entry}); err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	f.index[name] = entry
+	s.mu.Unlock()
+
+	s.logger.Printf("conflict on %s in folder %s, local version kept as %s", loser.Path, f.id, name)
+	return name, nil
+}
+
+// conflicts lists the conflict copies in every folder, ordered by folder and
+// path.
+func (s *syncer) conflicts() []conflict {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	conflicts := []conflict{}
+	for _, f := range s.folders {
+		for _, info := range f.index {
+			if info.Deleted {
+				continue
+			}
+			original, device, t, ok := parseConflictName(info.Path)
+			if !ok {
+				continue
+			}
+			conflicts = append(conflicts, conflict{
+				Folder:   f.id,
+				Path:     info.Path,
+				Original: original,
+				Device:   device,
+				Time:     t,
+				Size:     info.Size,
+			})
+		}
+	}
+	slices.SortFunc(conflicts, func(a, b conflict) int {
+		if c := strings.Compare(a.Folder, b.Folder); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Path, b.Path)
+	})
+	return conflicts
+}
+
+// resolveConflict resolves the conflict copy at p in folder id, either by
+// deleting it or, if keepCopy is set, by moving it over the original. The
+// folder is then rescanned so that the resolution reaches peers.
+func (s *syncer) resolveConflict(id, p string, keepCopy bool) error {
+	s.mu.Lock()
+	f, ok := s.folders[id]
+	var info fileInfo
+	var found bool
+	if ok {
+		info, found = f.index[p]
+	}
+	s.mu.Unlock()
+	if !ok {
+		return errFolderNotFound
+	}
+
+	original, _, _, isConflict := parseConflictName(p)
+	if !found || info.Deleted || !isConflict {
+		return errConflictNotFound
+	}
+	if !filepath.IsLocal(filepath.FromSlash(p)) {
+		return fmt.Errorf("refusing to resolve outside folder: %q", p)
+	}
+
+	f.writeMu.Lock()
+	copyPath := filepath.Join(f.root, filepath.FromSlash(p))
+	var err error
+	if keepCopy {
+		err = os.Rename(copyPath, filepath.Join(f.root, filepath.FromSlash(original)))
+	} else {
+		err = os.Remove(copyPath)
+	}
+	f.writeMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return s.rescanFolder(id)
+}
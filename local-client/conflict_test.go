@@ -0,0 +1,149 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestConflictNames(t *testing.T) {
+	when := time.Date(2026, 3, 14, 15, 9, 26, 0, time.UTC)
+
+	name := conflictName("docs/report.final.pdf", when, "AAAAAAA")
+	if name != "docs/report.final.sync-conflict-20260314-150926-AAAAAAA.pdf" {
+		t.Fatalf("unexpected conflict name %q", name)
+	}
+	original, device, parsed, ok := parseConflictName(name)
+	if !ok || original != "docs/report.final.pdf" || device != "AAAAAAA" || !parsed.Equal(when) {
+		t.Fatalf("expected %q to parse back, got %q %q %v %v", name, original, device, parsed, ok)
+	}
+
+	name = conflictName(".bashrc", when, "BBBBBBB")
+	if name != ".bashrc.sync-conflict-20260314-150926-BBBBBBB" {
+		t.Fatalf("unexpected conflict name for a dotfile %q", name)
+	}
+	if original, _, _, ok := parseConflictName(name); !ok || original != ".bashrc" {
+		t.Fatalf("expected the dotfile's name to parse back, got %q", original)
+	}
+
+	if _, _, _, ok := parseConflictName("notes/sync-conflict.txt"); ok {
+		t.Fatal("expected an ordinary file not to be taken for a conflict copy")
+	}
+}
+
+func TestWinsConflict(t *testing.T) {
+	now := time.Now()
+	a := fileInfo{Path: "a.txt", Hash: "aaa", ModTime: now, ModifiedBy: "AAAAAAA"}
+	b := fileInfo{Path: "a.txt", Hash: "bbb", ModTime: now, ModifiedBy: "BBBBBBB"}
+
+	if winsConflict(a, b) == winsConflict(b, a) {
+		t.Fatal("expected exactly one side to win")
+	}
+	if !winsConflict(b, a) {
+		t.Fatal("expected the tie on modification time to be broken by device")
+	}
+
+	a.ModTime = now.Add(time.Minute)
+	if !winsConflict(a, b) {
+		t.Fatal("expected the later modification to win")
+	}
+
+	b.Deleted = true
+	if !winsConflict(a, b) || winsConflict(b, a) {
+		t.Fatal("expected a change to beat a deletion")
+	}
+}
+
+func TestSyncSessionKeepsConflictCopies(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	rootA := t.TempDir()
+	rootB := t.TempDir()
+
+	// Both devices change the file before they ever talk, and A's change is
+	// the later one.
+	if err := os.WriteFile(filepath.Join(rootA, "notes.txt"), []byte("from a"), 0o644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(rootB, "notes.txt"), []byte("from b"), 0o644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	earlier := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(filepath.Join(rootB, "notes.txt"), earlier, earlier); err != nil {
+		t.Fatalf("failed to set modification time: %v", err)
+	}
+
+	a, err := newSyncer(logger, testIndexDB(t), "AAAAAAAA", rootA, folderSendReceive)
+	if err != nil {
+		t.Fatalf("newSyncer returned error: %v", err)
+	}
+	b, err := newSyncer(logger, testIndexDB(t), "BBBBBBBB", rootB, folderSendReceive)
+	if err != nil {
+		t.Fatalf("newSyncer returned error: %v", err)
+	}
+
+	connA, connB := net.Pipe()
+	go a.runSession(connA, remotePeer{deviceID: "device-b", clientID: "client-b"})
+	go b.runSession(connB, remotePeer{deviceID: "device-a", clientID: "client-a"})
+	t.Cleanup(func() {
+		connA.Close()
+		connB.Close()
+	})
+
+	waitForFile(t, filepath.Join(rootB, "notes.txt"), "from a")
+
+	// B's version is kept as a conflict copy, which reaches A too.
+	for _, s := range []*syncer{b, a} {
+		deadline := time.Now().Add(5 * time.Second)
+		for len(s.conflicts()) == 0 && time.Now().Before(deadline) {
+			time.Sleep(20 * time.Millisecond)
+		}
+		conflicts := s.conflicts()
+		if len(conflicts) != 1 || conflicts[0].Original != "notes.txt" || conflicts[0].Device != "BBBBBBB" {
+			t.Fatalf("expected one conflict copy of notes.txt made by B, got %+v", conflicts)
+		}
+	}
+	copyPath := b.conflicts()[0].Path
+	waitForFile(t, filepath.Join(rootA, filepath.FromSlash(copyPath)), "from b")
+	waitForFile(t, filepath.Join(rootA, "notes.txt"), "from a")
+}
+
+func TestResolveConflict(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	root := t.TempDir()
+
+	copyName := conflictName("notes.txt", time.Now(), "BBBBBBB")
+	if err := os.WriteFile(filepath.Join(root, "notes.txt"), []byte("winner"), 0o644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(root, copyName), []byte("loser"), 0o644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	s, err := newSyncer(logger, testIndexDB(t), "AAAAAAAA", root, folderSendReceive)
+	if err != nil {
+		t.Fatalf("newSyncer returned error: %v", err)
+	}
+	if len(s.conflicts()) != 1 {
+		t.Fatalf("expected one conflict, got %+v", s.conflicts())
+	}
+
+	if err := s.resolveConflict(defaultFolderID, "notes.txt", true); err != errConflictNotFound {
+		t.Fatalf("expected errConflictNotFound for a file that isn't a conflict copy, got %v", err)
+	}
+	if err := s.resolveConflict(defaultFolderID, copyName, true); err != nil {
+		t.Fatalf("resolveConflict returned error: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(root, "notes.txt"))
+	if err != nil || string(data) != "loser" {
+		t.Fatalf("expected the conflict copy to replace the original, got %q (%v)", data, err)
+	}
+	if len(s.conflicts()) != 0 {
+		t.Fatalf("expected no conflicts after resolving, got %+v", s.conflicts())
+	}
+}
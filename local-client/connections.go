@@ -0,0 +1,446 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	minReconnectDelay = time.Second
+	maxReconnectDelay = 2 * time.Minute
+	// stableSessionTime is how long a session must last before a later
+	// disconnect is treated as a fresh failure rather than part of a streak.
+	stableSessionTime = time.Minute
+)
+
+// connManager keeps one long-lived sync session open to every known peer. It
+// dials peers learned from the signalling server, accepts inbound
+// connections, settles simultaneous dials between the same pair of devices,
+// and redials with exponential backoff when a session ends.
+type connManager struct {
+	logger    *log.Logger
+	selfID    string
+	tlsConfig *tls.Config
+	syncer    *syncer
+	bandwidth *bandwidth
+
+	mu      sync.Mutex
+	peers   map[string]*peerState
+	puncher *holePuncher
+	relay   *relayClient
+}
+
+// peerState tracks a single peer, keyed by its signalling server client ID.
+type peerState struct {
+	// snapshot is the peer's last known contact information. It is nil for
+	// peers that have only ever connected to us, which are never redialed.
+	snapshot *clientSnapshot
+
+	conn     net.Conn
+	deviceID string
+	outbound bool
+	since    time.Time
+	// lan records that the peer was reached on the local network.
+	lan bool
+
+	dialing bool
+	backoff time.Duration
+	retry   *time.Timer
+}
+
+// Connection states reported for peers.
+const (
+	peerConnected    = "connected"
+	peerConnecting   = "connecting"
+	peerWaiting      = "waiting"
+	peerDisconnected = "disconnected"
+)
+
+// peerStatus describes a peer and its connection.
+type peerStatus struct {
+	ClientID    string    `json:"clientId"`
+	DeviceID    string    `json:"deviceId,omitempty"`
+	State       string    `json:"state"`
+	Address     string    `json:"address,omitempty"`
+	Outbound    bool      `json:"outbound"`
+	LAN         bool      `json:"lan,omitempty"`
+	ConnectedAt time.Time `json:"connectedAt,omitzero"`
+}
+
+// newConnManager returns a manager whose connections are held to the limits in
+// bw.
+func newConnManager(logger *log.Logger, selfID string, tlsConfig *tls.Config, s *syncer, bw *bandwidth) *connManager {
+	return &connManager{
+		logger:    logger,
+		selfID:    selfID,
+		tlsConfig: tlsConfig,
+		syncer:    s,
+		bandwidth: bw,
+		peers:     make(map[string]*peerState),
+	}
+}
+
+// addPeer records a peer's contact information and connects to it unless a
+// session or a connection attempt already exists.
+func (m *connManager) addPeer(peer clientSnapshot) {
+	if peer.ClientID == m.selfID {
+		return
+	}
+
+	m.mu.Lock()
+	st := m.state(peer.ClientID)
+	st.snapshot = &peer
+	idle := st.conn == nil && !st.dialing && st.retry == nil
+	m.mu.Unlock()
+
+	if idle {
+		go m.dial(peer.ClientID)
+	}
+}
+
+// updatePeer records new contact information for a peer and reconnects to it
+// straight away, since any existing session may be using a stale address.
+func (m *connManager) updatePeer(peer clientSnapshot) {
+	if peer.ClientID == m.selfID {
+		return
+	}
+
+	m.mu.Lock()
+	st := m.state(peer.ClientID)
+	st.snapshot = &peer
+	st.backoff = 0
+	m.stopRetryLocked(st)
+	if st.conn != nil {
+		st.conn.Close()
+		st.conn = nil
+	}
+	m.mu.Unlock()
+
+	go m.dial(peer.ClientID)
+}
+
+// removePeer forgets a peer and closes any session with it.
+func (m *connManager) removePeer(clientID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	st, ok := m.peers[clientID]
+	if !ok {
+		return
+	}
+	m.stopRetryLocked(st)
+	if st.conn != nil {
+		st.conn.Close()
+	}
+	delete(m.peers, clientID)
+}
+
+// knownPeers returns the client IDs of every peer with contact information.
+func (m *connManager) knownPeers() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var ids []string
+	for id, st := range m.peers {
+		if st.snapshot != nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// connected returns the peers that currently have a session, ordered by
+// client ID.
+func (m *connManager) connected() []peerStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var peers []peerStatus
+	for id, st := range m.peers {
+		if st.conn == nil {
+			continue
+		}
+		peers = append(peers, st.status(id))
+	}
+	slices.SortFunc(peers, func(a, b peerStatus) int { return strings.Compare(a.ClientID, b.ClientID) })
+	return peers
+}
+
+// peerStatuses returns every tracked peer, connected or not, ordered by client
+// ID.
+func (m *connManager) peerStatuses() []peerStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	peers := make([]peerStatus, 0, len(m.peers))
+	for id, st := range m.peers {
+		peers = append(peers, st.status(id))
+	}
+	slices.SortFunc(peers, func(a, b peerStatus) int { return strings.Compare(a.ClientID, b.ClientID) })
+	return peers
+}
+
+// redial connects to a peer that has no session straight away, rather than
+// waiting out its backoff. It reports whether the peer is known.
+func (m *connManager) redial(clientID string) bool {
+	m.mu.Lock()
+	st, ok := m.peers[clientID]
+	if !ok || st.snapshot == nil {
+		m.mu.Unlock()
+		return false
+	}
+	st.backoff = 0
+	m.stopRetryLocked(st)
+	m.mu.Unlock()
+
+	go m.dial(clientID)
+	return true
+}
+
+// enablePunching lets the manager fall back to hole punching for peers it
+// can't reach directly.
+func (m *connManager) enablePunching(p *holePuncher) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.puncher = p
+}
+
+// enableRelay lets the manager fall back to the signalling server's relay for
+// peers it can reach neither directly nor by hole punching.
+func (m *connManager) enableRelay(r *relayClient) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.relay = r
+}
+
+// handleInbound takes over an authenticated connection accepted from a peer
+// and runs a session on it, unless it duplicates a preferred one.
+func (m *connManager) handleInbound(conn net.Conn, peer remotePeer) {
+	m.attach(conn, peer, false)
+}
+
+func (m *connManager) dial(clientID string) {
+	m.mu.Lock()
+	st, ok := m.peers[clientID]
+	if !ok || st.snapshot == nil || st.conn != nil || st.dialing {
+		m.mu.Unlock()
+		return
+	}
+	st.dialing = true
+	snapshot := *st.snapshot
+	m.mu.Unlock()
+
+	conn, peer, err := m.dialSnapshot(snapshot)
+
+	m.mu.Lock()
+	st.dialing = false
+	if err != nil {
+		if m.peers[clientID] == st && st.conn == nil {
+			delay := m.scheduleRetryLocked(clientID, st)
+			m.logger.Printf("connect failed to %s: %v; retrying in %s", clientID, err, delay)
+		}
+		m.mu.Unlock()
+		return
+	}
+	m.mu.Unlock()
+
+	m.attach(conn, peer, true)
+}
+
+// dialSnapshot connects to a peer over TCP, falling back to a hole-punched
+// QUIC connection if that fails and both sides have a reflexive address, and
+// finally to the relay.
+func (m *connManager) dialSnapshot(snapshot clientSnapshot) (net.Conn, remotePeer, error) {
+	conn, peer, err := m.dialDirect(snapshot)
+	if err == nil {
+		return conn, peer, nil
+	}
+
+	m.mu.Lock()
+	puncher, relay := m.puncher, m.relay
+	m.mu.Unlock()
+
+	if puncher != nil && snapshot.ReflexiveIP != "" {
+		m.logger.Printf("direct connection to %s failed (%v); trying hole punch", snapshot.ClientID, err)
+		conn, peer, err = puncher.connect(snapshot)
+		if err == nil {
+			return conn, peer, nil
+		}
+	}
+
+	if relay == nil {
+		return nil, remotePeer{}, err
+	}
+
+	m.logger.Printf("connection to %s failed (%v); trying relay", snapshot.ClientID, err)
+	return relay.connect(snapshot)
+}
+
+func (m *connManager) dialDirect(snapshot clientSnapshot) (net.Conn, remotePeer, error) {
+	addr := pickPeerAddress(snapshot)
+	if addr == "" {
+		return nil, remotePeer{}, fmt.Errorf("no usable address")
+	}
+
+	m.logger.Printf("attempting connection to %s (%s)", snapshot.ClientID, addr)
+	conn, peer, err := dialPeer(addr, m.tlsConfig)
+	if err != nil {
+		return nil, remotePeer{}, err
+	}
+
+	// The signalling server derives client IDs from public keys, so the peer
+	// we reached must hold the key behind the ID we looked up.
+	if peer.clientID != snapshot.ClientID {
+		conn.Close()
+		return nil, remotePeer{}, fmt.Errorf("certificate at %s belongs to clientId %s", addr, peer.clientID)
+	}
+	return conn, peer, nil
+}
+
+// attach makes conn the session for its peer. When both devices dial each
+// other at once, each ends up with two connections; both sides keep the one
+// dialed by the device with the lower client ID so that they agree on which to
+// close. A newer connection in the same direction replaces the old one, which
+// the peer has evidently given up on. The connection is rate limited unless
+// it is exempt as a LAN connection.
+func (m *connManager) attach(conn net.Conn, peer remotePeer, outbound bool) {
+	m.mu.Lock()
+	st, ok := m.peers[peer.clientID]
+	if !ok {
+		if outbound {
+			// The peer was removed while we were dialing it.
+			m.mu.Unlock()
+			conn.Close()
+			return
+		}
+		st = m.state(peer.clientID)
+	}
+
+	if st.conn != nil {
+		if st.outbound != outbound && !m.preferred(peer.clientID, outbound) {
+			m.mu.Unlock()
+			m.logger.Printf("closing duplicate connection with %s", shortDeviceID(peer.deviceID))
+			conn.Close()
+			return
+		}
+		st.conn.Close()
+	}
+
+	lan := st.snapshot != nil && reachedLocally(*st.snapshot, conn.RemoteAddr())
+	conn = m.bandwidth.wrap(conn, peer.clientID, lan)
+
+	m.stopRetryLocked(st)
+	st.conn = conn
+	st.deviceID = peer.deviceID
+	st.outbound = outbound
+	st.since = time.Now()
+	st.lan = lan
+	m.mu.Unlock()
+
+	go m.serve(st, conn, peer)
+}
+
+// preferred reports whether a connection with the given peer, in the given
+// direction, is the one to keep when there are two.
+func (m *connManager) preferred(clientID string, outbound bool) bool {
+	return (m.selfID < clientID) == outbound
+}
+
+func (m *connManager) serve(st *peerState, conn net.Conn, peer remotePeer) {
+	m.syncer.runSession(conn, peer)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if st.conn != conn {
+		// Replaced by another connection, or closed because the peer left.
+		return
+	}
+	st.conn = nil
+
+	if m.peers[peer.clientID] != st {
+		return
+	}
+	if st.snapshot == nil {
+		delete(m.peers, peer.clientID)
+		return
+	}
+
+	if time.Since(st.since) >= stableSessionTime {
+		st.backoff = 0
+	}
+	delay := m.scheduleRetryLocked(peer.clientID, st)
+	m.logger.Printf("session with %s ended; reconnecting in %s", peer.clientID, delay)
+}
+
+// status describes the peer. m.mu must be held.
+func (st *peerState) status(clientID string) peerStatus {
+	status := peerStatus{ClientID: clientID, DeviceID: st.deviceID}
+	switch {
+	case st.conn != nil:
+		status.State = peerConnected
+		status.Address = st.conn.RemoteAddr().String()
+		status.Outbound = st.outbound
+		status.ConnectedAt = st.since
+		status.LAN = st.lan
+	case st.dialing:
+		status.State = peerConnecting
+	case st.retry != nil:
+		status.State = peerWaiting
+	default:
+		status.State = peerDisconnected
+	}
+	return status
+}
+
+// state returns the tracked state for a peer, creating it if needed. m.mu must
+// be held.
+func (m *connManager) state(clientID string) *peerState {
+	st, ok := m.peers[clientID]
+	if !ok {
+		st = &peerState{}
+		m.peers[clientID] = st
+	}
+	return st
+}
+
+// scheduleRetryLocked arranges for the peer to be dialed again after its
+// current backoff delay, which it returns, and doubles the delay for next
+// time. m.mu must be held.
+func (m *connManager) scheduleRetryLocked(clientID string, st *peerState) time.Duration {
+	delay := max(st.backoff, minReconnectDelay)
+	st.backoff = nextReconnectDelay(delay)
+
+	m.stopRetryLocked(st)
+	var timer *time.Timer
+	timer = time.AfterFunc(delay, func() {
+		m.mu.Lock()
+		if st.retry == timer {
+			st.retry = nil
+		}
+		m.mu.Unlock()
+		m.dial(clientID)
+	})
+	st.retry = timer
+	return delay
+}
+
+func (m *connManager) stopRetryLocked(st *peerState) {
+	if st.retry != nil {
+		st.retry.Stop()
+		st.retry = nil
+	}
+}
+
+// nextReconnectDelay doubles a reconnect delay, capped at maxReconnectDelay.
+func nextReconnectDelay(delay time.Duration) time.Duration {
+	return min(2*delay, maxReconnectDelay)
+}
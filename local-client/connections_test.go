@@ -0,0 +1,159 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestConnManager(t *testing.T, selfID string) *connManager {
+	t.Helper()
+
+	logger := log.New(io.Discard, "", 0)
+	s, err := newSyncer(logger, testIndexDB(t), "AAAAAAAA", t.TempDir(), folderSendReceive)
+	if err != nil {
+		t.Fatalf("newSyncer returned error: %v", err)
+	}
+	return newConnManager(logger, selfID, nil, s, newBandwidth(bandwidthConfig{}))
+}
+
+// pipeConn returns one end of an in-memory connection for the manager and the
+// other end for the test to observe.
+func pipeConn(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+
+	local, remote := net.Pipe()
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+	return local, remote
+}
+
+// expectClosed drains remote until the manager's end of the pipe is closed.
+func expectClosed(t *testing.T, remote net.Conn) {
+	t.Helper()
+
+	done := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, remote)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("expected connection to be closed")
+	}
+}
+
+// expectOpen checks that the manager's end of the pipe is still writing, which
+// a running session does by sending its Hello.
+func expectOpen(t *testing.T, remote net.Conn) {
+	t.Helper()
+
+	_ = remote.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 1)
+	if _, err := remote.Read(buf); err != nil {
+		t.Fatalf("expected connection to be open, got %v", err)
+	}
+}
+
+func TestConnManagerKeepsConnectionDialedByLowerID(t *testing.T) {
+	m := newTestConnManager(t, "aaaa")
+	peer := remotePeer{deviceID: "device-b", clientID: "bbbb"}
+
+	outbound, outboundRemote := pipeConn(t)
+	inbound, inboundRemote := pipeConn(t)
+
+	m.peers[peer.clientID] = &peerState{snapshot: &clientSnapshot{ClientID: peer.clientID}}
+	m.attach(outbound, peer, true)
+	m.attach(inbound, peer, false)
+
+	expectClosed(t, inboundRemote)
+	expectOpen(t, outboundRemote)
+
+	connected := m.connected()
+	if len(connected) != 1 || connected[0].ClientID != peer.clientID || !connected[0].Outbound {
+		t.Fatalf("expected single outbound session with %s, got %+v", peer.clientID, connected)
+	}
+}
+
+func TestConnManagerReplacesConnectionDialedByHigherID(t *testing.T) {
+	m := newTestConnManager(t, "cccc")
+	peer := remotePeer{deviceID: "device-b", clientID: "bbbb"}
+
+	outbound, outboundRemote := pipeConn(t)
+	inbound, inboundRemote := pipeConn(t)
+
+	m.peers[peer.clientID] = &peerState{snapshot: &clientSnapshot{ClientID: peer.clientID}}
+	m.attach(outbound, peer, true)
+	m.attach(inbound, peer, false)
+
+	expectClosed(t, outboundRemote)
+	expectOpen(t, inboundRemote)
+
+	connected := m.connected()
+	if len(connected) != 1 || connected[0].Outbound {
+		t.Fatalf("expected single inbound session, got %+v", connected)
+	}
+}
+
+func TestConnManagerForgetsInboundOnlyPeerOnDisconnect(t *testing.T) {
+	m := newTestConnManager(t, "aaaa")
+	peer := remotePeer{deviceID: "device-b", clientID: "bbbb"}
+
+	inbound, inboundRemote := pipeConn(t)
+	m.handleInbound(inbound, peer)
+	expectOpen(t, inboundRemote)
+
+	inboundRemote.Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		m.mu.Lock()
+		remaining := len(m.peers)
+		m.mu.Unlock()
+
+		if remaining == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected peer to be forgotten, still tracking %d peers", remaining)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestConnManagerRemovePeerClosesSession(t *testing.T) {
+	m := newTestConnManager(t, "aaaa")
+	peer := remotePeer{deviceID: "device-b", clientID: "bbbb"}
+
+	conn, remote := pipeConn(t)
+	m.peers[peer.clientID] = &peerState{snapshot: &clientSnapshot{ClientID: peer.clientID}}
+	m.attach(conn, peer, true)
+	expectOpen(t, remote)
+
+	m.removePeer(peer.clientID)
+	expectClosed(t, remote)
+
+	if len(m.knownPeers()) != 0 {
+		t.Fatalf("expected no known peers, got %v", m.knownPeers())
+	}
+}
+
+func TestNextReconnectDelayDoublesUpToCap(t *testing.T) {
+	delay := minReconnectDelay
+	for range 3 {
+		delay = nextReconnectDelay(delay)
+	}
+	if delay != 8*time.Second {
+		t.Fatalf("expected 8s after three doublings, got %s", delay)
+	}
+
+	if got := nextReconnectDelay(maxReconnectDelay); got != maxReconnectDelay {
+		t.Fatalf("expected delay to be capped at %s, got %s", maxReconnectDelay, got)
+	}
+}
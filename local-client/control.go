@@ -0,0 +1,834 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// The control API lets the user drive the client over HTTP instead of through
+// a desktop UI. It only listens on the loopback interface and has no
+// authentication, so it refuses requests that a web page could have made on
+// the user's behalf.
+
+// controlServer holds the state shared by the control API handlers.
+type controlServer struct {
+	logger *log.Logger
+	syncer *syncer
+	conns  *connManager
+	// config is nil if the client runs without a config file.
+	config   *configManager
+	deviceID string
+	clientID string
+	started  time.Time
+}
+
+func newControlServer(logger *log.Logger, s *syncer, conns *connManager, config *configManager, deviceID, clientID string) *controlServer {
+	return &controlServer{
+		logger:   logger,
+		syncer:   s,
+		conns:    conns,
+		config:   config,
+		deviceID: deviceID,
+		clientID: clientID,
+		started:  time.Now(),
+	}
+}
+
+// serve runs the control API on addr, which must be a loopback address.
+func (c *controlServer) serve(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if !isLoopbackHost(host) {
+		return fmt.Errorf("control API address %s is not a loopback address", addr)
+	}
+
+	srv := &http.Server{
+		Addr:         addr,
+		Handler:      c.routes(),
+		IdleTimeout:  time.Minute,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 30 * time.Second,
+	}
+
+	c.logger.Printf("control API listening on http://%s", addr)
+	return srv.ListenAndServe()
+}
+
+func (c *controlServer) routes() http.Handler {
+	router := httprouter.New()
+
+	router.NotFound = http.HandlerFunc(notFoundResponse)
+	router.MethodNotAllowed = http.HandlerFunc(methodNotAllowedResponse)
+
+	router.HandlerFunc(http.MethodGet, "/status", c.handle(c.StatusHandler))
+	router.HandlerFunc(http.MethodGet, "/peers", c.handle(c.PeersHandler))
+	router.HandlerFunc(http.MethodPost, "/peers/:id/resync", c.handle(c.ResyncPeerHandler))
+	router.HandlerFunc(http.MethodGet, "/folders", c.handle(c.FoldersHandler))
+	router.HandlerFunc(http.MethodPost, "/folders", c.handle(c.AddFolderHandler))
+	router.HandlerFunc(http.MethodDelete, "/folders/:id", c.handle(c.RemoveFolderHandler))
+	router.HandlerFunc(http.MethodPost, "/folders/:id/mode", c.handle(c.FolderModeHandler))
+	router.HandlerFunc(http.MethodPost, "/folders/:id/override", c.handle(c.OverrideRemoteHandler))
+	router.HandlerFunc(http.MethodPost, "/folders/:id/revert", c.handle(c.RevertLocalHandler))
+	router.HandlerFunc(http.MethodPost, "/folders/:id/versioning", c.handle(c.VersioningHandler))
+	router.HandlerFunc(http.MethodPost, "/rescan", c.handle(c.RescanHandler))
+	router.HandlerFunc(http.MethodGet, "/conflicts", c.handle(c.ConflictsHandler))
+	router.HandlerFunc(http.MethodPost, "/conflicts/resolve", c.handle(c.ResolveConflictHandler))
+	router.HandlerFunc(http.MethodGet, "/versions", c.handle(c.VersionsHandler))
+	router.HandlerFunc(http.MethodPost, "/versions/restore", c.handle(c.RestoreVersionHandler))
+	router.HandlerFunc(http.MethodGet, "/bandwidth", c.handle(c.BandwidthHandler))
+	router.HandlerFunc(http.MethodPost, "/bandwidth", c.handle(c.SetBandwidthHandler))
+	router.HandlerFunc(http.MethodGet, "/config", c.handle(c.ConfigHandler))
+	router.HandlerFunc(http.MethodPost, "/config/reload", c.handle(c.ReloadConfigHandler))
+	router.HandlerFunc(http.MethodPost, "/pause", c.handle(c.PauseHandler))
+	router.HandlerFunc(http.MethodPost, "/resume", c.handle(c.ResumeHandler))
+
+	return localOnly(router)
+}
+
+// handle provides a common wrapper for all handlers, allowing for
+// consistent error handling and logging.
+func (c *controlServer) handle(next func(http.ResponseWriter, *http.Request) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := next(w, r); err != nil {
+			c.logger.Printf("control API handler failed: %v", err)
+			serverErrorResponse(w)
+		}
+	}
+}
+
+// localOnly rejects requests that didn't come from a local program: those
+// addressed to a name other than localhost, which is how DNS rebinding
+// reaches loopback services, and those sent by a web page from another origin.
+func localOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if !isLoopbackHost(host) {
+			errorResponse(w, http.StatusForbidden, "the control API only accepts requests addressed to localhost")
+			return
+		}
+
+		if origin := r.Header.Get("Origin"); origin != "" {
+			parsed, err := url.Parse(origin)
+			if err != nil || !isLoopbackHost(parsed.Hostname()) {
+				errorResponse(w, http.StatusForbidden, "cross-origin requests are not allowed")
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (c *controlServer) StatusHandler(w http.ResponseWriter, r *http.Request) error {
+	peers := c.conns.peerStatuses()
+	connected := 0
+	for _, p := range peers {
+		if p.State == peerConnected {
+			connected++
+		}
+	}
+
+	env := envelope{
+		"status":         "success",
+		"deviceId":       c.deviceID,
+		"clientId":       c.clientID,
+		"version":        clientVersion,
+		"startedAt":      c.started.UTC().Format(time.RFC3339),
+		"uptimeSeconds":  int(time.Since(c.started).Seconds()),
+		"paused":         c.syncer.isPaused(),
+		"folders":        len(c.syncer.folderIDs()),
+		"knownPeers":     len(peers),
+		"connectedPeers": connected,
+	}
+
+	if err := writeJSON(w, http.StatusOK, env, nil); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (c *controlServer) PeersHandler(w http.ResponseWriter, r *http.Request) error {
+	env := envelope{
+		"status": "success",
+		"peers":  c.conns.peerStatuses(),
+	}
+
+	if err := writeJSON(w, http.StatusOK, env, nil); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ResyncPeerHandler resends our indexes to a connected peer and pulls anything
+// we are missing from it. A known peer without a session is redialed
+// immediately instead.
+func (c *controlServer) ResyncPeerHandler(w http.ResponseWriter, r *http.Request) error {
+	clientID := httprouter.ParamsFromContext(r.Context()).ByName("id")
+
+	var status int
+	env := envelope{"status": "success"}
+	switch {
+	case c.syncer.resyncPeer(clientID):
+		status = http.StatusOK
+		env["action"] = "resynced"
+	case c.conns.redial(clientID):
+		status = http.StatusAccepted
+		env["action"] = "reconnecting"
+	default:
+		errorResponse(w, http.StatusNotFound, "peer not found")
+		return nil
+	}
+
+	if err := writeJSON(w, status, env, nil); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (c *controlServer) FoldersHandler(w http.ResponseWriter, r *http.Request) error {
+	env := envelope{
+		"status":  "success",
+		"folders": c.syncer.folderStatuses(),
+	}
+
+	if err := writeJSON(w, http.StatusOK, env, nil); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+type addFolderRequest struct {
+	ID   string `json:"id"`
+	Path string `json:"path"`
+	// Mode is send-receive, send-only or receive-only. It defaults to
+	// send-receive.
+	Mode string `json:"mode"`
+	// Versioning defaults to keeping no old versions.
+	Versioning versioningConfig `json:"versioning"`
+	// Peers lists the device IDs the folder is shared with. It defaults to
+	// every peer.
+	Peers []string `json:"peers"`
+}
+
+func (c *controlServer) AddFolderHandler(w http.ResponseWriter, r *http.Request) error {
+	var req addFolderRequest
+
+	if r.Body != nil {
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+			errorResponse(w, http.StatusBadRequest, "invalid JSON body")
+			return nil
+		}
+	}
+
+	if req.ID == "" || req.Path == "" {
+		errorResponse(w, http.StatusBadRequest, "id and path are required")
+		return nil
+	}
+
+	mode, err := parseFolderMode(req.Mode)
+	if err != nil {
+		errorResponse(w, http.StatusBadRequest, err.Error())
+		return nil
+	}
+	versioning, err := req.Versioning.normalize()
+	if err != nil {
+		errorResponse(w, http.StatusBadRequest, err.Error())
+		return nil
+	}
+
+	// Checked first, since the config would otherwise reject the folder as
+	// configured twice.
+	if _, ok := c.syncer.folderStatus(req.ID); ok {
+		errorResponse(w, http.StatusConflict, errFolderExists.Error())
+		return nil
+	}
+
+	err = c.change(func(config *clientConfig) {
+		config.Folders = append(config.Folders, folderConfig{ID: req.ID, Path: req.Path, Mode: mode, Versioning: versioning, Peers: req.Peers})
+	}, func() error {
+		return c.syncer.addFolder(req.ID, req.Path, mode, versioning, req.Peers)
+	})
+	var invalid configErrors
+	if errors.Is(err, errFolderExists) {
+		errorResponse(w, http.StatusConflict, err.Error())
+		return nil
+	}
+	if errors.As(err, &invalid) {
+		errorResponse(w, http.StatusBadRequest, invalid.byKey())
+		return nil
+	}
+	if err != nil {
+		errorResponse(w, http.StatusUnprocessableEntity, fmt.Sprintf("cannot sync %s: %v", req.Path, err))
+		return nil
+	}
+	c.logger.Printf("added %s folder %s at %s", mode, req.ID, req.Path)
+
+	env := envelope{"status": "success"}
+	if f, ok := c.syncer.folderStatus(req.ID); ok {
+		env["folder"] = f
+	}
+
+	if err := writeJSON(w, http.StatusCreated, env, nil); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (c *controlServer) RemoveFolderHandler(w http.ResponseWriter, r *http.Request) error {
+	id := httprouter.ParamsFromContext(r.Context()).ByName("id")
+
+	err := c.change(func(config *clientConfig) {
+		config.Folders = slices.DeleteFunc(config.Folders, func(f folderConfig) bool { return f.ID == id })
+	}, func() error {
+		return c.syncer.removeFolder(id)
+	})
+	var invalid configErrors
+	if errors.Is(err, errFolderNotFound) {
+		errorResponse(w, http.StatusNotFound, err.Error())
+		return nil
+	}
+	if errors.As(err, &invalid) {
+		errorResponse(w, http.StatusBadRequest, invalid.byKey())
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	c.logger.Printf("removed folder %s", id)
+
+	if err := writeJSON(w, http.StatusOK, envelope{"status": "success"}, nil); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+type folderModeRequest struct {
+	Mode string `json:"mode"`
+}
+
+// FolderModeHandler switches a folder between send-receive, send-only and
+// receive-only.
+func (c *controlServer) FolderModeHandler(w http.ResponseWriter, r *http.Request) error {
+	id := httprouter.ParamsFromContext(r.Context()).ByName("id")
+
+	var req folderModeRequest
+
+	if r.Body != nil {
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+			errorResponse(w, http.StatusBadRequest, "invalid JSON body")
+			return nil
+		}
+	}
+
+	if req.Mode == "" {
+		errorResponse(w, http.StatusBadRequest, "mode is required")
+		return nil
+	}
+	mode, err := parseFolderMode(req.Mode)
+	if err != nil {
+		errorResponse(w, http.StatusBadRequest, err.Error())
+		return nil
+	}
+
+	err = c.change(func(config *clientConfig) {
+		editFolder(config, id, func(f *folderConfig) { f.Mode = mode })
+	}, func() error {
+		return c.syncer.setFolderMode(id, mode)
+	})
+	if errors.Is(err, errFolderNotFound) {
+		errorResponse(w, http.StatusNotFound, err.Error())
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	env := envelope{"status": "success"}
+	if f, ok := c.syncer.folderStatus(id); ok {
+		env["folder"] = f
+	}
+
+	if err := writeJSON(w, http.StatusOK, env, nil); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// OverrideRemoteHandler makes peers of a send-only folder go back to its
+// copies of the files they have changed.
+func (c *controlServer) OverrideRemoteHandler(w http.ResponseWriter, r *http.Request) error {
+	id := httprouter.ParamsFromContext(r.Context()).ByName("id")
+
+	n, err := c.syncer.overrideRemote(id)
+	if errors.Is(err, errFolderNotFound) {
+		errorResponse(w, http.StatusNotFound, err.Error())
+		return nil
+	}
+	if errors.Is(err, errWrongMode) {
+		errorResponse(w, http.StatusConflict, "only send-only folders can override remote changes")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	env := envelope{"status": "success", "overridden": n}
+	if f, ok := c.syncer.folderStatus(id); ok {
+		env["folder"] = f
+	}
+
+	if err := writeJSON(w, http.StatusOK, env, nil); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// RevertLocalHandler undoes the local changes to a receive-only folder, going
+// back to the copies its peers have.
+func (c *controlServer) RevertLocalHandler(w http.ResponseWriter, r *http.Request) error {
+	id := httprouter.ParamsFromContext(r.Context()).ByName("id")
+
+	n, err := c.syncer.revertLocalChanges(id)
+	if errors.Is(err, errFolderNotFound) {
+		errorResponse(w, http.StatusNotFound, err.Error())
+		return nil
+	}
+	if errors.Is(err, errWrongMode) {
+		errorResponse(w, http.StatusConflict, "only receive-only folders can revert local changes")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	env := envelope{"status": "success", "reverted": n}
+	if f, ok := c.syncer.folderStatus(id); ok {
+		env["folder"] = f
+	}
+
+	if err := writeJSON(w, http.StatusOK, env, nil); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// VersioningHandler changes how a folder keeps old versions of files.
+func (c *controlServer) VersioningHandler(w http.ResponseWriter, r *http.Request) error {
+	id := httprouter.ParamsFromContext(r.Context()).ByName("id")
+
+	var req versioningConfig
+
+	if r.Body != nil {
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+			errorResponse(w, http.StatusBadRequest, "invalid JSON body")
+			return nil
+		}
+	}
+
+	if req.Type == "" {
+		errorResponse(w, http.StatusBadRequest, "type is required")
+		return nil
+	}
+	config, err := req.normalize()
+	if err != nil {
+		errorResponse(w, http.StatusBadRequest, err.Error())
+		return nil
+	}
+
+	err = c.change(func(cfg *clientConfig) {
+		editFolder(cfg, id, func(f *folderConfig) { f.Versioning = config })
+	}, func() error {
+		return c.syncer.setVersioning(id, config)
+	})
+	if errors.Is(err, errFolderNotFound) {
+		errorResponse(w, http.StatusNotFound, err.Error())
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	env := envelope{"status": "success"}
+	if f, ok := c.syncer.folderStatus(id); ok {
+		env["folder"] = f
+	}
+
+	if err := writeJSON(w, http.StatusOK, env, nil); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// BandwidthHandler reports the rate limits on peer connections.
+func (c *controlServer) BandwidthHandler(w http.ResponseWriter, r *http.Request) error {
+	env := envelope{
+		"status":    "success",
+		"bandwidth": c.conns.bandwidth.currentConfig(),
+	}
+
+	if err := writeJSON(w, http.StatusOK, env, nil); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// SetBandwidthHandler replaces the rate limits on peer connections, including
+// those already open, and saves them to the config file.
+func (c *controlServer) SetBandwidthHandler(w http.ResponseWriter, r *http.Request) error {
+	var req bandwidthConfig
+
+	if r.Body != nil {
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+			errorResponse(w, http.StatusBadRequest, "invalid JSON body")
+			return nil
+		}
+	}
+
+	if err := req.validate(); err != nil {
+		errorResponse(w, http.StatusBadRequest, err.Error())
+		return nil
+	}
+	err := c.change(func(config *clientConfig) {
+		config.Bandwidth = req
+	}, func() error {
+		c.conns.bandwidth.setConfig(req)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	c.logger.Printf("bandwidth limits set: send %d KiB/s, receive %d KiB/s, %d peer overrides", req.SendKiBps, req.ReceiveKiBps, len(req.Peers))
+
+	env := envelope{
+		"status":    "success",
+		"bandwidth": c.conns.bandwidth.currentConfig(),
+	}
+
+	if err := writeJSON(w, http.StatusOK, env, nil); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ConfigHandler reports the config the client is running with.
+func (c *controlServer) ConfigHandler(w http.ResponseWriter, r *http.Request) error {
+	if c.config == nil {
+		errorResponse(w, http.StatusConflict, "running without a config file")
+		return nil
+	}
+
+	env := envelope{
+		"status": "success",
+		"path":   c.config.path,
+		"config": c.config.config(),
+	}
+
+	if err := writeJSON(w, http.StatusOK, env, nil); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// change makes a change to the running client through apply, recording it in
+// the config file with edit when there is one.
+func (c *controlServer) change(edit func(*clientConfig), apply func() error) error {
+	if c.config == nil {
+		return apply()
+	}
+	return c.config.change(edit, apply)
+}
+
+// editFolder applies edit to the settings of folder id in config, if it has
+// them.
+func editFolder(config *clientConfig, id string, edit func(*folderConfig)) {
+	if i := slices.IndexFunc(config.Folders, func(f folderConfig) bool { return f.ID == id }); i >= 0 {
+		edit(&config.Folders[i])
+	}
+}
+
+// ReloadConfigHandler reloads the config file, listing the changed settings
+// that need a restart to take effect. An invalid file is reported key by key
+// and leaves the running config as it was.
+func (c *controlServer) ReloadConfigHandler(w http.ResponseWriter, r *http.Request) error {
+	if c.config == nil {
+		errorResponse(w, http.StatusConflict, "running without a config file")
+		return nil
+	}
+
+	restart, err := c.config.reload()
+	var invalid configErrors
+	switch {
+	case errors.As(err, &invalid):
+		errorResponse(w, http.StatusBadRequest, invalid.byKey())
+		return nil
+	case errors.Is(err, errConfigSyntax):
+		errorResponse(w, http.StatusBadRequest, err.Error())
+		return nil
+	case errors.Is(err, fs.ErrNotExist):
+		errorResponse(w, http.StatusNotFound, err.Error())
+		return nil
+	case errors.Is(err, errConfigPartlyApplied):
+		errorResponse(w, http.StatusUnprocessableEntity, err.Error())
+		return nil
+	case err != nil:
+		return err
+	}
+	c.logger.Printf("reloaded config file %s", c.config.path)
+
+	env := envelope{
+		"status":          "success",
+		"restartRequired": restart,
+	}
+
+	if err := writeJSON(w, http.StatusOK, env, nil); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// RescanHandler rescans every folder, or just the one named by the folder
+// query parameter, before responding.
+func (c *controlServer) RescanHandler(w http.ResponseWriter, r *http.Request) error {
+	var err error
+	if id := r.URL.Query().Get("folder"); id != "" {
+		err = c.syncer.rescanFolder(id)
+	} else {
+		err = c.syncer.rescan()
+	}
+
+	if errors.Is(err, errFolderNotFound) {
+		errorResponse(w, http.StatusNotFound, err.Error())
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	env := envelope{
+		"status":  "success",
+		"folders": c.syncer.folderStatuses(),
+	}
+
+	if err := writeJSON(w, http.StatusOK, env, nil); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (c *controlServer) ConflictsHandler(w http.ResponseWriter, r *http.Request) error {
+	env := envelope{
+		"status":    "success",
+		"conflicts": c.syncer.conflicts(),
+	}
+
+	if err := writeJSON(w, http.StatusOK, env, nil); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+type resolveConflictRequest struct {
+	Folder string `json:"folder"`
+	Path   string `json:"path"`
+	// Keep is "original" to discard the conflict copy, or "conflict" to
+	// replace the original with it.
+	Keep string `json:"keep"`
+}
+
+// ResolveConflictHandler resolves a conflict by keeping either the original
+// or the conflict copy, and responds with the conflicts that remain.
+func (c *controlServer) ResolveConflictHandler(w http.ResponseWriter, r *http.Request) error {
+	var req resolveConflictRequest
+
+	if r.Body != nil {
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+			errorResponse(w, http.StatusBadRequest, "invalid JSON body")
+			return nil
+		}
+	}
+
+	if req.Folder == "" || req.Path == "" {
+		errorResponse(w, http.StatusBadRequest, "folder and path are required")
+		return nil
+	}
+	if req.Keep != "original" && req.Keep != "conflict" {
+		errorResponse(w, http.StatusBadRequest, `keep must be "original" or "conflict"`)
+		return nil
+	}
+
+	err := c.syncer.resolveConflict(req.Folder, req.Path, req.Keep == "conflict")
+	if errors.Is(err, errFolderNotFound) || errors.Is(err, errConflictNotFound) {
+		errorResponse(w, http.StatusNotFound, err.Error())
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	c.logger.Printf("resolved conflict %s in folder %s, kept the %s", req.Path, req.Folder, req.Keep)
+
+	env := envelope{
+		"status":    "success",
+		"conflicts": c.syncer.conflicts(),
+	}
+
+	if err := writeJSON(w, http.StatusOK, env, nil); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// VersionsHandler lists the old versions kept in a folder, of every file or
+// only of the one named by the path query parameter.
+func (c *controlServer) VersionsHandler(w http.ResponseWriter, r *http.Request) error {
+	query := r.URL.Query()
+	id := query.Get("folder")
+	if id == "" {
+		errorResponse(w, http.StatusBadRequest, "folder is required")
+		return nil
+	}
+
+	versions, err := c.syncer.versions(id, query.Get("path"))
+	if errors.Is(err, errFolderNotFound) {
+		errorResponse(w, http.StatusNotFound, err.Error())
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	env := envelope{
+		"status":   "success",
+		"versions": versions,
+	}
+
+	if err := writeJSON(w, http.StatusOK, env, nil); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+type restoreVersionRequest struct {
+	Folder string    `json:"folder"`
+	Path   string    `json:"path"`
+	Time   time.Time `json:"time"`
+}
+
+// RestoreVersionHandler puts an old version of a file back in place, and
+// responds with the versions of the file that remain.
+func (c *controlServer) RestoreVersionHandler(w http.ResponseWriter, r *http.Request) error {
+	var req restoreVersionRequest
+
+	if r.Body != nil {
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+			errorResponse(w, http.StatusBadRequest, "invalid JSON body")
+			return nil
+		}
+	}
+
+	if req.Folder == "" || req.Path == "" || req.Time.IsZero() {
+		errorResponse(w, http.StatusBadRequest, "folder, path and time are required")
+		return nil
+	}
+
+	err := c.syncer.restoreVersion(req.Folder, req.Path, req.Time)
+	if errors.Is(err, errFolderNotFound) || errors.Is(err, errVersionNotFound) {
+		errorResponse(w, http.StatusNotFound, err.Error())
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	c.logger.Printf("restored version of %s in folder %s from %s", req.Path, req.Folder, req.Time.UTC().Format(time.RFC3339))
+
+	versions, err := c.syncer.versions(req.Folder, req.Path)
+	if err != nil {
+		return err
+	}
+
+	env := envelope{
+		"status":   "success",
+		"versions": versions,
+	}
+
+	if err := writeJSON(w, http.StatusOK, env, nil); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (c *controlServer) PauseHandler(w http.ResponseWriter, r *http.Request) error {
+	c.syncer.setPaused(true)
+	c.logger.Printf("sync paused")
+
+	if err := writeJSON(w, http.StatusOK, envelope{"status": "success", "paused": true}, nil); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (c *controlServer) ResumeHandler(w http.ResponseWriter, r *http.Request) error {
+	c.syncer.setPaused(false)
+	c.logger.Printf("sync resumed")
+
+	if err := writeJSON(w, http.StatusOK, envelope{"status": "success", "paused": false}, nil); err != nil {
+		return err
+	}
+
+	return nil
+}
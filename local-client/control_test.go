@@ -0,0 +1,424 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestControlServer(t *testing.T) (*controlServer, string) {
+	t.Helper()
+
+	logger := log.New(io.Discard, "", 0)
+	root := t.TempDir()
+	s, err := newSyncer(logger, testIndexDB(t), "AAAAAAAA", root, folderSendReceive)
+	if err != nil {
+		t.Fatalf("newSyncer returned error: %v", err)
+	}
+	conns := newConnManager(logger, "self", nil, s, newBandwidth(bandwidthConfig{ExemptLAN: true}))
+	return newControlServer(logger, s, conns, nil, "DEVICE", "self"), root
+}
+
+// call sends a request to the control API and decodes the JSON response.
+func call(t *testing.T, c *controlServer, method, target, body string) (int, map[string]any) {
+	t.Helper()
+
+	req := httptest.NewRequest(method, "http://localhost:8385"+target, strings.NewReader(body))
+	recorder := httptest.NewRecorder()
+	c.routes().ServeHTTP(recorder, req)
+
+	var payload map[string]any
+	if err := json.NewDecoder(recorder.Body).Decode(&payload); err != nil {
+		t.Fatalf("failed to decode response to %s %s: %v", method, target, err)
+	}
+	return recorder.Code, payload
+}
+
+func TestControlStatus(t *testing.T) {
+	c, _ := newTestControlServer(t)
+	c.conns.addPeer(clientSnapshot{ClientID: "peer"})
+
+	code, payload := call(t, c, http.MethodGet, "/status", "")
+	if code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", code)
+	}
+	if payload["deviceId"] != "DEVICE" || payload["clientId"] != "self" || payload["version"] != clientVersion {
+		t.Fatalf("unexpected identity in status: %v", payload)
+	}
+	if payload["paused"] != false || payload["folders"] != float64(1) || payload["knownPeers"] != float64(1) || payload["connectedPeers"] != float64(0) {
+		t.Fatalf("unexpected counts in status: %v", payload)
+	}
+}
+
+func TestControlPeers(t *testing.T) {
+	c, _ := newTestControlServer(t)
+	c.conns.addPeer(clientSnapshot{ClientID: "peer"})
+
+	code, payload := call(t, c, http.MethodGet, "/peers", "")
+	if code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", code)
+	}
+	peers, ok := payload["peers"].([]any)
+	if !ok || len(peers) != 1 {
+		t.Fatalf("expected one peer, got %v", payload["peers"])
+	}
+	peer := peers[0].(map[string]any)
+	if peer["clientId"] != "peer" || peer["state"] == peerConnected {
+		t.Fatalf("expected an unconnected peer, got %v", peer)
+	}
+
+	if code, _ := call(t, c, http.MethodPost, "/peers/peer/resync", ""); code != http.StatusAccepted {
+		t.Fatalf("expected status 202 when resyncing an unconnected peer, got %d", code)
+	}
+	if code, _ := call(t, c, http.MethodPost, "/peers/missing/resync", ""); code != http.StatusNotFound {
+		t.Fatalf("expected status 404 when resyncing an unknown peer, got %d", code)
+	}
+}
+
+func TestControlFolders(t *testing.T) {
+	c, _ := newTestControlServer(t)
+	extra := filepath.Join(t.TempDir(), "photos")
+
+	code, payload := call(t, c, http.MethodPost, "/folders", `{"id":"photos","path":"`+filepath.ToSlash(extra)+`"}`)
+	if code != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d (%v)", code, payload)
+	}
+	if _, err := os.Stat(extra); err != nil {
+		t.Fatalf("expected the folder to be created: %v", err)
+	}
+
+	if code, _ := call(t, c, http.MethodPost, "/folders", `{"id":"photos","path":"elsewhere"}`); code != http.StatusConflict {
+		t.Fatalf("expected status 409 for a duplicate folder, got %d", code)
+	}
+	if code, _ := call(t, c, http.MethodPost, "/folders", `{"id":"photos"}`); code != http.StatusBadRequest {
+		t.Fatalf("expected status 400 without a path, got %d", code)
+	}
+
+	_, payload = call(t, c, http.MethodGet, "/folders", "")
+	folders := payload["folders"].([]any)
+	if len(folders) != 2 || folders[0].(map[string]any)["id"] != defaultFolderID || folders[1].(map[string]any)["id"] != "photos" {
+		t.Fatalf("expected the default and photos folders, got %v", folders)
+	}
+
+	if code, _ := call(t, c, http.MethodDelete, "/folders/photos", ""); code != http.StatusOK {
+		t.Fatalf("expected status 200 when removing a folder, got %d", code)
+	}
+	if code, _ := call(t, c, http.MethodDelete, "/folders/photos", ""); code != http.StatusNotFound {
+		t.Fatalf("expected status 404 when removing a missing folder, got %d", code)
+	}
+	if _, err := os.Stat(extra); err != nil {
+		t.Fatalf("expected a removed folder to be left on disk: %v", err)
+	}
+}
+
+func TestControlFolderModes(t *testing.T) {
+	c, _ := newTestControlServer(t)
+
+	code, payload := call(t, c, http.MethodPost, "/folders/"+defaultFolderID+"/mode", `{"mode":"receive-only"}`)
+	if code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d (%v)", code, payload)
+	}
+	if folder := payload["folder"].(map[string]any); folder["mode"] != "receive-only" {
+		t.Fatalf("expected the folder to be receive-only, got %v", folder)
+	}
+	if code, _ := call(t, c, http.MethodPost, "/folders/"+defaultFolderID+"/mode", `{"mode":"mirror"}`); code != http.StatusBadRequest {
+		t.Fatalf("expected status 400 for an unknown mode, got %d", code)
+	}
+	if code, _ := call(t, c, http.MethodPost, "/folders/missing/mode", `{"mode":"send-only"}`); code != http.StatusNotFound {
+		t.Fatalf("expected status 404 for an unknown folder, got %d", code)
+	}
+
+	if code, _ := call(t, c, http.MethodPost, "/folders/"+defaultFolderID+"/override", ""); code != http.StatusConflict {
+		t.Fatalf("expected status 409 when overriding a receive-only folder, got %d", code)
+	}
+	code, payload = call(t, c, http.MethodPost, "/folders/"+defaultFolderID+"/revert", "")
+	if code != http.StatusOK || payload["reverted"] != float64(0) {
+		t.Fatalf("expected nothing to revert, got %d (%v)", code, payload)
+	}
+
+	extra := filepath.Join(t.TempDir(), "artifacts")
+	code, payload = call(t, c, http.MethodPost, "/folders", `{"id":"artifacts","path":"`+filepath.ToSlash(extra)+`","mode":"send-only"}`)
+	if code != http.StatusCreated || payload["folder"].(map[string]any)["mode"] != "send-only" {
+		t.Fatalf("expected a send-only folder to be added, got %d (%v)", code, payload)
+	}
+	if code, _ := call(t, c, http.MethodPost, "/folders/artifacts/revert", ""); code != http.StatusConflict {
+		t.Fatalf("expected status 409 when reverting a send-only folder, got %d", code)
+	}
+}
+
+func TestControlRescan(t *testing.T) {
+	c, root := newTestControlServer(t)
+
+	if err := os.WriteFile(filepath.Join(root, "new.txt"), []byte("hello"), 0o644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	code, payload := call(t, c, http.MethodPost, "/rescan?folder="+defaultFolderID, "")
+	if code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", code)
+	}
+	folder := payload["folders"].([]any)[0].(map[string]any)
+	if folder["files"] != float64(1) || folder["bytes"] != float64(5) {
+		t.Fatalf("expected the new file to be indexed, got %v", folder)
+	}
+
+	if code, _ := call(t, c, http.MethodPost, "/rescan?folder=missing", ""); code != http.StatusNotFound {
+		t.Fatalf("expected status 404 for an unknown folder, got %d", code)
+	}
+}
+
+func TestControlConflicts(t *testing.T) {
+	c, root := newTestControlServer(t)
+
+	copyName := conflictName("notes.txt", time.Now(), "BBBBBBB")
+	for _, name := range []string{"notes.txt", copyName} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(name), 0o644); err != nil {
+			t.Fatalf("failed to write file: %v", err)
+		}
+	}
+	if err := c.syncer.rescan(); err != nil {
+		t.Fatalf("rescan returned error: %v", err)
+	}
+
+	code, payload := call(t, c, http.MethodGet, "/conflicts", "")
+	if code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", code)
+	}
+	conflicts := payload["conflicts"].([]any)
+	if len(conflicts) != 1 || conflicts[0].(map[string]any)["original"] != "notes.txt" {
+		t.Fatalf("expected one conflict with notes.txt, got %v", conflicts)
+	}
+
+	if code, _ := call(t, c, http.MethodPost, "/conflicts/resolve", `{"folder":"default","path":"`+copyName+`","keep":"both"}`); code != http.StatusBadRequest {
+		t.Fatalf("expected status 400 for an unknown choice, got %d", code)
+	}
+	if code, _ := call(t, c, http.MethodPost, "/conflicts/resolve", `{"folder":"default","path":"notes.txt","keep":"original"}`); code != http.StatusNotFound {
+		t.Fatalf("expected status 404 for a file that isn't a conflict copy, got %d", code)
+	}
+
+	code, payload = call(t, c, http.MethodPost, "/conflicts/resolve", `{"folder":"default","path":"`+copyName+`","keep":"original"}`)
+	if code != http.StatusOK || len(payload["conflicts"].([]any)) != 0 {
+		t.Fatalf("expected the conflict to be resolved, got %d %v", code, payload)
+	}
+	if _, err := os.Stat(filepath.Join(root, copyName)); !os.IsNotExist(err) {
+		t.Fatalf("expected the conflict copy to be deleted, got %v", err)
+	}
+}
+
+func TestControlVersions(t *testing.T) {
+	c, root := newTestControlServer(t)
+
+	if code, _ := call(t, c, http.MethodPost, "/folders/"+defaultFolderID+"/versioning", `{"type":"forever"}`); code != http.StatusBadRequest {
+		t.Fatalf("expected status 400 for an unknown versioning type, got %d", code)
+	}
+	code, payload := call(t, c, http.MethodPost, "/folders/"+defaultFolderID+"/versioning", `{"type":"simple","keep":3}`)
+	if code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d (%v)", code, payload)
+	}
+	if versioning := payload["folder"].(map[string]any)["versioning"].(map[string]any); versioning["type"] != "simple" || versioning["keep"] != float64(3) {
+		t.Fatalf("expected simple versioning keeping 3, got %v", versioning)
+	}
+
+	at := time.Date(2026, 2, 3, 20, 3, 11, 0, time.UTC)
+	kept := filepath.Join(root, filepath.FromSlash(versionsDir), filepath.FromSlash(versionName("notes.txt", at)))
+	if err := os.MkdirAll(filepath.Dir(kept), 0o755); err != nil {
+		t.Fatalf("failed to create dir: %v", err)
+	}
+	if err := os.WriteFile(kept, []byte("old"), 0o644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	code, payload = call(t, c, http.MethodGet, "/versions?folder="+defaultFolderID, "")
+	if code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", code)
+	}
+	versions := payload["versions"].([]any)
+	if len(versions) != 1 || versions[0].(map[string]any)["path"] != "notes.txt" || versions[0].(map[string]any)["size"] != float64(3) {
+		t.Fatalf("expected the version of notes.txt, got %v", versions)
+	}
+	if code, _ := call(t, c, http.MethodGet, "/versions", ""); code != http.StatusBadRequest {
+		t.Fatalf("expected status 400 without a folder, got %d", code)
+	}
+
+	if code, _ := call(t, c, http.MethodPost, "/versions/restore", `{"folder":"default","path":"notes.txt","time":"2020-01-01T00:00:00Z"}`); code != http.StatusNotFound {
+		t.Fatalf("expected status 404 for a missing version, got %d", code)
+	}
+	code, payload = call(t, c, http.MethodPost, "/versions/restore", `{"folder":"default","path":"notes.txt","time":"2026-02-03T20:03:11Z"}`)
+	if code != http.StatusOK || len(payload["versions"].([]any)) != 0 {
+		t.Fatalf("expected the version to be restored, got %d (%v)", code, payload)
+	}
+	if data, err := os.ReadFile(filepath.Join(root, "notes.txt")); err != nil || string(data) != "old" {
+		t.Fatalf("expected the restored file, got %q, %v", data, err)
+	}
+}
+
+func TestControlPauseResume(t *testing.T) {
+	c, _ := newTestControlServer(t)
+
+	if _, payload := call(t, c, http.MethodPost, "/pause", ""); payload["paused"] != true || !c.syncer.isPaused() {
+		t.Fatalf("expected sync to be paused, got %v", payload)
+	}
+	if _, payload := call(t, c, http.MethodPost, "/resume", ""); payload["paused"] != false || c.syncer.isPaused() {
+		t.Fatalf("expected sync to be resumed, got %v", payload)
+	}
+}
+
+func TestControlBandwidth(t *testing.T) {
+	c, _ := newTestControlServer(t)
+
+	code, payload := call(t, c, http.MethodPost, "/bandwidth", `{"sendKiBps": 512, "exemptLan": true, "peers": {"peer": {"receiveKiBps": 128}}}`)
+	if code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %v", code, payload)
+	}
+	if config := c.conns.bandwidth.currentConfig(); config.SendKiBps != 512 || !config.ExemptLAN || config.Peers["peer"].ReceiveKiBps != 128 {
+		t.Fatalf("expected the limits to be in force, got %+v", config)
+	}
+
+	_, payload = call(t, c, http.MethodGet, "/bandwidth", "")
+	bandwidth, ok := payload["bandwidth"].(map[string]any)
+	if !ok || bandwidth["sendKiBps"] != float64(512) || bandwidth["receiveKiBps"] != float64(0) {
+		t.Fatalf("expected the limits to be reported, got %v", payload)
+	}
+
+	if code, _ := call(t, c, http.MethodPost, "/bandwidth", `{"sendKiBps": -1}`); code != http.StatusBadRequest {
+		t.Fatalf("expected status 400 for a negative limit, got %d", code)
+	}
+	if code, _ := call(t, c, http.MethodPost, "/bandwidth", `{"upload": 1}`); code != http.StatusBadRequest {
+		t.Fatalf("expected status 400 for an unknown field, got %d", code)
+	}
+}
+
+func TestControlConfig(t *testing.T) {
+	c, _ := newTestControlServer(t)
+
+	if code, _ := call(t, c, http.MethodPost, "/config/reload", ""); code != http.StatusConflict {
+		t.Fatalf("expected status 409 without a config file, got %d", code)
+	}
+
+	current := defaultConfig()
+	current.Folders = nil
+	c.config, _ = newTestConfigManager(t, current)
+
+	next := current
+	next.ListenPort = 4100
+	next.Bandwidth = bandwidthConfig{rateLimits: rateLimits{SendKiBps: 64}}
+	if err := writeConfig(c.config.path, next); err != nil {
+		t.Fatalf("writeConfig returned error: %v", err)
+	}
+	code, payload := call(t, c, http.MethodPost, "/config/reload", "")
+	if code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %v", code, payload)
+	}
+	restart, ok := payload["restartRequired"].([]any)
+	if !ok || len(restart) != 1 || restart[0] != "listenPort" {
+		t.Fatalf("expected the listen port to need a restart, got %v", payload)
+	}
+
+	code, payload = call(t, c, http.MethodGet, "/config", "")
+	if code != http.StatusOK || payload["status"] != "success" {
+		t.Fatalf("expected a successful response, got %d: %v", code, payload)
+	}
+	config, ok := payload["config"].(map[string]any)
+	bandwidth, _ := config["bandwidth"].(map[string]any)
+	if !ok || bandwidth["sendKiBps"] != float64(64) || config["heartbeatInterval"] != "30s" {
+		t.Fatalf("expected the reloaded config, got %v", payload)
+	}
+	if config["listenPort"] != float64(4000) {
+		t.Fatalf("expected the listen port in use until a restart, got %v", config["listenPort"])
+	}
+
+	if err := os.WriteFile(c.config.path, []byte(`{"bandwidth": {"sendKiBps": -1}}`), 0o600); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	code, payload = call(t, c, http.MethodPost, "/config/reload", "")
+	problems, ok := payload["error"].(map[string]any)
+	if code != http.StatusBadRequest || !ok || problems["bandwidth.sendKiBps"] == nil {
+		t.Fatalf("expected status 400 naming the invalid key, got %d: %v", code, payload)
+	}
+}
+
+func TestControlRejectsNonLocalRequests(t *testing.T) {
+	c, _ := newTestControlServer(t)
+	handler := c.routes()
+
+	req := httptest.NewRequest(http.MethodPost, "http://attacker.example:8385/pause", nil)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusForbidden {
+		t.Fatalf("expected status 403 for a non-local Host, got %d", recorder.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "http://localhost:8385/pause", nil)
+	req.Header.Set("Origin", "https://attacker.example")
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusForbidden {
+		t.Fatalf("expected status 403 for a cross-origin request, got %d", recorder.Code)
+	}
+
+	if c.syncer.isPaused() {
+		t.Fatal("expected rejected requests to have no effect")
+	}
+}
+
+func TestControlChangesAreSavedToConfig(t *testing.T) {
+	current := defaultConfig()
+	current.Folders = []folderConfig{{ID: "docs", Path: t.TempDir()}}
+	m, s := newTestConfigManager(t, current)
+	c := newControlServer(log.New(io.Discard, "", 0), s, m.conns, m, "DEVICE", "self")
+
+	photos := t.TempDir()
+	code, payload := call(t, c, http.MethodPost, "/folders", `{"id": "photos", "path": "`+filepath.ToSlash(photos)+`", "mode": "receive-only", "peers": ["BBBBBBBB"]}`)
+	if code != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d: %v", code, payload)
+	}
+	if code, payload := call(t, c, http.MethodPost, "/folders/docs/mode", `{"mode": "send-only"}`); code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %v", code, payload)
+	}
+	if code, payload := call(t, c, http.MethodPost, "/bandwidth", `{"sendKiBps": 256}`); code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %v", code, payload)
+	}
+	if code, _ := call(t, c, http.MethodPost, "/folders", `{"id": "again", "path": "`+filepath.ToSlash(photos)+`"}`); code != http.StatusBadRequest {
+		t.Fatalf("expected status 400 for a folder the config would reject, got %d", code)
+	}
+
+	saved, err := loadConfig(m.path)
+	if err != nil {
+		t.Fatalf("loadConfig returned error: %v", err)
+	}
+	if len(saved.Folders) != 2 || saved.Folders[0].Mode != folderSendOnly || saved.Folders[1].ID != "photos" || saved.Folders[1].Mode != folderReceiveOnly {
+		t.Fatalf("expected the folder changes to be saved, got %+v", saved.Folders)
+	}
+	if saved.Bandwidth.SendKiBps != 256 || m.config().Bandwidth.SendKiBps != 256 {
+		t.Fatalf("expected the bandwidth limits to be saved, got %+v", saved.Bandwidth)
+	}
+	if !m.trust.isTrusted("BBBBBBBB") {
+		t.Fatal("expected a new folder's peers to be trusted")
+	}
+
+	// Reloading the saved file finds nothing to change.
+	if restart, err := m.reload(); err != nil || len(restart) != 0 {
+		t.Fatalf("expected a clean reload, got %v, %v", restart, err)
+	}
+	if ids := s.folderIDs(); !slices.Equal(ids, []string{"docs", "photos"}) {
+		t.Fatalf("expected folders docs and photos, got %v", ids)
+	}
+
+	if code, _ := call(t, c, http.MethodDelete, "/folders/photos", ""); code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", code)
+	}
+	if saved, _ := loadConfig(m.path); len(saved.Folders) != 1 {
+		t.Fatalf("expected the removal to be saved, got %+v", saved.Folders)
+	}
+	if code, _ := call(t, c, http.MethodDelete, "/folders/photos", ""); code != http.StatusNotFound {
+		t.Fatalf("expected status 404 for a folder that is already removed, got %d", code)
+	}
+}
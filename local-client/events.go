@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// eventRetryDelay is how long to wait before reopening a dropped event stream.
+	eventRetryDelay = 5 * time.Second
+	// eventIdleTimeout bounds how long the stream may be silent. The server sends
+	// a keepalive comment every 15 seconds, so anything longer means it is gone.
+	eventIdleTimeout = time.Minute
+)
+
+// peerWatcher keeps the connection manager's set of peers in step with peer
+// presence events pushed by the signalling server.
+type peerWatcher struct {
+	logger  *log.Logger
+	baseURL string
+	auth    *credentials
+	conns   *connManager
+	punch   *holePuncher
+	relay   *relayClient
+}
+
+// run subscribes to the event stream and reconnects whenever it drops. Each
+// time the stream is (re)opened, peers are rediscovered so that nothing missed
+// while disconnected is lost.
+func (w *peerWatcher) run() {
+	for {
+		w.resync()
+
+		err := subscribeEvents(w.baseURL, w.auth.get(), w.handle)
+		w.logger.Printf("event stream closed: %v; reconnecting in %s", err, eventRetryDelay)
+		time.Sleep(eventRetryDelay)
+	}
+}
+
+// resync replaces the set of known peers with the one the signalling server
+// currently reports.
+func (w *peerWatcher) resync() {
+	peers, err := discoverPeers(w.baseURL, w.auth.get())
+	if err != nil {
+		w.logger.Printf("discover failed: %v", err)
+		return
+	}
+
+	seen := make(map[string]bool, len(peers))
+	for _, peer := range peers {
+		seen[peer.ClientID] = true
+		w.conns.addPeer(peer)
+	}
+	for _, id := range w.conns.knownPeers() {
+		if !seen[id] {
+			w.conns.removePeer(id)
+		}
+	}
+}
+
+func (w *peerWatcher) handle(event peerEvent) {
+	peer := event.Client
+
+	switch event.Type {
+	case eventPeerJoined:
+		w.logger.Printf("peer %s joined", peer.ClientID)
+		w.conns.addPeer(peer)
+	case eventPeerAddressChanged:
+		w.logger.Printf("peer %s changed address", peer.ClientID)
+		w.conns.updatePeer(peer)
+	case eventPeerLeft:
+		w.logger.Printf("peer %s left", peer.ClientID)
+		w.conns.removePeer(peer.ClientID)
+	case eventPunchRequested:
+		if w.punch != nil {
+			w.logger.Printf("peer %s requested a hole punch", peer.ClientID)
+			go w.punch.respond(peer, event.StartAt)
+		}
+	case eventRelayRequested:
+		if w.relay != nil && event.Relay != nil {
+			w.logger.Printf("peer %s requested a relay", peer.ClientID)
+			go w.relay.respond(peer, *event.Relay, w.conns.handleInbound)
+		}
+	}
+}
+
+// subscribeEvents opens the signalling server's event stream and calls handle
+// for every peer event until the stream ends.
+func subscribeEvents(baseURL, token string, handle func(peerEvent)) error {
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/events", baseURL), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("events failed: status %s", resp.Status)
+	}
+
+	// Close the body if nothing, not even a keepalive, arrives for too long.
+	idle := time.AfterFunc(eventIdleTimeout, func() { resp.Body.Close() })
+	defer idle.Stop()
+
+	return readEvents(resp.Body, handle, func() { idle.Reset(eventIdleTimeout) })
+}
+
+// readEvents parses a Server-Sent Events stream, calling handle for each
+// complete event and activity for every line read.
+func readEvents(r io.Reader, handle func(peerEvent), activity func()) error {
+	scanner := bufio.NewScanner(r)
+	var data strings.Builder
+
+	for scanner.Scan() {
+		activity()
+		line := scanner.Text()
+
+		switch {
+		case line == "":
+			if data.Len() == 0 {
+				continue
+			}
+			var event peerEvent
+			if err := json.Unmarshal([]byte(data.String()), &event); err != nil {
+				return fmt.Errorf("decoding event: %w", err)
+			}
+			data.Reset()
+			handle(event)
+		case strings.HasPrefix(line, ":"):
+			// Comment, used by the server as a keepalive.
+		case strings.HasPrefix(line, "data:"):
+			if data.Len() > 0 {
+				data.WriteByte('\n')
+			}
+			data.WriteString(strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return io.EOF
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestReadEventsParsesStream(t *testing.T) {
+	stream := ": connected\n\n" +
+		"event: peer-joined\n" +
+		`data: {"type":"peer-joined","client":{"clientId":"abc","localIp":"10.0.0.2","localPort":4000}}` + "\n\n" +
+		": keepalive\n\n" +
+		"event: peer-left\n" +
+		`data: {"type":"peer-left","client":{"clientId":"abc"}}` + "\n\n"
+
+	var events []peerEvent
+	activity := 0
+	err := readEvents(strings.NewReader(stream), func(e peerEvent) {
+		events = append(events, e)
+	}, func() { activity++ })
+	if !errors.Is(err, io.EOF) {
+		t.Fatalf("expected io.EOF at end of stream, got %v", err)
+	}
+
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(events))
+	}
+	if events[0].Type != eventPeerJoined || events[0].Client.ClientID != "abc" || events[0].Client.LocalPort != 4000 {
+		t.Fatalf("unexpected first event: %+v", events[0])
+	}
+	if events[1].Type != eventPeerLeft {
+		t.Fatalf("expected peer-left, got %s", events[1].Type)
+	}
+	if activity == 0 {
+		t.Fatalf("expected activity callback to be called")
+	}
+}
+
+func TestReadEventsRejectsBadData(t *testing.T) {
+	err := readEvents(strings.NewReader("data: {not json\n\n"), func(peerEvent) {}, func() {})
+	if err == nil || errors.Is(err, io.EOF) {
+		t.Fatalf("expected decode error, got %v", err)
+	}
+}
@@ -2,4 +2,21 @@ module github.com/dantdj/syncmesh/local-client
 
 go 1.25.1
 
+require (
+	github.com/fsnotify/fsnotify v1.9.0
+	github.com/fxamacker/cbor/v2 v2.9.0
+	github.com/julienschmidt/httprouter v1.3.0
+	github.com/klauspost/compress v1.18.0
+	github.com/quic-go/quic-go v0.59.1
+	go.etcd.io/bbolt v1.4.3
+	golang.org/x/time v0.15.0
+)
+
+require (
+	github.com/x448/float16 v0.8.4 // indirect
+	golang.org/x/crypto v0.41.0 // indirect
+	golang.org/x/net v0.43.0 // indirect
+	golang.org/x/sys v0.35.0 // indirect
+)
+
 replace github.com/dantdj/syncmesh/api => ../api
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base32"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"io/fs"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	certFileName = "cert.pem"
+	keyFileName  = "key.pem"
+
+	certValidity = 20 * 365 * 24 * time.Hour
+)
+
+// identity is this client's long-lived keypair and self-signed certificate. The
+// device ID is derived from the certificate, so it stays stable for as long as
+// the files in the home directory are kept.
+type identity struct {
+	cert     tls.Certificate
+	deviceID string
+}
+
+// loadOrCreateIdentity loads the certificate and key from dir, generating and
+// persisting a new Ed25519 keypair and certificate on first start.
+func loadOrCreateIdentity(dir string) (*identity, error) {
+	certPath := filepath.Join(dir, certFileName)
+	keyPath := filepath.Join(dir, keyFileName)
+
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		if err := generateIdentity(dir, certPath, keyPath); err != nil {
+			return nil, err
+		}
+		cert, err = tls.LoadX509KeyPair(certPath, keyPath)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &identity{
+		cert:     cert,
+		deviceID: deviceIDFromCert(cert.Certificate[0]),
+	}, nil
+}
+
+func generateIdentity(dir, certPath, keyPath string) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "syncmesh"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(certValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, pub, priv)
+	if err != nil {
+		return err
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		return err
+	}
+	return os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644)
+}
+
+// deviceIDFromCert derives a device ID from the SHA-256 fingerprint of a DER
+// encoded certificate, formatted as dash-separated groups of base32 characters.
+func deviceIDFromCert(der []byte) string {
+	sum := sha256.Sum256(der)
+	encoded := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(sum[:])
+
+	groups := make([]string, 0, 4)
+	for len(encoded) > 13 {
+		groups = append(groups, encoded[:13])
+		encoded = encoded[13:]
+	}
+	groups = append(groups, encoded)
+	return strings.Join(groups, "-")
+}
+
+// publicKeyDER returns the PKIX encoding of this device's public key.
+func (id *identity) publicKeyDER() ([]byte, error) {
+	signer, ok := id.cert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("identity key cannot sign")
+	}
+	return x509.MarshalPKIXPublicKey(signer.Public())
+}
+
+// sign signs message with this device's Ed25519 private key.
+func (id *identity) sign(message []byte) ([]byte, error) {
+	key, ok := id.cert.PrivateKey.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("identity key is not an Ed25519 key")
+	}
+	return ed25519.Sign(key, message), nil
+}
+
+// clientIDForKey derives the signalling server's client ID for a PKIX encoded
+// public key. It must match the derivation used by the server.
+func clientIDForKey(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:16])
+}
+
+// clientIDForCert derives the signalling server's client ID for the key in cert.
+func clientIDForCert(cert *x509.Certificate) string {
+	return clientIDForKey(cert.RawSubjectPublicKeyInfo)
+}
+
+// normalizeDeviceID makes device IDs comparable regardless of case and grouping.
+func normalizeDeviceID(id string) string {
+	return strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(id), "-", ""))
+}
+
+func shortDeviceID(id string) string {
+	if len(id) < 7 {
+		return id
+	}
+	return id[:7]
+}
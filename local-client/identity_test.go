@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadOrCreateIdentityIsStable(t *testing.T) {
+	dir := t.TempDir()
+
+	first, err := loadOrCreateIdentity(dir)
+	if err != nil {
+		t.Fatalf("loadOrCreateIdentity returned error: %v", err)
+	}
+
+	second, err := loadOrCreateIdentity(dir)
+	if err != nil {
+		t.Fatalf("loadOrCreateIdentity returned error: %v", err)
+	}
+
+	if first.deviceID == "" || first.deviceID != second.deviceID {
+		t.Fatalf("expected stable device ID, got %q and %q", first.deviceID, second.deviceID)
+	}
+
+	info, err := os.Stat(filepath.Join(dir, keyFileName))
+	if err != nil {
+		t.Fatalf("expected key file to exist: %v", err)
+	}
+	if info.Mode().Perm() != 0o600 {
+		t.Fatalf("expected key file mode 0600, got %v", info.Mode().Perm())
+	}
+}
+
+func TestNormalizeDeviceID(t *testing.T) {
+	if normalizeDeviceID(" abcd-efgh ") != "ABCDEFGH" {
+		t.Fatalf("unexpected normalized ID %q", normalizeDeviceID(" abcd-efgh "))
+	}
+}
+
+func TestTrustStoreReadsTrustFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trusted_peers")
+	trust := newTrustStore(path, []string{"AAAA-BBBB"})
+
+	if !trust.isTrusted("aaaabbbb") {
+		t.Fatal("expected ID from flag to be trusted")
+	}
+	if trust.isTrusted("CCCC-DDDD") {
+		t.Fatal("expected unknown ID not to be trusted")
+	}
+
+	if err := os.WriteFile(path, []byte("# comment\nCCCC-DDDD\n"), 0o600); err != nil {
+		t.Fatalf("failed to write trust file: %v", err)
+	}
+	if !trust.isTrusted("CCCC-DDDD") {
+		t.Fatal("expected ID added to trust file to be trusted without a restart")
+	}
+}
+
+func TestPeerTLSHandshake(t *testing.T) {
+	alice, err := loadOrCreateIdentity(t.TempDir())
+	if err != nil {
+		t.Fatalf("loadOrCreateIdentity returned error: %v", err)
+	}
+	bob, err := loadOrCreateIdentity(t.TempDir())
+	if err != nil {
+		t.Fatalf("loadOrCreateIdentity returned error: %v", err)
+	}
+
+	aliceConfig := peerTLSConfig(alice, newTrustStore("", []string{bob.deviceID}))
+	bobConfig := peerTLSConfig(bob, newTrustStore("", []string{alice.deviceID}))
+
+	clientID, serverPeer, serverErr := handshakePair(t, aliceConfig, bobConfig)
+	serverID := serverPeer.deviceID
+	if serverErr != nil {
+		t.Fatalf("server handshake failed: %v", serverErr)
+	}
+	if clientID != bob.deviceID {
+		t.Fatalf("expected client to see %s, got %s", bob.deviceID, clientID)
+	}
+	if serverID != alice.deviceID {
+		t.Fatalf("expected server to see %s, got %s", alice.deviceID, serverID)
+	}
+
+	alicePublicKey, err := alice.publicKeyDER()
+	if err != nil {
+		t.Fatalf("publicKeyDER returned error: %v", err)
+	}
+	if serverPeer.clientID != clientIDForKey(alicePublicKey) {
+		t.Fatalf("expected server to derive clientId %s, got %s", clientIDForKey(alicePublicKey), serverPeer.clientID)
+	}
+}
+
+func TestPeerTLSHandshakeRejectsUntrustedPeer(t *testing.T) {
+	alice, err := loadOrCreateIdentity(t.TempDir())
+	if err != nil {
+		t.Fatalf("loadOrCreateIdentity returned error: %v", err)
+	}
+	mallory, err := loadOrCreateIdentity(t.TempDir())
+	if err != nil {
+		t.Fatalf("loadOrCreateIdentity returned error: %v", err)
+	}
+
+	// Mallory trusts Alice, but Alice has never heard of Mallory.
+	aliceConfig := peerTLSConfig(alice, newTrustStore("", nil))
+	malloryConfig := peerTLSConfig(mallory, newTrustStore("", []string{alice.deviceID}))
+
+	_, _, serverErr := handshakePair(t, malloryConfig, aliceConfig)
+	if !errors.Is(serverErr, errUntrustedPeer) {
+		t.Fatalf("expected untrusted peer error, got %v", serverErr)
+	}
+}
+
+// handshakePair runs a TLS handshake over a loopback connection and returns
+// the device ID seen by the client, the peer seen by the server, and the
+// server's handshake error.
+func handshakePair(t *testing.T, clientConfig, serverConfig *tls.Config) (string, remotePeer, error) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	type result struct {
+		peer remotePeer
+		err  error
+	}
+	serverDone := make(chan result, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			serverDone <- result{err: err}
+			return
+		}
+		defer conn.Close()
+		peer, err := tlsHandshake(tls.Server(conn, serverConfig))
+		serverDone <- result{peer, err}
+	}()
+
+	clientID := ""
+	conn, peer, err := dialPeer(listener.Addr().String(), clientConfig)
+	if err == nil {
+		clientID = peer.deviceID
+		defer conn.Close()
+	}
+
+	server := <-serverDone
+	return clientID, server.peer, server.err
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Each folder can list files to keep out of sync in a .syncmeshignore file at
+// its root, using gitignore syntax:
+//
+//   - A pattern without a slash matches a name at any depth, and one with a
+//     slash is relative to the folder root.
+//   - *, ? and [...] match within a path segment, and ** across segments.
+//   - A trailing slash matches directories only.
+//   - A leading ! brings back files an earlier pattern ignored. As in git,
+//     nothing inside an ignored directory can be brought back.
+//   - A (?i) prefix makes a pattern case-insensitive.
+//   - #include <file> reads more patterns from a file, relative to the one
+//     including it. Any other line starting with # is a comment.
+//
+// The ignore file itself is never synced, so each device keeps its own, and
+// neither is the client's own data in the folder.
+
+const ignoreFileName = ".syncmeshignore"
+
+// ignorePattern is one line of an ignore file.
+type ignorePattern struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// ignoreMatcher decides which paths in a folder are ignored. A nil matcher
+// ignores nothing.
+type ignoreMatcher struct {
+	patterns []ignorePattern
+	// files holds every file the patterns were read from, so that a change
+	// to any of them can be noticed.
+	files []string
+}
+
+// loadIgnores reads the ignore file at the root of a folder, if there is one.
+func loadIgnores(root string) (*ignoreMatcher, error) {
+	m := &ignoreMatcher{}
+	if err := m.load(filepath.Join(root, ignoreFileName), make(map[string]bool), false); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// load adds the patterns in the file at path, and in every file it includes.
+// seen holds the files already read, so that an include cycle ends.
+func (m *ignoreMatcher) load(path string, seen map[string]bool, included bool) error {
+	path = filepath.Clean(path)
+	if seen[path] {
+		return nil
+	}
+	seen[path] = true
+	m.files = append(m.files, path)
+
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) && !included {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+
+		if name, ok := strings.CutPrefix(line, "#include "); ok {
+			name = strings.TrimSpace(name)
+			if err := m.load(filepath.Join(filepath.Dir(path), filepath.FromSlash(name)), seen, true); err != nil {
+				return fmt.Errorf("%s:%d: %w", path, n, err)
+			}
+			continue
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		p, err := parseIgnorePattern(line)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+		m.patterns = append(m.patterns, p)
+	}
+	return scanner.Err()
+}
+
+func parseIgnorePattern(line string) (ignorePattern, error) {
+	var p ignorePattern
+
+	line, caseless := strings.CutPrefix(line, "(?i)")
+	switch {
+	case strings.HasPrefix(line, "!"):
+		p.negate = true
+		line = line[1:]
+	case strings.HasPrefix(line, `\!`), strings.HasPrefix(line, `\#`):
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		p.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	if line == "" {
+		return ignorePattern{}, errors.New("empty pattern")
+	}
+
+	expr, err := globToRegexp(line)
+	if err != nil {
+		return ignorePattern{}, err
+	}
+	if !anchored {
+		expr = "(?:.*/)?" + expr
+	}
+	expr = "^" + expr + "$"
+	if caseless {
+		expr = "(?i)" + expr
+	}
+
+	p.re, err = regexp.Compile(expr)
+	if err != nil {
+		return ignorePattern{}, fmt.Errorf("invalid pattern %q: %w", line, err)
+	}
+	return p, nil
+}
+
+// globToRegexp translates a gitignore glob into a regular expression.
+func globToRegexp(glob string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				// ** only crosses directories when it is a whole segment.
+				end := i + 2
+				if (i == 0 || glob[i-1] == '/') && (end == len(glob) || glob[end] == '/') {
+					if end == len(glob) {
+						b.WriteString(".*")
+					} else {
+						b.WriteString("(?:.*/)?")
+					}
+					i = end
+					continue
+				}
+				i++
+			}
+			b.WriteString("[^/]*")
+		case '?':
+			b.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				return "", fmt.Errorf("unterminated character class in %q", glob)
+			}
+			class := glob[i+1 : i+1+end]
+			if rest, ok := strings.CutPrefix(class, "!"); ok {
+				class = "^" + rest
+			}
+			b.WriteString("[" + class + "]")
+			i += end + 1
+		case '\\':
+			if i+1 == len(glob) {
+				return "", fmt.Errorf("trailing backslash in %q", glob)
+			}
+			i++
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		default:
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	return b.String(), nil
+}
+
+// ignored reports whether the file or directory at path, slash-separated and
+// relative to the folder root, is ignored.
+func (m *ignoreMatcher) ignored(path string, isDir bool) bool {
+	if path == ignoreFileName || path == folderDataDir || strings.HasPrefix(path, folderDataDir+"/") {
+		return true
+	}
+	if m == nil {
+		return false
+	}
+
+	for i := range len(path) {
+		if path[i] == '/' && m.matches(path[:i], true) {
+			return true
+		}
+	}
+	return m.matches(path, isDir)
+}
+
+// matches applies the patterns to path alone. The last pattern that matches
+// decides.
+func (m *ignoreMatcher) matches(path string, isDir bool) bool {
+	for i := len(m.patterns) - 1; i >= 0; i-- {
+		p := m.patterns[i]
+		if p.dirOnly && !isDir {
+			continue
+		}
+		if p.re.MatchString(path) {
+			return !p.negate
+		}
+	}
+	return false
+}
+
+// readsFrom reports whether the patterns were read from, or would be read
+// from, the file at path.
+func (m *ignoreMatcher) readsFrom(path string) bool {
+	if m == nil {
+		return false
+	}
+	return slices.Contains(m.files, filepath.Clean(path))
+}
+
+// withoutIgnored splits index into the entries that ignores doesn't exclude and
+// the paths of those it does.
+func withoutIgnored(index map[string]fileInfo, ignores *ignoreMatcher) (map[string]fileInfo, []string) {
+	kept := make(map[string]fileInfo, len(index))
+	var dropped []string
+	for path, info := range index {
+		if ignores.ignored(path, false) {
+			dropped = append(dropped, path)
+			continue
+		}
+		kept[path] = info
+	}
+	return kept, dropped
+}
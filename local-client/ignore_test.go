@@ -0,0 +1,221 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeIgnores(t *testing.T, root string, lines ...string) {
+	t.Helper()
+
+	if err := os.WriteFile(filepath.Join(root, ignoreFileName), []byte(strings.Join(lines, "\n")+"\n"), 0o644); err != nil {
+		t.Fatalf("failed to write ignore file: %v", err)
+	}
+}
+
+func TestIgnorePatterns(t *testing.T) {
+	root := t.TempDir()
+	writeIgnores(t, root,
+		"# build output and editor droppings",
+		"node_modules",
+		"*.tmp",
+		".git/",
+		".*.sw[a-p]",
+		"/build",
+		"docs/**/*.pdf",
+		"logs/",
+		"!logs/keep.log",
+		"*.log",
+		"!important.log",
+		"(?i)*.bak",
+	)
+
+	m, err := loadIgnores(root)
+	if err != nil {
+		t.Fatalf("loadIgnores returned error: %v", err)
+	}
+
+	if !m.ignored("node_modules", true) || !m.ignored("web/node_modules/react/index.js", false) {
+		t.Error("expected a bare name to be ignored at any depth, along with its contents")
+	}
+	if !m.ignored("a/b/scratch.tmp", false) {
+		t.Error("expected a glob to be ignored at any depth")
+	}
+	if !m.ignored(".git", true) || !m.ignored(".git/HEAD", false) || m.ignored(".git", false) {
+		t.Error("expected a trailing slash to match directories only")
+	}
+	if !m.ignored("src/.main.go.swp", false) {
+		t.Error("expected a character class to match")
+	}
+	if !m.ignored("build/out.bin", false) || m.ignored("src/build/out.bin", false) {
+		t.Error("expected a leading slash to anchor the pattern to the root")
+	}
+	if !m.ignored("docs/guide.pdf", false) || !m.ignored("docs/a/b/guide.pdf", false) || m.ignored("guide.pdf", false) {
+		t.Error("expected ** to match any number of directories")
+	}
+	if !m.ignored("debug.log", false) || m.ignored("important.log", false) || m.ignored("sub/important.log", false) {
+		t.Error("expected a negated pattern to bring a file back")
+	}
+	if !m.ignored("logs/keep.log", false) {
+		t.Error("expected nothing inside an ignored directory to be brought back")
+	}
+	if !m.ignored("notes.BAK", false) || m.ignored("notes.txt", false) {
+		t.Error("expected a (?i) pattern to match regardless of case")
+	}
+	if !m.ignored(ignoreFileName, false) {
+		t.Error("expected the ignore file itself to be ignored")
+	}
+}
+
+func TestIgnoreIncludes(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "shared"), 0o755); err != nil {
+		t.Fatalf("failed to create dir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "shared", "common"), []byte("*.o\n#include ../"+ignoreFileName+"\n"), 0o644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	writeIgnores(t, root, "#include shared/common", "*.a")
+
+	m, err := loadIgnores(root)
+	if err != nil {
+		t.Fatalf("loadIgnores returned error: %v", err)
+	}
+	if !m.ignored("lib/x.o", false) || !m.ignored("lib/x.a", false) {
+		t.Fatal("expected patterns from both files to apply")
+	}
+	if !m.readsFrom(filepath.Join(root, "shared", "common")) {
+		t.Fatal("expected the included file to be tracked")
+	}
+
+	writeIgnores(t, root, "#include missing")
+	if _, err := loadIgnores(root); err == nil {
+		t.Fatal("expected including a missing file to fail")
+	}
+
+	writeIgnores(t, root, "[abc")
+	if _, err := loadIgnores(root); err == nil || !strings.Contains(err.Error(), ":1:") {
+		t.Fatalf("expected an error naming the bad line, got %v", err)
+	}
+}
+
+func TestSyncerForgetsNewlyIgnoredFiles(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	root := t.TempDir()
+	db := testIndexDB(t)
+
+	for _, name := range []string{"keep.txt", "scratch.tmp"} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(name), 0o644); err != nil {
+			t.Fatalf("failed to write file: %v", err)
+		}
+	}
+	s, err := newSyncer(logger, db, "AAAAAAAA", root, folderSendReceive)
+	if err != nil {
+		t.Fatalf("newSyncer returned error: %v", err)
+	}
+	if update := s.indexUpdate(defaultFolderID); len(update.Files) != 2 {
+		t.Fatalf("expected both files to be indexed, got %+v", update.Files)
+	}
+
+	writeIgnores(t, root, "*.tmp")
+	if err := s.rescan(); err != nil {
+		t.Fatalf("rescan returned error: %v", err)
+	}
+
+	// The file is dropped rather than advertised as deleted, so that peers
+	// keep their copies.
+	update := s.indexUpdate(defaultFolderID)
+	if len(update.Files) != 1 || update.Files[0].Path != "keep.txt" {
+		t.Fatalf("expected only keep.txt to be advertised, got %+v", update.Files)
+	}
+	stored, err := db.loadFolder(defaultFolderID, root)
+	if err != nil {
+		t.Fatalf("loadFolder returned error: %v", err)
+	}
+	if _, ok := stored["scratch.tmp"]; ok {
+		t.Fatal("expected the ignored file to be removed from the database")
+	}
+}
+
+func TestFolderWatcherReloadsIgnores(t *testing.T) {
+	s, w, root := newTestWatcher(t)
+
+	stop := make(chan struct{})
+	go w.run(time.Hour, stop)
+	t.Cleanup(func() { close(stop) })
+
+	writeIgnores(t, root, "*.tmp")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.mu.Lock()
+		loaded := s.folders[defaultFolderID].ignores.ignored("x.tmp", false)
+		s.mu.Unlock()
+		if loaded {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the ignore file to be reloaded")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	if err := os.WriteFile(filepath.Join(root, "scratch.tmp"), []byte("x"), 0o644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "keep.txt"), []byte("keep"), 0o644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	waitForEntry(t, s, "keep.txt", present(4))
+
+	s.mu.Lock()
+	_, indexed := s.folders[defaultFolderID].index["scratch.tmp"]
+	s.mu.Unlock()
+	if indexed {
+		t.Fatal("expected the ignored file not to be indexed")
+	}
+}
+
+func TestSyncSessionSkipsIgnoredFiles(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	rootA := t.TempDir()
+	rootB := t.TempDir()
+	for _, name := range []string{"notes.txt", "scratch.tmp"} {
+		if err := os.WriteFile(filepath.Join(rootA, name), []byte(name), 0o644); err != nil {
+			t.Fatalf("failed to write file: %v", err)
+		}
+	}
+	writeIgnores(t, rootB, "*.tmp")
+
+	a, err := newSyncer(logger, testIndexDB(t), "AAAAAAAA", rootA, folderSendReceive)
+	if err != nil {
+		t.Fatalf("newSyncer returned error: %v", err)
+	}
+	b, err := newSyncer(logger, testIndexDB(t), "BBBBBBBB", rootB, folderSendReceive)
+	if err != nil {
+		t.Fatalf("newSyncer returned error: %v", err)
+	}
+
+	connA, connB := net.Pipe()
+	go a.runSession(connA, remotePeer{deviceID: "device-b", clientID: "client-b"})
+	go b.runSession(connB, remotePeer{deviceID: "device-a", clientID: "client-a"})
+	t.Cleanup(func() {
+		connA.Close()
+		connB.Close()
+	})
+
+	waitForFile(t, filepath.Join(rootB, "notes.txt"), "notes.txt")
+	time.Sleep(100 * time.Millisecond)
+	if _, err := os.Stat(filepath.Join(rootB, "scratch.tmp")); !os.IsNotExist(err) {
+		t.Fatalf("expected the ignored file not to be pulled, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(rootA, ignoreFileName)); !os.IsNotExist(err) {
+		t.Fatalf("expected the ignore file not to be synced, got %v", err)
+	}
+}
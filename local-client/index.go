@@ -0,0 +1,341 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dantdj/syncmesh/local-client/protocol"
+)
+
+// tempFilePrefix marks files that are still being downloaded so the scanner
+// never advertises a partially written file to peers.
+const tempFilePrefix = ".syncmesh-tmp-"
+
+// fileInfo describes a single file within the synced folder. Files that have
+// been deleted are kept as tombstones, with Deleted set and no content, so
+// that the deletion can be passed on to peers.
+type fileInfo struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+	// Mode holds the file's permission bits.
+	Mode    fs.FileMode
+	Hash    string
+	Blocks  []blockInfo
+	Version versionVector
+	// ModifiedBy is the device that made the latest change, which names the
+	// conflict copy if this version loses a conflict.
+	ModifiedBy string
+	// RenamedFrom is the path the file was moved from, if this version was
+	// detected as a rename. It is cleared whenever the version changes.
+	RenamedFrom string
+	// LocalChange marks a change made locally to a receive-only folder,
+	// which isn't advertised to peers and loses to any change they make.
+	LocalChange bool
+	Deleted     bool
+}
+
+// blockInfo is the hash of one content-defined block of a file.
+type blockInfo struct {
+	Offset int64
+	Size   int
+	Hash   string
+}
+
+func (f fileInfo) toWire() protocol.FileInfo {
+	return protocol.FileInfo{
+		Path:    f.Path,
+		Size:    f.Size,
+		ModTime: f.ModTime,
+		Hash:    f.Hash,
+		Mode:    uint32(f.Mode.Perm()),
+		Version: f.Version,
+		Deleted: f.Deleted,
+		Blocks:  blocksToWire(f.Blocks),
+
+		ModifiedBy:  f.ModifiedBy,
+		RenamedFrom: f.RenamedFrom,
+	}
+}
+
+func fileInfoFromWire(f protocol.FileInfo) fileInfo {
+	return fileInfo{
+		Path:    f.Path,
+		Size:    f.Size,
+		ModTime: f.ModTime.UTC(),
+		Hash:    f.Hash,
+		Mode:    fs.FileMode(f.Mode).Perm(),
+		Version: f.Version,
+		Deleted: f.Deleted,
+		Blocks:  blocksFromWire(f.Blocks),
+
+		ModifiedBy:  f.ModifiedBy,
+		RenamedFrom: f.RenamedFrom,
+	}
+}
+
+func blocksToWire(blocks []blockInfo) []protocol.BlockInfo {
+	if len(blocks) == 0 {
+		return nil
+	}
+	wire := make([]protocol.BlockInfo, len(blocks))
+	for i, b := range blocks {
+		wire[i] = protocol.BlockInfo{Offset: b.Offset, Size: b.Size, Hash: b.Hash}
+	}
+	return wire
+}
+
+func blocksFromWire(wire []protocol.BlockInfo) []blockInfo {
+	if len(wire) == 0 {
+		return nil
+	}
+	blocks := make([]blockInfo, len(wire))
+	for i, b := range wire {
+		blocks[i] = blockInfo{Offset: b.Offset, Size: b.Size, Hash: b.Hash}
+	}
+	return blocks
+}
+
+// checkBlocks reports whether the file's blocks, as a peer advertised them,
+// can be pulled: each between one byte and maxBlockSize long, starting where
+// the one before ended, and together making up the whole file.
+func (f fileInfo) checkBlocks() error {
+	if f.Deleted {
+		return nil
+	}
+	if f.Size < 0 {
+		return fmt.Errorf("negative size %d", f.Size)
+	}
+	var offset int64
+	for _, b := range f.Blocks {
+		if b.Size <= 0 || b.Size > maxBlockSize {
+			return fmt.Errorf("block at %d has size %d", b.Offset, b.Size)
+		}
+		if b.Offset != offset {
+			return fmt.Errorf("block at %d should be at %d", b.Offset, offset)
+		}
+		offset += int64(b.Size)
+	}
+	if offset != f.Size {
+		return fmt.Errorf("blocks make up %d bytes of %d", offset, f.Size)
+	}
+	return nil
+}
+
+// sameContent reports whether two entries describe the same state of a file,
+// regardless of their history.
+func sameContent(a, b fileInfo) bool {
+	if a.Deleted || b.Deleted {
+		return a.Deleted == b.Deleted
+	}
+	return a.Hash == b.Hash && a.Mode.Perm() == b.Mode.Perm()
+}
+
+// scanFolder walks root and returns an index of every regular file that
+// ignores doesn't exclude, keyed by its slash-separated path relative to root.
+// Entries from prev whose size, modification time and permissions are
+// unchanged are reused rather than rehashed.
+func scanFolder(root string, prev map[string]fileInfo, ignores *ignoreMatcher) (map[string]fileInfo, error) {
+	return scanTree(root, ".", prev, ignores)
+}
+
+// scanTree is like scanFolder but only indexes the file or directory tree at
+// dir, a slash-separated path relative to root. If dir doesn't exist the index
+// is empty.
+func scanTree(root, dir string, prev map[string]fileInfo, ignores *ignoreMatcher) (map[string]fileInfo, error) {
+	index := make(map[string]fileInfo)
+
+	start := filepath.Join(root, filepath.FromSlash(dir))
+	if _, err := os.Lstat(start); errors.Is(err, fs.ErrNotExist) {
+		return index, nil
+	}
+
+	err := filepath.WalkDir(start, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		if rel != "." && ignores.ignored(rel, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), tempFilePrefix) {
+			removeStaleTemp(path, d)
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		modTime := info.ModTime().UTC()
+		mode := info.Mode().Perm()
+		if old, ok := prev[rel]; ok && !old.Deleted && old.Size == info.Size() && old.ModTime.Equal(modTime) && old.Mode == mode {
+			index[rel] = old
+			return nil
+		}
+
+		hash, blocks, err := hashFile(path)
+		if err != nil {
+			return err
+		}
+
+		entry := fileInfo{
+			Path:    rel,
+			Size:    info.Size(),
+			ModTime: modTime,
+			Mode:    mode,
+			Hash:    hash,
+			Blocks:  blocks,
+		}
+		if old, ok := prev[rel]; ok {
+			entry.Version = old.Version
+		}
+		index[rel] = entry
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return index, nil
+}
+
+// reconcileScan merges a fresh scan of a folder into its previous index. Files
+// that are new or whose content changed get a new version from device, and
+// files that have disappeared become tombstones. It returns the merged index
+// and the entries that changed. recent remembers deletions between scans for
+// rename detection.
+func reconcileScan(prev, scanned map[string]fileInfo, device string, recent recentDeletions) (map[string]fileInfo, []fileInfo) {
+	index := make(map[string]fileInfo, len(scanned))
+	var changed []fileInfo
+
+	for path, entry := range scanned {
+		old, ok := prev[path]
+		switch {
+		case !ok || !sameContent(old, entry):
+			entry.Version = old.Version.update(device)
+			entry.ModifiedBy = device
+			changed = append(changed, entry)
+		case !old.ModTime.Equal(entry.ModTime) || old.Size != entry.Size:
+			// Touched but not changed: nothing to tell peers about, but the
+			// new metadata saves rehashing it next time.
+			entry.Version = old.Version
+			entry.ModifiedBy = old.ModifiedBy
+			entry.RenamedFrom = old.RenamedFrom
+			entry.LocalChange = old.LocalChange
+			changed = append(changed, entry)
+		default:
+			entry = old
+		}
+		index[path] = entry
+	}
+
+	for path, old := range prev {
+		if _, ok := scanned[path]; ok {
+			continue
+		}
+		if !old.Deleted {
+			old = fileInfo{
+				Path:    path,
+				ModTime: time.Now().UTC(),
+				Version: old.Version.update(device),
+				Deleted: true,
+
+				ModifiedBy: device,
+			}
+			changed = append(changed, old)
+		}
+		index[path] = old
+	}
+
+	detectRenames(prev, scanned, index, changed, recent)
+	return index, changed
+}
+
+// hashFile returns the SHA-256 hash of the file at path along with the hashes
+// of its blocks.
+func hashFile(path string) (string, []blockInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", nil, err
+	}
+	defer f.Close()
+
+	return hashContent(f)
+}
+
+// hashContent returns the SHA-256 hash of everything read from r along with
+// the hashes of its blocks.
+func hashContent(r io.Reader) (string, []blockInfo, error) {
+	whole := sha256.New()
+	chunks := newChunker(r)
+	var blocks []blockInfo
+	var offset int64
+	for {
+		block, err := chunks.next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return "", nil, err
+		}
+
+		whole.Write(block)
+		blocks = append(blocks, blockInfo{Offset: offset, Size: len(block), Hash: hashBlock(block)})
+		offset += int64(len(block))
+	}
+	return hex.EncodeToString(whole.Sum(nil)), blocks, nil
+}
+
+func hashBlock(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// needsPull reports whether the remote copy of a file should replace the local
+// one. A remote entry whose version descends from ours wins; so does any
+// remote file we don't have at all. If both were changed independently the
+// conflict is settled by winsConflict, unless ours is a local change to a
+// receive-only folder, which always loses. If one side has no version at all
+// the newer modification time wins.
+func needsPull(local fileInfo, haveLocal bool, remote fileInfo) bool {
+	if !haveLocal {
+		return !remote.Deleted
+	}
+	if sameContent(local, remote) {
+		return false
+	}
+
+	if len(local.Version) > 0 && len(remote.Version) > 0 {
+		switch remote.Version.compare(local.Version) {
+		case orderNewer:
+			return true
+		case orderOlder, orderEqual:
+			return false
+		case orderConcurrent:
+			return local.LocalChange || winsConflict(remote, local)
+		}
+	}
+	return remote.ModTime.After(local.ModTime)
+}
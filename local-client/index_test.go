@@ -0,0 +1,228 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestScanFolder(t *testing.T) {
+	root := t.TempDir()
+
+	if err := os.MkdirAll(filepath.Join(root, "nested"), 0o755); err != nil {
+		t.Fatalf("failed to create dir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "a.txt"), []byte("hello"), 0o644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "nested", "b.txt"), []byte("world"), 0o644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(root, tempFilePrefix+"partial"), []byte("x"), 0o644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	index, err := scanFolder(root, nil, nil)
+	if err != nil {
+		t.Fatalf("scanFolder returned error: %v", err)
+	}
+
+	if len(index) != 2 {
+		t.Fatalf("expected 2 files, got %d", len(index))
+	}
+
+	a, ok := index["a.txt"]
+	if !ok {
+		t.Fatal("expected a.txt to be indexed")
+	}
+	if a.Size != 5 {
+		t.Fatalf("expected size 5, got %d", a.Size)
+	}
+	// sha256("hello")
+	if a.Hash != "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" {
+		t.Fatalf("unexpected hash %s", a.Hash)
+	}
+
+	if _, ok := index["nested/b.txt"]; !ok {
+		t.Fatal("expected nested/b.txt to be indexed with a slash-separated path")
+	}
+}
+
+func TestScanFolderReusesUnchangedEntries(t *testing.T) {
+	root := t.TempDir()
+
+	if err := os.WriteFile(filepath.Join(root, "a.txt"), []byte("hello"), 0o644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	first, err := scanFolder(root, nil, nil)
+	if err != nil {
+		t.Fatalf("scanFolder returned error: %v", err)
+	}
+
+	// A stale hash proves the entry was reused rather than rehashed.
+	prev := first["a.txt"]
+	prev.Hash = "cached"
+	first["a.txt"] = prev
+
+	second, err := scanFolder(root, first, nil)
+	if err != nil {
+		t.Fatalf("scanFolder returned error: %v", err)
+	}
+
+	if second["a.txt"].Hash != "cached" {
+		t.Fatalf("expected unchanged file not to be rehashed, got %s", second["a.txt"].Hash)
+	}
+}
+
+func TestScanFolderRemovesStaleTempFiles(t *testing.T) {
+	root := t.TempDir()
+
+	stale := filepath.Join(root, tempFilePrefix+"stale")
+	fresh := filepath.Join(root, tempFilePrefix+"fresh")
+	for _, path := range []string{stale, fresh} {
+		if err := os.WriteFile(path, []byte("partial"), 0o600); err != nil {
+			t.Fatalf("failed to write file: %v", err)
+		}
+	}
+	old := time.Now().Add(-2 * tempFileMaxAge)
+	if err := os.Chtimes(stale, old, old); err != nil {
+		t.Fatalf("failed to set modification time: %v", err)
+	}
+
+	index, err := scanFolder(root, nil, nil)
+	if err != nil {
+		t.Fatalf("scanFolder returned error: %v", err)
+	}
+	if len(index) != 0 {
+		t.Fatalf("expected temporary files not to be indexed, got %+v", index)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Fatalf("expected the stale temporary file to be removed, got %v", err)
+	}
+	if _, err := os.Stat(fresh); err != nil {
+		t.Fatalf("expected a recent temporary file to be kept for resuming, got %v", err)
+	}
+}
+
+func TestNeedsPull(t *testing.T) {
+	now := time.Now().UTC()
+	local := fileInfo{Path: "a.txt", Hash: "aaa", ModTime: now}
+
+	if !needsPull(fileInfo{}, false, local) {
+		t.Error("expected missing file to be pulled")
+	}
+	if needsPull(local, true, local) {
+		t.Error("expected identical file not to be pulled")
+	}
+	if !needsPull(local, true, fileInfo{Path: "a.txt", Hash: "bbb", ModTime: now.Add(time.Minute)}) {
+		t.Error("expected newer remote file to be pulled")
+	}
+	if needsPull(local, true, fileInfo{Path: "a.txt", Hash: "bbb", ModTime: now.Add(-time.Minute)}) {
+		t.Error("expected older remote file not to be pulled")
+	}
+
+	versioned := fileInfo{Path: "a.txt", Hash: "aaa", ModTime: now, Version: versionVector{"AAAAAAA": 1}}
+	if !needsPull(versioned, true, fileInfo{Path: "a.txt", Hash: "bbb", ModTime: now.Add(-time.Minute), Version: versionVector{"AAAAAAA": 1, "BBBBBBB": 1}}) {
+		t.Error("expected a descendant version to be pulled despite an older modification time")
+	}
+	if needsPull(fileInfo{Path: "a.txt", Hash: "aaa", ModTime: now, Version: versionVector{"AAAAAAA": 2}}, true, fileInfo{Path: "a.txt", Hash: "bbb", ModTime: now.Add(time.Minute), Version: versionVector{"AAAAAAA": 1}}) {
+		t.Error("expected an ancestor version not to be pulled despite a newer modification time")
+	}
+	if !needsPull(versioned, true, fileInfo{Path: "a.txt", ModTime: now, Version: versionVector{"AAAAAAA": 2}, Deleted: true}) {
+		t.Error("expected a newer deletion to be applied")
+	}
+	if needsPull(fileInfo{}, false, fileInfo{Path: "a.txt", Version: versionVector{"AAAAAAA": 2}, Deleted: true}) {
+		t.Error("expected a deletion of a file we don't have to be ignored")
+	}
+
+	concurrent := fileInfo{Path: "a.txt", Hash: "bbb", ModTime: now.Add(time.Minute), Version: versionVector{"BBBBBBB": 1}}
+	if !needsPull(versioned, true, concurrent) {
+		t.Error("expected a concurrent change that wins the conflict to be pulled")
+	}
+	if needsPull(concurrent, true, versioned) {
+		t.Error("expected a concurrent change that loses the conflict not to be pulled")
+	}
+	concurrent.Deleted = true
+	if needsPull(versioned, true, concurrent) {
+		t.Error("expected a concurrent deletion to lose to a change")
+	}
+}
+
+func TestScanFolderRecordsBlocksAndMode(t *testing.T) {
+	root := t.TempDir()
+
+	data := randomBytes(t, 3*maxBlockSize)
+	if err := os.WriteFile(filepath.Join(root, "big.bin"), data, 0o600); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	index, err := scanFolder(root, nil, nil)
+	if err != nil {
+		t.Fatalf("scanFolder returned error: %v", err)
+	}
+
+	big := index["big.bin"]
+	if big.Mode != 0o600 {
+		t.Fatalf("expected mode 0600, got %v", big.Mode)
+	}
+	if len(big.Blocks) < 3 {
+		t.Fatalf("expected at least 3 blocks, got %d", len(big.Blocks))
+	}
+
+	var offset int64
+	for _, b := range big.Blocks {
+		if b.Offset != offset {
+			t.Fatalf("expected block at offset %d, got %d", offset, b.Offset)
+		}
+		if b.Hash != hashBlock(data[b.Offset:b.Offset+int64(b.Size)]) {
+			t.Fatalf("wrong hash for block at offset %d", b.Offset)
+		}
+		offset += int64(b.Size)
+	}
+	if offset != int64(len(data)) {
+		t.Fatalf("expected blocks to cover %d bytes, got %d", len(data), offset)
+	}
+}
+
+func TestReconcileScan(t *testing.T) {
+	modTime := time.Date(2026, 2, 3, 20, 3, 11, 0, time.UTC)
+	prev := map[string]fileInfo{
+		"same.txt":    {Path: "same.txt", Size: 1, ModTime: modTime, Hash: "s", Version: versionVector{"BBBBBBB": 1}},
+		"changed.txt": {Path: "changed.txt", Size: 1, ModTime: modTime, Hash: "old", Version: versionVector{"BBBBBBB": 1}},
+		"touched.txt": {Path: "touched.txt", Size: 1, ModTime: modTime, Hash: "t", Version: versionVector{"BBBBBBB": 1}},
+		"removed.txt": {Path: "removed.txt", Size: 1, ModTime: modTime, Hash: "r", Version: versionVector{"BBBBBBB": 1}},
+		"gone.txt":    {Path: "gone.txt", ModTime: modTime, Version: versionVector{"BBBBBBB": 2}, Deleted: true},
+	}
+	scanned := map[string]fileInfo{
+		"same.txt":    prev["same.txt"],
+		"changed.txt": {Path: "changed.txt", Size: 1, ModTime: modTime.Add(time.Second), Hash: "new"},
+		"touched.txt": {Path: "touched.txt", Size: 1, ModTime: modTime.Add(time.Second), Hash: "t"},
+		"new.txt":     {Path: "new.txt", Size: 1, ModTime: modTime, Hash: "n"},
+	}
+
+	index, changed := reconcileScan(prev, scanned, "AAAAAAA", make(recentDeletions))
+
+	if len(changed) != 4 {
+		t.Fatalf("expected 4 changed entries, got %d: %+v", len(changed), changed)
+	}
+	if v := index["same.txt"].Version; v.compare(versionVector{"BBBBBBB": 1}) != orderEqual {
+		t.Errorf("expected unchanged file to keep its version, got %v", v)
+	}
+	if v := index["changed.txt"].Version; v["AAAAAAA"] != 1 || v["BBBBBBB"] != 1 {
+		t.Errorf("expected changed file to get a new version, got %v", v)
+	}
+	if v := index["touched.txt"].Version; v.compare(versionVector{"BBBBBBB": 1}) != orderEqual || !index["touched.txt"].ModTime.Equal(modTime.Add(time.Second)) {
+		t.Errorf("expected touched file to keep its version with the new modification time, got %+v", index["touched.txt"])
+	}
+	if v := index["new.txt"].Version; v["AAAAAAA"] != 1 {
+		t.Errorf("expected new file to get a version, got %v", v)
+	}
+	if removed := index["removed.txt"]; !removed.Deleted || removed.Hash != "" || removed.Version["AAAAAAA"] != 1 {
+		t.Errorf("expected removed file to become a tombstone, got %+v", removed)
+	}
+	if gone := index["gone.txt"]; !gone.Deleted || gone.Version["AAAAAAA"] != 0 {
+		t.Errorf("expected an existing tombstone to be kept as it was, got %+v", gone)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	foldersBucket = []byte("folders")
+	filesBucket   = []byte("files")
+	rootKey       = []byte("root")
+)
+
+// indexDB persists the index of every synced folder in an embedded bbolt
+// database, so that a restart neither rehashes unchanged files nor forgets
+// which files have been deleted. Each folder is a bucket under foldersBucket
+// holding the directory it was indexed from and a nested bucket of file
+// entries, stored as JSON keyed by path.
+type indexDB struct {
+	db *bolt.DB
+}
+
+func openIndexDB(path string) (*indexDB, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(foldersBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &indexDB{db: db}, nil
+}
+
+// loadFolder returns the stored index of folder id. An index recorded for a
+// different directory is discarded rather than returned, since comparing it
+// with the new directory would make every file look deleted.
+func (x *indexDB) loadFolder(id, root string) (map[string]fileInfo, error) {
+	index := make(map[string]fileInfo)
+	err := x.db.Update(func(tx *bolt.Tx) error {
+		folders := tx.Bucket(foldersBucket)
+		bucket := folders.Bucket([]byte(id))
+		if bucket != nil && string(bucket.Get(rootKey)) != root {
+			if err := folders.DeleteBucket([]byte(id)); err != nil {
+				return err
+			}
+			bucket = nil
+		}
+		if bucket == nil {
+			return nil
+		}
+
+		return bucket.Bucket(filesBucket).ForEach(func(k, v []byte) error {
+			var info fileInfo
+			if err := json.Unmarshal(v, &info); err != nil {
+				return err
+			}
+			index[string(k)] = info
+			return nil
+		})
+	})
+	return index, err
+}
+
+// saveFiles stores entries in the index of folder id, which is indexed from
+// root.
+func (x *indexDB) saveFiles(id, root string, entries []fileInfo) error {
+	return x.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.Bucket(foldersBucket).CreateBucketIfNotExists([]byte(id))
+		if err != nil {
+			return err
+		}
+		if err := bucket.Put(rootKey, []byte(root)); err != nil {
+			return err
+		}
+		files, err := bucket.CreateBucketIfNotExists(filesBucket)
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			data, err := json.Marshal(entry)
+			if err != nil {
+				return err
+			}
+			if err := files.Put([]byte(entry.Path), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// deleteFiles removes the entries for paths from the stored index of folder
+// id, leaving no tombstone.
+func (x *indexDB) deleteFiles(id string, paths []string) error {
+	return x.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(foldersBucket).Bucket([]byte(id))
+		if bucket == nil {
+			return nil
+		}
+		files := bucket.Bucket(filesBucket)
+		if files == nil {
+			return nil
+		}
+
+		for _, path := range paths {
+			if err := files.Delete([]byte(path)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// dropFolder deletes the stored index of folder id.
+func (x *indexDB) dropFolder(id string) error {
+	return x.db.Update(func(tx *bolt.Tx) error {
+		err := tx.Bucket(foldersBucket).DeleteBucket([]byte(id))
+		if errors.Is(err, bolt.ErrBucketNotFound) {
+			return nil
+		}
+		return err
+	})
+}
+
+func (x *indexDB) Close() error {
+	return x.db.Close()
+}
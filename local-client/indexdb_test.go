@@ -0,0 +1,111 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testIndexDB opens an index database that is closed when the test ends.
+func testIndexDB(t *testing.T) *indexDB {
+	t.Helper()
+
+	db, err := openIndexDB(filepath.Join(t.TempDir(), "index.db"))
+	if err != nil {
+		t.Fatalf("openIndexDB returned error: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestIndexDBRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index.db")
+	db, err := openIndexDB(path)
+	if err != nil {
+		t.Fatalf("openIndexDB returned error: %v", err)
+	}
+
+	modTime := time.Date(2026, 2, 3, 20, 3, 11, 123456789, time.UTC)
+	entries := []fileInfo{
+		{
+			Path:    "a.txt",
+			Size:    5,
+			ModTime: modTime,
+			Mode:    0o600,
+			Hash:    "abc",
+			Blocks:  []blockInfo{{Offset: 0, Size: 5, Hash: "abc"}},
+			Version: versionVector{"AAAAAAA": 2},
+		},
+		{Path: "gone.txt", ModTime: modTime, Version: versionVector{"AAAAAAA": 1}, Deleted: true},
+	}
+	if err := db.saveFiles("default", "/data", entries); err != nil {
+		t.Fatalf("saveFiles returned error: %v", err)
+	}
+	db.Close()
+
+	// The index survives reopening the database.
+	db, err = openIndexDB(path)
+	if err != nil {
+		t.Fatalf("openIndexDB returned error: %v", err)
+	}
+	defer db.Close()
+
+	index, err := db.loadFolder("default", "/data")
+	if err != nil {
+		t.Fatalf("loadFolder returned error: %v", err)
+	}
+	if len(index) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(index))
+	}
+
+	a := index["a.txt"]
+	if a.Mode != 0o600 || !a.ModTime.Equal(modTime) || len(a.Blocks) != 1 || a.Version["AAAAAAA"] != 2 {
+		t.Fatalf("unexpected entry %+v", a)
+	}
+	if !index["gone.txt"].Deleted {
+		t.Fatal("expected the tombstone to be kept")
+	}
+
+	other, err := db.loadFolder("other", "/data")
+	if err != nil || len(other) != 0 {
+		t.Fatalf("expected no entries for another folder, got %v (%v)", other, err)
+	}
+}
+
+func TestIndexDBDiscardsIndexForAnotherDirectory(t *testing.T) {
+	db := testIndexDB(t)
+
+	if err := db.saveFiles("default", "/old", []fileInfo{{Path: "a.txt", Hash: "abc"}}); err != nil {
+		t.Fatalf("saveFiles returned error: %v", err)
+	}
+
+	index, err := db.loadFolder("default", "/new")
+	if err != nil {
+		t.Fatalf("loadFolder returned error: %v", err)
+	}
+	if len(index) != 0 {
+		t.Fatalf("expected the old directory's index to be discarded, got %v", index)
+	}
+
+	if index, _ := db.loadFolder("default", "/old"); len(index) != 0 {
+		t.Fatalf("expected the discarded index to be gone, got %v", index)
+	}
+}
+
+func TestIndexDBDropFolder(t *testing.T) {
+	db := testIndexDB(t)
+
+	if err := db.saveFiles("photos", "/photos", []fileInfo{{Path: "cat.jpg", Hash: "abc"}}); err != nil {
+		t.Fatalf("saveFiles returned error: %v", err)
+	}
+	if err := db.dropFolder("photos"); err != nil {
+		t.Fatalf("dropFolder returned error: %v", err)
+	}
+	if err := db.dropFolder("photos"); err != nil {
+		t.Fatalf("expected dropping a missing folder to succeed, got %v", err)
+	}
+
+	if index, _ := db.loadFolder("photos", "/photos"); len(index) != 0 {
+		t.Fatalf("expected the folder's index to be gone, got %v", index)
+	}
+}
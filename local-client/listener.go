@@ -1,37 +1,37 @@
 package main
 
 import (
-	"bytes"
-	"io"
+	"crypto/tls"
 	"log"
 	"net"
-	"time"
 )
 
-func acceptLoop(logger *log.Logger, listener net.Listener) {
+func acceptLoop(logger *log.Logger, listener net.Listener, m *connManager) {
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
 			logger.Printf("accept error: %v", err)
 			return
 		}
-		go handleConn(logger, conn)
+		go handleConn(logger, conn, m)
 	}
 }
 
-func handleConn(logger *log.Logger, conn net.Conn) {
-	defer conn.Close()
-
-	_ = conn.SetDeadline(time.Now().Add(30 * time.Second))
-	buf := make([]byte, 1024)
-	n, err := conn.Read(buf)
-	if err != nil && err != io.EOF {
-		logger.Printf("read error: %v", err)
+func handleConn(logger *log.Logger, conn net.Conn, m *connManager) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		logger.Printf("rejecting non-TLS connection from %s", conn.RemoteAddr().String())
+		conn.Close()
 		return
 	}
-	if n > 0 {
-		logger.Printf("received: %q from %s", string(bytes.TrimSpace(buf[:n])), conn.RemoteAddr().String())
+
+	peer, err := tlsHandshake(tlsConn)
+	if err != nil {
+		logger.Printf("TLS handshake with %s failed: %v", conn.RemoteAddr().String(), err)
+		conn.Close()
+		return
 	}
 
-	_, _ = conn.Write([]byte("hello from peer\n"))
+	logger.Printf("accepted connection from %s (device %s)", conn.RemoteAddr().String(), peer.deviceID)
+	m.handleInbound(conn, peer)
 }
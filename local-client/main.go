@@ -1,27 +1,183 @@
 package main
 
 import (
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
+	"io/fs"
 	"log"
 	"net"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"time"
+
+	"github.com/dantdj/syncmesh/local-client/protocol"
 )
 
 func main() {
-	serverURL := flag.String("server", "http://localhost:8089", "signalling server base URL")
-	listenPort := flag.Int("listen", 4000, "local TCP listen port")
+	defaults := defaultConfig()
+	defaultFolder := defaults.Folders[0]
+
+	printDeviceID := flag.Bool("device-id", false, "print this device's ID, creating its identity if needed, and exit")
+	configPath := flag.String("config", "", "JSON config file, created from the other flags if missing (default: config.json in -home)")
+	serverURL := flag.String("server", defaults.Server, "signalling server base URL")
+	listenPort := flag.Int("listen", defaults.ListenPort, "local TCP listen port")
+	folder := flag.String("folder", defaultFolder.Path, "directory to synchronise with peers")
+	modeName := flag.String("folder-mode", string(defaultFolder.Mode), "how changes to -folder flow: send-receive, send-only or receive-only")
+	versioning := flag.String("versioning", defaultFolder.Versioning.Type, "how -folder keeps files replaced or deleted by syncing: none, trashcan, simple or staggered")
+	versioningKeep := flag.Int("versioning-keep", defaultVersionsKept, "number of old versions of each file that simple versioning keeps")
+	versioningMaxAge := flag.Int("versioning-max-age", 0, "days that trashcan and staggered versioning keep old versions for, or 0 to keep them forever")
+	homeDir := flag.String("home", defaults.Home, "directory holding this device's identity, trusted peers and file index")
+	trusted := flag.String("trust", "", "comma-separated device IDs of trusted peers")
+	groups := flag.String("group", strings.Join(defaults.Groups, ","), "comma-separated sync groups to join on the signalling server")
+	stunAddr := flag.String("stun", "", "STUN server address (default: the signalling server's host, port 3478)")
+	apiAddr := flag.String("api", defaults.API, "loopback address for the control API")
+	sendLimit := flag.Int("send-limit", 0, "limit on the rate data is sent to peers, in KiB/s, or 0 for no limit")
+	receiveLimit := flag.Int("receive-limit", 0, "limit on the rate data is received from peers, in KiB/s, or 0 for no limit")
+	limitLAN := flag.Bool("limit-lan", false, "apply -send-limit and -receive-limit to peers on the local network too")
+	compression := flag.String("compression", string(defaults.Compression), "what to compress on connections to peers that agree: none, metadata or always")
+	scanInterval := flag.Duration("scan-interval", time.Duration(defaults.ScanInterval), "interval between full rescans of each folder, as a safety net for missed change notifications")
 	flag.Parse()
 
 	logger := log.New(os.Stdout, "client: ", log.LstdFlags)
 
-	localIP := detectLocalIP(*serverURL)
+	// Flags given on the command line take precedence over the config file.
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	override := func(cfg *clientConfig) {
+		set := func(name string, apply func()) {
+			if given[name] {
+				apply()
+			}
+		}
+		set("server", func() { cfg.Server = *serverURL })
+		set("listen", func() { cfg.ListenPort = *listenPort })
+		set("home", func() { cfg.Home = *homeDir })
+		set("trust", func() { cfg.Trusted = splitList(*trusted) })
+		set("group", func() { cfg.Groups = splitList(*groups) })
+		set("stun", func() { cfg.STUN = *stunAddr })
+		set("api", func() { cfg.API = *apiAddr })
+		set("send-limit", func() { cfg.Bandwidth.SendKiBps = *sendLimit })
+		set("receive-limit", func() { cfg.Bandwidth.ReceiveKiBps = *receiveLimit })
+		set("limit-lan", func() { cfg.Bandwidth.ExemptLAN = !*limitLAN })
+		set("compression", func() { cfg.Compression = protocol.Compression(*compression) })
+		set("scan-interval", func() { cfg.ScanInterval = duration(*scanInterval) })
+
+		// The folder flags describe the default folder.
+		if !given["folder"] && !given["folder-mode"] && !given["versioning"] && !given["versioning-keep"] && !given["versioning-max-age"] {
+			return
+		}
+		i := slices.IndexFunc(cfg.Folders, func(f folderConfig) bool { return f.ID == defaultFolderID })
+		if i < 0 {
+			cfg.Folders = append(cfg.Folders, defaultFolder)
+			i = len(cfg.Folders) - 1
+		}
+		f := &cfg.Folders[i]
+		set("folder", func() { f.Path = *folder })
+		set("folder-mode", func() { f.Mode = folderMode(*modeName) })
+		set("versioning", func() { f.Versioning.Type = *versioning })
+		set("versioning-keep", func() { f.Versioning.Keep = *versioningKeep })
+		set("versioning-max-age", func() { f.Versioning.MaxAgeDays = *versioningMaxAge })
+	}
+
+	if *configPath == "" {
+		*configPath = filepath.Join(*homeDir, "config.json")
+	}
+	cfg, err := loadConfig(*configPath)
+	created := errors.Is(err, fs.ErrNotExist)
+	if created {
+		cfg = defaults
+	} else if err != nil {
+		logger.Fatalf("invalid config file %s: %v", *configPath, err)
+	}
+	override(&cfg)
+	if err := cfg.validate(); err != nil {
+		logger.Fatalf("invalid flags: %v", err)
+	}
+	if *printDeviceID {
+		id, err := loadOrCreateIdentity(cfg.Home)
+		if err != nil {
+			logger.Fatalf("failed to load identity: %v", err)
+		}
+		fmt.Println(id.deviceID)
+		return
+	}
+	if created {
+		if err := writeConfig(*configPath, cfg); err != nil {
+			logger.Fatalf("failed to write config file: %v", err)
+		}
+		logger.Printf("wrote config file %s", *configPath)
+	}
+	signallingTimeout.Store(int64(cfg.SignallingTimeout))
+	wireCompression, _ := protocol.ParseCompression(string(cfg.Compression))
+
+	localIP := detectLocalIP(cfg.Server)
 	if localIP == "" {
 		localIP = "127.0.0.1"
 	}
 
-	listener, err := net.Listen("tcp", fmt.Sprintf("0.0.0.0:%d", *listenPort))
+	id, err := loadOrCreateIdentity(cfg.Home)
+	if err != nil {
+		logger.Fatalf("failed to load identity: %v", err)
+	}
+	logger.Printf("device ID: %s", id.deviceID)
+
+	trust := newTrustStore(filepath.Join(cfg.Home, "trusted_peers"), cfg.trustedIDs())
+	if err := trust.ensureTrustFile(); err != nil {
+		logger.Fatalf("failed to create trust file: %v", err)
+	}
+	tlsConfig := peerTLSConfig(id, trust)
+
+	db, err := openIndexDB(filepath.Join(cfg.Home, "index.db"))
+	if err != nil {
+		logger.Fatalf("failed to open index database: %v", err)
+	}
+	defer db.Close()
+
+	s := newEmptySyncer(logger, db, id.deviceID)
+	for _, f := range cfg.Folders {
+		mode, _ := parseFolderMode(string(f.Mode))
+		keepVersions, _ := f.Versioning.normalize()
+		if err := s.addFolder(f.ID, f.Path, mode, keepVersions, f.Peers); err != nil {
+			logger.Fatalf("failed to index folder %s: %v", f.ID, err)
+		}
+		logger.Printf("syncing folder %s at %s (%s)", f.ID, f.Path, mode)
+	}
+	s.setCompression(wireCompression)
+
+	s.startWatching(time.Duration(cfg.ScanInterval))
+
+	publicKey, err := id.publicKeyDER()
+	if err != nil {
+		logger.Fatalf("failed to encode public key: %v", err)
+	}
+	conns := newConnManager(logger, clientIDForKey(publicKey), tlsConfig, s, newBandwidth(cfg.Bandwidth))
+
+	config := &configManager{
+		logger:    logger,
+		path:      *configPath,
+		override:  override,
+		syncer:    s,
+		conns:     conns,
+		trust:     trust,
+		heartbeat: make(chan time.Duration, 1),
+		current:   cfg,
+	}
+	if err := config.watch(make(chan struct{})); err != nil {
+		logger.Printf("watching config file failed, reload it through the control API instead: %v", err)
+	}
+
+	control := newControlServer(logger, s, conns, config, id.deviceID, clientIDForKey(publicKey))
+	go func() {
+		if err := control.serve(cfg.API); err != nil {
+			logger.Fatalf("control API failed: %v", err)
+		}
+	}()
+
+	listener, err := tls.Listen("tcp", fmt.Sprintf("0.0.0.0:%d", cfg.ListenPort), tlsConfig)
 	if err != nil {
 		logger.Fatalf("failed to listen: %v", err)
 	}
@@ -29,21 +185,83 @@ func main() {
 
 	logger.Printf("listening on %s (local IP: %s)", listener.Addr().String(), localIP)
 
-	go acceptLoop(logger, listener)
+	go acceptLoop(logger, listener, conns)
 
-	clientID, err := register(logger, *serverURL, localIP, *listenPort)
+	// The UDP socket shares the TCP listen port. It must stay open so that the
+	// NAT mapping learned through STUN remains valid for peers to use.
+	udpConn, err := net.ListenPacket("udp", fmt.Sprintf("0.0.0.0:%d", cfg.ListenPort))
+	if err != nil {
+		logger.Fatalf("failed to open UDP socket: %v", err)
+	}
+	defer udpConn.Close()
+
+	reflexive := discoverReflexiveAddr(logger, udpConn, cfg.Server, cfg.STUN)
+
+	clientID, token, err := register(logger, cfg.Server, id, cfg.Groups, localIP, cfg.ListenPort, reflexive)
 	if err != nil {
 		logger.Fatalf("register failed: %v", err)
 	}
 	logger.Printf("registered with clientId=%s", clientID)
+	auth := newCredentials(token)
+
+	// STUN is done with the UDP socket, so QUIC can take it over.
+	udp := newUDPPeering(logger, clientID, udpConn, tlsConfig)
+	if err := udp.serve(conns.handleInbound); err != nil {
+		logger.Fatalf("failed to listen for QUIC: %v", err)
+	}
+	puncher := &holePuncher{logger: logger, baseURL: cfg.Server, auth: auth, udp: udp}
+	conns.enablePunching(puncher)
+	relay := &relayClient{logger: logger, baseURL: cfg.Server, auth: auth, tlsConfig: tlsConfig}
+	conns.enableRelay(relay)
 
-	go heartbeatLoop(logger, *serverURL, clientID, 30*time.Second)
+	reregister := func() (string, error) {
+		_, token, err := register(logger, cfg.Server, id, cfg.Groups, localIP, cfg.ListenPort, reflexive)
+		return token, err
+	}
+	go heartbeatLoop(logger, cfg.Server, clientID, auth, time.Duration(cfg.HeartbeatInterval), config.heartbeat, reregister)
 
 	time.Sleep(500 * time.Millisecond)
 
-	if err := connectToPeer(logger, *serverURL, clientID); err != nil {
-		logger.Printf("no peer connection made: %v", err)
+	watcher := &peerWatcher{
+		logger:  logger,
+		baseURL: cfg.Server,
+		auth:    auth,
+		conns:   conns,
+		punch:   puncher,
+		relay:   relay,
 	}
+	go watcher.run()
 
 	select {}
 }
+
+// discoverReflexiveAddr learns the public address of udpConn from the STUN
+// server, returning nil (and carrying on without it) if that fails.
+func discoverReflexiveAddr(logger *log.Logger, udpConn net.PacketConn, serverURL, stunAddr string) *net.UDPAddr {
+	if stunAddr == "" {
+		var err error
+		if stunAddr, err = stunServerAddr(serverURL); err != nil {
+			logger.Printf("no STUN server: %v", err)
+			return nil
+		}
+	}
+
+	addr, err := queryReflexiveAddr(udpConn, stunAddr)
+	if err != nil {
+		logger.Printf("STUN query to %s failed: %v", stunAddr, err)
+		return nil
+	}
+	logger.Printf("reflexive UDP address: %s", addr)
+	return addr
+}
+
+// splitList splits a comma-separated flag value, dropping empty entries.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
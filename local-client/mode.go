@@ -0,0 +1,269 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/dantdj/syncmesh/local-client/protocol"
+)
+
+// A folder's mode decides which way changes flow. A send-only folder is the
+// authority for its files: it advertises its changes but never applies a
+// peer's, and can override the changes peers have made instead. A
+// receive-only folder mirrors its peers: changes made to it locally are kept
+// to itself, lose to any change a peer makes, and can be reverted.
+
+type folderMode string
+
+const (
+	folderSendReceive folderMode = "send-receive"
+	folderSendOnly    folderMode = "send-only"
+	folderReceiveOnly folderMode = "receive-only"
+)
+
+var errWrongMode = errors.New("not possible in the folder's mode")
+
+// parseFolderMode parses a mode as given in the config or the control API. An
+// empty mode is send-receive.
+func parseFolderMode(s string) (folderMode, error) {
+	switch mode := folderMode(s); mode {
+	case "":
+		return folderSendReceive, nil
+	case folderSendReceive, folderSendOnly, folderReceiveOnly:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown folder mode %q, must be %s, %s or %s", s, folderSendReceive, folderSendOnly, folderReceiveOnly)
+	}
+}
+
+// markLocalChanges flags every entry in changed that records a change made on
+// this device rather than just new metadata, as reconciled from prev, and
+// updates index to match.
+func markLocalChanges(prev, index map[string]fileInfo, changed []fileInfo) {
+	for i, entry := range changed {
+		if entry.Version.compare(prev[entry.Path].Version) == orderEqual {
+			continue
+		}
+		entry.LocalChange = true
+		changed[i] = entry
+		index[entry.Path] = entry
+	}
+}
+
+// setFolderMode switches folder id to mode. Changes kept back while the folder
+// was receive-only are advertised once it isn't, and changes ignored while it
+// was send-only are pulled once it isn't.
+func (s *syncer) setFolderMode(id string, mode folderMode) error {
+	s.mu.Lock()
+	f, ok := s.folders[id]
+	if !ok {
+		s.mu.Unlock()
+		return errFolderNotFound
+	}
+	was := f.mode
+	f.mode = mode
+	s.mu.Unlock()
+
+	if was == mode {
+		return nil
+	}
+	if was == folderReceiveOnly {
+		if err := s.clearLocalChanges(f); err != nil {
+			return err
+		}
+	}
+	s.logger.Printf("folder %s is now %s", id, mode)
+
+	s.broadcastIndex(id)
+	s.pullFolder(id)
+	return nil
+}
+
+// clearLocalChanges turns the local changes in f into ordinary changes, to be
+// advertised to peers.
+func (s *syncer) clearLocalChanges(f *folder) error {
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+
+	var changed []fileInfo
+
+	s.mu.Lock()
+	for path, info := range f.index {
+		if info.LocalChange {
+			info.LocalChange = false
+			f.index[path] = info
+			changed = append(changed, info)
+		}
+	}
+	s.mu.Unlock()
+
+	return s.db.saveFiles(f.id, f.root, changed)
+}
+
+// overrideRemote makes our copy of every file a peer has changed win over the
+// peer's, so that the peer goes back to it. Files peers have that we don't are
+// deleted from them. Only send-only folders can override. It returns the
+// number of files overridden.
+func (s *syncer) overrideRemote(id string) (int, error) {
+	s.mu.Lock()
+	f, ok := s.folders[id]
+	var mode folderMode
+	if ok {
+		mode = f.mode
+	}
+	s.mu.Unlock()
+	if !ok {
+		return 0, errFolderNotFound
+	}
+	if mode != folderSendOnly {
+		return 0, fmt.Errorf("overriding remote changes: %w", errWrongMode)
+	}
+
+	remotes := s.remoteIndexes(id)
+
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+
+	overridden := make(map[string]fileInfo)
+
+	s.mu.Lock()
+	for _, update := range remotes {
+		for _, wire := range update.Files {
+			remote := fileInfoFromWire(wire)
+			if f.ignores.ignored(remote.Path, false) {
+				continue
+			}
+			local, ok := f.index[remote.Path]
+			if !needsPull(local, ok, remote) {
+				continue
+			}
+			if !ok {
+				local = fileInfo{Path: remote.Path, ModTime: time.Now().UTC(), Deleted: true}
+			}
+			local.Version = local.Version.merge(remote.Version).update(s.device)
+			local.ModifiedBy = s.device
+			local.RenamedFrom = ""
+			f.index[local.Path] = local
+			overridden[local.Path] = local
+		}
+	}
+	s.mu.Unlock()
+
+	if len(overridden) == 0 {
+		return 0, nil
+	}
+	if err := s.db.saveFiles(id, f.root, slices.Collect(maps.Values(overridden))); err != nil {
+		return 0, err
+	}
+
+	s.logger.Printf("folder %s overrode %d remote changes", id, len(overridden))
+	s.broadcastIndex(id)
+	return len(overridden), nil
+}
+
+// revertLocalChanges undoes every local change to a receive-only folder.
+// Files that no peer has are deleted, and the rest are forgotten so that the
+// peers' copies are pulled over them. It returns the number of files reverted.
+func (s *syncer) revertLocalChanges(id string) (int, error) {
+	s.mu.Lock()
+	f, ok := s.folders[id]
+	var mode folderMode
+	if ok {
+		mode = f.mode
+	}
+	s.mu.Unlock()
+	if !ok {
+		return 0, errFolderNotFound
+	}
+	if mode != folderReceiveOnly {
+		return 0, fmt.Errorf("reverting local changes: %w", errWrongMode)
+	}
+
+	live := make(map[string]bool)
+	for _, update := range s.remoteIndexes(id) {
+		for _, wire := range update.Files {
+			if !wire.Deleted {
+				live[wire.Path] = true
+			}
+		}
+	}
+
+	reverted, err := s.forgetLocalChanges(f, live)
+	if err != nil {
+		return 0, err
+	}
+	if reverted == 0 {
+		return 0, nil
+	}
+
+	s.logger.Printf("folder %s reverted %d local changes", id, reverted)
+	s.pullFolder(id)
+	return reverted, nil
+}
+
+// forgetLocalChanges drops every local change from f's index, deleting the
+// files that aren't in live, the set of paths some peer has. Deleted files are
+// kept as versions if f keeps them.
+func (s *syncer) forgetLocalChanges(f *folder, live map[string]bool) (int, error) {
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+
+	var changes []fileInfo
+
+	s.mu.Lock()
+	for _, info := range f.index {
+		if info.LocalChange {
+			changes = append(changes, info)
+		}
+	}
+	s.mu.Unlock()
+
+	paths := make([]string, 0, len(changes))
+	for _, info := range changes {
+		if !info.Deleted && !live[info.Path] && filepath.IsLocal(filepath.FromSlash(info.Path)) {
+			if err := s.archiveVersion(f, info.Path); err != nil {
+				return 0, err
+			}
+			err := os.Remove(filepath.Join(f.root, filepath.FromSlash(info.Path)))
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return 0, err
+			}
+			removeEmptyParents(f.root, info.Path)
+		}
+		paths = append(paths, info.Path)
+	}
+	if err := s.db.deleteFiles(f.id, paths); err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	for _, path := range paths {
+		delete(f.index, path)
+	}
+	s.mu.Unlock()
+
+	return len(paths), nil
+}
+
+// remoteIndexes returns the latest index every connected peer the folder is
+// shared with has sent for folder id.
+func (s *syncer) remoteIndexes(id string) []*protocol.IndexUpdate {
+	var updates []*protocol.IndexUpdate
+	for _, sess := range s.activeSessions() {
+		if !s.folderSharedWith(id, sess) {
+			continue
+		}
+		sess.mu.Lock()
+		if update := sess.remote[id]; update != nil {
+			updates = append(updates, update)
+		}
+		sess.mu.Unlock()
+	}
+	return updates
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func waitForRemoval(t *testing.T, path string) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %s to be removed", path)
+}
+
+func TestParseFolderMode(t *testing.T) {
+	if mode, err := parseFolderMode(""); err != nil || mode != folderSendReceive {
+		t.Fatalf("expected an empty mode to be send-receive, got %q, %v", mode, err)
+	}
+	if mode, err := parseFolderMode("receive-only"); err != nil || mode != folderReceiveOnly {
+		t.Fatalf("expected receive-only, got %q, %v", mode, err)
+	}
+	if _, err := parseFolderMode("mirror"); err == nil {
+		t.Fatal("expected an unknown mode to be rejected")
+	}
+}
+
+func TestSendOnlyFolderOverridesRemoteChanges(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	rootA := t.TempDir()
+	rootB := t.TempDir()
+	for _, root := range []string{rootA, rootB} {
+		if err := os.WriteFile(filepath.Join(root, "artifact.txt"), []byte("build 1"), 0o644); err != nil {
+			t.Fatalf("failed to write file: %v", err)
+		}
+	}
+
+	a, err := newSyncer(logger, testIndexDB(t), "AAAAAAAA", rootA, folderSendOnly)
+	if err != nil {
+		t.Fatalf("newSyncer returned error: %v", err)
+	}
+	b, err := newSyncer(logger, testIndexDB(t), "BBBBBBBB", rootB, folderSendReceive)
+	if err != nil {
+		t.Fatalf("newSyncer returned error: %v", err)
+	}
+
+	connA, connB := net.Pipe()
+	go a.runSession(connA, remotePeer{deviceID: "device-b", clientID: "client-b"})
+	go b.runSession(connB, remotePeer{deviceID: "device-a", clientID: "client-a"})
+	t.Cleanup(func() {
+		connA.Close()
+		connB.Close()
+	})
+	time.Sleep(200 * time.Millisecond)
+
+	if err := os.WriteFile(filepath.Join(rootB, "artifact.txt"), []byte("tampered"), 0o644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(rootB, "extra.txt"), []byte("extra"), 0o644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	if err := b.rescan(); err != nil {
+		t.Fatalf("rescan returned error: %v", err)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	if data, err := os.ReadFile(filepath.Join(rootA, "artifact.txt")); err != nil || string(data) != "build 1" {
+		t.Fatalf("expected the send-only folder to keep its copy, got %q, %v", data, err)
+	}
+	if _, err := os.Stat(filepath.Join(rootA, "extra.txt")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected the send-only folder not to pull new files, got %v", err)
+	}
+
+	n, err := a.overrideRemote(defaultFolderID)
+	if err != nil {
+		t.Fatalf("overrideRemote returned error: %v", err)
+	}
+	if n != 2 {
+		t.Fatalf("expected 2 files to be overridden, got %d", n)
+	}
+
+	waitForFile(t, filepath.Join(rootB, "artifact.txt"), "build 1")
+	waitForRemoval(t, filepath.Join(rootB, "extra.txt"))
+
+	if _, err := b.overrideRemote(defaultFolderID); !errors.Is(err, errWrongMode) {
+		t.Fatalf("expected a send-receive folder to refuse to override, got %v", err)
+	}
+}
+
+func TestReceiveOnlyFolderRevertsLocalChanges(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	rootA := t.TempDir()
+	rootB := t.TempDir()
+	if err := os.WriteFile(filepath.Join(rootA, "data.txt"), []byte("upstream"), 0o644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	a, err := newSyncer(logger, testIndexDB(t), "AAAAAAAA", rootA, folderSendReceive)
+	if err != nil {
+		t.Fatalf("newSyncer returned error: %v", err)
+	}
+	b, err := newSyncer(logger, testIndexDB(t), "BBBBBBBB", rootB, folderReceiveOnly)
+	if err != nil {
+		t.Fatalf("newSyncer returned error: %v", err)
+	}
+
+	connA, connB := net.Pipe()
+	go a.runSession(connA, remotePeer{deviceID: "device-b", clientID: "client-b"})
+	go b.runSession(connB, remotePeer{deviceID: "device-a", clientID: "client-a"})
+	t.Cleanup(func() {
+		connA.Close()
+		connB.Close()
+	})
+	waitForFile(t, filepath.Join(rootB, "data.txt"), "upstream")
+
+	if err := os.WriteFile(filepath.Join(rootB, "data.txt"), []byte("edited here"), 0o644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(rootB, "local.txt"), []byte("local"), 0o644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	if err := b.rescan(); err != nil {
+		t.Fatalf("rescan returned error: %v", err)
+	}
+
+	if status, _ := b.folderStatus(defaultFolderID); status.LocalChanges != 2 {
+		t.Fatalf("expected 2 local changes, got %+v", status)
+	}
+	if update := b.indexUpdate(defaultFolderID); len(update.Files) != 0 {
+		t.Fatalf("expected local changes not to be advertised, got %+v", update.Files)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	if data, err := os.ReadFile(filepath.Join(rootA, "data.txt")); err != nil || string(data) != "upstream" {
+		t.Fatalf("expected the peer to keep its copy, got %q, %v", data, err)
+	}
+	if _, err := os.Stat(filepath.Join(rootA, "local.txt")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected the peer not to receive local files, got %v", err)
+	}
+
+	n, err := b.revertLocalChanges(defaultFolderID)
+	if err != nil {
+		t.Fatalf("revertLocalChanges returned error: %v", err)
+	}
+	if n != 2 {
+		t.Fatalf("expected 2 files to be reverted, got %d", n)
+	}
+
+	waitForFile(t, filepath.Join(rootB, "data.txt"), "upstream")
+	if _, err := os.Stat(filepath.Join(rootB, "local.txt")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected the locally added file to be deleted, got %v", err)
+	}
+}
+
+func TestReceiveOnlyFolderLosesConflicts(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	rootA := t.TempDir()
+	rootB := t.TempDir()
+	if err := os.WriteFile(filepath.Join(rootA, "data.txt"), []byte("v1"), 0o644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	a, err := newSyncer(logger, testIndexDB(t), "AAAAAAAA", rootA, folderSendReceive)
+	if err != nil {
+		t.Fatalf("newSyncer returned error: %v", err)
+	}
+	b, err := newSyncer(logger, testIndexDB(t), "BBBBBBBB", rootB, folderReceiveOnly)
+	if err != nil {
+		t.Fatalf("newSyncer returned error: %v", err)
+	}
+
+	connA, connB := net.Pipe()
+	go a.runSession(connA, remotePeer{deviceID: "device-b", clientID: "client-b"})
+	go b.runSession(connB, remotePeer{deviceID: "device-a", clientID: "client-a"})
+	t.Cleanup(func() {
+		connA.Close()
+		connB.Close()
+	})
+	waitForFile(t, filepath.Join(rootB, "data.txt"), "v1")
+
+	if err := os.WriteFile(filepath.Join(rootB, "data.txt"), []byte("local edit"), 0o644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	if err := b.rescan(); err != nil {
+		t.Fatalf("rescan returned error: %v", err)
+	}
+
+	// The edits are concurrent, and the peer's wins however they compare.
+	if err := os.WriteFile(filepath.Join(rootA, "data.txt"), []byte("v2"), 0o644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	if err := a.rescan(); err != nil {
+		t.Fatalf("rescan returned error: %v", err)
+	}
+
+	waitForFile(t, filepath.Join(rootB, "data.txt"), "v2")
+	conflicts := b.conflicts()
+	if len(conflicts) != 1 {
+		t.Fatalf("expected the local edit to be kept as a conflict copy, got %+v", conflicts)
+	}
+	for _, info := range b.indexUpdate(defaultFolderID).Files {
+		if info.Path == conflicts[0].Path {
+			t.Fatal("expected the conflict copy not to be advertised")
+		}
+	}
+}
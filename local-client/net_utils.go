@@ -16,6 +16,17 @@ func pickPeerAddress(peer clientSnapshot) string {
 	return ""
 }
 
+// reachedLocally reports whether addr, the remote address of a connection
+// with peer, is the local address that pickPeerAddress tries first, meaning
+// the two devices are on the same network.
+func reachedLocally(peer clientSnapshot, addr net.Addr) bool {
+	if peer.LocalIP == "" {
+		return false
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	return err == nil && host == peer.LocalIP
+}
+
 func detectLocalIP(baseURL string) string {
 	parsed, err := url.Parse(baseURL)
 	if err != nil {
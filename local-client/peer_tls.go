@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// peerALPN is negotiated on every peer connection so that we never mistake
+	// some other TLS service for a SyncMesh peer.
+	peerALPN = "syncmesh/1"
+
+	tlsHandshakeTimeout = 10 * time.Second
+)
+
+var errUntrustedPeer = errors.New("peer device is not trusted")
+
+// trustStore holds the device IDs we are willing to talk to. IDs come from the
+// command line and config file plus a trust file in the home directory, which
+// is re-read on every check so that peers can be added without a restart.
+type trustStore struct {
+	path string
+
+	mu     sync.Mutex
+	static map[string]struct{}
+}
+
+func newTrustStore(path string, ids []string) *trustStore {
+	t := &trustStore{path: path}
+	t.setStatic(ids)
+	return t
+}
+
+// setStatic replaces the IDs trusted besides those in the trust file.
+func (t *trustStore) setStatic(ids []string) {
+	static := make(map[string]struct{}, len(ids))
+	for _, id := range ids {
+		if id = normalizeDeviceID(id); id != "" {
+			static[id] = struct{}{}
+		}
+	}
+
+	t.mu.Lock()
+	t.static = static
+	t.mu.Unlock()
+}
+
+func (t *trustStore) isTrusted(deviceID string) bool {
+	deviceID = normalizeDeviceID(deviceID)
+
+	t.mu.Lock()
+	_, ok := t.static[deviceID]
+	t.mu.Unlock()
+	if ok {
+		return true
+	}
+
+	f, err := os.Open(t.path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if normalizeDeviceID(line) == deviceID {
+			return true
+		}
+	}
+	return false
+}
+
+// ensureTrustFile creates an empty, commented trust file if none exists yet so
+// users know where to add peer device IDs.
+func (t *trustStore) ensureTrustFile() error {
+	_, err := os.Stat(t.path)
+	if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return os.WriteFile(t.path, []byte("# Device IDs of trusted peers, one per line.\n"), 0o600)
+}
+
+// peerTLSConfig returns the configuration used for both accepting and dialing
+// peer connections. Certificates are self-signed, so chain verification is
+// replaced by checking the peer's fingerprint against the trust store.
+func peerTLSConfig(id *identity, trust *trustStore) *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{id.cert},
+		ClientAuth:   tls.RequireAnyClientCert,
+		MinVersion:   tls.VersionTLS13,
+		NextProtos:   []string{peerALPN},
+		// Standard verification would reject the self-signed certificates, so
+		// it is disabled in favour of VerifyPeerCertificate below.
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("peer presented no certificate")
+			}
+			deviceID := deviceIDFromCert(rawCerts[0])
+			if !trust.isTrusted(deviceID) {
+				return fmt.Errorf("%w: %s", errUntrustedPeer, deviceID)
+			}
+			return nil
+		},
+	}
+}
+
+// remotePeer identifies the authenticated device at the other end of a
+// connection, both by its device ID and by its signalling server client ID.
+type remotePeer struct {
+	deviceID string
+	clientID string
+}
+
+// tlsHandshake completes the TLS handshake on conn and returns the identity of
+// the verified peer.
+func tlsHandshake(conn *tls.Conn) (remotePeer, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), tlsHandshakeTimeout)
+	defer cancel()
+
+	if err := conn.HandshakeContext(ctx); err != nil {
+		return remotePeer{}, err
+	}
+
+	return peerFromTLSState(conn.ConnectionState())
+}
+
+// peerFromTLSState returns the identity of the peer of a completed handshake,
+// whether it ran over TCP or QUIC.
+func peerFromTLSState(state tls.ConnectionState) (remotePeer, error) {
+	if state.NegotiatedProtocol != peerALPN {
+		return remotePeer{}, fmt.Errorf("unexpected application protocol %q", state.NegotiatedProtocol)
+	}
+	if len(state.PeerCertificates) == 0 {
+		return remotePeer{}, errors.New("peer presented no certificate")
+	}
+
+	cert := state.PeerCertificates[0]
+	return remotePeer{
+		deviceID: deviceIDFromCert(cert.Raw),
+		clientID: clientIDForCert(cert),
+	}, nil
+}
+
+// dialPeer opens a mutually authenticated TLS connection to addr.
+func dialPeer(addr string, config *tls.Config) (*tls.Conn, remotePeer, error) {
+	raw, err := net.DialTimeout("tcp", addr, 3*time.Second)
+	if err != nil {
+		return nil, remotePeer{}, err
+	}
+
+	conn := tls.Client(raw, config)
+	peer, err := tlsHandshake(conn)
+	if err != nil {
+		raw.Close()
+		return nil, remotePeer{}, err
+	}
+	return conn, peer, nil
+}
@@ -0,0 +1,156 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+const (
+	headerSize = 8
+
+	// MaxPayloadSize bounds the body of a single message so a misbehaving peer
+	// can't make us allocate arbitrary amounts of memory.
+	MaxPayloadSize = 64 << 20
+)
+
+// encMode keeps full nanosecond precision on timestamps, which peers rely on
+// when comparing modification times.
+var encMode = func() cbor.EncMode {
+	mode, err := cbor.EncOptions{Time: cbor.TimeRFC3339Nano}.EncMode()
+	if err != nil {
+		panic(err)
+	}
+	return mode
+}()
+
+var (
+	ErrUnsupportedVersion = errors.New("protocol: unsupported version")
+	ErrUnknownType        = errors.New("protocol: unknown message type")
+	ErrPayloadTooLarge    = errors.New("protocol: payload too large")
+	ErrUnknownFlags       = errors.New("protocol: unknown flags")
+)
+
+// Encoder writes framed messages to an underlying writer. It is safe for
+// concurrent use.
+type Encoder struct {
+	mu          sync.Mutex
+	w           io.Writer
+	compression Compression
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// SetCompression sets how much of what is encoded from now on is compressed.
+// Until it is called nothing is.
+func (e *Encoder) SetCompression(c Compression) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.compression = c
+}
+
+// Encode writes msg as a single frame.
+func (e *Encoder) Encode(msg Message) error {
+	body, err := encMode.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if len(body) > MaxPayloadSize {
+		return fmt.Errorf("%w: %d bytes", ErrPayloadTooLarge, len(body))
+	}
+
+	e.mu.Lock()
+	compression := e.compression
+	e.mu.Unlock()
+
+	var flags uint16
+	if shouldCompress(compression, msg) {
+		if compressed, ok := compressBody(body); ok {
+			body = compressed
+			flags |= flagCompressed
+		}
+	}
+
+	frame := make([]byte, headerSize+len(body))
+	frame[0] = Version
+	frame[1] = uint8(msg.Type())
+	binary.BigEndian.PutUint16(frame[2:4], flags)
+	binary.BigEndian.PutUint32(frame[4:8], uint32(len(body)))
+	copy(frame[headerSize:], body)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	_, err = e.w.Write(frame)
+	return err
+}
+
+// Decoder reads framed messages from an underlying reader. It is not safe for
+// concurrent use.
+type Decoder struct {
+	r      io.Reader
+	header [headerSize]byte
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: r}
+}
+
+// Decode reads the next frame and returns its body as a pointer to the concrete
+// message type, e.g. *Hello or *IndexUpdate. A clean end of stream between
+// frames is reported as io.EOF.
+func (d *Decoder) Decode() (Message, error) {
+	if _, err := io.ReadFull(d.r, d.header[:]); err != nil {
+		return nil, err
+	}
+
+	version := d.header[0]
+	msgType := MessageType(d.header[1])
+	flags := binary.BigEndian.Uint16(d.header[2:4])
+	length := binary.BigEndian.Uint32(d.header[4:8])
+
+	if version != Version {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, version)
+	}
+	if length > MaxPayloadSize {
+		return nil, fmt.Errorf("%w: %d bytes", ErrPayloadTooLarge, length)
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(d.r, body); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if flags&^flagCompressed != 0 {
+		return nil, fmt.Errorf("%w: %#x", ErrUnknownFlags, flags)
+	}
+	if flags&flagCompressed != 0 {
+		var err error
+		if body, err = decompressBody(body); err != nil {
+			return nil, err
+		}
+	}
+
+	msg, err := newMessage(msgType)
+	if err != nil {
+		return nil, err
+	}
+	if err := cbor.Unmarshal(body, msg); err != nil {
+		return nil, fmt.Errorf("protocol: decoding %s: %w", msgType, err)
+	}
+
+	return msg, nil
+}
+
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,93 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEncodeDecodeRoundTrip(t *testing.T) {
+	modTime := time.Date(2026, 2, 3, 20, 3, 11, 123456789, time.UTC)
+
+	messages := []Message{
+		&Hello{DeviceName: "laptop", ClientVersion: "0.1.0"},
+		&IndexUpdate{Folder: "default", Files: []FileInfo{
+			{Path: "a.txt", Size: 5, ModTime: modTime, Hash: "abc"},
+			{Path: "b.txt", Size: 3, ModTime: modTime, Hash: "def", Mode: 0o755, Version: map[string]uint64{"AAAAAAA": 2, "BBBBBBB": 1}, Blocks: []BlockInfo{{Offset: 0, Size: 3, Hash: "def"}}, ModifiedBy: "AAAAAAA"},
+			{Path: "c.txt", ModTime: modTime, Version: map[string]uint64{"AAAAAAA": 3}, Deleted: true},
+		}},
+		&Request{ID: 7, Folder: "default", Path: "a.txt", Hash: "abc", Offset: 65536, Size: 4096},
+		&Response{ID: 7, Data: []byte("hello")},
+		&Response{ID: 8, Error: "file not found"},
+		&Ping{},
+		&Close{Reason: "shutting down"},
+	}
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	for _, msg := range messages {
+		if err := enc.Encode(msg); err != nil {
+			t.Fatalf("Encode(%s) returned error: %v", msg.Type(), err)
+		}
+	}
+
+	dec := NewDecoder(&buf)
+	for _, want := range messages {
+		got, err := dec.Decode()
+		if err != nil {
+			t.Fatalf("Decode returned error: %v", err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("expected %+v, got %+v", want, got)
+		}
+	}
+
+	if _, err := dec.Decode(); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected io.EOF after last frame, got %v", err)
+	}
+}
+
+func TestDecodeRejectsUnsupportedVersion(t *testing.T) {
+	var buf bytes.Buffer
+	if err := NewEncoder(&buf).Encode(Ping{}); err != nil {
+		t.Fatalf("Encode returned error: %v", err)
+	}
+
+	frame := buf.Bytes()
+	frame[0] = Version + 1
+
+	if _, err := NewDecoder(bytes.NewReader(frame)).Decode(); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Fatalf("expected ErrUnsupportedVersion, got %v", err)
+	}
+}
+
+func TestDecodeRejectsUnknownType(t *testing.T) {
+	frame := []byte{Version, 0xff, 0, 0, 0, 0, 0, 1, 0xa0}
+
+	if _, err := NewDecoder(bytes.NewReader(frame)).Decode(); !errors.Is(err, ErrUnknownType) {
+		t.Fatalf("expected ErrUnknownType, got %v", err)
+	}
+}
+
+func TestDecodeRejectsOversizedPayload(t *testing.T) {
+	frame := []byte{Version, byte(TypePing), 0, 0, 0xff, 0xff, 0xff, 0xff}
+
+	if _, err := NewDecoder(bytes.NewReader(frame)).Decode(); !errors.Is(err, ErrPayloadTooLarge) {
+		t.Fatalf("expected ErrPayloadTooLarge, got %v", err)
+	}
+}
+
+func TestDecodeTruncatedFrame(t *testing.T) {
+	var buf bytes.Buffer
+	if err := NewEncoder(&buf).Encode(Close{Reason: "bye"}); err != nil {
+		t.Fatalf("Encode returned error: %v", err)
+	}
+
+	truncated := buf.Bytes()[:buf.Len()-1]
+	if _, err := NewDecoder(bytes.NewReader(truncated)).Decode(); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("expected io.ErrUnexpectedEOF, got %v", err)
+	}
+}
@@ -0,0 +1,171 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Frame bodies can be compressed with zstd, which is marked by flagCompressed
+// in the header; length is then the size of the compressed body. How much is
+// compressed is negotiated per connection in the Hello exchange, and each side
+// compresses only what both agreed to. Blocks that look compressed already,
+// judging by the entropy of their bytes or by a hint from the sender, are sent
+// as they are, as is any body that compression wouldn't shrink.
+
+// Compression is how much of a connection's traffic is compressed.
+type Compression string
+
+const (
+	// CompressionNone compresses nothing.
+	CompressionNone Compression = "none"
+	// CompressionMetadata compresses everything but file data, which is
+	// mostly indexes.
+	CompressionMetadata Compression = "metadata"
+	// CompressionAlways compresses file data as well.
+	CompressionAlways Compression = "always"
+)
+
+const (
+	flagCompressed uint16 = 1 << 0
+
+	// minCompressSize is the smallest body worth compressing.
+	minCompressSize = 128
+	// maxEntropy is the entropy, in bits per byte, above which data is taken
+	// to be compressed already.
+	maxEntropy = 7.5
+	// entropySample is how much of a block is looked at to estimate its
+	// entropy, in a few evenly spaced pieces.
+	entropySample = 16 * 1024
+	entropyPieces = 4
+)
+
+var (
+	zstdEncoder = mustEncoder()
+	zstdDecoder = mustDecoder()
+)
+
+func mustEncoder() *zstd.Encoder {
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault))
+	if err != nil {
+		panic(err)
+	}
+	return enc
+}
+
+func mustDecoder() *zstd.Decoder {
+	dec, err := zstd.NewReader(nil, zstd.WithDecoderMaxMemory(MaxPayloadSize))
+	if err != nil {
+		panic(err)
+	}
+	return dec
+}
+
+// ParseCompression parses a compression setting. An empty setting is none.
+func ParseCompression(s string) (Compression, error) {
+	switch c := Compression(s); c {
+	case "":
+		return CompressionNone, nil
+	case CompressionNone, CompressionMetadata, CompressionAlways:
+		return c, nil
+	default:
+		return "", fmt.Errorf("unknown compression %q, must be %s, %s or %s", s, CompressionNone, CompressionMetadata, CompressionAlways)
+	}
+}
+
+// Negotiate returns the compression for a connection on which one side asked
+// for a and the other for b, which is the lesser of the two. A peer that
+// didn't say, such as an older build, gets none.
+func Negotiate(a, b Compression) Compression {
+	rank := func(c Compression) int {
+		switch c {
+		case CompressionMetadata:
+			return 1
+		case CompressionAlways:
+			return 2
+		default:
+			return 0
+		}
+	}
+	if rank(a) < rank(b) {
+		return normalize(a)
+	}
+	return normalize(b)
+}
+
+func normalize(c Compression) Compression {
+	if c != CompressionMetadata && c != CompressionAlways {
+		return CompressionNone
+	}
+	return c
+}
+
+// shouldCompress reports whether msg is to be compressed under c.
+func shouldCompress(c Compression, msg Message) bool {
+	switch m := msg.(type) {
+	case Hello, *Hello:
+		// Compression isn't agreed until both Hellos are in.
+		return false
+	case Response:
+		return c == CompressionAlways && !m.Incompressible && !incompressible(m.Data)
+	case *Response:
+		return c == CompressionAlways && !m.Incompressible && !incompressible(m.Data)
+	default:
+		return c == CompressionMetadata || c == CompressionAlways
+	}
+}
+
+// compressBody returns body compressed, or false if compressing it wouldn't
+// save anything.
+func compressBody(body []byte) ([]byte, bool) {
+	if len(body) < minCompressSize {
+		return nil, false
+	}
+	compressed := zstdEncoder.EncodeAll(body, make([]byte, 0, len(body)))
+	if len(compressed) >= len(body) {
+		return nil, false
+	}
+	return compressed, true
+}
+
+func decompressBody(body []byte) ([]byte, error) {
+	decoded, err := zstdDecoder.DecodeAll(body, nil)
+	if errors.Is(err, zstd.ErrDecoderSizeExceeded) {
+		return nil, fmt.Errorf("%w: decompressed body", ErrPayloadTooLarge)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("protocol: decompressing body: %w", err)
+	}
+	return decoded, nil
+}
+
+// incompressible estimates whether data is compressed already from the
+// entropy of a sample of its bytes.
+func incompressible(data []byte) bool {
+	if len(data) < minCompressSize {
+		return false
+	}
+
+	var counts [256]int
+	sampled := 0
+	piece := min(len(data), entropySample) / entropyPieces
+	step := len(data) / entropyPieces
+	for i := range entropyPieces {
+		for _, b := range data[i*step : i*step+piece] {
+			counts[b]++
+		}
+		sampled += piece
+	}
+
+	entropy := 0.0
+	for _, n := range counts {
+		if n == 0 {
+			continue
+		}
+		p := float64(n) / float64(sampled)
+		entropy -= p * math.Log2(p)
+	}
+	return entropy > maxEntropy
+}
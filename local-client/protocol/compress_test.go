@@ -0,0 +1,164 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// encodeFrame encodes msg under c and returns the frame.
+func encodeFrame(t *testing.T, c Compression, msg Message) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.SetCompression(c)
+	if err := enc.Encode(msg); err != nil {
+		t.Fatalf("Encode(%s) returned error: %v", msg.Type(), err)
+	}
+	return buf.Bytes()
+}
+
+func compressed(frame []byte) bool {
+	return binary.BigEndian.Uint16(frame[2:4])&flagCompressed != 0
+}
+
+func textIndex() *IndexUpdate {
+	modTime := time.Date(2026, 2, 3, 20, 3, 11, 0, time.UTC)
+	update := &IndexUpdate{Folder: "default"}
+	for i := range 200 {
+		update.Files = append(update.Files, FileInfo{
+			Path:    fmt.Sprintf("logs/service-%03d.log", i),
+			Size:    int64(1000 + i),
+			ModTime: modTime,
+			Hash:    fmt.Sprintf("%064x", i),
+			Version: map[string]uint64{"AAAAAAA": uint64(i + 1)},
+		})
+	}
+	return update
+}
+
+func randomData(t *testing.T, n int) []byte {
+	t.Helper()
+
+	data := make([]byte, n)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatalf("failed to generate data: %v", err)
+	}
+	return data
+}
+
+func TestCompressionFollowsNegotiatedMode(t *testing.T) {
+	index := textIndex()
+	text := &Response{ID: 1, Data: bytes.Repeat([]byte("GET /healthz 200 served in 12ms\n"), 4096)}
+	random := &Response{ID: 2, Data: randomData(t, 256*1024)}
+
+	if compressed(encodeFrame(t, CompressionNone, index)) {
+		t.Fatal("expected nothing to be compressed without compression")
+	}
+	if !compressed(encodeFrame(t, CompressionMetadata, index)) {
+		t.Fatal("expected an index to be compressed under metadata compression")
+	}
+	if compressed(encodeFrame(t, CompressionMetadata, text)) {
+		t.Fatal("expected file data not to be compressed under metadata compression")
+	}
+
+	frame := encodeFrame(t, CompressionAlways, text)
+	if !compressed(frame) || len(frame) > len(text.Data)/10 {
+		t.Fatalf("expected text to be compressed, got a %d byte frame for %d bytes", len(frame), len(text.Data))
+	}
+	if compressed(encodeFrame(t, CompressionAlways, random)) {
+		t.Fatal("expected random data to be skipped")
+	}
+	hinted := *text
+	hinted.Incompressible = true
+	if compressed(encodeFrame(t, CompressionAlways, &hinted)) {
+		t.Fatal("expected data hinted as incompressible to be skipped")
+	}
+	if compressed(encodeFrame(t, CompressionAlways, &Hello{DeviceName: string(bytes.Repeat([]byte("a"), 1024))})) {
+		t.Fatal("expected a hello never to be compressed")
+	}
+}
+
+func TestCompressedRoundTrip(t *testing.T) {
+	text := bytes.Repeat([]byte("2026-02-03T20:03:11Z INFO synced folder default\n"), 2048)
+	random := randomData(t, 64*1024)
+
+	messages := []Message{
+		&Hello{DeviceName: "laptop", ClientVersion: "0.1.0", Compression: CompressionAlways},
+		textIndex(),
+		&Request{ID: 7, Folder: "default", Path: "a.txt", Hash: "abc", Offset: 65536, Size: 4096},
+		&Response{ID: 7, Data: text},
+		&Response{ID: 8, Data: random},
+		&Response{ID: 9, Data: text[:100]},
+		&Response{ID: 10, Error: "file not found"},
+		&Ping{},
+	}
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.SetCompression(CompressionAlways)
+	for _, msg := range messages {
+		if err := enc.Encode(msg); err != nil {
+			t.Fatalf("Encode(%s) returned error: %v", msg.Type(), err)
+		}
+	}
+
+	dec := NewDecoder(&buf)
+	for _, want := range messages {
+		got, err := dec.Decode()
+		if err != nil {
+			t.Fatalf("Decode returned error: %v", err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("expected %s to survive the round trip unchanged", want.Type())
+		}
+	}
+}
+
+func TestNegotiateCompression(t *testing.T) {
+	if c := Negotiate(CompressionAlways, CompressionMetadata); c != CompressionMetadata {
+		t.Fatalf("expected the lesser setting, got %q", c)
+	}
+	if c := Negotiate(CompressionAlways, CompressionAlways); c != CompressionAlways {
+		t.Fatalf("expected always, got %q", c)
+	}
+	if c := Negotiate(CompressionMetadata, ""); c != CompressionNone {
+		t.Fatalf("expected a peer that doesn't say to get none, got %q", c)
+	}
+	if _, err := ParseCompression("lz4"); err == nil {
+		t.Fatal("expected an unknown setting to be rejected")
+	}
+}
+
+func TestIncompressible(t *testing.T) {
+	if !incompressible(randomData(t, 1<<20)) {
+		t.Fatal("expected random data to look compressed")
+	}
+	if incompressible(bytes.Repeat([]byte("func main() {\n\tfmt.Println(\"hello\")\n}\n"), 4096)) {
+		t.Fatal("expected source code not to look compressed")
+	}
+}
+
+func TestDecodeRejectsBadCompressedFrames(t *testing.T) {
+	frame := encodeFrame(t, CompressionMetadata, textIndex())
+
+	corrupt := bytes.Clone(frame)
+	for i := headerSize; i < len(corrupt); i++ {
+		corrupt[i] ^= 0x5a
+	}
+	if _, err := NewDecoder(bytes.NewReader(corrupt)).Decode(); err == nil {
+		t.Fatal("expected a corrupt compressed body to be rejected")
+	}
+
+	unknown := bytes.Clone(frame)
+	binary.BigEndian.PutUint16(unknown[2:4], 0x8000|flagCompressed)
+	if _, err := NewDecoder(bytes.NewReader(unknown)).Decode(); !errors.Is(err, ErrUnknownFlags) {
+		t.Fatalf("expected ErrUnknownFlags, got %v", err)
+	}
+}
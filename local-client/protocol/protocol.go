@@ -0,0 +1,159 @@
+// Package protocol defines the messages exchanged between SyncMesh peers and the
+// framing used to carry them over a stream connection.
+//
+// Every message is sent as a fixed-size header followed by a CBOR-encoded body:
+//
+//	+---------+---------+---------+---------------+
+//	| version |  type   |  flags  |    length     |
+//	| 1 byte  | 1 byte  | 2 bytes |   4 bytes     |
+//	+---------+---------+---------+---------------+
+//
+// All header fields are big-endian. length is the size of the body in bytes.
+// flags marks a compressed body (see compress.go).
+package protocol
+
+import (
+	"fmt"
+	"time"
+)
+
+// Version is the protocol version spoken by this build.
+const Version uint8 = 1
+
+// MessageType identifies the kind of body that follows a header.
+type MessageType uint8
+
+const (
+	TypeHello MessageType = iota + 1
+	TypeIndexUpdate
+	TypeRequest
+	TypeResponse
+	TypePing
+	TypeClose
+)
+
+func (t MessageType) String() string {
+	switch t {
+	case TypeHello:
+		return "hello"
+	case TypeIndexUpdate:
+		return "index-update"
+	case TypeRequest:
+		return "request"
+	case TypeResponse:
+		return "response"
+	case TypePing:
+		return "ping"
+	case TypeClose:
+		return "close"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(t))
+	}
+}
+
+// Message is implemented by every body that can be sent on the wire.
+type Message interface {
+	Type() MessageType
+}
+
+// Hello is the first message sent by both sides of a connection.
+type Hello struct {
+	DeviceName    string `cbor:"1,keyasint"`
+	ClientVersion string `cbor:"2,keyasint"`
+	// Compression is how much the sender would like compressed.
+	Compression Compression `cbor:"3,keyasint,omitempty"`
+}
+
+// FileInfo describes a single file in a folder index. Deleted files are
+// advertised too, so that peers delete their copies.
+type FileInfo struct {
+	Path    string    `cbor:"1,keyasint"`
+	Size    int64     `cbor:"2,keyasint"`
+	ModTime time.Time `cbor:"3,keyasint"`
+	Hash    string    `cbor:"4,keyasint"`
+	// Mode holds the file's Unix permission bits.
+	Mode uint32 `cbor:"5,keyasint,omitempty"`
+	// Version maps the short ID of every device that has changed the file to
+	// the number of changes it has made.
+	Version map[string]uint64 `cbor:"6,keyasint,omitempty"`
+	Deleted bool              `cbor:"7,keyasint,omitempty"`
+	// Blocks lists the file's content-defined blocks in order.
+	Blocks []BlockInfo `cbor:"8,keyasint,omitempty"`
+	// ModifiedBy is the short ID of the device that made the latest change.
+	ModifiedBy string `cbor:"9,keyasint,omitempty"`
+	// RenamedFrom is the path the file was moved from, if this version
+	// appeared in place of another file with the same content. Later
+	// versions of the file leave it out.
+	RenamedFrom string `cbor:"10,keyasint,omitempty"`
+}
+
+// BlockInfo describes one block of a file by its position and SHA-256 hash.
+type BlockInfo struct {
+	Offset int64  `cbor:"1,keyasint"`
+	Size   int    `cbor:"2,keyasint"`
+	Hash   string `cbor:"3,keyasint"`
+}
+
+// IndexUpdate advertises the full set of files the sender has for a folder.
+type IndexUpdate struct {
+	Folder string     `cbor:"1,keyasint"`
+	Files  []FileInfo `cbor:"2,keyasint"`
+}
+
+// Request asks the peer for Size bytes of a file starting at Offset, normally
+// one of its blocks. Hash is the hash of the whole file, so that the peer can
+// refuse if its copy has changed since it was advertised. ID is chosen by the
+// sender and echoed back in the matching Response.
+type Request struct {
+	ID     uint64 `cbor:"1,keyasint"`
+	Folder string `cbor:"2,keyasint"`
+	Path   string `cbor:"3,keyasint"`
+	Hash   string `cbor:"4,keyasint"`
+	Offset int64  `cbor:"5,keyasint"`
+	Size   int    `cbor:"6,keyasint"`
+}
+
+// Response carries the data for a previously sent Request, or an error
+// explaining why it could not be served.
+type Response struct {
+	ID    uint64 `cbor:"1,keyasint"`
+	Data  []byte `cbor:"2,keyasint"`
+	Error string `cbor:"3,keyasint,omitempty"`
+	// Incompressible tells the encoder that Data is compressed already, such
+	// as a block of a zip file. It isn't sent.
+	Incompressible bool `cbor:"-"`
+}
+
+// Ping keeps an otherwise idle connection alive.
+type Ping struct{}
+
+// Close tells the peer that the sender is about to close the connection.
+type Close struct {
+	Reason string `cbor:"1,keyasint"`
+}
+
+func (Hello) Type() MessageType       { return TypeHello }
+func (IndexUpdate) Type() MessageType { return TypeIndexUpdate }
+func (Request) Type() MessageType     { return TypeRequest }
+func (Response) Type() MessageType    { return TypeResponse }
+func (Ping) Type() MessageType        { return TypePing }
+func (Close) Type() MessageType       { return TypeClose }
+
+func newMessage(t MessageType) (Message, error) {
+	switch t {
+	case TypeHello:
+		return &Hello{}, nil
+	case TypeIndexUpdate:
+		return &IndexUpdate{}, nil
+	case TypeRequest:
+		return &Request{}, nil
+	case TypeResponse:
+		return &Response{}, nil
+	case TypePing:
+		return &Ping{}, nil
+	case TypeClose:
+		return &Close{}, nil
+	default:
+		return nil, fmt.Errorf("%w: %d", ErrUnknownType, uint8(t))
+	}
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Files are pulled block by block. A new copy is assembled in a temporary file
+// next to the target: blocks that already exist in any local file, including
+// the old copy of the file itself, are copied across, and only the rest are
+// requested from peers, many at a time (see swarm.go). Every block is checked
+// against its hash before it is written, and one that arrives corrupted is
+// requested from another peer. Once every block is in place the whole file is
+// verified and renamed over the target.
+//
+// The temporary file is named after the version being pulled and kept if the
+// pull is interrupted, so that a later pull of the same version, even after a
+// restart, picks up the blocks already written instead of starting over.
+
+const (
+	// maxOutstandingRequests bounds the block requests in flight on a
+	// session, so that pulling a large file neither floods the peer nor
+	// buffers the whole file in memory.
+	maxOutstandingRequests = 16
+	// maxQueuedRequests bounds the requests a peer may have waiting to be
+	// served. A peer keeps within maxOutstandingRequests, but one that has
+	// given up on requests we are still serving can briefly go over.
+	maxQueuedRequests = 4 * maxOutstandingRequests
+	// tempFileMaxAge is how long an interrupted pull's temporary file is kept
+	// waiting to be resumed.
+	tempFileMaxAge = 24 * time.Hour
+)
+
+// pullJob assembles one file pulled from peers.
+type pullJob struct {
+	folder *folder
+	info   fileInfo
+	tmp    *os.File
+	// wake is signalled when a request slot may have been freed for the
+	// job's dispatch.
+	wake chan struct{}
+
+	mu sync.Mutex
+	// queue holds the blocks waiting to be requested.
+	queue       []blockInfo
+	dispatching bool
+	remaining   int
+	reused      int64
+	resumed     int64
+	// failures counts the times each session has failed to deliver each
+	// block, by offset.
+	failures map[*session]map[int64]int
+	done     bool
+}
+
+// blockSource locates a block in a local file.
+type blockSource struct {
+	path   string
+	offset int64
+	size   int
+}
+
+// localBlocks indexes every block of every file in f by hash. The syncer's mu
+// must be held.
+func localBlocks(f *folder) map[string]blockSource {
+	sources := make(map[string]blockSource)
+	for _, info := range f.index {
+		if info.Deleted {
+			continue
+		}
+		for _, b := range info.Blocks {
+			sources[b.Hash] = blockSource{path: info.Path, offset: b.Offset, size: b.Size}
+		}
+	}
+	return sources
+}
+
+// startPull begins pulling info into f, copying whatever blocks it can from
+// sources and requesting the rest from the peers that have them. It returns
+// once every block has been requested.
+func (s *syncer) startPull(f *folder, info fileInfo, sources map[string]blockSource) error {
+	if !filepath.IsLocal(filepath.FromSlash(info.Path)) {
+		return fmt.Errorf("refusing to write outside folder: %q", info.Path)
+	}
+
+	job := &pullJob{folder: f, info: info, wake: make(chan struct{}, 1)}
+
+	// The job is registered before its temporary file is opened, so that two
+	// pulls of the same file never write to it at once.
+	s.mu.Lock()
+	if f.pulling[info.Path] != nil {
+		s.mu.Unlock()
+		return nil
+	}
+	f.pulling[info.Path] = job
+	s.mu.Unlock()
+
+	target := filepath.Join(f.root, filepath.FromSlash(info.Path))
+	tmp, missing, resumed, err := openPullTemp(target, info)
+	if err != nil {
+		s.releasePull(job)
+		return err
+	}
+	job.tmp = tmp
+	job.resumed = resumed
+
+	missing, reused := copyLocalBlocks(f.root, missing, sources, tmp)
+	job.reused = reused
+	job.remaining = len(missing)
+	job.queue = missing
+	job.dispatching = true
+
+	if len(missing) == 0 {
+		s.finishPull(job)
+		return nil
+	}
+
+	s.dispatch(job)
+	return nil
+}
+
+// tempName returns the name of the temporary file that info is pulled into,
+// which is the same every time the same version of the file is pulled.
+func tempName(info fileInfo) string {
+	sum := sha256.Sum256([]byte(info.Path + "\x00" + info.Hash))
+	return tempFilePrefix + hex.EncodeToString(sum[:8])
+}
+
+// openPullTemp opens the temporary file for pulling info to target, creating
+// it if an earlier pull didn't leave one behind. It returns the blocks still
+// missing from the file and the number of bytes already in place.
+func openPullTemp(target string, info fileInfo) (*os.File, []blockInfo, int64, error) {
+	if err := info.checkBlocks(); err != nil {
+		return nil, nil, 0, err
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return nil, nil, 0, err
+	}
+	tmp, err := os.OpenFile(filepath.Join(filepath.Dir(target), tempName(info)), os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	stat, err := tmp.Stat()
+	if err != nil {
+		tmp.Close()
+		return nil, nil, 0, err
+	}
+	if err := tmp.Truncate(info.Size); err != nil {
+		tmp.Close()
+		return nil, nil, 0, err
+	}
+
+	if stat.Size() == 0 {
+		return tmp, info.Blocks, 0, nil
+	}
+	missing, resumed := verifiedBlocks(tmp, info.Blocks)
+	return tmp, missing, resumed, nil
+}
+
+// verifiedBlocks checks which blocks r already holds, returning the ones it
+// doesn't and the number of bytes it does.
+func verifiedBlocks(r io.ReaderAt, blocks []blockInfo) ([]blockInfo, int64) {
+	var missing []blockInfo
+	var present int64
+	buf := make([]byte, maxBlockSize)
+	for _, b := range blocks {
+		data := buf[:b.Size]
+		if _, err := r.ReadAt(data, b.Offset); err != nil || hashBlock(data) != b.Hash {
+			missing = append(missing, b)
+			continue
+		}
+		present += int64(b.Size)
+	}
+	return missing, present
+}
+
+// removeStaleTemp deletes the temporary file at path, found by a scan, if no
+// pull has touched it for tempFileMaxAge. Most likely the file has changed
+// since, so the version it held will never be pulled again.
+func removeStaleTemp(path string, d fs.DirEntry) {
+	info, err := d.Info()
+	if err == nil && time.Since(info.ModTime()) > tempFileMaxAge {
+		os.Remove(path)
+	}
+}
+
+// copyLocalBlocks copies every block found in sources into dst, returning the
+// blocks it couldn't find and the number of bytes copied. A source whose
+// content no longer matches its hash is treated as missing.
+func copyLocalBlocks(root string, blocks []blockInfo, sources map[string]blockSource, dst io.WriterAt) ([]blockInfo, int64) {
+	files := make(map[string]*os.File)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	var missing []blockInfo
+	var reused int64
+	buf := make([]byte, maxBlockSize)
+	for _, b := range blocks {
+		src, ok := sources[b.Hash]
+		if !ok || src.size != b.Size {
+			missing = append(missing, b)
+			continue
+		}
+
+		f, ok := files[src.path]
+		if !ok {
+			var err error
+			f, err = os.Open(filepath.Join(root, filepath.FromSlash(src.path)))
+			if err != nil {
+				missing = append(missing, b)
+				continue
+			}
+			files[src.path] = f
+		}
+
+		data := buf[:b.Size]
+		if _, err := f.ReadAt(data, src.offset); err != nil || hashBlock(data) != b.Hash {
+			missing = append(missing, b)
+			continue
+		}
+		if _, err := dst.WriteAt(data, b.Offset); err != nil {
+			missing = append(missing, b)
+			continue
+		}
+		reused += int64(b.Size)
+	}
+	return missing, reused
+}
+
+// handleBlock writes a block received from a peer into its file, once its
+// content has been checked against the block's hash. A block the peer sent
+// corrupted or couldn't serve is requested again from another peer.
+func (s *syncer) handleBlock(sess *session, id uint64, data []byte, errMsg string) error {
+	req, ok := sess.complete(id)
+	if !ok {
+		return fmt.Errorf("response for unknown request %d", id)
+	}
+	job := req.job
+
+	job.signal()
+
+	if errMsg != "" {
+		s.retryBlock(sess, job, req.block, fmt.Errorf("peer could not serve %s: %s", job.info.Path, errMsg))
+		return nil
+	}
+	if len(data) != req.block.Size || hashBlock(data) != req.block.Hash {
+		s.retryBlock(sess, job, req.block, fmt.Errorf("hash mismatch for block at %d of %s", req.block.Offset, job.info.Path))
+		return nil
+	}
+	sess.recordBlock(req)
+
+	job.mu.Lock()
+	if job.done {
+		job.mu.Unlock()
+		return nil
+	}
+	if _, err := job.tmp.WriteAt(data, req.block.Offset); err != nil {
+		job.mu.Unlock()
+		s.failPull(job, err)
+		return err
+	}
+	job.remaining--
+	complete := job.remaining == 0
+	job.mu.Unlock()
+
+	if complete {
+		s.finishPull(job)
+	}
+	return nil
+}
+
+// finishPull verifies an assembled file and moves it into place.
+func (s *syncer) finishPull(job *pullJob) {
+	job.mu.Lock()
+	if job.done {
+		job.mu.Unlock()
+		return
+	}
+	job.done = true
+	job.mu.Unlock()
+
+	f, info := job.folder, job.info
+	defer s.releasePull(job)
+	defer os.Remove(job.tmp.Name())
+
+	conflictCopy, err := s.installPulled(job)
+	if err != nil {
+		s.logger.Printf("pulling %s failed: %v", info.Path, err)
+		return
+	}
+
+	s.logger.Printf("pulled %s in folder %s (%d bytes, %d reused locally, %d resumed)", info.Path, f.id, info.Size, job.reused, job.resumed)
+	if conflictCopy != "" {
+		s.broadcastIndex(f.id)
+	}
+}
+
+// installPulled verifies the assembled file and renames it over the target. If
+// the local copy lost a conflict to it, the local copy is kept first and the
+// path it was kept under returned.
+func (s *syncer) installPulled(job *pullJob) (string, error) {
+	f, info := job.folder, job.info
+
+	if info.Mode == 0 {
+		info.Mode = defaultFileMode
+	}
+	if err := job.tmp.Chmod(info.Mode.Perm()); err != nil {
+		job.tmp.Close()
+		return "", err
+	}
+	if _, err := job.tmp.Seek(0, io.SeekStart); err != nil {
+		job.tmp.Close()
+		return "", err
+	}
+	hash, blocks, err := hashContent(job.tmp)
+	job.tmp.Close()
+	if err != nil {
+		return "", err
+	}
+	if hash != info.Hash {
+		return "", fmt.Errorf("hash mismatch for %s", info.Path)
+	}
+	info.Blocks = blocks
+
+	if err := os.Chtimes(job.tmp.Name(), info.ModTime, info.ModTime); err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	_, synced := s.folders[f.id]
+	s.mu.Unlock()
+	if !synced {
+		// The folder was removed while the file was on its way.
+		return "", nil
+	}
+
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+
+	var conflictCopy string
+	s.mu.Lock()
+	local, ok := f.index[info.Path]
+	s.mu.Unlock()
+	if ok && !local.Deleted && info.Version.compare(local.Version) == orderConcurrent {
+		if conflictCopy, err = s.keepConflictCopy(f, local); err != nil {
+			return "", err
+		}
+	} else if err := s.archiveVersion(f, info.Path); err != nil {
+		return "", err
+	}
+
+	target := filepath.Join(f.root, filepath.FromSlash(info.Path))
+	if err := os.Rename(job.tmp.Name(), target); err != nil {
+		return "", err
+	}
+	if err := s.db.saveFiles(f.id, f.root, []fileInfo{info}); err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	f.index[info.Path] = info
+	s.mu.Unlock()
+	return conflictCopy, nil
+}
+
+// failPull abandons a pull. Its temporary file is kept so that the blocks
+// already received needn't be pulled again.
+func (s *syncer) failPull(job *pullJob, err error) {
+	job.mu.Lock()
+	if job.done {
+		job.mu.Unlock()
+		return
+	}
+	job.done = true
+	job.tmp.Close()
+	job.mu.Unlock()
+
+	s.releasePull(job)
+	s.logger.Printf("pulling %s failed: %v", job.info.Path, err)
+}
+
+func (s *syncer) releasePull(job *pullJob) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if job.folder.pulling[job.info.Path] == job {
+		delete(job.folder.pulling, job.info.Path)
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dantdj/syncmesh/local-client/protocol"
+)
+
+// countingConn counts the bytes written to a connection.
+type countingConn struct {
+	net.Conn
+	written atomic.Int64
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.written.Add(int64(n))
+	return n, err
+}
+
+func TestPullTransfersOnlyChangedBlocks(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	rootA := t.TempDir()
+	rootB := t.TempDir()
+
+	original := randomBytes(t, 4<<20)
+	for _, root := range []string{rootA, rootB} {
+		if err := os.WriteFile(filepath.Join(root, "big.bin"), original, 0o644); err != nil {
+			t.Fatalf("failed to write file: %v", err)
+		}
+	}
+
+	a, err := newSyncer(logger, testIndexDB(t), "AAAAAAAA", rootA, folderSendReceive)
+	if err != nil {
+		t.Fatalf("newSyncer returned error: %v", err)
+	}
+	b, err := newSyncer(logger, testIndexDB(t), "BBBBBBBB", rootB, folderSendReceive)
+	if err != nil {
+		t.Fatalf("newSyncer returned error: %v", err)
+	}
+
+	pipeA, connB := net.Pipe()
+	connA := &countingConn{Conn: pipeA}
+	go a.runSession(connA, remotePeer{deviceID: "device-b", clientID: "client-b"})
+	go b.runSession(connB, remotePeer{deviceID: "device-a", clientID: "client-a"})
+	t.Cleanup(func() {
+		connA.Close()
+		connB.Close()
+	})
+
+	// Let the two settle on a common version of the file before editing it.
+	time.Sleep(200 * time.Millisecond)
+	before := connA.written.Load()
+
+	edited := slices.Concat(original[:2<<20], []byte("a small edit"), original[2<<20:])
+	if err := os.WriteFile(filepath.Join(rootA, "big.bin"), edited, 0o644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	if err := a.rescan(); err != nil {
+		t.Fatalf("rescan returned error: %v", err)
+	}
+
+	waitForFile(t, filepath.Join(rootB, "big.bin"), string(edited))
+
+	// The edit touches one or two blocks, so the transfer should be a couple
+	// of blocks plus the index, nowhere near the whole file.
+	if sent := connA.written.Load() - before; sent > 3*maxBlockSize {
+		t.Fatalf("expected only the changed blocks to be sent, sent %d bytes of %d", sent, len(edited))
+	}
+}
+
+// fakePeer plays a peer in a sync session with a syncer, handing the requests
+// it receives to the test.
+type fakePeer struct {
+	conn     net.Conn
+	enc      *protocol.Encoder
+	requests chan *protocol.Request
+	done     chan struct{}
+}
+
+func startFakePeer(t *testing.T, s *syncer, clientID string) *fakePeer {
+	t.Helper()
+
+	conn, peerConn := net.Pipe()
+	p := &fakePeer{
+		conn:     peerConn,
+		enc:      protocol.NewEncoder(peerConn),
+		requests: make(chan *protocol.Request, 1024),
+		done:     make(chan struct{}),
+	}
+	go func() {
+		s.runSession(conn, remotePeer{deviceID: "device-" + clientID, clientID: clientID})
+		close(p.done)
+	}()
+	go func() {
+		dec := protocol.NewDecoder(peerConn)
+		for {
+			msg, err := dec.Decode()
+			if err != nil {
+				return
+			}
+			if req, ok := msg.(*protocol.Request); ok {
+				p.requests <- req
+			}
+		}
+	}()
+	t.Cleanup(func() { peerConn.Close() })
+
+	if err := p.enc.Encode(protocol.Hello{DeviceName: clientID, ClientVersion: clientVersion}); err != nil {
+		t.Fatalf("failed to send hello: %v", err)
+	}
+	return p
+}
+
+// advertise sends the peer's index for the default folder.
+func (p *fakePeer) advertise(t *testing.T, files ...protocol.FileInfo) {
+	t.Helper()
+
+	if err := p.enc.Encode(protocol.IndexUpdate{Folder: defaultFolderID, Files: files}); err != nil {
+		t.Fatalf("failed to send index: %v", err)
+	}
+}
+
+// serve answers a request with the matching range of data.
+func (p *fakePeer) serve(req *protocol.Request, data []byte) error {
+	return p.enc.Encode(protocol.Response{ID: req.ID, Data: data[req.Offset : req.Offset+int64(req.Size)]})
+}
+
+// serveAll answers every request from now on with data, counting them.
+func (p *fakePeer) serveAll(data []byte, count *atomic.Int64) {
+	for {
+		select {
+		case req := <-p.requests:
+			count.Add(1)
+			if err := p.serve(req, data); err != nil {
+				return
+			}
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// nextRequest waits for the peer's next request.
+func (p *fakePeer) nextRequest(t *testing.T) *protocol.Request {
+	t.Helper()
+
+	select {
+	case req := <-p.requests:
+		return req
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a request")
+		return nil
+	}
+}
+
+// testFile returns the index entry a peer would advertise for data.
+func testFile(t *testing.T, path string, data []byte) protocol.FileInfo {
+	t.Helper()
+
+	hash, blocks, err := hashContent(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("hashContent returned error: %v", err)
+	}
+	info := fileInfo{
+		Path:    path,
+		Size:    int64(len(data)),
+		ModTime: time.Now().UTC(),
+		Mode:    0o644,
+		Hash:    hash,
+		Blocks:  blocks,
+		Version: versionVector{"AAAAAAA": 1},
+	}
+	return info.toWire()
+}
+
+func TestInterruptedPullResumesFromTempFile(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	root := t.TempDir()
+	s, err := newSyncer(logger, testIndexDB(t), "BBBBBBBB", root, folderSendReceive)
+	if err != nil {
+		t.Fatalf("newSyncer returned error: %v", err)
+	}
+
+	data := randomBytes(t, 4<<20)
+	file := testFile(t, "big.bin", data)
+	if len(file.Blocks) < 4 {
+		t.Fatalf("expected the file to span several blocks, got %d", len(file.Blocks))
+	}
+
+	// Serve half the blocks, then drop the connection.
+	first := startFakePeer(t, s, "client-a")
+	first.advertise(t, file)
+	served := len(file.Blocks) / 2
+	for range served {
+		if err := first.serve(first.nextRequest(t), data); err != nil {
+			t.Fatalf("failed to send response: %v", err)
+		}
+	}
+	time.Sleep(200 * time.Millisecond)
+	first.conn.Close()
+	<-first.done
+
+	if !hasTempFile(t, root) {
+		t.Fatal("expected the interrupted pull's temporary file to be kept")
+	}
+
+	// A new session picks up where the last one stopped.
+	second := startFakePeer(t, s, "client-a")
+	var requested atomic.Int64
+	go second.serveAll(data, &requested)
+	second.advertise(t, file)
+
+	waitForFile(t, filepath.Join(root, "big.bin"), string(data))
+	if n := requested.Load(); n != int64(len(file.Blocks)-served) {
+		t.Fatalf("expected only the %d missing blocks to be requested, got %d", len(file.Blocks)-served, n)
+	}
+	if hasTempFile(t, root) {
+		t.Fatal("expected the temporary file to be renamed into place")
+	}
+}
+
+func TestResumedPullRejectsOversizedBlock(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	root := t.TempDir()
+	s, err := newSyncer(logger, testIndexDB(t), "BBBBBBBB", root, folderSendReceive)
+	if err != nil {
+		t.Fatalf("newSyncer returned error: %v", err)
+	}
+
+	// A peer advertised a block larger than any block can be, and an
+	// earlier pull of it left its temporary file behind.
+	data := randomBytes(t, 2*maxBlockSize)
+	bad := testFile(t, "big.bin", data)
+	bad.Blocks = []protocol.BlockInfo{
+		{Offset: 0, Size: maxBlockSize + 1, Hash: hashBlock(data[:maxBlockSize+1])},
+		{Offset: maxBlockSize + 1, Size: maxBlockSize - 1, Hash: hashBlock(data[maxBlockSize+1:])},
+	}
+	info := fileInfoFromWire(bad)
+	if err := os.WriteFile(filepath.Join(root, tempName(info)), data, 0o600); err != nil {
+		t.Fatalf("failed to write temporary file: %v", err)
+	}
+
+	if _, _, _, err := openPullTemp(filepath.Join(root, "big.bin"), info); err == nil {
+		t.Fatal("expected openPullTemp to reject the oversized block")
+	}
+
+	p := startFakePeer(t, s, "client-a")
+	p.advertise(t, bad)
+	select {
+	case req := <-p.requests:
+		t.Fatalf("expected the file to be ignored, got a request for %s", req.Path)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	// The client carries on with the rest of the index.
+	good := testFile(t, "good.bin", data)
+	var requested atomic.Int64
+	go p.serveAll(data, &requested)
+	p.advertise(t, bad, good)
+	waitForFile(t, filepath.Join(root, "good.bin"), string(data))
+}
+
+func TestCorruptBlockIsRequestedFromAnotherPeer(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	root := t.TempDir()
+	s, err := newSyncer(logger, testIndexDB(t), "BBBBBBBB", root, folderSendReceive)
+	if err != nil {
+		t.Fatalf("newSyncer returned error: %v", err)
+	}
+
+	data := randomBytes(t, 2<<20)
+	file := testFile(t, "big.bin", data)
+	corrupted := bytes.Clone(data)
+	for i := range corrupted {
+		corrupted[i] ^= 0xff
+	}
+
+	// The pull starts from the bad peer, since the good one has nothing to
+	// offer until after it has begun.
+	good := startFakePeer(t, s, "client-good")
+	good.advertise(t)
+	bad := startFakePeer(t, s, "client-bad")
+	bad.advertise(t, file)
+	req := bad.nextRequest(t)
+	good.advertise(t, file)
+	time.Sleep(100 * time.Millisecond)
+
+	var fromGood, fromBad atomic.Int64
+	go good.serveAll(data, &fromGood)
+	if err := bad.serve(req, corrupted); err != nil {
+		t.Fatalf("failed to send response: %v", err)
+	}
+	go bad.serveAll(corrupted, &fromBad)
+
+	waitForFile(t, filepath.Join(root, "big.bin"), string(data))
+	if fromGood.Load() == 0 {
+		t.Fatal("expected corrupted blocks to be requested from the other peer")
+	}
+}
+
+func hasTempFile(t *testing.T, root string) bool {
+	t.Helper()
+
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		t.Fatalf("failed to read folder: %v", err)
+	}
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), tempFilePrefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// Peers behind NAT can't accept each other's TCP connections, but can usually
+// reach each other over UDP if both start sending at the same time: each
+// side's outgoing probes open a mapping in its own NAT that the other side's
+// probes then come in through. The signalling server introduces the two sides
+// and tells them when to start. Once a path is open, the peer protocol runs
+// over QUIC on the same UDP socket, which provides a reliable stream secured
+// with the same mutual TLS as TCP connections.
+
+const (
+	punchProbeInterval = 200 * time.Millisecond
+	punchTimeout       = 10 * time.Second
+	// punchTrailingProbes is how many probes the responding side keeps sending
+	// after it hears from the initiator, so that the initiator hears it too.
+	punchTrailingProbes = 5
+	// quicKeepAlive keeps NAT mappings for idle QUIC connections alive.
+	quicKeepAlive = 15 * time.Second
+)
+
+// punchProbeMagic starts every probe, followed by the sender's client ID. Its
+// first byte has the top two bits clear, so the QUIC transport sharing the
+// socket hands probes over instead of treating them as QUIC packets.
+var punchProbeMagic = []byte("\x00SMPUNCH")
+
+// udpPeering runs peer connections over QUIC on the client's UDP socket, the
+// same one whose public mapping was learned through STUN.
+type udpPeering struct {
+	logger     *log.Logger
+	selfID     string
+	transport  *quic.Transport
+	tlsConfig  *tls.Config
+	quicConfig *quic.Config
+
+	mu sync.Mutex
+	// probes holds a channel for every punch in progress, keyed by the client
+	// ID of the peer whose probes it is waiting for.
+	probes map[string]chan net.Addr
+}
+
+func newUDPPeering(logger *log.Logger, selfID string, conn net.PacketConn, tlsConfig *tls.Config) *udpPeering {
+	u := &udpPeering{
+		logger:    logger,
+		selfID:    selfID,
+		transport: &quic.Transport{Conn: conn},
+		tlsConfig: tlsConfig,
+		quicConfig: &quic.Config{
+			HandshakeIdleTimeout: helloTimeout,
+			KeepAlivePeriod:      quicKeepAlive,
+		},
+		probes: make(map[string]chan net.Addr),
+	}
+	go u.readProbes()
+	return u
+}
+
+// serve accepts QUIC connections from peers in the background and passes each
+// one, once authenticated, to handle.
+func (u *udpPeering) serve(handle func(net.Conn, remotePeer)) error {
+	listener, err := u.transport.Listen(u.tlsConfig, u.quicConfig)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept(context.Background())
+			if err != nil {
+				u.logger.Printf("QUIC accept error: %v", err)
+				return
+			}
+			go u.handleConn(conn, handle)
+		}
+	}()
+	return nil
+}
+
+func (u *udpPeering) handleConn(conn *quic.Conn, handle func(net.Conn, remotePeer)) {
+	peer, err := peerFromTLSState(conn.ConnectionState().TLS)
+	if err != nil {
+		u.logger.Printf("QUIC connection from %s rejected: %v", conn.RemoteAddr(), err)
+		conn.CloseWithError(0, "")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), helloTimeout)
+	defer cancel()
+
+	stream, err := conn.AcceptStream(ctx)
+	if err != nil {
+		u.logger.Printf("QUIC connection from %s opened no stream: %v", conn.RemoteAddr(), err)
+		conn.CloseWithError(0, "")
+		return
+	}
+
+	u.logger.Printf("accepted QUIC connection from %s (device %s)", conn.RemoteAddr(), peer.deviceID)
+	handle(&quicStreamConn{Stream: stream, conn: conn}, peer)
+}
+
+// dial punches a hole to peer starting at startAt and opens a QUIC connection
+// over it.
+func (u *udpPeering) dial(peer clientSnapshot, startAt time.Time) (net.Conn, remotePeer, error) {
+	addr, err := u.punch(peer, startAt, true)
+	if err != nil {
+		return nil, remotePeer{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), punchTimeout)
+	defer cancel()
+
+	conn, err := u.transport.Dial(ctx, addr, u.tlsConfig, u.quicConfig)
+	if err != nil {
+		return nil, remotePeer{}, err
+	}
+
+	remote, err := peerFromTLSState(conn.ConnectionState().TLS)
+	if err != nil {
+		conn.CloseWithError(0, "")
+		return nil, remotePeer{}, err
+	}
+
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		conn.CloseWithError(0, "")
+		return nil, remotePeer{}, err
+	}
+	return &quicStreamConn{Stream: stream, conn: conn}, remote, nil
+}
+
+// punch sends probes to peer from startAt until one of the peer's probes
+// arrives, proving that a path is open, and returns the address it came from.
+// The initiator returns straight away to dial; the responder keeps probing a
+// little longer so that the initiator hears from it too.
+func (u *udpPeering) punch(peer clientSnapshot, startAt time.Time, initiator bool) (net.Addr, error) {
+	targets := punchTargets(peer)
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no UDP address for %s", peer.ClientID)
+	}
+
+	seen := make(chan net.Addr, 1)
+	u.mu.Lock()
+	u.probes[peer.ClientID] = seen
+	u.mu.Unlock()
+	defer func() {
+		u.mu.Lock()
+		if u.probes[peer.ClientID] == seen {
+			delete(u.probes, peer.ClientID)
+		}
+		u.mu.Unlock()
+	}()
+
+	time.Sleep(time.Until(startAt))
+
+	probe := append(slices.Clone(punchProbeMagic), u.selfID...)
+	ticker := time.NewTicker(punchProbeInterval)
+	defer ticker.Stop()
+	timeout := time.NewTimer(punchTimeout)
+	defer timeout.Stop()
+
+	var found net.Addr
+	for trailing := 0; ; {
+		for _, target := range targets {
+			_, _ = u.transport.WriteTo(probe, target)
+		}
+		if found != nil {
+			trailing++
+			if initiator || trailing >= punchTrailingProbes {
+				return found, nil
+			}
+		}
+
+		select {
+		case addr := <-seen:
+			if found == nil {
+				u.logger.Printf("hole punched to %s at %s", peer.ClientID, addr)
+				found = addr
+			}
+		case <-ticker.C:
+		case <-timeout.C:
+			return nil, fmt.Errorf("no probe from %s within %s", peer.ClientID, punchTimeout)
+		}
+	}
+}
+
+// readProbes passes probes received on the socket to the punch waiting for
+// them. Anything else that isn't QUIC is dropped.
+func (u *udpPeering) readProbes() {
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := u.transport.ReadNonQUICPacket(context.Background(), buf)
+		if err != nil {
+			return
+		}
+
+		sender, ok := bytes.CutPrefix(buf[:n], punchProbeMagic)
+		if !ok {
+			continue
+		}
+
+		u.mu.Lock()
+		seen := u.probes[string(sender)]
+		u.mu.Unlock()
+
+		if seen != nil {
+			select {
+			case seen <- from:
+			default:
+			}
+		}
+	}
+}
+
+// punchTargets lists the UDP addresses to probe for peer: its reflexive address
+// and, in case both sides are behind the same NAT, its local address, since
+// the UDP socket shares the local TCP port.
+func punchTargets(peer clientSnapshot) []net.Addr {
+	var targets []net.Addr
+	add := func(ip string, port int) {
+		if ip == "" || port == 0 {
+			return
+		}
+		addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(ip, strconv.Itoa(port)))
+		if err != nil {
+			return
+		}
+		for _, t := range targets {
+			if t.String() == addr.String() {
+				return
+			}
+		}
+		targets = append(targets, addr)
+	}
+
+	add(peer.ReflexiveIP, peer.ReflexivePort)
+	add(peer.LocalIP, peer.LocalPort)
+	return targets
+}
+
+// quicStreamConn presents a QUIC connection carrying a single stream as a
+// net.Conn, so that sync sessions run over it just as they do over TCP.
+type quicStreamConn struct {
+	*quic.Stream
+	conn *quic.Conn
+}
+
+func (c *quicStreamConn) LocalAddr() net.Addr  { return c.conn.LocalAddr() }
+func (c *quicStreamConn) RemoteAddr() net.Addr { return c.conn.RemoteAddr() }
+
+func (c *quicStreamConn) Close() error {
+	c.Stream.Close()
+	return c.conn.CloseWithError(0, "")
+}
+
+// holePuncher connects to peers by hole punching, coordinating with them
+// through the signalling server.
+type holePuncher struct {
+	logger  *log.Logger
+	baseURL string
+	auth    *credentials
+	udp     *udpPeering
+}
+
+// connect asks the signalling server to introduce us to peer, then punches a
+// hole to it and opens a QUIC connection.
+func (h *holePuncher) connect(peer clientSnapshot) (net.Conn, remotePeer, error) {
+	target, startAt, err := requestPunch(h.baseURL, h.auth.get(), peer.ClientID)
+	if err != nil {
+		return nil, remotePeer{}, err
+	}
+
+	conn, remote, err := h.udp.dial(target, startAt)
+	if err != nil {
+		return nil, remotePeer{}, err
+	}
+
+	if remote.clientID != peer.ClientID {
+		conn.Close()
+		return nil, remotePeer{}, fmt.Errorf("certificate at %s belongs to clientId %s", conn.RemoteAddr(), remote.clientID)
+	}
+	return conn, remote, nil
+}
+
+// respond takes part in a hole punch that peer asked the signalling server
+// for. The peer dials once the hole is open, and its connection arrives
+// through serve.
+func (h *holePuncher) respond(peer clientSnapshot, startAt time.Time) {
+	if _, err := h.udp.punch(peer, startAt, false); err != nil {
+		h.logger.Printf("hole punch requested by %s failed: %v", peer.ClientID, err)
+	}
+}
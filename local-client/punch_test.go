@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// natConn simulates an address-restricted NAT in front of a UDP socket:
+// packets are only let in from addresses the socket has already sent to.
+type natConn struct {
+	net.PacketConn
+
+	mu      sync.Mutex
+	allowed map[string]bool
+}
+
+func (c *natConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	c.allowed[addr.String()] = true
+	c.mu.Unlock()
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+func (c *natConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(p)
+		if err != nil {
+			return n, addr, err
+		}
+
+		c.mu.Lock()
+		ok := c.allowed[addr.String()]
+		c.mu.Unlock()
+		if ok {
+			return n, addr, nil
+		}
+	}
+}
+
+type natPeer struct {
+	udp      *udpPeering
+	snapshot clientSnapshot
+}
+
+// newNATPeers returns two peers that trust each other, each with its UDP
+// socket behind a simulated NAT.
+func newNATPeers(t *testing.T) (natPeer, natPeer) {
+	t.Helper()
+
+	alice, err := loadOrCreateIdentity(t.TempDir())
+	if err != nil {
+		t.Fatalf("loadOrCreateIdentity returned error: %v", err)
+	}
+	bob, err := loadOrCreateIdentity(t.TempDir())
+	if err != nil {
+		t.Fatalf("loadOrCreateIdentity returned error: %v", err)
+	}
+
+	a := newNATPeer(t, alice, peerTLSConfig(alice, newTrustStore("", []string{bob.deviceID})))
+	b := newNATPeer(t, bob, peerTLSConfig(bob, newTrustStore("", []string{alice.deviceID})))
+	return a, b
+}
+
+func newNATPeer(t *testing.T, id *identity, tlsConfig *tls.Config) natPeer {
+	t.Helper()
+
+	publicKey, err := id.publicKeyDER()
+	if err != nil {
+		t.Fatalf("publicKeyDER returned error: %v", err)
+	}
+	clientID := clientIDForKey(publicKey)
+
+	raw, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	conn := &natConn{PacketConn: raw, allowed: make(map[string]bool)}
+
+	udp := newUDPPeering(log.New(io.Discard, "", 0), clientID, conn, tlsConfig)
+	t.Cleanup(func() { udp.transport.Close() })
+
+	addr := raw.LocalAddr().(*net.UDPAddr)
+	return natPeer{
+		udp: udp,
+		snapshot: clientSnapshot{
+			ClientID:      clientID,
+			ReflexiveIP:   addr.IP.String(),
+			ReflexivePort: addr.Port,
+		},
+	}
+}
+
+func TestHolePunchOpensQUICPath(t *testing.T) {
+	alice, bob := newNATPeers(t)
+
+	type inbound struct {
+		conn net.Conn
+		peer remotePeer
+	}
+	accepted := make(chan inbound, 1)
+	if err := bob.udp.serve(func(conn net.Conn, peer remotePeer) {
+		accepted <- inbound{conn, peer}
+	}); err != nil {
+		t.Fatalf("serve returned error: %v", err)
+	}
+
+	startAt := time.Now().Add(50 * time.Millisecond)
+	go bob.udp.punch(alice.snapshot, startAt, false)
+
+	conn, remote, err := alice.udp.dial(bob.snapshot, startAt)
+	if err != nil {
+		t.Fatalf("dial returned error: %v", err)
+	}
+	defer conn.Close()
+
+	if remote.clientID != bob.snapshot.ClientID {
+		t.Fatalf("expected to reach %s, got %s", bob.snapshot.ClientID, remote.clientID)
+	}
+
+	// The stream only reaches the other side once something is sent on it.
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	select {
+	case in := <-accepted:
+		defer in.conn.Close()
+
+		if in.peer.clientID != alice.snapshot.ClientID {
+			t.Fatalf("expected inbound connection from %s, got %s", alice.snapshot.ClientID, in.peer.clientID)
+		}
+
+		buf := make([]byte, 5)
+		_ = in.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := io.ReadFull(in.conn, buf); err != nil || string(buf) != "hello" {
+			t.Fatalf("expected to read hello, got %q (%v)", buf, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected bob to accept the connection")
+	}
+}
+
+func TestNATBlocksDialWithoutPunch(t *testing.T) {
+	alice, bob := newNATPeers(t)
+
+	if err := bob.udp.serve(func(conn net.Conn, _ remotePeer) { conn.Close() }); err != nil {
+		t.Fatalf("serve returned error: %v", err)
+	}
+
+	addr := &net.UDPAddr{IP: net.ParseIP(bob.snapshot.ReflexiveIP), Port: bob.snapshot.ReflexivePort}
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	if conn, err := alice.udp.transport.Dial(ctx, addr, alice.udp.tlsConfig, alice.udp.quicConfig); err == nil {
+		conn.CloseWithError(0, "")
+		t.Fatal("expected the simulated NAT to drop a dial that wasn't punched")
+	}
+}
+
+func TestPunchTargetsIncludesLocalAddress(t *testing.T) {
+	targets := punchTargets(clientSnapshot{
+		ReflexiveIP:   "203.0.113.10",
+		ReflexivePort: 61000,
+		LocalIP:       "192.168.1.20",
+		LocalPort:     4000,
+	})
+
+	if len(targets) != 2 || targets[0].String() != "203.0.113.10:61000" || targets[1].String() != "192.168.1.20:4000" {
+		t.Fatalf("unexpected targets: %v", targets)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+)
+
+// When neither a direct connection nor hole punching gets through, peers can
+// meet at the signalling server's relay. Each side connects out to it and
+// presents a ticket, after which the relay forwards bytes between them. The
+// usual mutual TLS runs end to end over the relayed stream, with the side that
+// asked for the relay acting as the TLS client.
+
+const relayDialTimeout = 5 * time.Second
+
+// relayClient connects to peers through the signalling server's relay.
+type relayClient struct {
+	logger    *log.Logger
+	baseURL   string
+	auth      *credentials
+	tlsConfig *tls.Config
+}
+
+// connect asks the signalling server for a relay session with peer and opens
+// a TLS connection to it through the relay.
+func (r *relayClient) connect(peer clientSnapshot) (net.Conn, remotePeer, error) {
+	ticket, err := requestRelay(r.baseURL, r.auth.get(), peer.ClientID)
+	if err != nil {
+		return nil, remotePeer{}, err
+	}
+
+	raw, err := joinRelay(ticket)
+	if err != nil {
+		return nil, remotePeer{}, err
+	}
+
+	conn := tls.Client(raw, r.tlsConfig)
+	remote, err := tlsHandshake(conn)
+	if err != nil {
+		raw.Close()
+		return nil, remotePeer{}, err
+	}
+
+	if remote.clientID != peer.ClientID {
+		conn.Close()
+		return nil, remotePeer{}, fmt.Errorf("certificate through relay belongs to clientId %s", remote.clientID)
+	}
+	r.logger.Printf("connected to %s through relay %s", peer.ClientID, ticket.Address)
+	return conn, remote, nil
+}
+
+// respond joins a relay session that peer asked the signalling server for and
+// passes the connection, once authenticated, to handle.
+func (r *relayClient) respond(peer clientSnapshot, ticket relayTicket, handle func(net.Conn, remotePeer)) {
+	raw, err := joinRelay(ticket)
+	if err != nil {
+		r.logger.Printf("relay requested by %s failed: %v", peer.ClientID, err)
+		return
+	}
+
+	conn := tls.Server(raw, r.tlsConfig)
+	remote, err := tlsHandshake(conn)
+	if err != nil {
+		r.logger.Printf("relay requested by %s failed: %v", peer.ClientID, err)
+		raw.Close()
+		return
+	}
+
+	if remote.clientID != peer.ClientID {
+		r.logger.Printf("relay requested by %s reached clientId %s instead", peer.ClientID, remote.clientID)
+		conn.Close()
+		return
+	}
+
+	r.logger.Printf("accepted connection from %s through relay %s", peer.ClientID, ticket.Address)
+	handle(conn, remote)
+}
+
+// joinRelay connects to the relay named in ticket and presents the ticket.
+func joinRelay(ticket relayTicket) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", ticket.Address, relayDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := io.WriteString(conn, ticket.Ticket+"\n"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
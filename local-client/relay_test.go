@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRelay pairs the first two connections to arrive and splices them
+// together once each has sent its ticket line.
+func fakeRelay(t *testing.T) (string, <-chan string) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	tickets := make(chan string, 2)
+	go func() {
+		var conns [2]net.Conn
+		var readers [2]*bufio.Reader
+		for i := range 2 {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			readers[i] = bufio.NewReader(conn)
+			line, err := readers[i].ReadString('\n')
+			if err != nil {
+				return
+			}
+			tickets <- strings.TrimSpace(line)
+			conns[i] = conn
+		}
+
+		var wg sync.WaitGroup
+		for i := range 2 {
+			wg.Go(func() {
+				io.Copy(conns[1-i], readers[i])
+				conns[0].Close()
+				conns[1].Close()
+			})
+		}
+		wg.Wait()
+	}()
+	return listener.Addr().String(), tickets
+}
+
+func TestRelayClientConnectsThroughRelay(t *testing.T) {
+	alice, bob := newNATPeers(t)
+
+	relayAddr, tickets := fakeRelay(t)
+
+	var requested relayRequest
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/relay" || r.Header.Get("Authorization") != "Bearer alice-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(relayResponse{Status: "error", Error: "unauthorized"})
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&requested)
+		json.NewEncoder(w).Encode(relayResponse{
+			Status: "success",
+			Relay:  relayTicket{Address: relayAddr, Ticket: "alice-ticket"},
+		})
+	}))
+	defer api.Close()
+
+	logger := log.New(io.Discard, "", 0)
+	aliceRelay := &relayClient{logger: logger, baseURL: api.URL, auth: newCredentials("alice-token"), tlsConfig: alice.udp.tlsConfig}
+	bobRelay := &relayClient{logger: logger, tlsConfig: bob.udp.tlsConfig}
+
+	type inbound struct {
+		conn net.Conn
+		peer remotePeer
+	}
+	accepted := make(chan inbound, 1)
+	go bobRelay.respond(alice.snapshot, relayTicket{Address: relayAddr, Ticket: "bob-ticket"}, func(conn net.Conn, peer remotePeer) {
+		accepted <- inbound{conn, peer}
+	})
+
+	conn, remote, err := aliceRelay.connect(bob.snapshot)
+	if err != nil {
+		t.Fatalf("connect returned error: %v", err)
+	}
+	defer conn.Close()
+
+	if requested.PeerID != bob.snapshot.ClientID {
+		t.Fatalf("expected a relay to be requested for %s, got %q", bob.snapshot.ClientID, requested.PeerID)
+	}
+	if remote.clientID != bob.snapshot.ClientID {
+		t.Fatalf("expected to reach %s, got %s", bob.snapshot.ClientID, remote.clientID)
+	}
+
+	seen := map[string]bool{<-tickets: true, <-tickets: true}
+	if !seen["alice-ticket"] || !seen["bob-ticket"] {
+		t.Fatalf("expected both tickets to be presented, got %v", seen)
+	}
+
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	select {
+	case in := <-accepted:
+		defer in.conn.Close()
+
+		if in.peer.clientID != alice.snapshot.ClientID {
+			t.Fatalf("expected inbound connection from %s, got %s", alice.snapshot.ClientID, in.peer.clientID)
+		}
+
+		buf := make([]byte, 5)
+		_ = in.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := io.ReadFull(in.conn, buf); err != nil || string(buf) != "hello" {
+			t.Fatalf("expected to read hello, got %q (%v)", buf, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected bob to accept the relayed connection")
+	}
+}
+
+func TestRequestRelayReportsServerError(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(relayResponse{Status: "error", Error: "relay session limit reached"})
+	}))
+	defer api.Close()
+
+	_, err := requestRelay(api.URL, "token", "peer")
+	if err == nil || !strings.Contains(err.Error(), "relay session limit reached") {
+		t.Fatalf("expected the server's error to be reported, got %v", err)
+	}
+}
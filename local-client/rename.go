@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// Renames aren't visible to the scanner, which only sees a file disappear and
+// another appear. When a file appears with the same content as one that
+// disappeared within renameWindow, it is recorded as renamed from it. A peer
+// that still has the old file then moves it into place instead of downloading
+// it again, so moving a directory costs nothing over the network. The record
+// only describes the version it was made in, and is dropped when the file's
+// version next changes.
+
+// renameWindow is how long the content of a deleted file is remembered, so
+// that a move the watcher reports as a deletion and a creation in separate
+// scans is still recognised.
+const renameWindow = 30 * time.Second
+
+// recentDeletions holds the files deleted within renameWindow by path. It is
+// guarded by the folder's writeMu.
+type recentDeletions map[string]deletedFile
+
+// deletedFile is the content of a recently deleted file and when it went.
+type deletedFile struct {
+	hash string
+	at   time.Time
+}
+
+// pendingRename is a move a peer made that can be repeated locally.
+type pendingRename struct {
+	// from is our entry for the old path, and tombstone the peer's.
+	from      fileInfo
+	tombstone fileInfo
+	to        fileInfo
+}
+
+// detectRenames marks every new file in changed whose content matches a file
+// that disappeared between prev and scanned, or in an earlier scan recorded in
+// recent, as renamed from it, updating index to match. Empty files are never
+// matched, since all of them look alike.
+func detectRenames(prev, scanned, index map[string]fileInfo, changed []fileInfo, recent recentDeletions) {
+	now := time.Now()
+	for p, d := range recent {
+		if _, back := scanned[p]; back || now.Sub(d.at) > renameWindow {
+			delete(recent, p)
+		}
+	}
+	for p, old := range prev {
+		if _, ok := scanned[p]; !ok && !old.Deleted && old.Size > 0 {
+			recent[p] = deletedFile{hash: old.Hash, at: now}
+		}
+	}
+	if len(recent) == 0 {
+		return
+	}
+
+	gone := make(map[string][]string)
+	for p, d := range recent {
+		gone[d.hash] = append(gone[d.hash], p)
+	}
+	for _, paths := range gone {
+		slices.Sort(paths)
+	}
+
+	for i, entry := range changed {
+		if entry.Deleted || entry.Size == 0 {
+			continue
+		}
+		if old, ok := prev[entry.Path]; ok && !old.Deleted {
+			continue
+		}
+		from, ok := takeRenameSource(gone, entry)
+		if !ok {
+			continue
+		}
+		delete(recent, from)
+		entry.RenamedFrom = from
+		changed[i] = entry
+		index[entry.Path] = entry
+	}
+}
+
+// takeRenameSource picks the disappeared file that entry was most likely
+// renamed from, preferring one with the same name, and removes it from gone.
+func takeRenameSource(gone map[string][]string, entry fileInfo) (string, bool) {
+	paths := gone[entry.Hash]
+	if len(paths) == 0 {
+		return "", false
+	}
+
+	i := slices.IndexFunc(paths, func(p string) bool { return path.Base(p) == path.Base(entry.Path) })
+	if i < 0 {
+		i = 0
+	}
+	from := paths[i]
+	gone[entry.Hash] = slices.Delete(paths, i, i+1)
+	return from, true
+}
+
+// findRenames picks out the files in needed that the peer renamed from a file
+// we still have, and whose old path was deleted by the same device in a way we
+// would follow. remote holds the peer's entries by path. The syncer's mu must
+// be held.
+func findRenames(f *folder, needed []fileInfo, remote map[string]fileInfo) []pendingRename {
+	var renames []pendingRename
+	used := make(map[string]bool)
+	for _, to := range needed {
+		if to.Deleted || to.RenamedFrom == "" || used[to.RenamedFrom] {
+			continue
+		}
+		if local, ok := f.index[to.Path]; ok && !local.Deleted {
+			continue
+		}
+		from, ok := f.index[to.RenamedFrom]
+		if !ok || from.Deleted || from.Hash != to.Hash || f.pulling[from.Path] != nil {
+			continue
+		}
+		tombstone, ok := remote[to.RenamedFrom]
+		if !ok || !tombstone.Deleted || tombstone.ModifiedBy != to.ModifiedBy || !needsPull(from, true, tombstone) {
+			continue
+		}
+
+		used[from.Path] = true
+		renames = append(renames, pendingRename{from: from, tombstone: tombstone, to: to})
+	}
+	return renames
+}
+
+// applyRename repeats a peer's rename by moving our copy of the file, once it
+// has been checked to still hold the expected content.
+func (s *syncer) applyRename(f *folder, r pendingRename) error {
+	if !filepath.IsLocal(filepath.FromSlash(r.from.Path)) || !filepath.IsLocal(filepath.FromSlash(r.to.Path)) {
+		return fmt.Errorf("refusing to move outside folder: %q to %q", r.from.Path, r.to.Path)
+	}
+
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+
+	src := filepath.Join(f.root, filepath.FromSlash(r.from.Path))
+	dst := filepath.Join(f.root, filepath.FromSlash(r.to.Path))
+
+	hash, blocks, err := hashFile(src)
+	if err != nil {
+		return err
+	}
+	if hash != r.to.Hash {
+		return fmt.Errorf("%s has changed", r.from.Path)
+	}
+	if _, err := os.Lstat(dst); err == nil {
+		return fmt.Errorf("%s already exists", r.to.Path)
+	}
+
+	to := r.to
+	to.Blocks = blocks
+	if to.Mode == 0 {
+		to.Mode = defaultFileMode
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	if err := os.Rename(src, dst); err != nil {
+		return err
+	}
+	if err := os.Chmod(dst, to.Mode.Perm()); err != nil {
+		return err
+	}
+	if err := os.Chtimes(dst, to.ModTime, to.ModTime); err != nil {
+		return err
+	}
+	removeEmptyParents(f.root, r.from.Path)
+
+	if err := s.db.saveFiles(f.id, f.root, []fileInfo{r.tombstone, to}); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	f.index[r.tombstone.Path] = r.tombstone
+	f.index[to.Path] = to
+	s.mu.Unlock()
+
+	s.logger.Printf("moved %s to %s in folder %s", r.from.Path, to.Path, f.id)
+	return nil
+}
+
+// removeEmptyParents removes the directories holding the file at p, a
+// slash-separated path relative to root, for as long as they are empty.
+func removeEmptyParents(root, p string) {
+	for dir := path.Dir(p); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if err := os.Remove(filepath.Join(root, filepath.FromSlash(dir))); err != nil {
+			return
+		}
+	}
+}
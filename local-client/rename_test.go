@@ -0,0 +1,147 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReconcileScanDetectsRenames(t *testing.T) {
+	modTime := time.Date(2026, 2, 3, 20, 3, 11, 0, time.UTC)
+	prev := map[string]fileInfo{
+		"old/a.txt":   {Path: "old/a.txt", Size: 5, ModTime: modTime, Hash: "same"},
+		"old/b.txt":   {Path: "old/b.txt", Size: 5, ModTime: modTime, Hash: "same"},
+		"empty.txt":   {Path: "empty.txt", ModTime: modTime, Hash: "empty"},
+		"changed.txt": {Path: "changed.txt", Size: 3, ModTime: modTime, Hash: "before"},
+	}
+	scanned := map[string]fileInfo{
+		"new/b.txt":    {Path: "new/b.txt", Size: 5, ModTime: modTime, Hash: "same"},
+		"new/a.txt":    {Path: "new/a.txt", Size: 5, ModTime: modTime, Hash: "same"},
+		"moved.txt":    {Path: "moved.txt", ModTime: modTime, Hash: "empty"},
+		"changed.txt":  {Path: "changed.txt", Size: 5, ModTime: modTime, Hash: "same"},
+		"unrelated.go": {Path: "unrelated.go", Size: 5, ModTime: modTime, Hash: "other"},
+	}
+
+	index, _ := reconcileScan(prev, scanned, "AAAAAAA", make(recentDeletions))
+
+	if index["new/a.txt"].RenamedFrom != "old/a.txt" || index["new/b.txt"].RenamedFrom != "old/b.txt" {
+		t.Fatalf("expected files to be matched to the old files with the same name, got %q and %q", index["new/a.txt"].RenamedFrom, index["new/b.txt"].RenamedFrom)
+	}
+	if !index["old/a.txt"].Deleted || !index["old/b.txt"].Deleted {
+		t.Fatal("expected the old paths to be recorded as deleted")
+	}
+	if index["moved.txt"].RenamedFrom != "" {
+		t.Fatal("expected empty files not to be matched")
+	}
+	if index["changed.txt"].RenamedFrom != "" {
+		t.Fatal("expected a file that already existed not to be taken for a rename")
+	}
+	if index["unrelated.go"].RenamedFrom != "" {
+		t.Fatal("expected a file with different content not to be taken for a rename")
+	}
+}
+
+func TestReconcileScanDetectsRenamesAcrossScans(t *testing.T) {
+	modTime := time.Date(2026, 2, 3, 20, 3, 11, 0, time.UTC)
+	recent := make(recentDeletions)
+
+	prev := map[string]fileInfo{
+		"a.txt": {Path: "a.txt", Size: 5, ModTime: modTime, Hash: "same"},
+		"b.txt": {Path: "b.txt", Size: 5, ModTime: modTime, Hash: "other"},
+	}
+	index, _ := reconcileScan(prev, map[string]fileInfo{}, "AAAAAAA", recent)
+	if !index["a.txt"].Deleted || !index["b.txt"].Deleted {
+		t.Fatal("expected the old paths to be recorded as deleted")
+	}
+
+	// b.txt was deleted too long ago to be taken for the source of a rename.
+	recent["b.txt"] = deletedFile{hash: "other", at: time.Now().Add(-2 * renameWindow)}
+
+	scanned := map[string]fileInfo{
+		"moved/a.txt": {Path: "moved/a.txt", Size: 5, ModTime: modTime, Hash: "same"},
+		"moved/b.txt": {Path: "moved/b.txt", Size: 5, ModTime: modTime, Hash: "other"},
+	}
+	index, _ = reconcileScan(index, scanned, "AAAAAAA", recent)
+	if index["moved/a.txt"].RenamedFrom != "a.txt" {
+		t.Fatalf("expected a file deleted by an earlier scan to be matched, got %q", index["moved/a.txt"].RenamedFrom)
+	}
+	if index["moved/b.txt"].RenamedFrom != "" {
+		t.Fatal("expected a file deleted before the window not to be matched")
+	}
+	if len(recent) != 0 {
+		t.Fatalf("expected matched and expired deletions to be forgotten, got %v", recent)
+	}
+
+	// The next change to the file is no longer a rename.
+	scanned["moved/a.txt"] = fileInfo{Path: "moved/a.txt", Size: 6, ModTime: modTime, Hash: "changed"}
+	index, _ = reconcileScan(index, scanned, "AAAAAAA", recent)
+	if index["moved/a.txt"].RenamedFrom != "" {
+		t.Fatal("expected a new version not to keep the rename")
+	}
+}
+
+func TestSyncSessionRepeatsRenamesLocally(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	rootA := t.TempDir()
+	rootB := t.TempDir()
+
+	data := randomBytes(t, 4<<20)
+	for _, root := range []string{rootA, rootB} {
+		if err := os.MkdirAll(filepath.Join(root, "old"), 0o755); err != nil {
+			t.Fatalf("failed to create dir: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(root, "old", "big.bin"), data, 0o644); err != nil {
+			t.Fatalf("failed to write file: %v", err)
+		}
+	}
+
+	a, err := newSyncer(logger, testIndexDB(t), "AAAAAAAA", rootA, folderSendReceive)
+	if err != nil {
+		t.Fatalf("newSyncer returned error: %v", err)
+	}
+	b, err := newSyncer(logger, testIndexDB(t), "BBBBBBBB", rootB, folderSendReceive)
+	if err != nil {
+		t.Fatalf("newSyncer returned error: %v", err)
+	}
+
+	pipeA, connB := net.Pipe()
+	connA := &countingConn{Conn: pipeA}
+	go a.runSession(connA, remotePeer{deviceID: "device-b", clientID: "client-b"})
+	go b.runSession(connB, remotePeer{deviceID: "device-a", clientID: "client-a"})
+	t.Cleanup(func() {
+		connA.Close()
+		connB.Close()
+	})
+
+	// Let the two settle on a common version of the file before moving it.
+	time.Sleep(200 * time.Millisecond)
+	before := connA.written.Load()
+
+	if err := os.Rename(filepath.Join(rootA, "old"), filepath.Join(rootA, "new")); err != nil {
+		t.Fatalf("failed to rename dir: %v", err)
+	}
+	if err := a.rescan(); err != nil {
+		t.Fatalf("rescan returned error: %v", err)
+	}
+
+	waitForFile(t, filepath.Join(rootB, "new", "big.bin"), string(data))
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(filepath.Join(rootB, "old")); os.IsNotExist(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the old directory to go")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	if sent := connA.written.Load() - before; sent > 64*1024 {
+		t.Fatalf("expected the move to need no content from the peer, sent %d bytes", sent)
+	}
+}
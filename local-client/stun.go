@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+)
+
+// Just enough of STUN (RFC 5389) to ask the signalling server's binding
+// service which public address our UDP socket is mapped to.
+
+const (
+	stunHeaderSize  = 20
+	stunMagicCookie = 0x2112A442
+
+	stunBindingRequest  = 0x0001
+	stunBindingResponse = 0x0101
+
+	stunAttrMappedAddress    = 0x0001
+	stunAttrXorMappedAddress = 0x0020
+
+	stunFamilyIPv4 = 0x01
+	stunFamilyIPv6 = 0x02
+
+	defaultSTUNPort = 3478
+)
+
+// stunRetransmits are the waits between successive Binding requests. UDP may
+// drop either the request or the response, so a few are sent before giving up.
+var stunRetransmits = []time.Duration{500 * time.Millisecond, time.Second, 2 * time.Second}
+
+// stunServerAddr returns the STUN address of the signalling server at baseURL,
+// which serves it on the same host as the HTTP API.
+func stunServerAddr(baseURL string) (string, error) {
+	parsed, err := url.Parse(baseURL)
+	if err != nil {
+		return "", err
+	}
+	if parsed.Hostname() == "" {
+		return "", fmt.Errorf("no host in server URL %q", baseURL)
+	}
+	return net.JoinHostPort(parsed.Hostname(), fmt.Sprint(defaultSTUNPort)), nil
+}
+
+// queryReflexiveAddr asks the STUN server at server for the address that
+// packets from conn appear to come from.
+func queryReflexiveAddr(conn net.PacketConn, server string) (*net.UDPAddr, error) {
+	serverAddr, err := net.ResolveUDPAddr("udp", server)
+	if err != nil {
+		return nil, err
+	}
+
+	request, transactionID, err := newBindingRequest()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.SetReadDeadline(time.Time{})
+
+	buf := make([]byte, 1500)
+	for _, wait := range stunRetransmits {
+		if _, err := conn.WriteTo(request, serverAddr); err != nil {
+			return nil, err
+		}
+
+		deadline := time.Now().Add(wait)
+		for {
+			_ = conn.SetReadDeadline(deadline)
+			n, _, err := conn.ReadFrom(buf)
+			if errors.Is(err, net.ErrClosed) {
+				return nil, err
+			}
+			if err != nil {
+				break
+			}
+
+			addr, err := parseBindingResponse(buf[:n], transactionID)
+			if err == nil {
+				return addr, nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("no response from STUN server %s", server)
+}
+
+// newBindingRequest returns a Binding request with a fresh transaction ID.
+func newBindingRequest() ([]byte, []byte, error) {
+	msg := make([]byte, stunHeaderSize)
+	binary.BigEndian.PutUint16(msg[0:2], stunBindingRequest)
+	binary.BigEndian.PutUint32(msg[4:8], stunMagicCookie)
+	if _, err := rand.Read(msg[8:20]); err != nil {
+		return nil, nil, err
+	}
+	return msg, msg[8:20], nil
+}
+
+// parseBindingResponse extracts the mapped address from a Binding success
+// response to the request with the given transaction ID.
+func parseBindingResponse(msg, transactionID []byte) (*net.UDPAddr, error) {
+	if len(msg) < stunHeaderSize {
+		return nil, errors.New("stun: message too short")
+	}
+	if binary.BigEndian.Uint16(msg[0:2]) != stunBindingResponse {
+		return nil, errors.New("stun: not a binding success response")
+	}
+	if binary.BigEndian.Uint32(msg[4:8]) != stunMagicCookie || string(msg[8:20]) != string(transactionID) {
+		return nil, errors.New("stun: response does not match request")
+	}
+	length := int(binary.BigEndian.Uint16(msg[2:4]))
+	if stunHeaderSize+length > len(msg) {
+		return nil, errors.New("stun: truncated message")
+	}
+
+	var key [16]byte
+	binary.BigEndian.PutUint32(key[0:4], stunMagicCookie)
+	copy(key[4:], transactionID)
+
+	var mapped *net.UDPAddr
+	attrs := msg[stunHeaderSize : stunHeaderSize+length]
+	for len(attrs) >= 4 {
+		attrType := binary.BigEndian.Uint16(attrs[0:2])
+		attrLen := int(binary.BigEndian.Uint16(attrs[2:4]))
+		if 4+attrLen > len(attrs) {
+			return nil, errors.New("stun: truncated attribute")
+		}
+		value := attrs[4 : 4+attrLen]
+
+		switch attrType {
+		case stunAttrXorMappedAddress:
+			addr, err := decodeSTUNAddress(value, key[:])
+			if err != nil {
+				return nil, err
+			}
+			return addr, nil
+		case stunAttrMappedAddress:
+			// Only used if the server doesn't send the XOR form.
+			addr, err := decodeSTUNAddress(value, make([]byte, 16))
+			if err != nil {
+				return nil, err
+			}
+			mapped = addr
+		}
+
+		padded := min(4+(attrLen+3)/4*4, len(attrs))
+		attrs = attrs[padded:]
+	}
+
+	if mapped == nil {
+		return nil, errors.New("stun: response has no mapped address")
+	}
+	return mapped, nil
+}
+
+// decodeSTUNAddress decodes a (XOR-)MAPPED-ADDRESS value, XORing the address
+// bytes with key. The port is XORed with the top of key, so an all-zero key
+// decodes a plain MAPPED-ADDRESS.
+func decodeSTUNAddress(value, key []byte) (*net.UDPAddr, error) {
+	if len(value) < 4 {
+		return nil, errors.New("stun: short address attribute")
+	}
+
+	var size int
+	switch value[1] {
+	case stunFamilyIPv4:
+		size = net.IPv4len
+	case stunFamilyIPv6:
+		size = net.IPv6len
+	default:
+		return nil, fmt.Errorf("stun: unknown address family %d", value[1])
+	}
+	if len(value) != 4+size {
+		return nil, errors.New("stun: bad address attribute length")
+	}
+
+	ip := make(net.IP, size)
+	for i := range ip {
+		ip[i] = value[4+i] ^ key[i]
+	}
+	port := binary.BigEndian.Uint16(value[2:4]) ^ binary.BigEndian.Uint16(key[0:2])
+	return &net.UDPAddr{IP: ip, Port: int(port)}, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"strings"
+	"testing"
+)
+
+// The sample IPv4 Binding response from RFC 5769, section 2.2.
+const rfc5769IPv4Response = "0101003c2112a442b7e7a701bc34d686fa87dfae" +
+	"8022000b7465737420766563746f7220" +
+	"002000080001a147e112a643" +
+	"000800142b91f599fd9e90c38c7489f92af9ba53f06be7d7" +
+	"80280004c07d4c96"
+
+func TestParseBindingResponseRFC5769Vector(t *testing.T) {
+	msg, err := hex.DecodeString(rfc5769IPv4Response)
+	if err != nil {
+		t.Fatalf("bad test vector: %v", err)
+	}
+
+	addr, err := parseBindingResponse(msg, msg[8:20])
+	if err != nil {
+		t.Fatalf("parseBindingResponse returned error: %v", err)
+	}
+	if !addr.IP.Equal(net.ParseIP("192.0.2.1")) || addr.Port != 32853 {
+		t.Fatalf("expected 192.0.2.1:32853, got %s", addr)
+	}
+}
+
+func TestParseBindingResponseRejectsOtherTransactions(t *testing.T) {
+	msg, err := hex.DecodeString(rfc5769IPv4Response)
+	if err != nil {
+		t.Fatalf("bad test vector: %v", err)
+	}
+
+	if _, err := parseBindingResponse(msg, []byte("abcdefghijkl")); err == nil {
+		t.Fatalf("expected response for another transaction to be rejected")
+	}
+}
+
+func TestQueryReflexiveAddr(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer server.Close()
+
+	// Answer with a plain MAPPED-ADDRESS, echoing the sender's address.
+	go func() {
+		buf := make([]byte, 1500)
+		n, from, err := server.ReadFrom(buf)
+		if err != nil || n < stunHeaderSize {
+			return
+		}
+		udp := from.(*net.UDPAddr)
+
+		resp := make([]byte, stunHeaderSize, stunHeaderSize+12)
+		binary.BigEndian.PutUint16(resp[0:2], stunBindingResponse)
+		binary.BigEndian.PutUint16(resp[2:4], 12)
+		binary.BigEndian.PutUint32(resp[4:8], stunMagicCookie)
+		copy(resp[8:20], buf[8:20])
+		resp = binary.BigEndian.AppendUint16(resp, stunAttrMappedAddress)
+		resp = binary.BigEndian.AppendUint16(resp, 8)
+		resp = append(resp, 0, stunFamilyIPv4)
+		resp = binary.BigEndian.AppendUint16(resp, uint16(udp.Port))
+		resp = append(resp, udp.IP.To4()...)
+		server.WriteTo(resp, from)
+	}()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer conn.Close()
+
+	addr, err := queryReflexiveAddr(conn, server.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("queryReflexiveAddr returned error: %v", err)
+	}
+	if addr.String() != conn.LocalAddr().String() {
+		t.Fatalf("expected %s, got %s", conn.LocalAddr(), addr)
+	}
+}
+
+func TestStunServerAddr(t *testing.T) {
+	addr, err := stunServerAddr("http://signalling-server:8089")
+	if err != nil {
+		t.Fatalf("stunServerAddr returned error: %v", err)
+	}
+	if addr != "signalling-server:3478" {
+		t.Fatalf("expected signalling-server:3478, got %s", addr)
+	}
+
+	if _, err := stunServerAddr("not a url"); err == nil || !strings.Contains(err.Error(), "no host") {
+		t.Fatalf("expected missing host error, got %v", err)
+	}
+}
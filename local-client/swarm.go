@@ -0,0 +1,369 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/dantdj/syncmesh/local-client/protocol"
+)
+
+// A file is pulled from every connected peer that has its blocks at once. The
+// blocks in each peer's index are kept by hash, so a block can be requested
+// from any file a peer has that contains it, not only the version being
+// pulled. Each block goes to the peer expected to deliver it soonest, going by
+// the round trip time and throughput measured on the blocks it has already
+// sent and by what it is still sending. A faster peer is thus sent more of the
+// file, while the request slots of every session bound how much any one peer
+// is asked for at once. Blocks a peer fails to deliver, because it sent them
+// corrupted, couldn't serve them, disconnected or stopped answering, go back
+// on the queue. A peer that has failed is only asked for a block when no other
+// peer has it, so the remaining peers take over where there are any, and it is
+// given up on once it has failed the same block maxBlockAttempts times.
+
+const (
+	// dispatchPollInterval is how often a pull waiting for a request slot
+	// checks again, since slots freed by other pulls don't wake it.
+	dispatchPollInterval = 50 * time.Millisecond
+	// probeThroughput is the throughput assumed of a peer that hasn't sent a
+	// block yet, in bytes per second.
+	probeThroughput = 8 << 20
+	// statsWeight is the weight of each new sample in a peer's averages.
+	statsWeight = 0.25
+	// requestTimeout is how long a request may go unanswered while the peer
+	// delivers nothing else either. Requests queue behind each other, so one
+	// sent to a slow but working peer is waited for as long as blocks keep
+	// arriving.
+	requestTimeout = 30 * time.Second
+	// maxBlockAttempts is how many times a peer may fail to deliver a block
+	// before it isn't asked for the block again.
+	maxBlockAttempts = 3
+)
+
+// remoteBlock locates a block in a file a peer has advertised.
+type remoteBlock struct {
+	path string
+	// hash is the hash of the whole file, which the peer checks before
+	// serving it.
+	hash   string
+	offset int64
+	size   int
+}
+
+// remoteBlocks indexes every block of every file in a peer's index by hash.
+func remoteBlocks(update *protocol.IndexUpdate) map[string]remoteBlock {
+	blocks := make(map[string]remoteBlock)
+	for _, file := range update.Files {
+		if file.Deleted {
+			continue
+		}
+		for _, b := range file.Blocks {
+			blocks[b.Hash] = remoteBlock{path: file.Path, hash: file.Hash, offset: b.Offset, size: b.Size}
+		}
+	}
+	return blocks
+}
+
+// peerStats measures how quickly a peer delivers blocks. It is guarded by the
+// session's mu.
+type peerStats struct {
+	// latency averages the round trip of requests sent while no other
+	// request was in flight, so that it isn't inflated by queueing.
+	latency time.Duration
+	// throughput averages the bytes per second delivered.
+	throughput float64
+	// inflight is the number of bytes requested but not yet received.
+	inflight    int64
+	lastArrival time.Time
+}
+
+// record updates the averages with a block delivered at now in answer to req.
+// A block's transfer is timed from when it was requested or when the block
+// before it arrived, whichever is later, since requests are pipelined.
+func (p *peerStats) record(req pendingRequest, now time.Time) {
+	if req.idle {
+		p.latency = time.Duration(average(float64(p.latency), float64(now.Sub(req.sent))))
+	}
+	start := req.sent
+	if p.lastArrival.After(start) {
+		start = p.lastArrival
+	}
+	if elapsed := now.Sub(start); elapsed > 0 {
+		p.throughput = average(p.throughput, float64(req.block.Size)/elapsed.Seconds())
+	}
+	p.lastArrival = now
+}
+
+// eta estimates how long the peer would take to deliver a block of size bytes
+// requested now, behind the bytes it is already sending.
+func (p *peerStats) eta(size int) time.Duration {
+	throughput := p.throughput
+	if throughput == 0 {
+		throughput = probeThroughput
+	}
+	return p.latency + time.Duration(float64(p.inflight+int64(size))/throughput*float64(time.Second))
+}
+
+// average folds sample into a moving average, which starts at the first
+// sample.
+func average(avg, sample float64) float64 {
+	if avg == 0 {
+		return sample
+	}
+	return avg + statsWeight*(sample-avg)
+}
+
+// blockOffer is a peer that can send a block.
+type blockOffer struct {
+	sess *session
+	loc  remoteBlock
+	eta  time.Duration
+}
+
+// blockOffers returns the connected peers that have advertised block in
+// folder id, leaving out those in excluded, soonest expected first after any
+// not in demoted.
+func (s *syncer) blockOffers(id string, block blockInfo, excluded, demoted map[*session]bool) []blockOffer {
+	var offers []blockOffer
+	for _, sess := range s.activeSessions() {
+		if excluded[sess] || !s.folderSharedWith(id, sess) {
+			continue
+		}
+		sess.mu.Lock()
+		loc, ok := sess.blocks[id][block.Hash]
+		eta := sess.stats.eta(block.Size)
+		sess.mu.Unlock()
+		if ok && loc.size == block.Size {
+			offers = append(offers, blockOffer{sess: sess, loc: loc, eta: eta})
+		}
+	}
+	slices.SortFunc(offers, func(a, b blockOffer) int {
+		if demoted[a.sess] != demoted[b.sess] {
+			if demoted[a.sess] {
+				return 1
+			}
+			return -1
+		}
+		return cmp.Compare(a.eta, b.eta)
+	})
+	return offers
+}
+
+// dispatch requests job's queued blocks, each from the peer expected to send
+// it soonest that has a free request slot, until the queue is empty or the
+// job is over. It waits for a slot whenever every peer with the next block is
+// busy. Only one dispatch runs for a job at a time.
+func (s *syncer) dispatch(job *pullJob) {
+	for {
+		job.mu.Lock()
+		if job.done || len(job.queue) == 0 {
+			job.dispatching = false
+			job.mu.Unlock()
+			return
+		}
+		block := job.queue[0]
+		excluded, demoted := job.avoided(block)
+		job.mu.Unlock()
+
+		offers := s.blockOffers(job.folder.id, block, excluded, demoted)
+		if len(offers) == 0 {
+			job.mu.Lock()
+			job.dispatching = false
+			job.mu.Unlock()
+			s.failPull(job, fmt.Errorf("no connected peer can send the block at %d", block.Offset))
+			return
+		}
+
+		sent := false
+		for _, offer := range offers {
+			req, ok := offer.sess.tryRequest(job, block, offer.loc)
+			if !ok {
+				continue
+			}
+			job.mu.Lock()
+			job.queue = job.queue[1:]
+			job.mu.Unlock()
+			// A request that can't be sent is left pending, to be put back on
+			// the queue when its session ends or the request times out.
+			sess := offer.sess
+			time.AfterFunc(requestTimeout, func() { s.expireRequest(sess, req.ID, time.Now()) })
+			_ = sess.enc.Encode(req)
+			sent = true
+			break
+		}
+		if sent {
+			continue
+		}
+
+		select {
+		case <-job.wake:
+		case <-time.After(dispatchPollInterval):
+		}
+	}
+}
+
+// requeue puts a block that wasn't delivered back on job's queue and makes
+// sure it is dispatched.
+func (s *syncer) requeue(job *pullJob, block blockInfo) {
+	job.mu.Lock()
+	if job.done {
+		job.mu.Unlock()
+		return
+	}
+	job.queue = append(job.queue, block)
+	start := !job.dispatching
+	job.dispatching = true
+	job.mu.Unlock()
+
+	if start {
+		go s.dispatch(job)
+	} else {
+		job.signal()
+	}
+}
+
+// retryBlock puts a block that bad failed to deliver back on the queue, to be
+// requested from another peer if there is one. bad is asked for the file's
+// blocks again only when no other peer has them, and not for this block once
+// it has failed it maxBlockAttempts times.
+func (s *syncer) retryBlock(bad *session, job *pullJob, block blockInfo, err error) {
+	job.mu.Lock()
+	if job.failures == nil {
+		job.failures = make(map[*session]map[int64]int)
+	}
+	if job.failures[bad] == nil {
+		job.failures[bad] = make(map[int64]int)
+	}
+	job.failures[bad][block.Offset]++
+	job.mu.Unlock()
+
+	s.logger.Printf("%v from %s, requesting it again", err, bad.conn.RemoteAddr())
+	s.requeue(job, block)
+}
+
+// avoided returns the sessions not to ask for block, those that have failed
+// to deliver it maxBlockAttempts times, and those to ask only when no other
+// peer has it, having failed to deliver any of the file's blocks. job's mu
+// must be held.
+func (job *pullJob) avoided(block blockInfo) (excluded, demoted map[*session]bool) {
+	excluded = make(map[*session]bool)
+	demoted = make(map[*session]bool)
+	for sess, failures := range job.failures {
+		demoted[sess] = true
+		if failures[block.Offset] >= maxBlockAttempts {
+			excluded[sess] = true
+		}
+	}
+	return excluded, demoted
+}
+
+// expireRequest gives up on request id on sess if it is overdue at now,
+// freeing its slot and requesting the block from another peer, as for a block
+// the peer failed to deliver. Otherwise it checks again once it could be.
+func (s *syncer) expireRequest(sess *session, id uint64, now time.Time) {
+	sess.mu.Lock()
+	req, ok := sess.pending[id]
+	since := req.sent
+	if sess.stats.lastArrival.After(since) {
+		since = sess.stats.lastArrival
+	}
+	sess.mu.Unlock()
+	if !ok {
+		return
+	}
+	if wait := since.Add(requestTimeout).Sub(now); wait > 0 {
+		time.AfterFunc(wait, func() { s.expireRequest(sess, id, time.Now()) })
+		return
+	}
+
+	if req, ok = sess.complete(id); !ok {
+		return
+	}
+	req.job.signal()
+	s.retryBlock(sess, req.job, req.block, fmt.Errorf("request for block at %d of %s timed out", req.block.Offset, req.job.info.Path))
+}
+
+// signal wakes job's dispatch if it is waiting for a request slot.
+func (job *pullJob) signal() {
+	select {
+	case job.wake <- struct{}{}:
+	default:
+	}
+}
+
+// tryRequest registers a request for block of the file job is pulling, which
+// the peer has at loc, if the session has a free request slot.
+func (sess *session) tryRequest(job *pullJob, block blockInfo, loc remoteBlock) (protocol.Request, bool) {
+	select {
+	case sess.slots <- struct{}{}:
+	default:
+		return protocol.Request{}, false
+	}
+
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	// Once the session has ended its pending requests are put back on their
+	// queues, so a request registered after that would be lost.
+	select {
+	case <-sess.done:
+		<-sess.slots
+		return protocol.Request{}, false
+	default:
+	}
+
+	sess.nextID++
+	sess.pending[sess.nextID] = pendingRequest{
+		job:   job,
+		block: block,
+		sent:  time.Now(),
+		idle:  sess.stats.inflight == 0,
+	}
+	sess.stats.inflight += int64(block.Size)
+	return protocol.Request{
+		ID:     sess.nextID,
+		Folder: job.folder.id,
+		Path:   loc.path,
+		Hash:   loc.hash,
+		Offset: loc.offset,
+		Size:   block.Size,
+	}, true
+}
+
+// complete removes and returns the pending request with the given ID, freeing
+// its request slot.
+func (sess *session) complete(id uint64) (pendingRequest, bool) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	req, ok := sess.pending[id]
+	if ok {
+		delete(sess.pending, id)
+		sess.stats.inflight -= int64(req.block.Size)
+		<-sess.slots
+	}
+	return req, ok
+}
+
+// recordBlock updates the session's stats with a block delivered in answer to
+// req.
+func (sess *session) recordBlock(req pendingRequest) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	sess.stats.record(req, time.Now())
+}
+
+// abortPulls puts every block still pending on sess back on its pull's queue,
+// once the session has ended, so that the remaining peers send it instead.
+func (s *syncer) abortPulls(sess *session) {
+	sess.mu.Lock()
+	pending := sess.pending
+	sess.pending = make(map[uint64]pendingRequest)
+	sess.mu.Unlock()
+
+	for _, req := range pending {
+		s.requeue(req.job, req.block)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"io"
+	"log"
+	"maps"
+	"path/filepath"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPeerStatsPreferFasterPeers(t *testing.T) {
+	start := time.Now()
+
+	var fast, slow peerStats
+	for i := range 4 {
+		fast.record(pendingRequest{block: blockInfo{Size: avgBlockSize}, sent: start, idle: i == 0}, start.Add(time.Duration(i+1)*10*time.Millisecond))
+		slow.record(pendingRequest{block: blockInfo{Size: avgBlockSize}, sent: start, idle: i == 0}, start.Add(time.Duration(i+1)*100*time.Millisecond))
+	}
+	if fast.latency != 10*time.Millisecond || slow.latency != 100*time.Millisecond {
+		t.Fatalf("expected the latency of the first, idle round trip, got %v and %v", fast.latency, slow.latency)
+	}
+	if fast.eta(avgBlockSize) >= slow.eta(avgBlockSize) {
+		t.Fatalf("expected the fast peer to be expected sooner, got %v and %v", fast.eta(avgBlockSize), slow.eta(avgBlockSize))
+	}
+
+	// Enough queued on the fast peer makes the slow one the better choice.
+	fast.inflight = 64 * avgBlockSize
+	if fast.eta(avgBlockSize) <= slow.eta(avgBlockSize) {
+		t.Fatalf("expected a busy fast peer to be expected later, got %v and %v", fast.eta(avgBlockSize), slow.eta(avgBlockSize))
+	}
+
+	var unknown peerStats
+	if unknown.eta(avgBlockSize) <= 0 {
+		t.Fatal("expected a peer without stats to be given an estimate")
+	}
+}
+
+func TestPullSpreadsBlocksAcrossPeers(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	root := t.TempDir()
+	s, err := newSyncer(logger, testIndexDB(t), "BBBBBBBB", root, folderSendReceive)
+	if err != nil {
+		t.Fatalf("newSyncer returned error: %v", err)
+	}
+
+	data := randomBytes(t, 8<<20)
+	file := testFile(t, "big.bin", data)
+
+	// The pull starts once every peer's index is in.
+	s.setPaused(true)
+	var counts [3]atomic.Int64
+	for i, id := range []string{"client-a", "client-b", "client-c"} {
+		p := startFakePeer(t, s, id)
+		go p.serveAll(data, &counts[i])
+		p.advertise(t, file)
+	}
+	time.Sleep(100 * time.Millisecond)
+	s.setPaused(false)
+
+	waitForFile(t, filepath.Join(root, "big.bin"), string(data))
+	var total int64
+	for i := range counts {
+		n := counts[i].Load()
+		if n == 0 {
+			t.Fatalf("expected every peer to be sent requests, got %d, %d and %d", counts[0].Load(), counts[1].Load(), counts[2].Load())
+		}
+		total += n
+	}
+	if total != int64(len(file.Blocks)) {
+		t.Fatalf("expected each of the %d blocks to be requested once, got %d requests", len(file.Blocks), total)
+	}
+}
+
+func TestPullReassignsBlocksOfDisconnectedPeer(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	root := t.TempDir()
+	s, err := newSyncer(logger, testIndexDB(t), "BBBBBBBB", root, folderSendReceive)
+	if err != nil {
+		t.Fatalf("newSyncer returned error: %v", err)
+	}
+
+	data := randomBytes(t, 8<<20)
+	file := testFile(t, "big.bin", data)
+
+	s.setPaused(true)
+	steady := startFakePeer(t, s, "client-steady")
+	var fromSteady atomic.Int64
+	go steady.serveAll(data, &fromSteady)
+	steady.advertise(t, file)
+	leaving := startFakePeer(t, s, "client-leaving")
+	leaving.advertise(t, file)
+	time.Sleep(100 * time.Millisecond)
+	s.setPaused(false)
+
+	// The leaving peer takes its share of the blocks, then disconnects
+	// without sending any of them.
+	leaving.nextRequest(t)
+	leaving.conn.Close()
+	<-leaving.done
+
+	waitForFile(t, filepath.Join(root, "big.bin"), string(data))
+	if n := fromSteady.Load(); n != int64(len(file.Blocks)) {
+		t.Fatalf("expected every block to come from the remaining peer, got %d of %d", n, len(file.Blocks))
+	}
+}
+
+func TestPullReassignsBlocksOfStalledPeer(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	root := t.TempDir()
+	s, err := newSyncer(logger, testIndexDB(t), "BBBBBBBB", root, folderSendReceive)
+	if err != nil {
+		t.Fatalf("newSyncer returned error: %v", err)
+	}
+
+	data := randomBytes(t, 8<<20)
+	file := testFile(t, "big.bin", data)
+
+	s.setPaused(true)
+	steady := startFakePeer(t, s, "client-steady")
+	var fromSteady atomic.Int64
+	go steady.serveAll(data, &fromSteady)
+	steady.advertise(t, file)
+	stalled := startFakePeer(t, s, "client-stalled")
+	stalled.advertise(t, file)
+	time.Sleep(100 * time.Millisecond)
+	s.setPaused(false)
+
+	// The stalled peer takes its share of the blocks and never answers.
+	stalled.nextRequest(t)
+	time.Sleep(200 * time.Millisecond)
+	var sess *session
+	for _, active := range s.activeSessions() {
+		if active.peer.clientID == "client-stalled" {
+			sess = active
+		}
+	}
+	if sess == nil {
+		t.Fatal("expected a session with the stalled peer")
+	}
+
+	// Pretend the deadline has passed for all of them.
+	sess.mu.Lock()
+	ids := slices.Collect(maps.Keys(sess.pending))
+	sess.mu.Unlock()
+	for _, id := range ids {
+		s.expireRequest(sess, id, time.Now().Add(requestTimeout))
+	}
+	if n := len(sess.slots); n != 0 {
+		t.Fatalf("expected the timed out requests to free their slots, %d still taken", n)
+	}
+
+	waitForFile(t, filepath.Join(root, "big.bin"), string(data))
+	if n := fromSteady.Load(); n != int64(len(file.Blocks)) {
+		t.Fatalf("expected every block to come from the steady peer, got %d of %d", n, len(file.Blocks))
+	}
+}
+
+func TestPullRetriesStalledBlocksFromOnlyPeer(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	root := t.TempDir()
+	s, err := newSyncer(logger, testIndexDB(t), "BBBBBBBB", root, folderSendReceive)
+	if err != nil {
+		t.Fatalf("newSyncer returned error: %v", err)
+	}
+
+	data := randomBytes(t, 4<<20)
+	file := testFile(t, "big.bin", data)
+
+	// The only peer with the file stalls on its first requests.
+	p := startFakePeer(t, s, "client-a")
+	p.advertise(t, file)
+	p.nextRequest(t)
+	time.Sleep(200 * time.Millisecond)
+	for len(p.requests) > 0 {
+		<-p.requests
+	}
+	sess := s.activeSessions()[0]
+
+	sess.mu.Lock()
+	ids := slices.Collect(maps.Keys(sess.pending))
+	sess.mu.Unlock()
+	var requested atomic.Int64
+	go p.serveAll(data, &requested)
+	for _, id := range ids {
+		s.expireRequest(sess, id, time.Now().Add(requestTimeout))
+	}
+
+	// Having no other peer to turn to, the pull asks it again.
+	waitForFile(t, filepath.Join(root, "big.bin"), string(data))
+	if n := requested.Load(); n != int64(len(file.Blocks)) {
+		t.Fatalf("expected every block to be requested again, got %d of %d", n, len(file.Blocks))
+	}
+}
@@ -0,0 +1,1020 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"maps"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dantdj/syncmesh/local-client/protocol"
+)
+
+const (
+	// defaultFolderID identifies the folder given on the command line.
+	defaultFolderID = "default"
+
+	clientVersion = "0.1.0"
+
+	// defaultFileMode is given to pulled files whose peer didn't send
+	// permissions.
+	defaultFileMode = 0o644
+
+	helloTimeout = 10 * time.Second
+	pingInterval = 30 * time.Second
+	// idleTimeout is how long a session may go without receiving anything
+	// (including pings) before it is considered dead.
+	idleTimeout = 3 * pingInterval
+)
+
+var (
+	errFolderExists   = errors.New("folder already exists")
+	errFolderNotFound = errors.New("folder not found")
+)
+
+// syncer owns the index of every synced folder and every active peer session.
+type syncer struct {
+	logger     *log.Logger
+	db         *indexDB
+	deviceName string
+	// device identifies this device in version vectors.
+	device string
+
+	mu       sync.Mutex
+	folders  map[string]*folder
+	sessions map[*session]struct{}
+	// paused stops files being pulled from or served to peers. Indexes from
+	// peers are still recorded so that nothing is missed on resume.
+	paused bool
+	// fullScan is how often watched folders are rescanned in full. It is zero
+	// until watching starts.
+	fullScan time.Duration
+	// compression is how much compression new sessions ask the peer for.
+	compression protocol.Compression
+}
+
+// folder is a directory synced with peers that share the same folder ID.
+type folder struct {
+	id   string
+	root string
+	// writeMu serialises scans with changes written to the folder by syncing,
+	// so that a scan never mistakes a file pulled halfway through it for a
+	// local change.
+	writeMu sync.Mutex
+	// deleted remembers recently deleted files for rename detection. It is
+	// guarded by writeMu.
+	deleted recentDeletions
+	// mode, versioning, peers, index, ignores and pulling are guarded by
+	// the syncer's mu.
+	mode       folderMode
+	versioning versioningConfig
+	// peers holds the normalised IDs of the devices the folder is shared
+	// with, or nothing if it is shared with every peer.
+	peers   map[string]bool
+	index   map[string]fileInfo
+	ignores *ignoreMatcher
+	// pulling holds the files being pulled, by path, so that a file isn't
+	// pulled twice at once.
+	pulling map[string]*pullJob
+	// stop is closed when the folder is removed.
+	stop chan struct{}
+}
+
+// folderStatus summarises a folder for the control API.
+type folderStatus struct {
+	ID    string     `json:"id"`
+	Path  string     `json:"path"`
+	Mode  folderMode `json:"mode"`
+	Files int        `json:"files"`
+	Bytes int64      `json:"bytes"`
+	// Versioning is how old copies of files replaced by syncing are kept.
+	Versioning versioningConfig `json:"versioning"`
+	// LocalChanges counts the files changed locally in a receive-only
+	// folder, which peers aren't told about.
+	LocalChanges int `json:"localChanges"`
+	// Peers lists the devices the folder is shared with, if it isn't shared
+	// with every peer.
+	Peers []string `json:"peers,omitempty"`
+}
+
+type session struct {
+	peer remotePeer
+	conn net.Conn
+	enc  *protocol.Encoder
+	dec  *protocol.Decoder
+	done chan struct{}
+	// compression is what the two sides agreed to compress.
+	compression protocol.Compression
+
+	// slots holds a token for every request in flight, up to
+	// maxOutstandingRequests.
+	slots chan struct{}
+	// queued holds a token for every request from the peer not yet answered,
+	// up to maxQueuedRequests, and serving one for each being read from
+	// disk, up to maxOutstandingRequests, since each holds a block in memory.
+	queued  chan struct{}
+	serving chan struct{}
+
+	mu      sync.Mutex
+	nextID  uint64
+	pending map[uint64]pendingRequest
+	// remote holds the latest index the peer has sent for each folder, and
+	// blocks the blocks in it by hash.
+	remote map[string]*protocol.IndexUpdate
+	blocks map[string]map[string]remoteBlock
+	stats  peerStats
+}
+
+// pendingRequest is a block requested from a peer and not yet received.
+type pendingRequest struct {
+	job   *pullJob
+	block blockInfo
+	sent  time.Time
+	// idle records that nothing else was in flight when it was sent.
+	idle bool
+}
+
+// newSyncer returns a syncer for the folder at root, synced in mode under
+// defaultFolderID, that keeps its indexes in db. deviceID is this device's ID.
+func newSyncer(logger *log.Logger, db *indexDB, deviceID, root string, mode folderMode) (*syncer, error) {
+	s := newEmptySyncer(logger, db, deviceID)
+	if err := s.addFolder(defaultFolderID, root, mode, versioningConfig{Type: versioningNone}, nil); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// newEmptySyncer returns a syncer with no folders yet, that keeps their
+// indexes in db.
+func newEmptySyncer(logger *log.Logger, db *indexDB, deviceID string) *syncer {
+	deviceName, err := os.Hostname()
+	if err != nil {
+		deviceName = "unknown"
+	}
+
+	return &syncer{
+		logger:     logger,
+		db:         db,
+		deviceName: deviceName,
+		device:     shortDeviceID(deviceID),
+		folders:    make(map[string]*folder),
+		sessions:   make(map[*session]struct{}),
+		// Indexes of large folders shrink a lot, and are cheap to compress.
+		compression: protocol.CompressionMetadata,
+	}
+}
+
+// addFolder starts syncing the directory at root, creating it if needed, as
+// folder id in mode, keeping old copies of files as versioning says. It is
+// shared with the devices in peers, or with every peer if there are none.
+// Peers are sent its index straight away, and any index they have already sent
+// for it is acted on.
+func (s *syncer) addFolder(id, root string, mode folderMode, versioning versioningConfig, peers []string) error {
+	s.mu.Lock()
+	_, exists := s.folders[id]
+	s.mu.Unlock()
+	if exists {
+		return errFolderExists
+	}
+
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return err
+	}
+
+	ignores, err := loadIgnores(root)
+	if err != nil {
+		return err
+	}
+
+	// Files whose size and modification time match the stored index aren't
+	// rehashed, and files missing since last time are recorded as deleted.
+	// Files ignored since last time are forgotten.
+	stored, err := s.db.loadFolder(id, root)
+	if err != nil {
+		return err
+	}
+	prev, dropped := withoutIgnored(stored, ignores)
+	if err := s.db.deleteFiles(id, dropped); err != nil {
+		return err
+	}
+	scanned, err := scanFolder(root, prev, ignores)
+	if err != nil {
+		return err
+	}
+	deleted := make(recentDeletions)
+	index, changed := reconcileScan(prev, scanned, s.device, deleted)
+	if mode == folderReceiveOnly {
+		markLocalChanges(prev, index, changed)
+	}
+	if err := s.db.saveFiles(id, root, changed); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	if _, exists := s.folders[id]; exists {
+		s.mu.Unlock()
+		return errFolderExists
+	}
+	f := &folder{
+		id:         id,
+		root:       root,
+		mode:       mode,
+		versioning: versioning,
+		peers:      peerSet(peers),
+		index:      index,
+		ignores:    ignores,
+		deleted:    deleted,
+		pulling:    make(map[string]*pullJob),
+		stop:       make(chan struct{}),
+	}
+	s.folders[id] = f
+	fullScan := s.fullScan
+	s.mu.Unlock()
+
+	if fullScan > 0 {
+		s.watchFolder(f, fullScan)
+		go s.cleanVersionsLoop(f, versionCleanInterval)
+	}
+
+	s.broadcastIndex(id)
+	s.pullFolder(id)
+	return nil
+}
+
+// removeFolder stops syncing folder id and forgets its index. Its files are
+// left on disk.
+func (s *syncer) removeFolder(id string) error {
+	s.mu.Lock()
+	f, ok := s.folders[id]
+	if !ok {
+		s.mu.Unlock()
+		return errFolderNotFound
+	}
+	delete(s.folders, id)
+	s.mu.Unlock()
+
+	close(f.stop)
+
+	return s.db.dropFolder(id)
+}
+
+// setFolderPeers shares folder id with the devices in peers, or with every peer
+// if there are none. Peers it is newly shared with are sent its index and
+// pulled from.
+func (s *syncer) setFolderPeers(id string, peers []string) error {
+	s.mu.Lock()
+	f, ok := s.folders[id]
+	if ok {
+		f.peers = peerSet(peers)
+	}
+	s.mu.Unlock()
+	if !ok {
+		return errFolderNotFound
+	}
+
+	s.broadcastIndex(id)
+	s.pullFolder(id)
+	return nil
+}
+
+// peerSet normalises a list of device IDs into a set.
+func peerSet(peers []string) map[string]bool {
+	set := make(map[string]bool, len(peers))
+	for _, id := range peers {
+		set[normalizeDeviceID(id)] = true
+	}
+	return set
+}
+
+// sharedWith reports whether the folder is shared with the device. The
+// syncer's mu must be held.
+func (f *folder) sharedWith(deviceID string) bool {
+	return len(f.peers) == 0 || f.peers[normalizeDeviceID(deviceID)]
+}
+
+// sharedFolderIDs returns the IDs of the folders shared with the peer on sess.
+func (s *syncer) sharedFolderIDs(sess *session) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var ids []string
+	for id, f := range s.folders {
+		if f.sharedWith(sess.peer.deviceID) {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+// folderSharedWith reports whether folder id is synced and shared with the
+// peer on sess.
+func (s *syncer) folderSharedWith(id string, sess *session) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, ok := s.folders[id]
+	return ok && f.sharedWith(sess.peer.deviceID)
+}
+
+// folderStatuses describes every synced folder, ordered by ID.
+func (s *syncer) folderStatuses() []folderStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	statuses := make([]folderStatus, 0, len(s.folders))
+	for _, f := range s.folders {
+		statuses = append(statuses, f.status())
+	}
+	slices.SortFunc(statuses, func(a, b folderStatus) int { return strings.Compare(a.ID, b.ID) })
+	return statuses
+}
+
+// folderStatus describes folder id, if it is synced.
+func (s *syncer) folderStatus(id string) (folderStatus, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, ok := s.folders[id]
+	if !ok {
+		return folderStatus{}, false
+	}
+	return f.status(), true
+}
+
+// status summarises the folder. The syncer's mu must be held.
+func (f *folder) status() folderStatus {
+	status := folderStatus{ID: f.id, Path: f.root, Mode: f.mode, Versioning: f.versioning}
+	if len(f.peers) > 0 {
+		status.Peers = slices.Sorted(maps.Keys(f.peers))
+	}
+	for _, info := range f.index {
+		if info.LocalChange {
+			status.LocalChanges++
+		}
+		if !info.Deleted {
+			status.Files++
+			status.Bytes += info.Size
+		}
+	}
+	return status
+}
+
+// setPaused pauses or resumes syncing. On resume every peer is resynced, to
+// catch up on anything that changed in the meantime.
+func (s *syncer) setPaused(paused bool) {
+	s.mu.Lock()
+	was := s.paused
+	s.paused = paused
+	s.mu.Unlock()
+
+	if was && !paused {
+		for _, sess := range s.activeSessions() {
+			s.resyncSession(sess)
+		}
+	}
+}
+
+func (s *syncer) isPaused() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.paused
+}
+
+// setCompression sets how much compression sessions started from now on ask
+// their peer for.
+func (s *syncer) setCompression(c protocol.Compression) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.compression = c
+}
+
+// resyncPeer resends our indexes to the peer with the given client ID and
+// pulls anything we are missing from its latest indexes. It reports whether
+// there was a session with the peer.
+func (s *syncer) resyncPeer(clientID string) bool {
+	found := false
+	for _, sess := range s.activeSessions() {
+		if sess.peer.clientID == clientID {
+			found = true
+			s.resyncSession(sess)
+		}
+	}
+	return found
+}
+
+func (s *syncer) resyncSession(sess *session) {
+	for _, id := range s.sharedFolderIDs(sess) {
+		if err := sess.enc.Encode(s.indexUpdate(id)); err != nil {
+			s.logger.Printf("index send to %s failed: %v", sess.conn.RemoteAddr(), err)
+			return
+		}
+		if err := s.pullRemote(sess, id); err != nil {
+			s.logger.Printf("pull for folder %s from %s failed: %v", id, sess.conn.RemoteAddr(), err)
+		}
+	}
+}
+
+// startWatching watches every folder for changes, and every folder added from
+// now on, rescanning each in full every fullScan as well. Old versions of
+// files are thinned out from then on too.
+func (s *syncer) startWatching(fullScan time.Duration) {
+	s.mu.Lock()
+	s.fullScan = fullScan
+	folders := slices.Collect(maps.Values(s.folders))
+	s.mu.Unlock()
+
+	for _, f := range folders {
+		s.watchFolder(f, fullScan)
+		go s.cleanVersionsLoop(f, versionCleanInterval)
+	}
+}
+
+// watchFolder watches f until it is removed. A folder that can't be watched,
+// for instance because the system's inotify limits have been reached, is
+// scanned regularly instead.
+func (s *syncer) watchFolder(f *folder, fullScan time.Duration) {
+	w, err := newFolderWatcher(s.logger, s, f)
+	if err != nil {
+		s.logger.Printf("watching folder %s failed, scanning it every %s instead: %v", f.id, fallbackScanInterval, err)
+		go s.scanLoop(f, fallbackScanInterval)
+		return
+	}
+	go w.run(fullScan, f.stop)
+}
+
+// scanLoop rescans f on every tick until it is removed.
+func (s *syncer) scanLoop(f *folder, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-f.stop:
+			return
+		case <-ticker.C:
+			if err := s.rescanFolder(f.id); err != nil && !errors.Is(err, errFolderNotFound) {
+				s.logger.Printf("scan of folder %s failed: %v", f.id, err)
+			}
+		}
+	}
+}
+
+// rescan rescans every folder.
+func (s *syncer) rescan() error {
+	var errs []error
+	for _, id := range s.folderIDs() {
+		if err := s.rescanFolder(id); err != nil && !errors.Is(err, errFolderNotFound) {
+			errs = append(errs, fmt.Errorf("folder %s: %w", id, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// rescanFolder rescans folder id and pushes its new index to all connected
+// peers if anything has changed. Its ignore patterns are reread first.
+func (s *syncer) rescanFolder(id string) error {
+	if err := s.reloadIgnores(id); err != nil && !errors.Is(err, errFolderNotFound) {
+		s.logger.Printf("reading ignore patterns for folder %s failed, keeping the previous ones: %v", id, err)
+	}
+	return s.rescanPaths(id, []string{"."})
+}
+
+// reloadIgnores rereads the ignore patterns of folder id.
+func (s *syncer) reloadIgnores(id string) error {
+	s.mu.Lock()
+	f, ok := s.folders[id]
+	s.mu.Unlock()
+	if !ok {
+		return errFolderNotFound
+	}
+
+	ignores, err := loadIgnores(f.root)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	f.ignores = ignores
+	s.mu.Unlock()
+	return nil
+}
+
+// rescanPaths rescans the given files and directory trees in folder id, as
+// slash-separated paths relative to its root, and pushes the new index to all
+// connected peers if anything has changed. Files that have become ignored are
+// dropped from the index without a tombstone, so peers keep their copies.
+func (s *syncer) rescanPaths(id string, paths []string) error {
+	s.mu.Lock()
+	f, ok := s.folders[id]
+	if !ok {
+		s.mu.Unlock()
+		return errFolderNotFound
+	}
+	s.mu.Unlock()
+
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+
+	s.mu.Lock()
+	index := maps.Clone(f.index)
+	ignores := f.ignores
+	mode := f.mode
+	s.mu.Unlock()
+
+	prev := make(map[string]fileInfo)
+	scanned := make(map[string]fileInfo)
+	for _, dir := range paths {
+		for path, info := range index {
+			if dir == "." || path == dir || strings.HasPrefix(path, dir+"/") {
+				prev[path] = info
+			}
+		}
+		tree, err := scanTree(f.root, dir, index, ignores)
+		if err != nil {
+			return err
+		}
+		maps.Copy(scanned, tree)
+	}
+	prev, dropped := withoutIgnored(prev, ignores)
+
+	updated, changed := reconcileScan(prev, scanned, s.device, f.deleted)
+	if mode == folderReceiveOnly {
+		markLocalChanges(prev, updated, changed)
+	}
+	if len(changed) == 0 && len(dropped) == 0 {
+		return nil
+	}
+	if err := s.db.saveFiles(id, f.root, changed); err != nil {
+		return err
+	}
+	if err := s.db.deleteFiles(id, dropped); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	maps.Copy(f.index, updated)
+	for _, path := range dropped {
+		delete(f.index, path)
+	}
+	s.mu.Unlock()
+
+	s.logger.Printf("folder %s changed, %d entries updated", id, len(changed))
+	if len(dropped) > 0 {
+		s.logger.Printf("folder %s no longer syncs %d newly ignored files", id, len(dropped))
+	}
+	s.broadcastIndex(id)
+	return nil
+}
+
+// folderIDs returns the IDs of every synced folder.
+func (s *syncer) folderIDs() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return slices.Sorted(maps.Keys(s.folders))
+}
+
+// indexUpdate returns the index of folder id as advertised to peers, which
+// leaves out local changes to a receive-only folder.
+func (s *syncer) indexUpdate(id string) protocol.IndexUpdate {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	update := protocol.IndexUpdate{Folder: id}
+	if f, ok := s.folders[id]; ok {
+		update.Files = make([]protocol.FileInfo, 0, len(f.index))
+		for _, info := range f.index {
+			if info.LocalChange {
+				continue
+			}
+			update.Files = append(update.Files, info.toWire())
+		}
+	}
+	return update
+}
+
+func (s *syncer) broadcastIndex(id string) {
+	if s.isPaused() {
+		return
+	}
+
+	update := s.indexUpdate(id)
+	for _, sess := range s.activeSessions() {
+		if !s.folderSharedWith(id, sess) {
+			continue
+		}
+		if err := sess.enc.Encode(update); err != nil {
+			s.logger.Printf("index push to %s failed: %v", sess.conn.RemoteAddr(), err)
+		}
+	}
+}
+
+// pullFolder pulls folder id from every connected peer.
+func (s *syncer) pullFolder(id string) {
+	for _, sess := range s.activeSessions() {
+		if err := s.pullRemote(sess, id); err != nil {
+			s.logger.Printf("pull for folder %s from %s failed: %v", id, sess.conn.RemoteAddr(), err)
+		}
+	}
+}
+
+func (s *syncer) activeSessions() []*session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sessions := make([]*session, 0, len(s.sessions))
+	for sess := range s.sessions {
+		sessions = append(sessions, sess)
+	}
+	return sessions
+}
+
+// runSession performs the Hello handshake with the peer on conn, then exchanges
+// indexes and serves and pulls files until the connection is closed. It is used
+// by both the dialing and the accepting side, once the peer's device has been
+// authenticated.
+func (s *syncer) runSession(conn net.Conn, peer remotePeer) {
+	defer conn.Close()
+
+	sess := &session{
+		peer:    peer,
+		conn:    conn,
+		enc:     protocol.NewEncoder(conn),
+		dec:     protocol.NewDecoder(conn),
+		done:    make(chan struct{}),
+		slots:   make(chan struct{}, maxOutstandingRequests),
+		queued:  make(chan struct{}, maxQueuedRequests),
+		serving: make(chan struct{}, maxOutstandingRequests),
+		pending: make(map[uint64]pendingRequest),
+		remote:  make(map[string]*protocol.IndexUpdate),
+		blocks:  make(map[string]map[string]remoteBlock),
+	}
+	defer s.abortPulls(sess)
+	defer close(sess.done)
+
+	remote := fmt.Sprintf("%s (%s)", shortDeviceID(peer.deviceID), conn.RemoteAddr().String())
+
+	hello, err := s.handshake(sess)
+	if err != nil {
+		s.logger.Printf("handshake with %s failed: %v", remote, err)
+		return
+	}
+	s.logger.Printf("sync session started with %s, %q running version %s, compression %s", remote, hello.DeviceName, hello.ClientVersion, sess.compression)
+
+	s.mu.Lock()
+	s.sessions[sess] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.sessions, sess)
+		s.mu.Unlock()
+	}()
+
+	// Writes happen off the read loop so that two peers writing to each other at
+	// the same time can never deadlock on full socket buffers.
+	go func() {
+		for _, id := range s.sharedFolderIDs(sess) {
+			if err := sess.enc.Encode(s.indexUpdate(id)); err != nil {
+				s.logger.Printf("index send to %s failed: %v", remote, err)
+				return
+			}
+		}
+	}()
+	go sess.pingLoop()
+
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(idleTimeout))
+
+		msg, err := sess.dec.Decode()
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				s.logger.Printf("read from %s failed: %v", remote, err)
+			}
+			s.logger.Printf("sync session with %s closed", remote)
+			return
+		}
+
+		if c, ok := msg.(*protocol.Close); ok {
+			s.logger.Printf("sync session with %s closed by peer: %s", remote, c.Reason)
+			return
+		}
+
+		// Requests beyond what a well-behaved peer sends are dropped, and
+		// time out on its side, rather than piling up here.
+		if _, ok := msg.(*protocol.Request); ok {
+			select {
+			case sess.queued <- struct{}{}:
+			default:
+				s.logger.Printf("dropped a request from %s, which has too many outstanding", remote)
+				continue
+			}
+		}
+
+		go func() {
+			if err := s.handleMessage(sess, msg); err != nil {
+				s.logger.Printf("handling %s from %s failed: %v", msg.Type(), remote, err)
+			}
+		}()
+	}
+}
+
+// handshake sends our Hello and waits for the peer's, which must be the first
+// message on the connection. Everything sent after it is compressed as far as
+// both sides asked for.
+func (s *syncer) handshake(sess *session) (*protocol.Hello, error) {
+	_ = sess.conn.SetDeadline(time.Now().Add(helloTimeout))
+	defer sess.conn.SetDeadline(time.Time{})
+
+	s.mu.Lock()
+	compression := s.compression
+	s.mu.Unlock()
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- sess.enc.Encode(protocol.Hello{DeviceName: s.deviceName, ClientVersion: clientVersion, Compression: compression})
+	}()
+
+	msg, err := sess.dec.Decode()
+	if err != nil {
+		if errors.Is(err, protocol.ErrUnsupportedVersion) {
+			_ = sess.enc.Encode(protocol.Close{Reason: "unsupported protocol version"})
+		}
+		return nil, err
+	}
+	if err := <-errc; err != nil {
+		return nil, err
+	}
+
+	hello, ok := msg.(*protocol.Hello)
+	if !ok {
+		_ = sess.enc.Encode(protocol.Close{Reason: "expected hello"})
+		return nil, fmt.Errorf("expected hello, got %s", msg.Type())
+	}
+
+	sess.compression = protocol.Negotiate(compression, hello.Compression)
+	sess.enc.SetCompression(sess.compression)
+	return hello, nil
+}
+
+func (s *syncer) handleMessage(sess *session, msg protocol.Message) error {
+	switch m := msg.(type) {
+	case *protocol.IndexUpdate:
+		return s.handleIndex(sess, m)
+	case *protocol.Request:
+		defer func() { <-sess.queued }()
+		sess.serving <- struct{}{}
+		defer func() { <-sess.serving }()
+		return s.handleRequest(sess, m)
+	case *protocol.Response:
+		return s.handleResponse(sess, m)
+	case *protocol.Ping:
+		return nil
+	default:
+		return fmt.Errorf("unexpected message %s", msg.Type())
+	}
+}
+
+// handleIndex records a peer's index and pulls from it. Indexes for folders we
+// don't sync are kept in case the folder is added later. Files whose blocks
+// don't add up are left out, since pulling them would go wrong.
+func (s *syncer) handleIndex(sess *session, update *protocol.IndexUpdate) error {
+	valid := make([]protocol.FileInfo, 0, len(update.Files))
+	for _, wire := range update.Files {
+		if err := fileInfoFromWire(wire).checkBlocks(); err != nil {
+			s.logger.Printf("ignoring %s in folder %s from %s: %v", wire.Path, update.Folder, sess.conn.RemoteAddr(), err)
+			continue
+		}
+		valid = append(valid, wire)
+	}
+	update.Files = valid
+
+	blocks := remoteBlocks(update)
+
+	sess.mu.Lock()
+	sess.remote[update.Folder] = update
+	sess.blocks[update.Folder] = blocks
+	sess.mu.Unlock()
+
+	return s.pullRemote(sess, update.Folder)
+}
+
+// pullRemote compares the peer's latest index for a folder with ours and pulls
+// every file that is missing locally or newer on the peer. Send-only folders
+// pull nothing.
+func (s *syncer) pullRemote(sess *session, folderID string) error {
+	sess.mu.Lock()
+	update := sess.remote[folderID]
+	sess.mu.Unlock()
+	if update == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	f, ok := s.folders[folderID]
+	paused := s.paused
+	var mode folderMode
+	if ok {
+		mode = f.mode
+		ok = f.sharedWith(sess.peer.deviceID)
+	}
+	s.mu.Unlock()
+	if !ok || paused {
+		return nil
+	}
+
+	if err := s.adoptVersions(f, update.Files); err != nil {
+		return err
+	}
+	if mode == folderSendOnly {
+		return nil
+	}
+
+	var needed []fileInfo
+	remote := make(map[string]fileInfo, len(update.Files))
+
+	s.mu.Lock()
+	for _, wire := range update.Files {
+		info := fileInfoFromWire(wire)
+		if f.ignores.ignored(info.Path, false) {
+			continue
+		}
+		remote[info.Path] = info
+		local, ok := f.index[info.Path]
+		if needsPull(local, ok, info) && f.pulling[info.Path] == nil {
+			needed = append(needed, info)
+		}
+	}
+	renames := findRenames(f, needed, remote)
+	sources := localBlocks(f)
+	s.mu.Unlock()
+
+	// Files the peer moved are moved here too. Anything left is pulled before
+	// deletions are applied, so that blocks from deleted files can be reused.
+	done := make(map[string]bool)
+	for _, r := range renames {
+		if err := s.applyRename(f, r); err != nil {
+			s.logger.Printf("moving %s to %s failed, pulling it instead: %v", r.from.Path, r.to.Path, err)
+			continue
+		}
+		done[r.from.Path] = true
+		done[r.to.Path] = true
+	}
+	for _, info := range needed {
+		if info.Deleted || done[info.Path] {
+			continue
+		}
+		if err := s.startPull(f, info, sources); err != nil {
+			return err
+		}
+	}
+	for _, info := range needed {
+		if !info.Deleted || done[info.Path] {
+			continue
+		}
+		if err := s.applyDeletion(f, info); err != nil {
+			s.logger.Printf("deleting %s failed: %v", info.Path, err)
+		}
+	}
+	return nil
+}
+
+// adoptVersions merges the peer's version of every file whose content already
+// matches ours into our own. Copies that were made separately, such as a
+// folder seeded on two devices, then share a history, so a later change on
+// either side descends from both instead of conflicting. A local change that
+// matches the peer's copy is no longer a local change.
+func (s *syncer) adoptVersions(f *folder, files []protocol.FileInfo) error {
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+
+	var changed []fileInfo
+
+	s.mu.Lock()
+	for _, wire := range files {
+		remote := fileInfoFromWire(wire)
+		local, ok := f.index[remote.Path]
+		if !ok || !sameContent(local, remote) {
+			continue
+		}
+		merged := local.Version.merge(remote.Version)
+		if merged.compare(local.Version) == orderEqual && !local.LocalChange {
+			continue
+		}
+		local.Version = merged
+		local.RenamedFrom = ""
+		local.LocalChange = false
+		f.index[local.Path] = local
+		changed = append(changed, local)
+	}
+	s.mu.Unlock()
+
+	if len(changed) == 0 {
+		return nil
+	}
+	return s.db.saveFiles(f.id, f.root, changed)
+}
+
+// applyDeletion deletes a file that a peer has deleted, keeping it as a version
+// if the folder keeps them, and records the tombstone.
+func (s *syncer) applyDeletion(f *folder, info fileInfo) error {
+	if !filepath.IsLocal(filepath.FromSlash(info.Path)) {
+		return fmt.Errorf("refusing to delete outside folder: %q", info.Path)
+	}
+
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+
+	if err := s.archiveVersion(f, info.Path); err != nil {
+		return err
+	}
+	target := filepath.Join(f.root, filepath.FromSlash(info.Path))
+	if err := os.Remove(target); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	removeEmptyParents(f.root, info.Path)
+	if err := s.db.saveFiles(f.id, f.root, []fileInfo{info}); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	f.index[info.Path] = info
+	s.mu.Unlock()
+
+	s.logger.Printf("deleted %s", info.Path)
+	return nil
+}
+
+func (s *syncer) handleRequest(sess *session, req *protocol.Request) error {
+	s.mu.Lock()
+	paused := s.paused
+	var info fileInfo
+	var root string
+	f, ok := s.folders[req.Folder]
+	if ok {
+		ok = f.sharedWith(sess.peer.deviceID)
+	}
+	if ok {
+		root = f.root
+		info, ok = f.index[req.Path]
+	}
+	s.mu.Unlock()
+
+	if paused {
+		return sess.enc.Encode(protocol.Response{ID: req.ID, Error: "sync paused"})
+	}
+	if !ok || info.Deleted {
+		return sess.enc.Encode(protocol.Response{ID: req.ID, Error: "file not found"})
+	}
+	if info.Hash != req.Hash {
+		return sess.enc.Encode(protocol.Response{ID: req.ID, Error: "file has changed"})
+	}
+
+	if req.Offset < 0 || req.Size < 0 || req.Size > maxBlockSize || req.Offset+int64(req.Size) > info.Size {
+		return sess.enc.Encode(protocol.Response{ID: req.ID, Error: "invalid range"})
+	}
+
+	file, err := os.Open(filepath.Join(root, filepath.FromSlash(req.Path)))
+	if err != nil {
+		return sess.enc.Encode(protocol.Response{ID: req.ID, Error: err.Error()})
+	}
+	defer file.Close()
+
+	data := make([]byte, req.Size)
+	if _, err := file.ReadAt(data, req.Offset); err != nil {
+		return sess.enc.Encode(protocol.Response{ID: req.ID, Error: err.Error()})
+	}
+
+	return sess.enc.Encode(protocol.Response{ID: req.ID, Data: data, Incompressible: compressedFormat(req.Path)})
+}
+
+// handleResponse hands a block received from a peer to the pull it belongs to.
+func (s *syncer) handleResponse(sess *session, resp *protocol.Response) error {
+	return s.handleBlock(sess, resp.ID, resp.Data, resp.Error)
+}
+
+func (sess *session) pingLoop() {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-sess.done:
+			return
+		case <-ticker.C:
+			if err := sess.enc.Encode(protocol.Ping{}); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dantdj/syncmesh/local-client/protocol"
+)
+
+func TestSyncSessionPullsMissingFiles(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	rootA := t.TempDir()
+	rootB := t.TempDir()
+
+	if err := os.WriteFile(filepath.Join(rootA, "from-a.txt"), []byte("alpha"), 0o644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(rootB, "dir"), 0o755); err != nil {
+		t.Fatalf("failed to create dir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(rootB, "dir", "from-b.txt"), []byte("bravo"), 0o644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	a, err := newSyncer(logger, testIndexDB(t), "AAAAAAAA", rootA, folderSendReceive)
+	if err != nil {
+		t.Fatalf("newSyncer returned error: %v", err)
+	}
+	b, err := newSyncer(logger, testIndexDB(t), "BBBBBBBB", rootB, folderSendReceive)
+	if err != nil {
+		t.Fatalf("newSyncer returned error: %v", err)
+	}
+
+	connA, connB := net.Pipe()
+	go a.runSession(connA, remotePeer{deviceID: "device-b", clientID: "client-b"})
+	go b.runSession(connB, remotePeer{deviceID: "device-a", clientID: "client-a"})
+	t.Cleanup(func() {
+		connA.Close()
+		connB.Close()
+	})
+
+	waitForFile(t, filepath.Join(rootB, "from-a.txt"), "alpha")
+	waitForFile(t, filepath.Join(rootA, "dir", "from-b.txt"), "bravo")
+}
+
+func TestSyncSessionSyncsAddedFolders(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	a, err := newSyncer(logger, testIndexDB(t), "AAAAAAAA", t.TempDir(), folderSendReceive)
+	if err != nil {
+		t.Fatalf("newSyncer returned error: %v", err)
+	}
+	b, err := newSyncer(logger, testIndexDB(t), "BBBBBBBB", t.TempDir(), folderSendReceive)
+	if err != nil {
+		t.Fatalf("newSyncer returned error: %v", err)
+	}
+
+	photosA := t.TempDir()
+	if err := os.WriteFile(filepath.Join(photosA, "cat.jpg"), []byte("meow"), 0o644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	if err := a.addFolder("photos", photosA, folderSendReceive, versioningConfig{Type: versioningNone}, nil); err != nil {
+		t.Fatalf("addFolder returned error: %v", err)
+	}
+
+	connA, connB := net.Pipe()
+	go a.runSession(connA, remotePeer{deviceID: "device-b", clientID: "client-b"})
+	go b.runSession(connB, remotePeer{deviceID: "device-a", clientID: "client-a"})
+	t.Cleanup(func() {
+		connA.Close()
+		connB.Close()
+	})
+
+	// b only starts syncing the folder after a's index for it has arrived.
+	time.Sleep(100 * time.Millisecond)
+	photosB := filepath.Join(t.TempDir(), "photos")
+	if err := b.addFolder("photos", photosB, folderSendReceive, versioningConfig{Type: versioningNone}, nil); err != nil {
+		t.Fatalf("addFolder returned error: %v", err)
+	}
+
+	waitForFile(t, filepath.Join(photosB, "cat.jpg"), "meow")
+}
+
+func TestFolderSyncsOnlyWithItsPeers(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	a, err := newSyncer(logger, testIndexDB(t), "AAAAAAAA", t.TempDir(), folderSendReceive)
+	if err != nil {
+		t.Fatalf("newSyncer returned error: %v", err)
+	}
+	b, err := newSyncer(logger, testIndexDB(t), "BBBBBBBB", t.TempDir(), folderSendReceive)
+	if err != nil {
+		t.Fatalf("newSyncer returned error: %v", err)
+	}
+
+	privateA := t.TempDir()
+	privateB := t.TempDir()
+	if err := os.WriteFile(filepath.Join(privateA, "diary.txt"), []byte("dear diary"), 0o644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	if err := a.addFolder("private", privateA, folderSendReceive, versioningConfig{Type: versioningNone}, []string{"device-c"}); err != nil {
+		t.Fatalf("addFolder returned error: %v", err)
+	}
+	if err := b.addFolder("private", privateB, folderSendReceive, versioningConfig{Type: versioningNone}, nil); err != nil {
+		t.Fatalf("addFolder returned error: %v", err)
+	}
+
+	connA, connB := net.Pipe()
+	go a.runSession(connA, remotePeer{deviceID: "device-b", clientID: "client-b"})
+	go b.runSession(connB, remotePeer{deviceID: "device-a", clientID: "client-a"})
+	t.Cleanup(func() {
+		connA.Close()
+		connB.Close()
+	})
+
+	time.Sleep(200 * time.Millisecond)
+	if _, err := os.Stat(filepath.Join(privateB, "diary.txt")); !os.IsNotExist(err) {
+		t.Fatalf("expected a folder not shared with the peer to stay private, got %v", err)
+	}
+
+	if err := a.setFolderPeers("private", []string{"device-c", "device-b"}); err != nil {
+		t.Fatalf("setFolderPeers returned error: %v", err)
+	}
+	waitForFile(t, filepath.Join(privateB, "diary.txt"), "dear diary")
+}
+
+func TestPausedSyncerCatchesUpOnResume(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	rootA := t.TempDir()
+	rootB := t.TempDir()
+	if err := os.WriteFile(filepath.Join(rootA, "note.txt"), []byte("later"), 0o644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	a, err := newSyncer(logger, testIndexDB(t), "AAAAAAAA", rootA, folderSendReceive)
+	if err != nil {
+		t.Fatalf("newSyncer returned error: %v", err)
+	}
+	b, err := newSyncer(logger, testIndexDB(t), "BBBBBBBB", rootB, folderSendReceive)
+	if err != nil {
+		t.Fatalf("newSyncer returned error: %v", err)
+	}
+	b.setPaused(true)
+
+	connA, connB := net.Pipe()
+	go a.runSession(connA, remotePeer{deviceID: "device-b", clientID: "client-b"})
+	go b.runSession(connB, remotePeer{deviceID: "device-a", clientID: "client-a"})
+	t.Cleanup(func() {
+		connA.Close()
+		connB.Close()
+	})
+
+	time.Sleep(200 * time.Millisecond)
+	if _, err := os.Stat(filepath.Join(rootB, "note.txt")); !os.IsNotExist(err) {
+		t.Fatalf("expected nothing to be pulled while paused, got %v", err)
+	}
+
+	b.setPaused(false)
+	waitForFile(t, filepath.Join(rootB, "note.txt"), "later")
+}
+
+func TestSyncSessionPropagatesDeletions(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	rootA := t.TempDir()
+	rootB := t.TempDir()
+	for _, root := range []string{rootA, rootB} {
+		if err := os.WriteFile(filepath.Join(root, "shared.txt"), []byte("both"), 0o644); err != nil {
+			t.Fatalf("failed to write file: %v", err)
+		}
+	}
+
+	a, err := newSyncer(logger, testIndexDB(t), "AAAAAAAA", rootA, folderSendReceive)
+	if err != nil {
+		t.Fatalf("newSyncer returned error: %v", err)
+	}
+	b, err := newSyncer(logger, testIndexDB(t), "BBBBBBBB", rootB, folderSendReceive)
+	if err != nil {
+		t.Fatalf("newSyncer returned error: %v", err)
+	}
+
+	connA, connB := net.Pipe()
+	go a.runSession(connA, remotePeer{deviceID: "device-b", clientID: "client-b"})
+	go b.runSession(connB, remotePeer{deviceID: "device-a", clientID: "client-a"})
+	t.Cleanup(func() {
+		connA.Close()
+		connB.Close()
+	})
+
+	// Let the two settle on a common version of the file before deleting it.
+	time.Sleep(200 * time.Millisecond)
+	if err := os.Remove(filepath.Join(rootA, "shared.txt")); err != nil {
+		t.Fatalf("failed to remove file: %v", err)
+	}
+	if err := a.rescan(); err != nil {
+		t.Fatalf("rescan returned error: %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(filepath.Join(rootB, "shared.txt")); os.IsNotExist(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the deletion to reach the peer")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestSyncerRemembersDeletionsAcrossRestarts(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	root := t.TempDir()
+	db := testIndexDB(t)
+
+	if err := os.WriteFile(filepath.Join(root, "a.txt"), []byte("hello"), 0o644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	if _, err := newSyncer(logger, db, "AAAAAAAA", root, folderSendReceive); err != nil {
+		t.Fatalf("newSyncer returned error: %v", err)
+	}
+
+	// Deleted while the client wasn't running.
+	if err := os.Remove(filepath.Join(root, "a.txt")); err != nil {
+		t.Fatalf("failed to remove file: %v", err)
+	}
+
+	s, err := newSyncer(logger, db, "AAAAAAAA", root, folderSendReceive)
+	if err != nil {
+		t.Fatalf("newSyncer returned error: %v", err)
+	}
+
+	update := s.indexUpdate(defaultFolderID)
+	if len(update.Files) != 1 || !update.Files[0].Deleted || update.Files[0].Version["AAAAAAA"] != 2 {
+		t.Fatalf("expected a.txt to be advertised as deleted, got %+v", update.Files)
+	}
+}
+
+func waitForFile(t *testing.T, path, want string) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		data, err := os.ReadFile(path)
+		if err == nil && string(data) == want {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %s", path)
+}
+
+func TestSyncSessionDropsRequestsBeyondLimit(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	s, err := newSyncer(logger, testIndexDB(t), "AAAAAAAA", t.TempDir(), folderSendReceive)
+	if err != nil {
+		t.Fatalf("newSyncer returned error: %v", err)
+	}
+
+	conn, peerConn := net.Pipe()
+	go s.runSession(conn, remotePeer{deviceID: "device-b", clientID: "client-b"})
+	t.Cleanup(func() { peerConn.Close() })
+
+	enc := protocol.NewEncoder(peerConn)
+	dec := protocol.NewDecoder(peerConn)
+	if _, err := dec.Decode(); err != nil {
+		t.Fatalf("failed to read hello: %v", err)
+	}
+	if err := enc.Encode(protocol.Hello{DeviceName: "client-b", ClientVersion: clientVersion}); err != nil {
+		t.Fatalf("failed to send hello: %v", err)
+	}
+
+	// Nothing is read while the requests go out, so every answer stays
+	// pending and the syncer has to stop accepting more.
+	sent := maxQueuedRequests + 20
+	for i := range sent {
+		if err := enc.Encode(protocol.Request{ID: uint64(i), Folder: defaultFolderID, Path: "missing.txt"}); err != nil {
+			t.Fatalf("failed to send request: %v", err)
+		}
+	}
+
+	answered := 0
+	for {
+		_ = peerConn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		msg, err := dec.Decode()
+		if err != nil {
+			break
+		}
+		if _, ok := msg.(*protocol.Response); ok {
+			answered++
+		}
+	}
+	if answered != maxQueuedRequests {
+		t.Fatalf("expected %d of %d requests to be answered, got %d", maxQueuedRequests, sent, answered)
+	}
+}
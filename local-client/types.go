@@ -1,13 +1,28 @@
 package main
 
+import "time"
+
+type challengeResponse struct {
+	Status string `json:"status"`
+	Nonce  string `json:"nonce"`
+	Error  string `json:"error"`
+}
+
 type registerRequest struct {
-	LocalIP   string `json:"localIp"`
-	LocalPort int    `json:"localPort"`
+	Groups        []string `json:"groups,omitempty"`
+	LocalIP       string   `json:"localIp"`
+	LocalPort     int      `json:"localPort"`
+	ReflexiveIP   string   `json:"reflexiveIp,omitempty"`
+	ReflexivePort int      `json:"reflexivePort,omitempty"`
+	PublicKey     string   `json:"publicKey"`
+	Nonce         string   `json:"nonce"`
+	Signature     string   `json:"signature"`
 }
 
 type registerResponse struct {
 	Status   string `json:"status"`
 	ClientID string `json:"clientId"`
+	Token    string `json:"token"`
 	Error    string `json:"error"`
 }
 
@@ -18,9 +33,55 @@ type discoverResponse struct {
 }
 
 type clientSnapshot struct {
-	ClientID   string `json:"clientId"`
-	PublicIP   string `json:"publicIp"`
-	PublicPort int    `json:"publicPort"`
-	LocalIP    string `json:"localIp"`
-	LocalPort  int    `json:"localPort"`
+	ClientID      string   `json:"clientId"`
+	Groups        []string `json:"groups"`
+	PublicIP      string   `json:"publicIp"`
+	PublicPort    int      `json:"publicPort"`
+	LocalIP       string   `json:"localIp"`
+	LocalPort     int      `json:"localPort"`
+	ReflexiveIP   string   `json:"reflexiveIp"`
+	ReflexivePort int      `json:"reflexivePort"`
+}
+
+// Peer event types sent on the signalling server's event stream.
+const (
+	eventPeerJoined         = "peer-joined"
+	eventPeerLeft           = "peer-left"
+	eventPeerAddressChanged = "peer-address-changed"
+	eventPunchRequested     = "punch-requested"
+	eventRelayRequested     = "relay-requested"
+)
+
+type peerEvent struct {
+	Type    string         `json:"type"`
+	Client  clientSnapshot `json:"client"`
+	StartAt time.Time      `json:"startAt"`
+	Relay   *relayTicket   `json:"relay"`
+}
+
+type punchRequest struct {
+	PeerID string `json:"peerId"`
+}
+
+type punchResponse struct {
+	Status  string         `json:"status"`
+	Peer    clientSnapshot `json:"peer"`
+	StartAt time.Time      `json:"startAt"`
+	Error   string         `json:"error"`
+}
+
+type relayRequest struct {
+	PeerID string `json:"peerId"`
+}
+
+// relayTicket lets one side of a relay session join it.
+type relayTicket struct {
+	Address string `json:"address"`
+	Ticket  string `json:"ticket"`
+}
+
+type relayResponse struct {
+	Status string      `json:"status"`
+	Relay  relayTicket `json:"relay"`
+	Error  string      `json:"error"`
 }
@@ -0,0 +1,71 @@
+package main
+
+import "maps"
+
+// versionVector records, for every device that has changed a file, how many
+// changes it has made. Comparing two vectors tells whether one version of a
+// file descends from the other or whether they were changed independently.
+type versionVector map[string]uint64
+
+// ordering is the result of comparing two version vectors.
+type ordering int
+
+const (
+	orderEqual ordering = iota
+	// orderNewer means the vector descends from the other one.
+	orderNewer
+	// orderOlder means the other vector descends from this one.
+	orderOlder
+	// orderConcurrent means each vector has changes the other lacks.
+	orderConcurrent
+)
+
+// update returns a copy of v with device's counter incremented, recording a
+// change made by that device.
+func (v versionVector) update(device string) versionVector {
+	next := maps.Clone(v)
+	if next == nil {
+		next = make(versionVector)
+	}
+	next[device]++
+	return next
+}
+
+// compare reports how v relates to other.
+func (v versionVector) compare(other versionVector) ordering {
+	newer, older := false, false
+	for device, n := range v {
+		if n > other[device] {
+			newer = true
+		}
+	}
+	for device, n := range other {
+		if n > v[device] {
+			older = true
+		}
+	}
+
+	switch {
+	case newer && older:
+		return orderConcurrent
+	case newer:
+		return orderNewer
+	case older:
+		return orderOlder
+	default:
+		return orderEqual
+	}
+}
+
+// merge returns a vector that descends from both v and other, holding the
+// larger of their counters for each device.
+func (v versionVector) merge(other versionVector) versionVector {
+	merged := maps.Clone(v)
+	if merged == nil {
+		merged = make(versionVector)
+	}
+	for device, n := range other {
+		merged[device] = max(merged[device], n)
+	}
+	return merged
+}
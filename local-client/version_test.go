@@ -0,0 +1,55 @@
+package main
+
+import "testing"
+
+func TestVersionVectorUpdate(t *testing.T) {
+	var v versionVector
+
+	first := v.update("AAAAAAA")
+	second := first.update("AAAAAAA").update("BBBBBBB")
+
+	if first["AAAAAAA"] != 1 || len(first) != 1 {
+		t.Fatalf("expected update not to modify its receiver, got %v", first)
+	}
+	if second["AAAAAAA"] != 2 || second["BBBBBBB"] != 1 {
+		t.Fatalf("unexpected vector %v", second)
+	}
+}
+
+func TestVersionVectorCompare(t *testing.T) {
+	base := versionVector{"AAAAAAA": 1}
+	ours := base.update("AAAAAAA")
+	theirs := base.update("BBBBBBB")
+
+	if got := base.compare(versionVector{"AAAAAAA": 1}); got != orderEqual {
+		t.Errorf("expected equal vectors, got %d", got)
+	}
+	if got := (versionVector{}).compare(nil); got != orderEqual {
+		t.Errorf("expected empty and nil vectors to be equal, got %d", got)
+	}
+	if got := ours.compare(base); got != orderNewer {
+		t.Errorf("expected a descendant to be newer, got %d", got)
+	}
+	if got := base.compare(theirs); got != orderOlder {
+		t.Errorf("expected an ancestor to be older, got %d", got)
+	}
+	if got := ours.compare(theirs); got != orderConcurrent {
+		t.Errorf("expected independent changes to be concurrent, got %d", got)
+	}
+}
+
+func TestVersionVectorMerge(t *testing.T) {
+	ours := versionVector{"AAAAAAA": 2, "BBBBBBB": 1}
+	theirs := versionVector{"BBBBBBB": 3, "CCCCCCC": 1}
+
+	merged := ours.merge(theirs)
+	if merged.compare(ours) != orderNewer || merged.compare(theirs) != orderNewer {
+		t.Fatalf("expected the merge to descend from both vectors, got %v", merged)
+	}
+	if merged["AAAAAAA"] != 2 || merged["BBBBBBB"] != 3 || merged["CCCCCCC"] != 1 {
+		t.Fatalf("unexpected merged vector %v", merged)
+	}
+	if len(ours) != 2 {
+		t.Fatalf("expected merge not to modify its receiver, got %v", ours)
+	}
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// A folder can keep the copies of files that syncing replaces or deletes, so
+// that a bad change made on another device can be undone. Old copies are moved
+// into .syncmesh/versions, under the same relative path with the time they
+// were replaced added to the name, and thinned out by one of these strategies:
+//
+//   - trashcan keeps the latest copy of each file for a number of days.
+//   - simple keeps the last few copies of each file.
+//   - staggered keeps one copy every 30 seconds for the last hour, one an hour
+//     for the last day, one a day for the last 30 days and one a week after
+//     that, up to a maximum age.
+//
+// Nothing under .syncmesh is ever scanned or synced.
+
+const (
+	// folderDataDir holds the client's own data within a folder.
+	folderDataDir = ".syncmesh"
+	versionsDir   = folderDataDir + "/versions"
+
+	versionTimeFormat = "20060102-150405"
+
+	versioningNone      = "none"
+	versioningTrashcan  = "trashcan"
+	versioningSimple    = "simple"
+	versioningStaggered = "staggered"
+
+	// defaultVersionsKept is how many copies simple versioning keeps if not
+	// told otherwise.
+	defaultVersionsKept = 5
+	// versionCleanInterval is how often old versions are thinned out, for the
+	// strategies that expire them with age.
+	versionCleanInterval = time.Hour
+)
+
+var errVersionNotFound = errors.New("version not found")
+
+// versionNamePattern matches the name of an old copy, capturing the stem of
+// the original name, the time and the original extension.
+var versionNamePattern = regexp.MustCompile(`^(.*)~(\d{8}-\d{6})(.*)$`)
+
+// staggeredIntervals are the spans of age in which staggered versioning keeps
+// one copy every step. Copies older than the last span keep one every week.
+var staggeredIntervals = []struct {
+	until time.Duration
+	step  time.Duration
+}{
+	{time.Hour, 30 * time.Second},
+	{24 * time.Hour, time.Hour},
+	{30 * 24 * time.Hour, 24 * time.Hour},
+}
+
+// versioningConfig is how a folder keeps old copies of files.
+type versioningConfig struct {
+	// Type is none, trashcan, simple or staggered.
+	Type string `json:"type"`
+	// Keep is how many copies of each file simple versioning keeps.
+	Keep int `json:"keep,omitempty"`
+	// MaxAgeDays is how long trashcan and staggered versioning keep copies
+	// for. Zero keeps them forever.
+	MaxAgeDays int `json:"maxAgeDays,omitempty"`
+}
+
+// fileVersion is an old copy of a file.
+type fileVersion struct {
+	Folder string    `json:"folder"`
+	Path   string    `json:"path"`
+	Time   time.Time `json:"time"`
+	Size   int64     `json:"size"`
+
+	// name is where the copy is kept, relative to the versions directory.
+	name string
+}
+
+// normalize checks the config and fills in defaults.
+func (c versioningConfig) normalize() (versioningConfig, error) {
+	if c.Keep < 0 || c.MaxAgeDays < 0 {
+		return versioningConfig{}, errors.New("keep and maxAgeDays must not be negative")
+	}
+	switch c.Type {
+	case "", versioningNone:
+		return versioningConfig{Type: versioningNone}, nil
+	case versioningTrashcan, versioningStaggered:
+		c.Keep = 0
+	case versioningSimple:
+		c.MaxAgeDays = 0
+		if c.Keep == 0 {
+			c.Keep = defaultVersionsKept
+		}
+	default:
+		return versioningConfig{}, fmt.Errorf("unknown versioning type %q, must be %s, %s, %s or %s", c.Type, versioningNone, versioningTrashcan, versioningSimple, versioningStaggered)
+	}
+	return c, nil
+}
+
+func (c versioningConfig) enabled() bool {
+	return c.Type != "" && c.Type != versioningNone
+}
+
+// expired returns the copies of a single file, ordered newest first, that the
+// config no longer keeps at now.
+func (c versioningConfig) expired(versions []fileVersion, now time.Time) []fileVersion {
+	maxAge := time.Duration(c.MaxAgeDays) * 24 * time.Hour
+
+	var expired []fileVersion
+	var lastKept time.Time
+	for i, v := range versions {
+		age := now.Sub(v.Time)
+		keep := true
+		switch c.Type {
+		case versioningTrashcan:
+			keep = i == 0 && (maxAge == 0 || age <= maxAge)
+		case versioningSimple:
+			keep = i < c.Keep
+		case versioningStaggered:
+			if maxAge > 0 && age > maxAge {
+				keep = false
+				break
+			}
+			step := 7 * 24 * time.Hour
+			for _, interval := range staggeredIntervals {
+				if age < interval.until {
+					step = interval.step
+					break
+				}
+			}
+			keep = lastKept.IsZero() || lastKept.Sub(v.Time) >= step
+		}
+		if keep {
+			lastKept = v.Time
+		} else {
+			expired = append(expired, v)
+		}
+	}
+	return expired
+}
+
+// versionName returns the name of the copy of the file at p, a slash-separated
+// path, replaced at t.
+func versionName(p string, t time.Time) string {
+	dir, name := path.Split(p)
+	ext := path.Ext(name)
+	if ext == name {
+		ext = ""
+	}
+	stem := strings.TrimSuffix(name, ext)
+	return dir + stem + "~" + t.UTC().Format(versionTimeFormat) + ext
+}
+
+// parseVersionName reports whether name names an old copy and, if so, the path
+// of the file it is a copy of and when it was replaced.
+func parseVersionName(name string) (string, time.Time, bool) {
+	dir, base := path.Split(name)
+	m := versionNamePattern.FindStringSubmatch(base)
+	if m == nil {
+		return "", time.Time{}, false
+	}
+	t, err := time.Parse(versionTimeFormat, m[2])
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	return dir + m[1] + m[3], t, true
+}
+
+// setVersioning changes how folder id keeps old copies of files. Copies kept
+// so far are thinned out to suit.
+func (s *syncer) setVersioning(id string, config versioningConfig) error {
+	s.mu.Lock()
+	f, ok := s.folders[id]
+	if ok {
+		f.versioning = config
+	}
+	s.mu.Unlock()
+	if !ok {
+		return errFolderNotFound
+	}
+
+	s.logger.Printf("folder %s versioning set to %s", id, config.Type)
+	return s.cleanVersions(f, "")
+}
+
+// archiveVersion moves the file at p in f into the versions directory before
+// it is replaced or deleted, if f keeps versions. f's writeMu must be held.
+func (s *syncer) archiveVersion(f *folder, p string) error {
+	s.mu.Lock()
+	config := f.versioning
+	s.mu.Unlock()
+	if !config.enabled() {
+		return nil
+	}
+
+	if err := moveToVersions(f.root, p, time.Now()); err != nil {
+		return err
+	}
+	if err := s.cleanVersions(f, p); err != nil {
+		s.logger.Printf("cleaning old versions of %s in folder %s failed: %v", p, f.id, err)
+	}
+	return nil
+}
+
+// moveToVersions moves the file at p, a slash-separated path relative to
+// root, into the versions directory as replaced at t. A missing file is left
+// alone.
+func moveToVersions(root, p string, t time.Time) error {
+	if !filepath.IsLocal(filepath.FromSlash(p)) {
+		return fmt.Errorf("refusing to archive outside folder: %q", p)
+	}
+
+	src := filepath.Join(root, filepath.FromSlash(p))
+	info, err := os.Lstat(src)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+
+	dst := filepath.Join(root, filepath.FromSlash(versionsDir), filepath.FromSlash(versionName(p, t)))
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	return os.Rename(src, dst)
+}
+
+// versions lists the old copies kept in folder id of the file at p, or of
+// every file if p is empty, ordered by path and then newest first.
+func (s *syncer) versions(id, p string) ([]fileVersion, error) {
+	s.mu.Lock()
+	f, ok := s.folders[id]
+	s.mu.Unlock()
+	if !ok {
+		return nil, errFolderNotFound
+	}
+	return listVersions(f, p)
+}
+
+func listVersions(f *folder, p string) ([]fileVersion, error) {
+	root := filepath.Join(f.root, filepath.FromSlash(versionsDir))
+	start := root
+	if p != "" {
+		start = filepath.Join(root, filepath.FromSlash(path.Dir(p)))
+	}
+
+	versions := []fileVersion{}
+	err := filepath.WalkDir(start, func(walked string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && p != "" && walked != start {
+			return filepath.SkipDir
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, walked)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		original, t, ok := parseVersionName(name)
+		if !ok || (p != "" && original != p) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		versions = append(versions, fileVersion{Folder: f.id, Path: original, Time: t, Size: info.Size(), name: name})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	slices.SortFunc(versions, func(a, b fileVersion) int {
+		if c := strings.Compare(a.Path, b.Path); c != 0 {
+			return c
+		}
+		return b.Time.Compare(a.Time)
+	})
+	return versions, nil
+}
+
+// cleanVersions deletes the old copies of the file at p in f, or of every file
+// if p is empty, that its versioning no longer keeps. Copies are left alone
+// if versioning is off.
+func (s *syncer) cleanVersions(f *folder, p string) error {
+	s.mu.Lock()
+	config := f.versioning
+	s.mu.Unlock()
+	if !config.enabled() {
+		return nil
+	}
+
+	versions, err := listVersions(f, p)
+	if err != nil {
+		return err
+	}
+
+	root := filepath.Join(f.root, filepath.FromSlash(versionsDir))
+	now := time.Now()
+	for start := 0; start < len(versions); {
+		end := start + 1
+		for end < len(versions) && versions[end].Path == versions[start].Path {
+			end++
+		}
+		group := versions[start:end]
+		start = end
+
+		for _, v := range config.expired(group, now) {
+			if err := os.Remove(filepath.Join(root, filepath.FromSlash(v.name))); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+			removeEmptyParents(root, v.name)
+		}
+	}
+	return nil
+}
+
+// cleanVersionsLoop thins out the old copies in f on every tick until the
+// folder is removed.
+func (s *syncer) cleanVersionsLoop(f *folder, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-f.stop:
+			return
+		case <-ticker.C:
+			if err := s.cleanVersions(f, ""); err != nil {
+				s.logger.Printf("cleaning old versions in folder %s failed: %v", f.id, err)
+			}
+		}
+	}
+}
+
+// restoreVersion puts back the copy of the file at p in folder id that was
+// replaced at t. The file it replaces is kept as a version in turn, so that
+// the restore can be undone, and the change is synced like any other.
+func (s *syncer) restoreVersion(id, p string, t time.Time) error {
+	if !filepath.IsLocal(filepath.FromSlash(p)) {
+		return fmt.Errorf("refusing to restore outside folder: %q", p)
+	}
+
+	s.mu.Lock()
+	f, ok := s.folders[id]
+	s.mu.Unlock()
+	if !ok {
+		return errFolderNotFound
+	}
+
+	if err := s.putBackVersion(f, p, t); err != nil {
+		return err
+	}
+	s.logger.Printf("restored %s in folder %s to its version from %s", p, id, t.UTC().Format(time.RFC3339))
+
+	return s.rescanPaths(id, []string{p})
+}
+
+func (s *syncer) putBackVersion(f *folder, p string, t time.Time) error {
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+
+	versions, err := listVersions(f, p)
+	if err != nil {
+		return err
+	}
+	i := slices.IndexFunc(versions, func(v fileVersion) bool { return v.Time.Equal(t.Truncate(time.Second)) })
+	if i < 0 {
+		return errVersionNotFound
+	}
+
+	// The copy is moved out of the way first, since the file it replaces may
+	// be archived under the same name.
+	target := filepath.Join(f.root, filepath.FromSlash(p))
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return err
+	}
+	staged := filepath.Join(filepath.Dir(target), tempFilePrefix+path.Base(p))
+	if err := os.Rename(filepath.Join(f.root, filepath.FromSlash(versionsDir), filepath.FromSlash(versions[i].name)), staged); err != nil {
+		return err
+	}
+	if err := moveToVersions(f.root, p, time.Now()); err != nil {
+		return err
+	}
+	if err := os.Rename(staged, target); err != nil {
+		return err
+	}
+	removeEmptyParents(filepath.Join(f.root, filepath.FromSlash(versionsDir)), versions[i].name)
+
+	// The restored file is a new change, so it must not look untouched to
+	// the scanner.
+	now := time.Now()
+	return os.Chtimes(target, now, now)
+}
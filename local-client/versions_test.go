@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestVersionNames(t *testing.T) {
+	at := time.Date(2026, 2, 3, 20, 3, 11, 0, time.UTC)
+
+	name := versionName("docs/report.final.pdf", at)
+	if name != "docs/report.final~20260203-200311.pdf" {
+		t.Fatalf("unexpected version name %q", name)
+	}
+	original, when, ok := parseVersionName(name)
+	if !ok || original != "docs/report.final.pdf" || !when.Equal(at) {
+		t.Fatalf("expected the name to parse back, got %q, %v, %v", original, when, ok)
+	}
+
+	if name := versionName(".bashrc", at); name != ".bashrc~20260203-200311" {
+		t.Fatalf("expected a dotfile to keep its whole name, got %q", name)
+	}
+	if _, _, ok := parseVersionName("notes.txt"); ok {
+		t.Fatal("expected an ordinary name not to parse")
+	}
+}
+
+func TestVersioningExpiry(t *testing.T) {
+	now := time.Date(2026, 2, 3, 20, 0, 0, 0, time.UTC)
+	versionsAt := func(ages ...time.Duration) []fileVersion {
+		var versions []fileVersion
+		for _, age := range ages {
+			versions = append(versions, fileVersion{Path: "a.txt", Time: now.Add(-age)})
+		}
+		return versions
+	}
+	day := 24 * time.Hour
+
+	simple := versioningConfig{Type: versioningSimple, Keep: 2}
+	expired := simple.expired(versionsAt(time.Minute, time.Hour, day, 2*day), now)
+	if len(expired) != 2 || !expired[0].Time.Equal(now.Add(-day)) {
+		t.Fatalf("expected simple versioning to keep the newest 2, expired %+v", expired)
+	}
+
+	trashcan := versioningConfig{Type: versioningTrashcan, MaxAgeDays: 7}
+	if expired := trashcan.expired(versionsAt(time.Hour, 2*time.Hour), now); len(expired) != 1 || !expired[0].Time.Equal(now.Add(-2*time.Hour)) {
+		t.Fatalf("expected the trash can to keep only the latest copy, expired %+v", expired)
+	}
+	if expired := trashcan.expired(versionsAt(8*day), now); len(expired) != 1 {
+		t.Fatalf("expected the trash can to empty after 7 days, expired %+v", expired)
+	}
+
+	staggered := versioningConfig{Type: versioningStaggered, MaxAgeDays: 365}
+	expired = staggered.expired(versionsAt(
+		10*time.Second, 20*time.Second, 50*time.Second,
+		2*time.Hour, 150*time.Minute,
+		40*day, 41*day,
+		400*day,
+	), now)
+	var ages []time.Duration
+	for _, v := range expired {
+		ages = append(ages, now.Sub(v.Time))
+	}
+	if len(ages) != 4 || ages[0] != 20*time.Second || ages[1] != 150*time.Minute || ages[2] != 41*day || ages[3] != 400*day {
+		t.Fatalf("expected staggered versioning to thin out close copies, expired copies aged %v", ages)
+	}
+
+	if _, err := (versioningConfig{Type: "forever"}).normalize(); err == nil {
+		t.Fatal("expected an unknown versioning type to be rejected")
+	}
+	if config, err := (versioningConfig{Type: versioningSimple}).normalize(); err != nil || config.Keep != defaultVersionsKept {
+		t.Fatalf("expected simple versioning to keep %d copies by default, got %+v, %v", defaultVersionsKept, config, err)
+	}
+}
+
+func TestSyncSessionKeepsReplacedVersions(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	rootA := t.TempDir()
+	rootB := t.TempDir()
+	for _, name := range []string{"notes.txt", "old.txt"} {
+		if err := os.WriteFile(filepath.Join(rootA, name), []byte("original "+name), 0o644); err != nil {
+			t.Fatalf("failed to write file: %v", err)
+		}
+	}
+
+	a, err := newSyncer(logger, testIndexDB(t), "AAAAAAAA", rootA, folderSendReceive)
+	if err != nil {
+		t.Fatalf("newSyncer returned error: %v", err)
+	}
+	b, err := newSyncer(logger, testIndexDB(t), "BBBBBBBB", rootB, folderSendReceive)
+	if err != nil {
+		t.Fatalf("newSyncer returned error: %v", err)
+	}
+	if err := b.setVersioning(defaultFolderID, versioningConfig{Type: versioningSimple, Keep: 5}); err != nil {
+		t.Fatalf("setVersioning returned error: %v", err)
+	}
+
+	connA, connB := net.Pipe()
+	go a.runSession(connA, remotePeer{deviceID: "device-b", clientID: "client-b"})
+	go b.runSession(connB, remotePeer{deviceID: "device-a", clientID: "client-a"})
+	t.Cleanup(func() {
+		connA.Close()
+		connB.Close()
+	})
+	waitForFile(t, filepath.Join(rootB, "notes.txt"), "original notes.txt")
+	waitForFile(t, filepath.Join(rootB, "old.txt"), "original old.txt")
+
+	if err := os.WriteFile(filepath.Join(rootA, "notes.txt"), []byte("overwritten"), 0o644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	if err := os.Remove(filepath.Join(rootA, "old.txt")); err != nil {
+		t.Fatalf("failed to remove file: %v", err)
+	}
+	if err := a.rescan(); err != nil {
+		t.Fatalf("rescan returned error: %v", err)
+	}
+	waitForFile(t, filepath.Join(rootB, "notes.txt"), "overwritten")
+	waitForRemoval(t, filepath.Join(rootB, "old.txt"))
+
+	versions, err := b.versions(defaultFolderID, "")
+	if err != nil {
+		t.Fatalf("versions returned error: %v", err)
+	}
+	if len(versions) != 2 || versions[0].Path != "notes.txt" || versions[1].Path != "old.txt" {
+		t.Fatalf("expected a version of each file, got %+v", versions)
+	}
+	data, err := os.ReadFile(filepath.Join(rootB, filepath.FromSlash(versionsDir), versions[0].name))
+	if err != nil || string(data) != "original notes.txt" {
+		t.Fatalf("expected the version to hold the replaced content, got %q, %v", data, err)
+	}
+
+	// Restoring is a local change like any other, so it syncs back.
+	if err := b.restoreVersion(defaultFolderID, "notes.txt", versions[0].Time); err != nil {
+		t.Fatalf("restoreVersion returned error: %v", err)
+	}
+	waitForFile(t, filepath.Join(rootB, "notes.txt"), "original notes.txt")
+	waitForFile(t, filepath.Join(rootA, "notes.txt"), "original notes.txt")
+
+	remaining, err := b.versions(defaultFolderID, "notes.txt")
+	if err != nil {
+		t.Fatalf("versions returned error: %v", err)
+	}
+	if len(remaining) != 1 {
+		t.Fatalf("expected the replaced file to be kept in turn, got %+v", remaining)
+	}
+
+	if err := b.restoreVersion(defaultFolderID, "notes.txt", time.Unix(0, 0)); !errors.Is(err, errVersionNotFound) {
+		t.Fatalf("expected errVersionNotFound, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(rootA, folderDataDir)); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected versions not to be synced, got %v", err)
+	}
+}
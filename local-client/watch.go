@@ -0,0 +1,247 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Folders are watched for changes rather than walked constantly. Events are
+// coalesced until the folder has been quiet for a moment, and then only the
+// paths they named are rescanned. inotify watches a single directory, so every
+// directory in the folder is watched, including ones created later. If the
+// kernel drops events the whole folder is rescanned, and a slow periodic full
+// scan catches anything missed some other way.
+
+const (
+	// watchDelay is how long a folder must be quiet after a change before it
+	// is rescanned, so that a burst of writes leads to one rescan.
+	watchDelay = time.Second
+	// watchMaxDelay bounds how long a folder that never goes quiet can put off
+	// its rescan.
+	watchMaxDelay = 10 * watchDelay
+	// fallbackScanInterval is how often a folder that can't be watched is
+	// scanned instead.
+	fallbackScanInterval = 10 * time.Second
+)
+
+// folderWatcher rescans a folder whenever it changes.
+type folderWatcher struct {
+	logger   *log.Logger
+	syncer   *syncer
+	folder   *folder
+	watcher  *fsnotify.Watcher
+	delay    time.Duration
+	maxDelay time.Duration
+
+	// dirty holds the paths changed since the last rescan, relative to the
+	// folder root. full means the whole folder needs rescanning instead.
+	dirty map[string]struct{}
+	full  bool
+	// since is when the oldest change waiting for a rescan happened.
+	since time.Time
+}
+
+func newFolderWatcher(logger *log.Logger, s *syncer, f *folder) (*folderWatcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	w := &folderWatcher{
+		logger:   logger,
+		syncer:   s,
+		folder:   f,
+		watcher:  watcher,
+		delay:    watchDelay,
+		maxDelay: watchMaxDelay,
+		dirty:    make(map[string]struct{}),
+	}
+	if err := w.watchTree(f.root); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// watchTree watches dir and every directory below it, except ignored ones.
+func (w *folderWatcher) watchTree(dir string) error {
+	ignores := w.ignores()
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// The directory may have gone again already, which its own
+			// event will deal with.
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if rel, err := filepath.Rel(w.folder.root, path); err == nil && rel != "." && ignores.ignored(filepath.ToSlash(rel), true) {
+			return filepath.SkipDir
+		}
+		if err := w.watcher.Add(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	})
+}
+
+// run handles events until stop is closed, rescanning the whole folder every
+// fullScan as well.
+func (w *folderWatcher) run(fullScan time.Duration, stop <-chan struct{}) {
+	defer w.watcher.Close()
+
+	settle := time.NewTimer(w.delay)
+	settle.Stop()
+	ticker := time.NewTicker(fullScan)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			settle.Stop()
+			return
+
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			if w.handle(event) {
+				settle.Reset(w.wait())
+			}
+
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			if errors.Is(err, fsnotify.ErrEventOverflow) {
+				w.logger.Printf("watcher for folder %s overflowed, rescanning it", w.folder.id)
+				w.markFull()
+				settle.Reset(w.wait())
+				continue
+			}
+			w.logger.Printf("watcher for folder %s failed: %v", w.folder.id, err)
+
+		case <-settle.C:
+			w.flush()
+
+		case <-ticker.C:
+			w.markFull()
+			w.flush()
+		}
+	}
+}
+
+// handle records the path an event names as changed, and starts watching
+// directories as they appear. It reports whether the event needs a rescan.
+func (w *folderWatcher) handle(event fsnotify.Event) bool {
+	if event.Op == fsnotify.Chmod && !w.isFile(event.Name) {
+		return false
+	}
+	if strings.HasPrefix(filepath.Base(event.Name), tempFilePrefix) {
+		return false
+	}
+
+	rel, err := filepath.Rel(w.folder.root, event.Name)
+	if err != nil || !filepath.IsLocal(rel) {
+		return false
+	}
+	rel = filepath.ToSlash(rel)
+
+	ignores := w.ignores()
+	if ignores.readsFrom(event.Name) {
+		// The ignore patterns have changed, which can change what's synced
+		// anywhere in the folder.
+		w.markFull()
+		return true
+	}
+	if ignores.ignored(rel, w.isDir(event.Name)) {
+		return false
+	}
+
+	if event.Has(fsnotify.Create) {
+		if w.isDir(event.Name) {
+			// Anything created in the directory before it was watched is
+			// picked up by rescanning the directory as a whole.
+			if err := w.watchTree(event.Name); err != nil {
+				w.logger.Printf("watching %s failed, rescanning folder %s: %v", event.Name, w.folder.id, err)
+				w.markFull()
+			}
+		}
+	}
+
+	if len(w.dirty) == 0 && !w.full {
+		w.since = time.Now()
+	}
+	w.dirty[rel] = struct{}{}
+	return true
+}
+
+func (w *folderWatcher) ignores() *ignoreMatcher {
+	w.syncer.mu.Lock()
+	defer w.syncer.mu.Unlock()
+
+	return w.folder.ignores
+}
+
+func (w *folderWatcher) isFile(path string) bool {
+	info, err := os.Lstat(path)
+	return err == nil && info.Mode().IsRegular()
+}
+
+func (w *folderWatcher) isDir(path string) bool {
+	info, err := os.Lstat(path)
+	return err == nil && info.IsDir()
+}
+
+func (w *folderWatcher) markFull() {
+	if len(w.dirty) == 0 && !w.full {
+		w.since = time.Now()
+	}
+	w.full = true
+}
+
+// wait returns how long to wait before rescanning: the usual delay, unless
+// that would put the rescan off past the maximum.
+func (w *folderWatcher) wait() time.Duration {
+	return max(0, min(w.delay, time.Until(w.since.Add(w.maxDelay))))
+}
+
+// flush rescans whatever has changed. If that fails, the whole folder is
+// rescanned on the next change or tick.
+func (w *folderWatcher) flush() {
+	if len(w.dirty) == 0 && !w.full {
+		return
+	}
+
+	var err error
+	if w.full {
+		err = w.syncer.rescanFolder(w.folder.id)
+		// Directories that were ignored before the ignore patterns changed
+		// aren't watched yet.
+		if err == nil {
+			err = w.watchTree(w.folder.root)
+		}
+	} else {
+		err = w.syncer.rescanPaths(w.folder.id, slices.Sorted(maps.Keys(w.dirty)))
+	}
+	clear(w.dirty)
+	w.full = false
+
+	if err != nil && !errors.Is(err, errFolderNotFound) {
+		w.logger.Printf("rescanning folder %s failed: %v", w.folder.id, err)
+		w.full = true
+		w.since = time.Now()
+	}
+}
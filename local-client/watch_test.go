@@ -0,0 +1,188 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func newTestWatcher(t *testing.T) (*syncer, *folderWatcher, string) {
+	t.Helper()
+
+	logger := log.New(io.Discard, "", 0)
+	root := t.TempDir()
+	s, err := newSyncer(logger, testIndexDB(t), "AAAAAAAA", root, folderSendReceive)
+	if err != nil {
+		t.Fatalf("newSyncer returned error: %v", err)
+	}
+
+	s.mu.Lock()
+	f := s.folders[defaultFolderID]
+	s.mu.Unlock()
+
+	w, err := newFolderWatcher(logger, s, f)
+	if err != nil {
+		t.Fatalf("newFolderWatcher returned error: %v", err)
+	}
+	w.delay = 50 * time.Millisecond
+	w.maxDelay = 500 * time.Millisecond
+	return s, w, root
+}
+
+// waitForEntry waits for the default folder's index entry for path to satisfy
+// ok.
+func waitForEntry(t *testing.T, s *syncer, path string, ok func(fileInfo, bool) bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		s.mu.Lock()
+		info, found := s.folders[defaultFolderID].index[path]
+		s.mu.Unlock()
+		if ok(info, found) {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for the index entry for %s", path)
+}
+
+func present(size int64) func(fileInfo, bool) bool {
+	return func(info fileInfo, found bool) bool {
+		return found && !info.Deleted && info.Size == size
+	}
+}
+
+func deleted(info fileInfo, found bool) bool {
+	return found && info.Deleted
+}
+
+func TestFolderWatcherUpdatesIndex(t *testing.T) {
+	s, w, root := newTestWatcher(t)
+
+	stop := make(chan struct{})
+	go w.run(time.Hour, stop)
+	t.Cleanup(func() { close(stop) })
+
+	if err := os.WriteFile(filepath.Join(root, "a.txt"), []byte("hello"), 0o644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	waitForEntry(t, s, "a.txt", present(5))
+
+	if err := os.WriteFile(filepath.Join(root, "a.txt"), []byte("hello, world"), 0o644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	waitForEntry(t, s, "a.txt", present(12))
+
+	// Files in a new directory are found, as are files in directories below
+	// it created afterwards.
+	if err := os.MkdirAll(filepath.Join(root, "dir", "sub"), 0o755); err != nil {
+		t.Fatalf("failed to create dir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "dir", "sub", "b.txt"), []byte("bravo"), 0o644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	waitForEntry(t, s, "dir/sub/b.txt", present(5))
+	time.Sleep(100 * time.Millisecond)
+	if err := os.WriteFile(filepath.Join(root, "dir", "sub", "c.txt"), []byte("charlie"), 0o644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	waitForEntry(t, s, "dir/sub/c.txt", present(7))
+
+	if err := os.Rename(filepath.Join(root, "a.txt"), filepath.Join(root, "dir", "renamed.txt")); err != nil {
+		t.Fatalf("failed to rename file: %v", err)
+	}
+	waitForEntry(t, s, "a.txt", deleted)
+	waitForEntry(t, s, "dir/renamed.txt", present(12))
+
+	if err := os.Remove(filepath.Join(root, "dir", "renamed.txt")); err != nil {
+		t.Fatalf("failed to remove file: %v", err)
+	}
+	waitForEntry(t, s, "dir/renamed.txt", deleted)
+
+	if err := os.RemoveAll(filepath.Join(root, "dir")); err != nil {
+		t.Fatalf("failed to remove dir: %v", err)
+	}
+	waitForEntry(t, s, "dir/sub/b.txt", deleted)
+	waitForEntry(t, s, "dir/sub/c.txt", deleted)
+}
+
+func TestFolderWatcherCoalescesEvents(t *testing.T) {
+	_, w, root := newTestWatcher(t)
+	t.Cleanup(func() { w.watcher.Close() })
+
+	for range 3 {
+		w.handle(fsnotify.Event{Name: filepath.Join(root, "a.txt"), Op: fsnotify.Write})
+	}
+	w.handle(fsnotify.Event{Name: filepath.Join(root, "dir", "b.txt"), Op: fsnotify.Create})
+	if w.handle(fsnotify.Event{Name: filepath.Join(root, tempFilePrefix+"123"), Op: fsnotify.Create}) {
+		t.Fatal("expected temporary files to be ignored")
+	}
+	if len(w.dirty) != 2 {
+		t.Fatalf("expected two dirty paths, got %v", w.dirty)
+	}
+	if _, ok := w.dirty["dir/b.txt"]; !ok {
+		t.Fatalf("expected dirty paths relative to the root, got %v", w.dirty)
+	}
+
+	if wait := w.wait(); wait != w.delay {
+		t.Fatalf("expected to wait the usual delay, got %s", wait)
+	}
+	w.since = time.Now().Add(-w.maxDelay)
+	if wait := w.wait(); wait != 0 {
+		t.Fatalf("expected no more waiting once the maximum delay has passed, got %s", wait)
+	}
+
+	w.flush()
+	if len(w.dirty) != 0 || w.full {
+		t.Fatalf("expected flush to clear the pending changes, got %v", w.dirty)
+	}
+}
+
+func TestFolderWatcherRescansOnOverflow(t *testing.T) {
+	s, w, root := newTestWatcher(t)
+
+	// Written before the watcher runs, so no event will mention it.
+	if err := os.WriteFile(filepath.Join(root, "missed.txt"), []byte("missed"), 0o644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	stop := make(chan struct{})
+	go w.run(time.Hour, stop)
+	t.Cleanup(func() { close(stop) })
+
+	w.watcher.Errors <- fsnotify.ErrEventOverflow
+	waitForEntry(t, s, "missed.txt", present(6))
+}
+
+func TestRescanPathsOnlyScansGivenPaths(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	root := t.TempDir()
+	s, err := newSyncer(logger, testIndexDB(t), "AAAAAAAA", root, folderSendReceive)
+	if err != nil {
+		t.Fatalf("newSyncer returned error: %v", err)
+	}
+
+	for _, name := range []string{"a.txt", "b.txt"} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(name), 0o644); err != nil {
+			t.Fatalf("failed to write file: %v", err)
+		}
+	}
+	if err := s.rescanPaths(defaultFolderID, []string{"a.txt"}); err != nil {
+		t.Fatalf("rescanPaths returned error: %v", err)
+	}
+
+	s.mu.Lock()
+	index := s.folders[defaultFolderID].index
+	_, haveA := index["a.txt"]
+	_, haveB := index["b.txt"]
+	s.mu.Unlock()
+	if !haveA || haveB {
+		t.Fatalf("expected only a.txt to be indexed, got %v", index)
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	nonceTTL = time.Minute
+	// maxNonces caps the nonces outstanding at once, and maxNoncesPerHost
+	// those issued to a single remote host, so that challenges, which need no
+	// authentication, can't be used to exhaust memory or crowd out others.
+	maxNonces        = 10000
+	maxNoncesPerHost = 16
+)
+
+var (
+	errInvalidNonce     = errors.New("nonce is invalid or has expired")
+	errTooManyNonces    = errors.New("too many outstanding challenges, try again later")
+	errInvalidPublicKey = errors.New("publicKey is not a supported PKIX public key")
+	errInvalidSignature = errors.New("signature does not match publicKey")
+)
+
+type contextKey string
+
+const clientIDContextKey = contextKey("clientId")
+
+// nonceStore tracks the registration nonces that have been issued and not yet
+// used. Nonces only need to live for a minute, so they are never persisted.
+type nonceStore struct {
+	mu      sync.Mutex
+	nonces  map[string]issuedNonce
+	perHost map[string]int
+	ttl     time.Duration
+	max     int
+	maxHost int
+}
+
+// issuedNonce records when a nonce expires and which host it was issued to.
+type issuedNonce struct {
+	expires time.Time
+	host    string
+}
+
+func newNonceStore(ttl time.Duration, max, maxHost int) *nonceStore {
+	return &nonceStore{
+		nonces:  make(map[string]issuedNonce),
+		perHost: make(map[string]int),
+		ttl:     ttl,
+		max:     max,
+		maxHost: maxHost,
+	}
+}
+
+// issue returns a fresh single-use nonce for a client on host to sign when
+// registering, or errTooManyNonces if too many are outstanding, for host or
+// altogether.
+func (n *nonceStore) issue(host string) (string, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	now := time.Now().UTC()
+	for nonce, issued := range n.nonces {
+		if now.After(issued.expires) {
+			n.remove(nonce, issued)
+		}
+	}
+	if len(n.nonces) >= n.max || n.perHost[host] >= n.maxHost {
+		return "", errTooManyNonces
+	}
+
+	b := make([]byte, 32)
+	rand.Read(b)
+	nonce := hex.EncodeToString(b)
+	n.nonces[nonce] = issuedNonce{expires: now.Add(n.ttl), host: host}
+	n.perHost[host]++
+	return nonce, nil
+}
+
+// remove forgets nonce. n.mu must be held.
+func (n *nonceStore) remove(nonce string, issued issuedNonce) {
+	delete(n.nonces, nonce)
+	if n.perHost[issued.host]--; n.perHost[issued.host] <= 0 {
+		delete(n.perHost, issued.host)
+	}
+}
+
+// consume reports whether nonce was issued by us and has not expired. A nonce
+// can only be consumed once.
+func (n *nonceStore) consume(nonce string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	issued, ok := n.nonces[nonce]
+	if !ok {
+		return false
+	}
+	n.remove(nonce, issued)
+	return time.Now().UTC().Before(issued.expires)
+}
+
+// VerifyRegistration checks that signature is a valid signature over nonce by
+// the private key matching publicKey, and returns the client ID derived from
+// that key. publicKey and signature are base64-encoded.
+func (s *server) VerifyRegistration(publicKey, nonce, signature string) (string, error) {
+	if !s.nonces.consume(nonce) {
+		return "", errInvalidNonce
+	}
+
+	der, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil {
+		return "", errInvalidPublicKey
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return "", errInvalidPublicKey
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return "", errInvalidSignature
+	}
+
+	switch k := key.(type) {
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, []byte(nonce), sig) {
+			return "", errInvalidSignature
+		}
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256([]byte(nonce))
+		if !ecdsa.VerifyASN1(k, digest[:], sig) {
+			return "", errInvalidSignature
+		}
+	default:
+		return "", errInvalidPublicKey
+	}
+
+	return clientIDForKey(der), nil
+}
+
+// clientIDForKey derives a client ID from a PKIX-encoded public key, so the
+// same key always maps to the same ID.
+func clientIDForKey(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:16])
+}
+
+// newToken returns a bearer token for id along with the hash that should be
+// stored. Tokens embed the client ID so the owning client can be looked up
+// directly.
+func newToken(id string) (string, string) {
+	b := make([]byte, 32)
+	rand.Read(b)
+	secret := hex.EncodeToString(b)
+	return id + "." + secret, hashSecret(secret)
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// authenticated wraps a handler so that it only runs for requests carrying a
+// valid bearer token. The authenticated client ID is available to the handler
+// through authenticatedClientID.
+func (s *server) authenticated(next func(http.ResponseWriter, *http.Request) error) func(http.ResponseWriter, *http.Request) error {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			errorResponse(w, http.StatusUnauthorized, "a bearer token is required")
+			return nil
+		}
+
+		id, secret, ok := strings.Cut(token, ".")
+		if ok {
+			valid, err := s.AuthenticateClient(id, secret)
+			if err != nil {
+				return err
+			}
+			ok = valid
+		}
+		if !ok {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			errorResponse(w, http.StatusUnauthorized, "invalid or expired token")
+			return nil
+		}
+
+		ctx := context.WithValue(r.Context(), clientIDContextKey, id)
+		return next(w, r.WithContext(ctx))
+	}
+}
+
+func authenticatedClientID(r *http.Request) string {
+	id, _ := r.Context().Value(clientIDContextKey).(string)
+	return id
+}
+
+func secretsMatch(hash, secret string) bool {
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(hashSecret(secret))) == 1
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dantdj/syncmesh/api"
+)
+
+func TestVerifyRegistrationDerivesStableID(t *testing.T) {
+	s := newTestServer(t)
+
+	signer := ed25519Signer(t)
+
+	var first, second api.RegisterRequest
+	if err := json.Unmarshal(signedRegisterBody(t, s, signer, "", 0), &first); err != nil {
+		t.Fatalf("failed to decode body: %v", err)
+	}
+	if err := json.Unmarshal(signedRegisterBody(t, s, signer, "", 0), &second); err != nil {
+		t.Fatalf("failed to decode body: %v", err)
+	}
+
+	firstID, err := s.VerifyRegistration(first.PublicKey, first.Nonce, first.Signature)
+	if err != nil {
+		t.Fatalf("VerifyRegistration returned error: %v", err)
+	}
+	secondID, err := s.VerifyRegistration(second.PublicKey, second.Nonce, second.Signature)
+	if err != nil {
+		t.Fatalf("VerifyRegistration returned error: %v", err)
+	}
+
+	if firstID != secondID {
+		t.Fatalf("expected the same key to map to the same ID, got %s and %s", firstID, secondID)
+	}
+
+	der, _ := x509.MarshalPKIXPublicKey(signer.Public())
+	if firstID != clientIDForKey(der) {
+		t.Fatalf("expected ID derived from public key, got %s", firstID)
+	}
+}
+
+func TestVerifyRegistrationAcceptsECDSA(t *testing.T) {
+	s := newTestServer(t)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	var req api.RegisterRequest
+	if err := json.Unmarshal(signedRegisterBody(t, s, key, "", 0), &req); err != nil {
+		t.Fatalf("failed to decode body: %v", err)
+	}
+
+	if _, err := s.VerifyRegistration(req.PublicKey, req.Nonce, req.Signature); err != nil {
+		t.Fatalf("VerifyRegistration returned error: %v", err)
+	}
+}
+
+func TestVerifyRegistrationRejectsReusedNonce(t *testing.T) {
+	s := newTestServer(t)
+
+	var req api.RegisterRequest
+	if err := json.Unmarshal(signedRegisterBody(t, s, ed25519Signer(t), "", 0), &req); err != nil {
+		t.Fatalf("failed to decode body: %v", err)
+	}
+
+	if _, err := s.VerifyRegistration(req.PublicKey, req.Nonce, req.Signature); err != nil {
+		t.Fatalf("VerifyRegistration returned error: %v", err)
+	}
+	if _, err := s.VerifyRegistration(req.PublicKey, req.Nonce, req.Signature); !errors.Is(err, errInvalidNonce) {
+		t.Fatalf("expected errInvalidNonce on reuse, got %v", err)
+	}
+}
+
+func TestVerifyRegistrationRejectsUnknownNonce(t *testing.T) {
+	s := newTestServer(t)
+
+	_, err := s.VerifyRegistration(base64.StdEncoding.EncodeToString([]byte("key")), "not-issued", "sig")
+	if !errors.Is(err, errInvalidNonce) {
+		t.Fatalf("expected errInvalidNonce, got %v", err)
+	}
+}
+
+func TestAuthenticatedSetsClientID(t *testing.T) {
+	s := newTestServer(t)
+
+	token := mustRegister(t, s, "client-auth", nil, "203.0.113.70", 5030, "", 0)
+
+	var seen string
+	handler := s.authenticated(func(w http.ResponseWriter, r *http.Request) error {
+		seen = authenticatedClientID(r)
+		return nil
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/discover", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	if err := handler(httptest.NewRecorder(), req); err != nil {
+		t.Fatalf("handler returned error: %v", err)
+	}
+
+	if seen != "client-auth" {
+		t.Fatalf("expected client-auth, got %q", seen)
+	}
+}
+
+func TestNonceStoreCapsOutstandingNonces(t *testing.T) {
+	n := newNonceStore(time.Minute, 3, 2)
+
+	for range 2 {
+		if _, err := n.issue("192.0.2.1"); err != nil {
+			t.Fatalf("issue returned error: %v", err)
+		}
+	}
+	if _, err := n.issue("192.0.2.1"); !errors.Is(err, errTooManyNonces) {
+		t.Fatalf("expected errTooManyNonces past the per-host cap, got %v", err)
+	}
+
+	nonce, err := n.issue("192.0.2.2")
+	if err != nil {
+		t.Fatalf("issue returned error: %v", err)
+	}
+	if _, err := n.issue("192.0.2.3"); !errors.Is(err, errTooManyNonces) {
+		t.Fatalf("expected errTooManyNonces past the overall cap, got %v", err)
+	}
+
+	// Using a nonce makes room for another.
+	if !n.consume(nonce) {
+		t.Fatal("expected the nonce to be consumed")
+	}
+	if _, err := n.issue("192.0.2.3"); err != nil {
+		t.Fatalf("expected room once a nonce was used, got %v", err)
+	}
+
+	expiring := newNonceStore(time.Millisecond, 1, 1)
+	if _, err := expiring.issue("192.0.2.1"); err != nil {
+		t.Fatalf("issue returned error: %v", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if _, err := expiring.issue("192.0.2.1"); err != nil {
+		t.Fatalf("expected expired nonces to make room, got %v", err)
+	}
+}
+
+func TestChallengeHandlerLimitsHost(t *testing.T) {
+	s := newTestServer(t)
+
+	for range maxNoncesPerHost {
+		recorder := httptest.NewRecorder()
+		s.routes().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/challenge", nil))
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", recorder.Code)
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	s.routes().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/challenge", nil))
+	if recorder.Code != http.StatusTooManyRequests || recorder.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected status 429 with Retry-After, got %d", recorder.Code)
+	}
+}
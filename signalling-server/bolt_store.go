@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	clientsBucket = []byte("clients")
+	groupsBucket  = []byte("groups")
+)
+
+// boltStore keeps the registry in an embedded bbolt database so registrations
+// survive restarts. Clients are stored as JSON keyed by ID, and each group is a
+// nested bucket whose keys are the IDs of its members.
+type boltStore struct {
+	db *bolt.DB
+}
+
+func newBoltStore(path string) (*boltStore, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(clientsBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(groupsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &boltStore{db: db}, nil
+}
+
+func (b *boltStore) Register(id string, info clientInfo) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	return b.db.Update(func(tx *bolt.Tx) error {
+		if err := removeClient(tx, id); err != nil {
+			return err
+		}
+		if err := tx.Bucket(clientsBucket).Put([]byte(id), data); err != nil {
+			return err
+		}
+
+		for _, group := range info.Groups {
+			members, err := tx.Bucket(groupsBucket).CreateBucketIfNotExists([]byte(group))
+			if err != nil {
+				return err
+			}
+			if err := members.Put([]byte(id), nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *boltStore) Unregister(id string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return removeClient(tx, id)
+	})
+}
+
+func (b *boltStore) Touch(id string, at time.Time) (bool, error) {
+	found := false
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		info, ok, err := getClient(tx, id)
+		if err != nil || !ok {
+			return err
+		}
+		found = true
+
+		info.LastSeen = at
+		data, err := json.Marshal(info)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(clientsBucket).Put([]byte(id), data)
+	})
+	return found, err
+}
+
+func (b *boltStore) Get(id string) (clientInfo, bool, error) {
+	var (
+		info clientInfo
+		ok   bool
+	)
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var err error
+		info, ok, err = getClient(tx, id)
+		return err
+	})
+	return info, ok, err
+}
+
+func (b *boltStore) List(group string) (map[string]clientInfo, error) {
+	result := make(map[string]clientInfo)
+	err := b.db.View(func(tx *bolt.Tx) error {
+		if group == "" {
+			return tx.Bucket(clientsBucket).ForEach(func(k, v []byte) error {
+				var info clientInfo
+				if err := json.Unmarshal(v, &info); err != nil {
+					return err
+				}
+				result[string(k)] = info
+				return nil
+			})
+		}
+
+		members := tx.Bucket(groupsBucket).Bucket([]byte(group))
+		if members == nil {
+			return nil
+		}
+		return members.ForEach(func(k, _ []byte) error {
+			info, ok, err := getClient(tx, string(k))
+			if err != nil {
+				return err
+			}
+			if ok {
+				result[string(k)] = info
+			}
+			return nil
+		})
+	})
+	return result, err
+}
+
+func (b *boltStore) Prune(cutoff time.Time) (map[string]clientInfo, error) {
+	var pruned map[string]clientInfo
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		expired := make(map[string]clientInfo)
+		err := tx.Bucket(clientsBucket).ForEach(func(k, v []byte) error {
+			var info clientInfo
+			if err := json.Unmarshal(v, &info); err != nil {
+				return err
+			}
+			if info.LastSeen.Before(cutoff) {
+				expired[string(k)] = info
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// Buckets must not be modified while iterating over them, so removal
+		// happens in a second pass.
+		for id := range expired {
+			if err := removeClient(tx, id); err != nil {
+				return err
+			}
+		}
+		pruned = expired
+		return nil
+	})
+	return pruned, err
+}
+
+func (b *boltStore) Close() error {
+	return b.db.Close()
+}
+
+func getClient(tx *bolt.Tx, id string) (clientInfo, bool, error) {
+	data := tx.Bucket(clientsBucket).Get([]byte(id))
+	if data == nil {
+		return clientInfo{}, false, nil
+	}
+
+	var info clientInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return clientInfo{}, false, err
+	}
+	return info, true, nil
+}
+
+// removeClient deletes id from the clients bucket and from every group it
+// belongs to, dropping groups that become empty.
+func removeClient(tx *bolt.Tx, id string) error {
+	info, ok, err := getClient(tx, id)
+	if err != nil || !ok {
+		return err
+	}
+
+	groups := tx.Bucket(groupsBucket)
+	for _, group := range info.Groups {
+		members := groups.Bucket([]byte(group))
+		if members == nil {
+			continue
+		}
+		if err := members.Delete([]byte(id)); err != nil {
+			return err
+		}
+		if k, _ := members.Cursor().First(); k == nil {
+			if err := groups.DeleteBucket([]byte(group)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Bucket(clientsBucket).Delete([]byte(id))
+}
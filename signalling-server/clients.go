@@ -1,89 +1,280 @@
 package main
 
 import (
-	"crypto/rand"
-	"encoding/hex"
-	"maps"
-	"sync"
+	"errors"
+	"log/slog"
+	"slices"
 	"time"
+
+	"github.com/dantdj/syncmesh/api"
 )
 
+// defaultGroup is used for clients that register without naming any groups.
+const defaultGroup = "default"
+
+// punchLeadTime is how far ahead a hole punch is scheduled, giving the
+// introduced peer time to receive its event before both sides start probing.
+var punchLeadTime = 2 * time.Second
+
 var (
-	clients   = make(map[string]clientInfo)
-	mu        sync.Mutex
-	clientTTL = 5 * time.Minute
+	errPeerNotFound     = errors.New("peer not found")
+	errNotSharingGroup  = errors.New("peer does not share a group with the caller")
+	errNoReflexiveAddr  = errors.New("both clients must have registered a reflexive address")
+	errPeerNotListening = errors.New("peer is not listening for events")
 )
 
-type clientInfo struct {
-	PublicIP   string
-	PublicPort int
-	LocalIP    string
-	LocalPort  int
-	LastSeen   time.Time
+// RegisterClient records the contact details and group memberships for id,
+// replacing any previous registration, and returns a new bearer token for the
+// client.
+func (s *server) RegisterClient(id string, groupIDs []string, publicIP string, publicPort int, localIP string, localPort int, reflexiveIP string, reflexivePort int) (string, error) {
+	if err := s.pruneExpired(); err != nil {
+		return "", err
+	}
+
+	if len(groupIDs) == 0 {
+		groupIDs = []string{defaultGroup}
+	}
+	groupIDs = slices.Compact(slices.Sorted(slices.Values(groupIDs)))
+
+	s.registryMu.Lock()
+	defer s.registryMu.Unlock()
+
+	previous, existed, err := s.store.Get(id)
+	if err != nil {
+		return "", err
+	}
+
+	token, tokenHash := newToken(id)
+	info := clientInfo{
+		Groups:        groupIDs,
+		PublicIP:      publicIP,
+		PublicPort:    publicPort,
+		LocalIP:       localIP,
+		LocalPort:     localPort,
+		ReflexiveIP:   reflexiveIP,
+		ReflexivePort: reflexivePort,
+		LastSeen:      time.Now().UTC(),
+		TokenHash:     tokenHash,
+	}
+	if err := s.store.Register(id, info); err != nil {
+		return "", err
+	}
+
+	s.events.setGroups(id, groupIDs)
+	if existed {
+		s.events.publishChange(id, &previous, &info)
+	} else {
+		s.events.publishChange(id, nil, &info)
+	}
+	return token, nil
 }
 
-func RegisterClient(publicIP string, publicPort int, localIP string, localPort int) string {
-	mu.Lock()
-	defer mu.Unlock()
+// SubscribeEvents subscribes id to events about the peers it shares a group
+// with, reporting false if it isn't registered.
+func (s *server) SubscribeEvents(id string) (*subscription, bool, error) {
+	s.registryMu.Lock()
+	defer s.registryMu.Unlock()
 
-	pruneExpiredLocked()
+	info, ok, err := s.store.Get(id)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	return s.events.subscribe(id, info.Groups), true, nil
+}
 
-	b := make([]byte, 16)
-	rand.Read(b)
-	id := hex.EncodeToString(b)
+// AuthenticateClient reports whether secret is the current token secret for a
+// registered client.
+func (s *server) AuthenticateClient(id, secret string) (bool, error) {
+	if err := s.pruneExpired(); err != nil {
+		return false, err
+	}
 
-	clients[id] = clientInfo{
-		PublicIP:   publicIP,
-		PublicPort: publicPort,
-		LocalIP:    localIP,
-		LocalPort:  localPort,
-		LastSeen:   time.Now().UTC(),
+	info, ok, err := s.store.Get(id)
+	if err != nil {
+		return false, err
 	}
-	return id
+	return ok && secretsMatch(info.TokenHash, secret), nil
 }
 
-func UnregisterClient(id string) {
-	mu.Lock()
-	defer mu.Unlock()
-	pruneExpiredLocked()
-	delete(clients, id)
+func (s *server) UnregisterClient(id string) error {
+	if err := s.pruneExpired(); err != nil {
+		return err
+	}
+
+	s.registryMu.Lock()
+	defer s.registryMu.Unlock()
+
+	info, ok, err := s.store.Get(id)
+	if err != nil || !ok {
+		return err
+	}
+
+	if err := s.store.Unregister(id); err != nil {
+		return err
+	}
+
+	s.events.publishChange(id, &info, nil)
+	return nil
+}
+
+// DiscoverGroup returns the clients that are members of group.
+func (s *server) DiscoverGroup(group string) (map[string]clientInfo, error) {
+	if err := s.pruneExpired(); err != nil {
+		return nil, err
+	}
+	return s.store.List(group)
 }
 
-func DiscoverClients() map[string]clientInfo {
-	mu.Lock()
-	defer mu.Unlock()
+// DiscoverPeers returns every client sharing at least one group with id,
+// including id itself.
+func (s *server) DiscoverPeers(id string) (map[string]clientInfo, error) {
+	if err := s.pruneExpired(); err != nil {
+		return nil, err
+	}
 
-	pruneExpiredLocked()
+	info, ok, err := s.store.Get(id)
+	if err != nil || !ok {
+		return map[string]clientInfo{}, err
+	}
 
-	copy := make(map[string]clientInfo, len(clients))
-	maps.Copy(copy, clients)
-	return copy
+	peers := make(map[string]clientInfo)
+	for _, group := range info.Groups {
+		members, err := s.store.List(group)
+		if err != nil {
+			return nil, err
+		}
+		for member, memberInfo := range members {
+			peers[member] = memberInfo
+		}
+	}
+	return peers, nil
 }
 
-func TouchClient(id string) bool {
-	mu.Lock()
-	defer mu.Unlock()
+// IntroducePeers arranges a UDP hole punch between id and peerID. peerID is
+// sent id's contact details and a start time over its event stream; the start
+// time and peerID's registration are returned for id to use.
+func (s *server) IntroducePeers(id, peerID string) (clientInfo, time.Time, error) {
+	info, peer, err := s.peerPair(id, peerID)
+	if err != nil {
+		return clientInfo{}, time.Time{}, err
+	}
+	if info.ReflexiveIP == "" || peer.ReflexiveIP == "" {
+		return clientInfo{}, time.Time{}, errNoReflexiveAddr
+	}
+
+	startAt := time.Now().UTC().Add(punchLeadTime)
+	event := api.PeerEvent{Type: api.PunchRequested, Client: snapshot(id, info), StartAt: startAt}
+	if !s.events.publishTo(peerID, event) {
+		return clientInfo{}, time.Time{}, errPeerNotListening
+	}
+
+	slog.Info("Introduced peers for hole punching", slog.String("clientId", id), slog.String("peerId", peerID))
+	return peer, startAt, nil
+}
+
+// RelayPeers allocates a relay session between id and peerID. peerID is sent
+// its ticket over its event stream, and id's ticket is returned.
+func (s *server) RelayPeers(id, peerID, address string) (string, error) {
+	info, _, err := s.peerPair(id, peerID)
+	if err != nil {
+		return "", err
+	}
+
+	ticket, peerTicket, err := s.relay.allocate(id)
+	if err != nil {
+		return "", err
+	}
+
+	event := api.PeerEvent{
+		Type:   api.RelayRequested,
+		Client: snapshot(id, info),
+		Relay:  &api.RelayTicket{Address: address, Ticket: peerTicket},
+	}
+	if !s.events.publishTo(peerID, event) {
+		// Nobody will join the session, so its slot is freed straight away.
+		s.relay.cancel(ticket)
+		return "", errPeerNotListening
+	}
+
+	slog.Info("Allocated relay session", slog.String("clientId", id), slog.String("peerId", peerID))
+	return ticket, nil
+}
+
+// peerPair returns the registrations of id and peerID, which must both exist
+// and share a group.
+func (s *server) peerPair(id, peerID string) (clientInfo, clientInfo, error) {
+	if err := s.pruneExpired(); err != nil {
+		return clientInfo{}, clientInfo{}, err
+	}
 
-	pruneExpiredLocked()
+	info, ok, err := s.store.Get(id)
+	if err != nil {
+		return clientInfo{}, clientInfo{}, err
+	}
+	if !ok {
+		return clientInfo{}, clientInfo{}, errPeerNotFound
+	}
 
-	info, ok := clients[id]
+	peer, ok, err := s.store.Get(peerID)
+	if err != nil {
+		return clientInfo{}, clientInfo{}, err
+	}
 	if !ok {
-		return false
+		return clientInfo{}, clientInfo{}, errPeerNotFound
+	}
+	if !sharesGroup(info.Groups, peer.Groups) {
+		return clientInfo{}, clientInfo{}, errNotSharingGroup
+	}
+	return info, peer, nil
+}
+
+// IsGroupMember reports whether id is registered into group.
+func (s *server) IsGroupMember(id, group string) (bool, error) {
+	info, ok, err := s.store.Get(id)
+	if err != nil || !ok {
+		return false, err
 	}
-	info.LastSeen = time.Now().UTC()
-	clients[id] = info
-	return true
+	return slices.Contains(info.Groups, group), nil
 }
 
-func pruneExpiredLocked() {
-	if len(clients) == 0 {
-		return
+func (s *server) TouchClient(id string) (bool, error) {
+	if err := s.pruneExpired(); err != nil {
+		return false, err
 	}
+	return s.store.Touch(id, time.Now().UTC())
+}
+
+// pruneExpired removes clients that have missed their heartbeats for longer than
+// the TTL and tells their peers that they have left.
+func (s *server) pruneExpired() error {
+	s.registryMu.Lock()
+	defer s.registryMu.Unlock()
+
+	pruned, err := s.store.Prune(time.Now().UTC().Add(-s.clientTTL))
+	if err != nil {
+		return err
+	}
+
+	for id, info := range pruned {
+		s.events.publishChange(id, &info, nil)
+	}
+	return nil
+}
+
+// pruneLoop prunes expired clients on every tick, so that peers hear about TTL
+// expiry even when no requests are arriving, until done is closed.
+func (s *server) pruneLoop(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 
-	cutoff := time.Now().UTC().Add(-clientTTL)
-	for id, info := range clients {
-		if info.LastSeen.Before(cutoff) {
-			delete(clients, id)
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := s.pruneExpired(); err != nil {
+				slog.Error("Failed to prune expired clients", slog.String("error", err.Error()))
+			}
 		}
 	}
 }
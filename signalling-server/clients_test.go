@@ -1,32 +1,56 @@
 package main
 
 import (
+	"strings"
 	"testing"
 	"time"
 )
 
-// resetClients clears the global clients map for testing purposes.
-// This helper accesses internal state to ensure clean test runs.
-func resetClients() {
-	mu.Lock()
-	defer mu.Unlock()
-	clients = make(map[string]clientInfo)
-}
+// newTestServer returns a server backed by a fresh in-memory store.
+func newTestServer(t *testing.T) *server {
+	t.Helper()
 
-func TestRegisterClient(t *testing.T) {
-	resetClients()
+	store := newMemoryStore()
+	t.Cleanup(func() { store.Close() })
+	return newServer(store)
+}
 
-	id := RegisterClient("203.0.113.5", 5000, "192.168.1.5", 4000)
+// mustRegister registers a client and fails the test on error.
+func mustRegister(t *testing.T, s *server, id string, groups []string, publicIP string, publicPort int, localIP string, localPort int) string {
+	t.Helper()
 
-	if id == "" {
-		t.Fatal("Expected a non-empty ID returned from RegisterClient")
+	token, err := s.RegisterClient(id, groups, publicIP, publicPort, localIP, localPort, "", 0)
+	if err != nil {
+		t.Fatalf("RegisterClient returned error: %v", err)
 	}
+	return token
+}
 
-	clients := DiscoverClients()
-	info, ok := clients[id]
+// mustGet returns the stored entry for id, failing the test if it is missing.
+func mustGet(t *testing.T, s *server, id string) clientInfo {
+	t.Helper()
+
+	info, ok, err := s.store.Get(id)
+	if err != nil {
+		t.Fatalf("Get returned error: %v", err)
+	}
 	if !ok {
 		t.Fatalf("Expected client %s to be registered", id)
 	}
+	return info
+}
+
+func TestRegisterClient(t *testing.T) {
+	s := newTestServer(t)
+
+	id := "client-a"
+	token := mustRegister(t, s, id, nil, "203.0.113.5", 5000, "192.168.1.5", 4000)
+
+	if !strings.HasPrefix(token, id+".") {
+		t.Fatalf("Expected token to be prefixed with the client ID, got %q", token)
+	}
+
+	info := mustGet(t, s, id)
 
 	if info.PublicIP != "203.0.113.5" || info.PublicPort != 5000 {
 		t.Errorf("Unexpected public info: %+v", info)
@@ -37,59 +61,150 @@ func TestRegisterClient(t *testing.T) {
 	}
 }
 
+func TestRegisterClientStoresReflexiveAddress(t *testing.T) {
+	s := newTestServer(t)
+
+	if _, err := s.RegisterClient("client-r", nil, "203.0.113.5", 5000, "", 0, "203.0.113.5", 61000); err != nil {
+		t.Fatalf("RegisterClient returned error: %v", err)
+	}
+
+	info := mustGet(t, s, "client-r")
+	if info.ReflexiveIP != "203.0.113.5" || info.ReflexivePort != 61000 {
+		t.Errorf("Unexpected reflexive info: %+v", info)
+	}
+
+	if got := snapshot("client-r", info); got.ReflexiveIP != "203.0.113.5" || got.ReflexivePort != 61000 {
+		t.Errorf("Expected reflexive address in snapshot, got %+v", got)
+	}
+}
+
 func TestUnregisterClient(t *testing.T) {
-	resetClients()
+	s := newTestServer(t)
 
-	id := RegisterClient("203.0.113.6", 5001, "", 0)
-	UnregisterClient(id)
+	id := "client-b"
+	mustRegister(t, s, id, nil, "203.0.113.6", 5001, "", 0)
+	if err := s.UnregisterClient(id); err != nil {
+		t.Fatalf("UnregisterClient returned error: %v", err)
+	}
 
-	clients := DiscoverClients()
-	if _, ok := clients[id]; ok {
+	if _, ok, _ := s.store.Get(id); ok {
 		t.Error("Expected client to be unregistered")
 	}
 }
 
 func TestTouchClientUpdatesLastSeen(t *testing.T) {
-	resetClients()
+	s := newTestServer(t)
 
-	id := RegisterClient("203.0.113.7", 5002, "", 0)
+	id := "client-c"
+	mustRegister(t, s, id, nil, "203.0.113.7", 5002, "", 0)
 
-	mu.Lock()
-	info := clients[id]
-	info.LastSeen = time.Now().UTC().Add(-1 * time.Minute)
-	clients[id] = info
-	mu.Unlock()
+	if _, err := s.store.Touch(id, time.Now().UTC().Add(-1*time.Minute)); err != nil {
+		t.Fatalf("Touch returned error: %v", err)
+	}
 
-	if !TouchClient(id) {
+	found, err := s.TouchClient(id)
+	if err != nil {
+		t.Fatalf("TouchClient returned error: %v", err)
+	}
+	if !found {
 		t.Fatal("Expected TouchClient to return true for existing client")
 	}
 
-	mu.Lock()
-	updated := clients[id]
-	mu.Unlock()
-
-	if time.Since(updated.LastSeen) > time.Minute {
+	if time.Since(mustGet(t, s, id).LastSeen) > time.Minute {
 		t.Error("Expected LastSeen to be updated recently")
 	}
 }
 
-func TestDiscoverClientsPrunesExpired(t *testing.T) {
-	resetClients()
-
-	previousTTL := clientTTL
-	clientTTL = time.Minute
-	t.Cleanup(func() { clientTTL = previousTTL })
+func TestDiscoverPrunesExpired(t *testing.T) {
+	s := newTestServer(t)
+	s.clientTTL = time.Minute
 
-	id := RegisterClient("203.0.113.8", 5003, "", 0)
+	id := "client-d"
+	mustRegister(t, s, id, nil, "203.0.113.8", 5003, "", 0)
 
-	mu.Lock()
-	info := clients[id]
-	info.LastSeen = time.Now().UTC().Add(-2 * time.Minute)
-	clients[id] = info
-	mu.Unlock()
+	if _, err := s.store.Touch(id, time.Now().UTC().Add(-2*time.Minute)); err != nil {
+		t.Fatalf("Touch returned error: %v", err)
+	}
 
-	discovered := DiscoverClients()
+	discovered, err := s.DiscoverGroup(defaultGroup)
+	if err != nil {
+		t.Fatalf("DiscoverGroup returned error: %v", err)
+	}
 	if _, ok := discovered[id]; ok {
 		t.Error("Expected expired client to be pruned")
 	}
 }
+
+func TestAuthenticateClient(t *testing.T) {
+	s := newTestServer(t)
+
+	authenticate := func(id, secret string) bool {
+		t.Helper()
+		ok, err := s.AuthenticateClient(id, secret)
+		if err != nil {
+			t.Fatalf("AuthenticateClient returned error: %v", err)
+		}
+		return ok
+	}
+
+	id := "client-e"
+	token := mustRegister(t, s, id, nil, "203.0.113.9", 5004, "", 0)
+	_, secret, _ := strings.Cut(token, ".")
+
+	if !authenticate(id, secret) {
+		t.Fatal("Expected issued token to authenticate")
+	}
+	if authenticate(id, "wrong") {
+		t.Error("Expected wrong secret to be rejected")
+	}
+	if authenticate("client-f", secret) {
+		t.Error("Expected secret not to authenticate a different client")
+	}
+
+	rotated := mustRegister(t, s, id, nil, "203.0.113.9", 5004, "", 0)
+	_, newSecret, _ := strings.Cut(rotated, ".")
+	if authenticate(id, secret) {
+		t.Error("Expected re-registering to revoke the previous token")
+	}
+	if !authenticate(id, newSecret) {
+		t.Error("Expected the new token to authenticate")
+	}
+}
+
+func TestRegisterClientIndexesGroups(t *testing.T) {
+	s := newTestServer(t)
+
+	mustRegister(t, s, "alpha-1", []string{"alpha"}, "203.0.113.20", 5100, "", 0)
+	mustRegister(t, s, "alpha-2", []string{"alpha", "beta"}, "203.0.113.21", 5101, "", 0)
+	mustRegister(t, s, "beta-1", []string{"beta"}, "203.0.113.22", 5102, "", 0)
+	mustRegister(t, s, "loner", nil, "203.0.113.23", 5103, "", 0)
+
+	alpha, err := s.DiscoverGroup("alpha")
+	if err != nil {
+		t.Fatalf("DiscoverGroup returned error: %v", err)
+	}
+	if len(alpha) != 2 {
+		t.Fatalf("Expected 2 members of alpha, got %d", len(alpha))
+	}
+	if _, ok := alpha["beta-1"]; ok {
+		t.Error("Expected beta-1 not to be a member of alpha")
+	}
+
+	peers, err := s.DiscoverPeers("alpha-1")
+	if err != nil {
+		t.Fatalf("DiscoverPeers returned error: %v", err)
+	}
+	if len(peers) != 2 {
+		t.Fatalf("Expected alpha-1 to see 2 clients, got %d", len(peers))
+	}
+
+	if member, _ := s.IsGroupMember("loner", defaultGroup); !member {
+		t.Error("Expected client without groups to join the default group")
+	}
+
+	// Re-registering moves the client out of groups it no longer names.
+	mustRegister(t, s, "alpha-2", []string{"beta"}, "203.0.113.21", 5101, "", 0)
+	if member, _ := s.IsGroupMember("alpha-2", "alpha"); member {
+		t.Error("Expected alpha-2 to have left alpha")
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"slices"
+	"sync"
+
+	"github.com/dantdj/syncmesh/api"
+)
+
+// subscriberBuffer is how many events may queue for a subscriber before it is
+// considered too slow and disconnected. A disconnected client reconnects and
+// rediscovers its peers, so dropping it loses nothing.
+const subscriberBuffer = 64
+
+// subscription is a single client listening on the events endpoint.
+type subscription struct {
+	clientID string
+	// groups are the client's current groups. They are guarded by the
+	// broker's mu.
+	groups []string
+	events chan api.PeerEvent
+}
+
+// eventBroker fans peer events out to the subscribers that share a group with
+// the peer concerned.
+type eventBroker struct {
+	mu          sync.Mutex
+	subscribers map[*subscription]struct{}
+}
+
+func newEventBroker() *eventBroker {
+	return &eventBroker{subscribers: make(map[*subscription]struct{})}
+}
+
+// subscribe registers clientID for events about peers in groups. The groups are
+// replaced by setGroups whenever the client registers again.
+func (b *eventBroker) subscribe(clientID string, groups []string) *subscription {
+	sub := &subscription{
+		clientID: clientID,
+		groups:   groups,
+		events:   make(chan api.PeerEvent, subscriberBuffer),
+	}
+
+	b.mu.Lock()
+	b.subscribers[sub] = struct{}{}
+	b.mu.Unlock()
+	return sub
+}
+
+func (b *eventBroker) unsubscribe(sub *subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.subscribers[sub]; ok {
+		delete(b.subscribers, sub)
+		close(sub.events)
+	}
+}
+
+// setGroups replaces the groups of every subscription held by clientID, so
+// that its streams follow the client into the groups it registered with last.
+func (b *eventBroker) setGroups(clientID string, groups []string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for sub := range b.subscribers {
+		if sub.clientID == clientID {
+			sub.groups = groups
+		}
+	}
+}
+
+// publishChange tells every subscriber how a change to id's registration from
+// before to after looks from where they stand. Either side may be nil, for a
+// new registration or a removal. A subscriber that starts sharing a group with
+// id sees it join, one that stops sharing sees it leave, and one that shares a
+// group throughout sees an address change if the contact details differ.
+func (b *eventBroker) publishChange(id string, before, after *clientInfo) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for sub := range b.subscribers {
+		if sub.clientID == id {
+			continue
+		}
+
+		sharedBefore := before != nil && sharesGroup(sub.groups, before.Groups)
+		sharedAfter := after != nil && sharesGroup(sub.groups, after.Groups)
+
+		var event api.PeerEvent
+		switch {
+		case !sharedBefore && sharedAfter:
+			event = api.PeerEvent{Type: api.PeerJoined, Client: snapshot(id, *after)}
+		case sharedBefore && !sharedAfter:
+			event = api.PeerEvent{Type: api.PeerLeft, Client: snapshot(id, *before)}
+		case sharedBefore && sharedAfter && !sameAddress(*before, *after):
+			event = api.PeerEvent{Type: api.PeerAddressChanged, Client: snapshot(id, *after)}
+		default:
+			continue
+		}
+
+		select {
+		case sub.events <- event:
+		default:
+			delete(b.subscribers, sub)
+			close(sub.events)
+		}
+	}
+}
+
+// publishTo sends event to every subscription held by clientID and reports
+// whether there were any.
+func (b *eventBroker) publishTo(clientID string, event api.PeerEvent) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delivered := false
+	for sub := range b.subscribers {
+		if sub.clientID != clientID {
+			continue
+		}
+
+		select {
+		case sub.events <- event:
+			delivered = true
+		default:
+			delete(b.subscribers, sub)
+			close(sub.events)
+		}
+	}
+	return delivered
+}
+
+func sharesGroup(a, b []string) bool {
+	for _, group := range a {
+		if slices.Contains(b, group) {
+			return true
+		}
+	}
+	return false
+}
+
+func sameAddress(a, b clientInfo) bool {
+	return a.PublicIP == b.PublicIP && a.PublicPort == b.PublicPort &&
+		a.LocalIP == b.LocalIP && a.LocalPort == b.LocalPort &&
+		a.ReflexiveIP == b.ReflexiveIP && a.ReflexivePort == b.ReflexivePort
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dantdj/syncmesh/api"
+)
+
+func TestPublishChange(t *testing.T) {
+	broker := newEventBroker()
+	alpha := broker.subscribe("watcher-alpha", []string{"alpha"})
+	beta := broker.subscribe("watcher-beta", []string{"beta"})
+	self := broker.subscribe("peer", []string{"alpha"})
+
+	joined := clientInfo{Groups: []string{"alpha"}, PublicIP: "203.0.113.1", PublicPort: 5000}
+	broker.publishChange("peer", nil, &joined)
+	expectEvent(t, alpha, api.PeerJoined, "peer")
+	expectNoEvent(t, beta)
+	expectNoEvent(t, self)
+
+	moved := joined
+	moved.PublicPort = 5001
+	broker.publishChange("peer", &joined, &moved)
+	expectEvent(t, alpha, api.PeerAddressChanged, "peer")
+
+	// Re-registering with the same address is not worth an event.
+	broker.publishChange("peer", &moved, &moved)
+	expectNoEvent(t, alpha)
+
+	// Switching groups looks like a leave to alpha and a join to beta.
+	switched := moved
+	switched.Groups = []string{"beta"}
+	broker.publishChange("peer", &moved, &switched)
+	expectEvent(t, alpha, api.PeerLeft, "peer")
+	expectEvent(t, beta, api.PeerJoined, "peer")
+
+	broker.publishChange("peer", &switched, nil)
+	expectEvent(t, beta, api.PeerLeft, "peer")
+}
+
+func TestPublishChangeDropsSlowSubscribers(t *testing.T) {
+	broker := newEventBroker()
+	sub := broker.subscribe("watcher", []string{"alpha"})
+
+	info := clientInfo{Groups: []string{"alpha"}}
+	for i := 0; i <= subscriberBuffer; i++ {
+		broker.publishChange("peer", nil, &info)
+	}
+
+	for range subscriberBuffer {
+		<-sub.events
+	}
+	if _, ok := <-sub.events; ok {
+		t.Fatal("expected the subscription to be closed once its buffer overflowed")
+	}
+}
+
+func TestPruneExpiredPublishesPeerLeft(t *testing.T) {
+	s := newTestServer(t)
+	s.clientTTL = time.Minute
+
+	mustRegister(t, s, "stale", []string{"alpha"}, "203.0.113.1", 5000, "", 0)
+	if _, err := s.store.Touch("stale", time.Now().UTC().Add(-2*time.Minute)); err != nil {
+		t.Fatalf("Touch returned error: %v", err)
+	}
+
+	sub := s.events.subscribe("watcher", []string{"alpha"})
+
+	if err := s.pruneExpired(); err != nil {
+		t.Fatalf("pruneExpired returned error: %v", err)
+	}
+	expectEvent(t, sub, api.PeerLeft, "stale")
+}
+
+// slowStore delays lookups, widening the gap between reading a client's entry
+// and replacing it.
+type slowStore struct {
+	Store
+}
+
+func (s slowStore) Get(id string) (clientInfo, bool, error) {
+	info, ok, err := s.Store.Get(id)
+	time.Sleep(5 * time.Millisecond)
+	return info, ok, err
+}
+
+func TestConcurrentRegistrationsJoinOnce(t *testing.T) {
+	s := newTestServer(t)
+	s.store = slowStore{Store: s.store}
+	sub := s.events.subscribe("watcher", []string{"alpha"})
+
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Go(func() {
+			if _, err := s.RegisterClient("peer", []string{"alpha"}, "203.0.113.1", 5000+i, "", 0, "", 0); err != nil {
+				t.Errorf("RegisterClient returned error: %v", err)
+			}
+		})
+	}
+	wg.Wait()
+
+	// Every registration after the first is judged against the one before
+	// it, so only address changes follow the join.
+	expectEvent(t, sub, api.PeerJoined, "peer")
+	for range 7 {
+		expectEvent(t, sub, api.PeerAddressChanged, "peer")
+	}
+	expectNoEvent(t, sub)
+}
+
+func TestSubscriptionFollowsReregistration(t *testing.T) {
+	s := newTestServer(t)
+	mustRegister(t, s, "watcher", []string{"alpha"}, "203.0.113.1", 5000, "", 0)
+
+	sub, ok, err := s.SubscribeEvents("watcher")
+	if err != nil || !ok {
+		t.Fatalf("SubscribeEvents returned %v, %v", ok, err)
+	}
+
+	mustRegister(t, s, "watcher", []string{"beta"}, "203.0.113.1", 5000, "", 0)
+	mustRegister(t, s, "in-alpha", []string{"alpha"}, "203.0.113.2", 5000, "", 0)
+	mustRegister(t, s, "in-beta", []string{"beta"}, "203.0.113.3", 5000, "", 0)
+
+	expectEvent(t, sub, api.PeerJoined, "in-beta")
+	expectNoEvent(t, sub)
+
+	if _, ok, _ := s.SubscribeEvents("nobody"); ok {
+		t.Fatal("expected an unregistered client not to be subscribed")
+	}
+}
+
+func TestEventsHandlerStreamsPeerEvents(t *testing.T) {
+	s := newTestServer(t)
+	srv := httptest.NewServer(s.routes())
+	t.Cleanup(srv.Close)
+
+	token := mustRegister(t, s, "watcher", []string{"alpha"}, "203.0.113.1", 5000, "", 0)
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/events", nil)
+	if err != nil {
+		t.Fatalf("failed to build request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatalf("events request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Content-Type"); got != "text/event-stream" {
+		t.Fatalf("expected Content-Type text/event-stream, got %q", got)
+	}
+
+	reader := bufio.NewReader(resp.Body)
+	// Wait for the stream to open so the subscription exists before the
+	// event we expect is published.
+	if line, err := reader.ReadString('\n'); err != nil || !strings.HasPrefix(line, ":") {
+		t.Fatalf("expected an opening comment, got %q (%v)", line, err)
+	}
+
+	mustRegister(t, s, "newcomer", []string{"alpha"}, "203.0.113.2", 5001, "", 0)
+
+	var eventType, data string
+	for data == "" {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("failed reading stream: %v", err)
+		}
+		line = strings.TrimRight(line, "\n")
+		if v, ok := strings.CutPrefix(line, "event: "); ok {
+			eventType = v
+		}
+		if v, ok := strings.CutPrefix(line, "data: "); ok {
+			data = v
+		}
+	}
+
+	if eventType != api.PeerJoined {
+		t.Fatalf("expected %s event, got %q", api.PeerJoined, eventType)
+	}
+
+	var event api.PeerEvent
+	if err := json.Unmarshal([]byte(data), &event); err != nil {
+		t.Fatalf("failed to decode event: %v", err)
+	}
+	if event.Client.ClientID != "newcomer" || event.Client.PublicPort != 5001 {
+		t.Fatalf("unexpected event payload: %+v", event)
+	}
+}
+
+func expectEvent(t *testing.T, sub *subscription, eventType, clientID string) {
+	t.Helper()
+
+	select {
+	case event := <-sub.events:
+		if event.Type != eventType || event.Client.ClientID != clientID {
+			t.Fatalf("expected %s for %s, got %s for %s", eventType, clientID, event.Type, event.Client.ClientID)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for %s for %s", eventType, clientID)
+	}
+}
+
+func expectNoEvent(t *testing.T, sub *subscription) {
+	t.Helper()
+
+	select {
+	case event := <-sub.events:
+		t.Fatalf("expected no event, got %s for %s", event.Type, event.Client.ClientID)
+	default:
+	}
+}
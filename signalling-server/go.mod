@@ -6,6 +6,10 @@ require (
 	github.com/dantdj/syncmesh/api v0.0.0
 	github.com/joho/godotenv v1.5.1
 	github.com/julienschmidt/httprouter v1.3.0
+	go.etcd.io/bbolt v1.4.3
+	golang.org/x/time v0.15.0
 )
 
+require golang.org/x/sys v0.29.0 // indirect
+
 replace github.com/dantdj/syncmesh/api => ../api
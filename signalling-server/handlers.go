@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"log/slog"
 	"net"
@@ -13,6 +14,10 @@ import (
 	"github.com/dantdj/syncmesh/api"
 )
 
+// eventKeepaliveInterval is how often a comment is written to idle event
+// streams so that proxies and clients don't consider them dead.
+var eventKeepaliveInterval = 15 * time.Second
+
 func PingHandler(w http.ResponseWriter, r *http.Request) error {
 	env := envelope{
 		"status": "available",
@@ -28,7 +33,32 @@ func PingHandler(w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
 
-func RegisterHandler(w http.ResponseWriter, r *http.Request) error {
+func (s *server) ChallengeHandler(w http.ResponseWriter, r *http.Request) error {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	nonce, err := s.nonces.issue(host)
+	if errors.Is(err, errTooManyNonces) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(nonceTTL.Seconds())))
+		errorResponse(w, http.StatusTooManyRequests, err.Error())
+		return nil
+	}
+
+	env := envelope{
+		"status": "success",
+		"nonce":  nonce,
+	}
+
+	if err := writeJSON(w, http.StatusOK, env, nil); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *server) RegisterHandler(w http.ResponseWriter, r *http.Request) error {
 	var req api.RegisterRequest
 
 	if r.Body != nil {
@@ -40,6 +70,24 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) error {
 		}
 	}
 
+	if req.PublicKey == "" || req.Nonce == "" || req.Signature == "" {
+		errorResponse(w, http.StatusBadRequest, "publicKey, nonce and signature are required")
+		return nil
+	}
+
+	for _, group := range req.Groups {
+		if !validGroupID(group) {
+			errorResponse(w, http.StatusBadRequest, fmt.Sprintf("invalid group %q", group))
+			return nil
+		}
+	}
+
+	clientId, err := s.VerifyRegistration(req.PublicKey, req.Nonce, req.Signature)
+	if err != nil {
+		errorResponse(w, http.StatusUnauthorized, err.Error())
+		return nil
+	}
+
 	host, port, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
 		// If there is an error (e.g. missing port), use the address as is
@@ -52,10 +100,15 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) error {
 		publicPort = 0
 	}
 
-	clientId := RegisterClient(host, publicPort, req.LocalIP, req.LocalPort)
+	token, err := s.RegisterClient(clientId, req.Groups, host, publicPort, req.LocalIP, req.LocalPort, req.ReflexiveIP, req.ReflexivePort)
+	if err != nil {
+		return err
+	}
+
 	env := envelope{
 		"status":   "success",
 		"clientId": clientId,
+		"token":    token,
 	}
 
 	if err := writeJSON(w, http.StatusOK, env, nil); err != nil {
@@ -65,8 +118,15 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
 
-func UnregisterHandler(w http.ResponseWriter, r *http.Request) error {
-	UnregisterClient(r.URL.Query().Get("clientId"))
+func (s *server) UnregisterHandler(w http.ResponseWriter, r *http.Request) error {
+	clientId, ok := requestClientID(w, r)
+	if !ok {
+		return nil
+	}
+
+	if err := s.UnregisterClient(clientId); err != nil {
+		return err
+	}
 
 	env := envelope{
 		"status": "success",
@@ -79,14 +139,18 @@ func UnregisterHandler(w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
 
-func HeartbeatHandler(w http.ResponseWriter, r *http.Request) error {
-	clientId := r.URL.Query().Get("clientId")
-	if clientId == "" {
-		errorResponse(w, http.StatusBadRequest, "clientId is required")
+func (s *server) HeartbeatHandler(w http.ResponseWriter, r *http.Request) error {
+	clientId, ok := requestClientID(w, r)
+	if !ok {
 		return nil
 	}
 
-	if !TouchClient(clientId) {
+	found, err := s.TouchClient(clientId)
+	if err != nil {
+		return err
+	}
+
+	if !found {
 		errorResponse(w, http.StatusNotFound, "client not found")
 		return nil
 	}
@@ -104,17 +168,39 @@ func HeartbeatHandler(w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
 
-func DiscoverHandler(w http.ResponseWriter, r *http.Request) error {
-	clients := DiscoverClients()
+// DiscoverHandler lists the peers visible to the caller: members of the group
+// named by the group query parameter, or by default every client that shares a
+// group with the caller.
+func (s *server) DiscoverHandler(w http.ResponseWriter, r *http.Request) error {
+	callerId := authenticatedClientID(r)
+
+	var clients map[string]clientInfo
+	if group := r.URL.Query().Get("group"); group != "" {
+		member, err := s.IsGroupMember(callerId, group)
+		if err != nil {
+			return err
+		}
+
+		if !member {
+			errorResponse(w, http.StatusForbidden, "not a member of the requested group")
+			return nil
+		}
+
+		clients, err = s.DiscoverGroup(group)
+		if err != nil {
+			return err
+		}
+	} else {
+		var err error
+		clients, err = s.DiscoverPeers(callerId)
+		if err != nil {
+			return err
+		}
+	}
+
 	snapshots := make([]api.ClientSnapshot, 0, len(clients))
 	for id, info := range clients {
-		snapshots = append(snapshots, api.ClientSnapshot{
-			ClientID:   id,
-			PublicIP:   info.PublicIP,
-			PublicPort: info.PublicPort,
-			LocalIP:    info.LocalIP,
-			LocalPort:  info.LocalPort,
-		})
+		snapshots = append(snapshots, snapshot(id, info))
 	}
 
 	env := envelope{
@@ -128,3 +214,229 @@ func DiscoverHandler(w http.ResponseWriter, r *http.Request) error {
 
 	return nil
 }
+
+// EventsHandler streams peer events to the caller as Server-Sent Events until
+// the client disconnects. Only events about peers sharing a group with the
+// caller are sent.
+func (s *server) EventsHandler(w http.ResponseWriter, r *http.Request) error {
+	callerId := authenticatedClientID(r)
+
+	sub, ok, err := s.SubscribeEvents(callerId)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		errorResponse(w, http.StatusNotFound, "client not found")
+		return nil
+	}
+	defer s.events.unsubscribe(sub)
+
+	// The server's WriteTimeout would otherwise cut the stream off, so lift
+	// the deadline for this response. Not every ResponseWriter supports it.
+	rc := http.NewResponseController(w)
+	_ = rc.SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	if _, err := io.WriteString(w, ": connected\n\n"); err != nil {
+		return nil
+	}
+	_ = rc.Flush()
+
+	keepalive := time.NewTicker(eventKeepaliveInterval)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return nil
+		case <-keepalive.C:
+			if _, err := io.WriteString(w, ": keepalive\n\n"); err != nil {
+				return nil
+			}
+		case event, ok := <-sub.events:
+			if !ok {
+				// The broker dropped us for falling behind.
+				return nil
+			}
+
+			data, err := json.Marshal(event)
+			if err != nil {
+				return err
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data); err != nil {
+				return nil
+			}
+		}
+		_ = rc.Flush()
+	}
+}
+
+// PunchHandler introduces the caller to a peer for UDP hole punching. The peer
+// is told about the caller over its event stream, and both are given the same
+// time to start probing.
+func (s *server) PunchHandler(w http.ResponseWriter, r *http.Request) error {
+	callerId := authenticatedClientID(r)
+
+	var req api.PunchRequest
+
+	if r.Body != nil {
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+			errorResponse(w, http.StatusBadRequest, "invalid JSON body")
+			return nil
+		}
+	}
+
+	if req.PeerID == "" {
+		errorResponse(w, http.StatusBadRequest, "peerId is required")
+		return nil
+	}
+	if req.PeerID == callerId {
+		errorResponse(w, http.StatusBadRequest, "cannot punch a hole to yourself")
+		return nil
+	}
+
+	peer, startAt, err := s.IntroducePeers(callerId, req.PeerID)
+	switch {
+	case errors.Is(err, errPeerNotFound):
+		errorResponse(w, http.StatusNotFound, err.Error())
+		return nil
+	case errors.Is(err, errNotSharingGroup):
+		errorResponse(w, http.StatusForbidden, err.Error())
+		return nil
+	case errors.Is(err, errNoReflexiveAddr), errors.Is(err, errPeerNotListening):
+		errorResponse(w, http.StatusConflict, err.Error())
+		return nil
+	case err != nil:
+		return err
+	}
+
+	env := envelope{
+		"status":  "success",
+		"peer":    snapshot(req.PeerID, peer),
+		"startAt": startAt,
+	}
+
+	if err := writeJSON(w, http.StatusOK, env, nil); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// RelayHandler allocates a relay session between the caller and a peer, for
+// when neither a direct connection nor hole punching works. The peer is sent
+// its ticket over its event stream.
+func (s *server) RelayHandler(w http.ResponseWriter, r *http.Request) error {
+	callerId := authenticatedClientID(r)
+
+	var req api.RelayRequest
+
+	if r.Body != nil {
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+			errorResponse(w, http.StatusBadRequest, "invalid JSON body")
+			return nil
+		}
+	}
+
+	if req.PeerID == "" {
+		errorResponse(w, http.StatusBadRequest, "peerId is required")
+		return nil
+	}
+	if req.PeerID == callerId {
+		errorResponse(w, http.StatusBadRequest, "cannot relay to yourself")
+		return nil
+	}
+
+	address := s.relayAddress
+	if address == "" {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		address = net.JoinHostPort(host, strconv.Itoa(s.relayPort))
+	}
+
+	ticket, err := s.RelayPeers(callerId, req.PeerID, address)
+	switch {
+	case errors.Is(err, errPeerNotFound):
+		errorResponse(w, http.StatusNotFound, err.Error())
+		return nil
+	case errors.Is(err, errNotSharingGroup):
+		errorResponse(w, http.StatusForbidden, err.Error())
+		return nil
+	case errors.Is(err, errPeerNotListening):
+		errorResponse(w, http.StatusConflict, err.Error())
+		return nil
+	case errors.Is(err, errRelayFull):
+		errorResponse(w, http.StatusServiceUnavailable, err.Error())
+		return nil
+	case errors.Is(err, errRelayClientFull):
+		errorResponse(w, http.StatusTooManyRequests, err.Error())
+		return nil
+	case err != nil:
+		return err
+	}
+
+	env := envelope{
+		"status": "success",
+		"relay":  api.RelayTicket{Address: address, Ticket: ticket},
+	}
+
+	if err := writeJSON(w, http.StatusOK, env, nil); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func snapshot(id string, info clientInfo) api.ClientSnapshot {
+	return api.ClientSnapshot{
+		ClientID:      id,
+		Groups:        info.Groups,
+		PublicIP:      info.PublicIP,
+		PublicPort:    info.PublicPort,
+		LocalIP:       info.LocalIP,
+		LocalPort:     info.LocalPort,
+		ReflexiveIP:   info.ReflexiveIP,
+		ReflexivePort: info.ReflexivePort,
+	}
+}
+
+// requestClientID returns the client a request acts on: the authenticated
+// client, which must match the clientId query parameter if one is given. If
+// they differ an error response is written and ok is false.
+func requestClientID(w http.ResponseWriter, r *http.Request) (string, bool) {
+	clientId := authenticatedClientID(r)
+
+	if requested := r.URL.Query().Get("clientId"); requested != "" && requested != clientId {
+		errorResponse(w, http.StatusForbidden, "token does not belong to clientId")
+		return "", false
+	}
+
+	return clientId, true
+}
+
+// validGroupID reports whether group is a usable group ID: 1-64 characters
+// drawn from letters, digits, '.', '_' and '-'.
+func validGroupID(group string) bool {
+	if group == "" || len(group) > 64 {
+		return false
+	}
+	for _, c := range group {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '.', c == '_', c == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -2,9 +2,17 @@ package main
 
 import (
 	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
@@ -14,13 +22,14 @@ import (
 type registerResponsePayload struct {
 	Status   string `json:"status"`
 	ClientID string `json:"clientId"`
+	Token    string `json:"token"`
 	Error    string `json:"error"`
 }
 
 type discoverResponsePayload struct {
-	Status  string              `json:"status"`
+	Status  string               `json:"status"`
 	Clients []api.ClientSnapshot `json:"clients"`
-	Error   string              `json:"error"`
+	Error   string               `json:"error"`
 }
 
 func TestPingHandler(t *testing.T) {
@@ -60,14 +69,14 @@ func TestPingHandler(t *testing.T) {
 }
 
 func TestRegisterDiscoverUnregisterHandlers(t *testing.T) {
-	resetClients()
+	s := newTestServer(t)
 
-	registerBody := []byte(`{"localIp":"192.168.1.10","localPort":4000}`)
+	registerBody := signedRegisterBody(t, s, ed25519Signer(t), "192.168.1.10", 4000)
 	req := httptest.NewRequest(http.MethodPost, "/register", bytes.NewReader(registerBody))
 	req.RemoteAddr = "203.0.113.10:51234"
 	recorder := httptest.NewRecorder()
 
-	if err := RegisterHandler(recorder, req); err != nil {
+	if err := s.RegisterHandler(recorder, req); err != nil {
 		t.Fatalf("RegisterHandler returned error: %v", err)
 	}
 
@@ -80,13 +89,14 @@ func TestRegisterDiscoverUnregisterHandlers(t *testing.T) {
 		t.Fatalf("failed to decode register response: %v", err)
 	}
 
-	if reg.ClientID == "" {
-		t.Fatal("expected clientId to be set")
+	if reg.ClientID == "" || reg.Token == "" {
+		t.Fatal("expected clientId and token to be set")
 	}
 
 	discoverReq := httptest.NewRequest(http.MethodGet, "/discover", nil)
+	discoverReq.Header.Set("Authorization", "Bearer "+reg.Token)
 	discoverRecorder := httptest.NewRecorder()
-	if err := DiscoverHandler(discoverRecorder, discoverReq); err != nil {
+	if err := s.authenticated(s.DiscoverHandler)(discoverRecorder, discoverReq); err != nil {
 		t.Fatalf("DiscoverHandler returned error: %v", err)
 	}
 
@@ -115,8 +125,9 @@ func TestRegisterDiscoverUnregisterHandlers(t *testing.T) {
 	}
 
 	unregisterReq := httptest.NewRequest(http.MethodPost, "/unregister?clientId="+reg.ClientID, nil)
+	unregisterReq.Header.Set("Authorization", "Bearer "+reg.Token)
 	unregisterRecorder := httptest.NewRecorder()
-	if err := UnregisterHandler(unregisterRecorder, unregisterReq); err != nil {
+	if err := s.authenticated(s.UnregisterHandler)(unregisterRecorder, unregisterReq); err != nil {
 		t.Fatalf("UnregisterHandler returned error: %v", err)
 	}
 
@@ -126,7 +137,7 @@ func TestRegisterDiscoverUnregisterHandlers(t *testing.T) {
 
 	confirmReq := httptest.NewRequest(http.MethodGet, "/discover", nil)
 	confirmRecorder := httptest.NewRecorder()
-	if err := DiscoverHandler(confirmRecorder, confirmReq); err != nil {
+	if err := s.DiscoverHandler(confirmRecorder, confirmReq); err != nil {
 		t.Fatalf("DiscoverHandler returned error: %v", err)
 	}
 
@@ -140,14 +151,141 @@ func TestRegisterDiscoverUnregisterHandlers(t *testing.T) {
 	}
 }
 
+func TestRegisterHandlerRequiresSignature(t *testing.T) {
+	s := newTestServer(t)
+
+	req := httptest.NewRequest(http.MethodPost, "/register", bytes.NewReader([]byte(`{"localIp":"192.168.1.10","localPort":4000}`)))
+	recorder := httptest.NewRecorder()
+
+	if err := s.RegisterHandler(recorder, req); err != nil {
+		t.Fatalf("RegisterHandler returned error: %v", err)
+	}
+
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400, got %d", recorder.Code)
+	}
+}
+
+func TestRegisterHandlerRejectsBadSignature(t *testing.T) {
+	s := newTestServer(t)
+
+	var body api.RegisterRequest
+	if err := json.Unmarshal(signedRegisterBody(t, s, ed25519Signer(t), "", 0), &body); err != nil {
+		t.Fatalf("failed to decode body: %v", err)
+	}
+
+	// Sign the nonce with a different key than the one being registered.
+	other := ed25519Signer(t)
+	sig, err := other.Sign(rand.Reader, []byte(body.Nonce), crypto.Hash(0))
+	if err != nil {
+		t.Fatalf("failed to sign nonce: %v", err)
+	}
+	body.Signature = base64.StdEncoding.EncodeToString(sig)
+
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		t.Fatalf("failed to encode body: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/register", bytes.NewReader(encoded))
+	recorder := httptest.NewRecorder()
+	if err := s.RegisterHandler(recorder, req); err != nil {
+		t.Fatalf("RegisterHandler returned error: %v", err)
+	}
+
+	if recorder.Code != http.StatusUnauthorized {
+		t.Fatalf("expected status 401, got %d", recorder.Code)
+	}
+}
+
+func TestRegisterHandlerRejectsInvalidGroup(t *testing.T) {
+	s := newTestServer(t)
+
+	var body api.RegisterRequest
+	if err := json.Unmarshal(signedRegisterBody(t, s, ed25519Signer(t), "", 0), &body); err != nil {
+		t.Fatalf("failed to decode body: %v", err)
+	}
+	body.Groups = []string{"not a group!"}
+
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		t.Fatalf("failed to encode body: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/register", bytes.NewReader(encoded))
+	recorder := httptest.NewRecorder()
+	if err := s.RegisterHandler(recorder, req); err != nil {
+		t.Fatalf("RegisterHandler returned error: %v", err)
+	}
+
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400, got %d", recorder.Code)
+	}
+}
+
+func TestDiscoverHandlerIsolatesGroups(t *testing.T) {
+	s := newTestServer(t)
+
+	alphaToken := mustRegister(t, s, "alpha-1", []string{"alpha"}, "203.0.113.30", 5200, "", 0)
+	mustRegister(t, s, "alpha-2", []string{"alpha", "shared"}, "203.0.113.31", 5201, "", 0)
+	mustRegister(t, s, "beta-1", []string{"beta", "shared"}, "203.0.113.32", 5202, "", 0)
+
+	discover := func(path string) (int, discoverResponsePayload) {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Authorization", "Bearer "+alphaToken)
+		recorder := httptest.NewRecorder()
+		if err := s.authenticated(s.DiscoverHandler)(recorder, req); err != nil {
+			t.Fatalf("DiscoverHandler returned error: %v", err)
+		}
+
+		var payload discoverResponsePayload
+		if err := json.NewDecoder(recorder.Body).Decode(&payload); err != nil {
+			t.Fatalf("failed to decode discover response: %v", err)
+		}
+		return recorder.Code, payload
+	}
+
+	code, all := discover("/discover")
+	if code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", code)
+	}
+	if len(all.Clients) != 2 {
+		t.Fatalf("expected 2 clients sharing a group with alpha-1, got %d", len(all.Clients))
+	}
+	for _, client := range all.Clients {
+		if client.ClientID == "beta-1" {
+			t.Fatal("expected beta-1 not to be visible to alpha-1")
+		}
+	}
+
+	code, alpha := discover("/discover?group=alpha")
+	if code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", code)
+	}
+	if len(alpha.Clients) != 2 {
+		t.Fatalf("expected 2 members of alpha, got %d", len(alpha.Clients))
+	}
+
+	code, _ = discover("/discover?group=beta")
+	if code != http.StatusForbidden {
+		t.Fatalf("expected status 403 for a group alpha-1 is not in, got %d", code)
+	}
+}
+
 func TestHeartbeatHandler(t *testing.T) {
-	resetClients()
+	s := newTestServer(t)
 
-	id := RegisterClient("203.0.113.55", 5010, "192.168.1.55", 4055)
+	id := "client-heartbeat"
+	token := mustRegister(t, s, id, nil, "203.0.113.55", 5010, "192.168.1.55", 4055)
+
+	if _, err := s.store.Touch(id, time.Now().UTC().Add(-2*time.Minute)); err != nil {
+		t.Fatalf("Touch returned error: %v", err)
+	}
 
 	req := httptest.NewRequest(http.MethodPost, "/heartbeat?clientId="+id, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
 	recorder := httptest.NewRecorder()
-	if err := HeartbeatHandler(recorder, req); err != nil {
+	if err := s.authenticated(s.HeartbeatHandler)(recorder, req); err != nil {
 		t.Fatalf("HeartbeatHandler returned error: %v", err)
 	}
 
@@ -155,37 +293,293 @@ func TestHeartbeatHandler(t *testing.T) {
 		t.Fatalf("expected status 200, got %d", recorder.Code)
 	}
 
-	mu.Lock()
-	info := clients[id]
-	mu.Unlock()
-
-	if time.Since(info.LastSeen) > time.Minute {
+	if time.Since(mustGet(t, s, id).LastSeen) > time.Minute {
 		t.Fatalf("expected LastSeen to be updated recently")
 	}
 }
 
-func TestHeartbeatHandlerMissingClientID(t *testing.T) {
-	req := httptest.NewRequest(http.MethodPost, "/heartbeat", nil)
+func TestHeartbeatHandlerMissingToken(t *testing.T) {
+	s := newTestServer(t)
+
+	id := "client-heartbeat"
+	mustRegister(t, s, id, nil, "203.0.113.55", 5010, "", 0)
+
+	req := httptest.NewRequest(http.MethodPost, "/heartbeat?clientId="+id, nil)
 	recorder := httptest.NewRecorder()
 
-	if err := HeartbeatHandler(recorder, req); err != nil {
+	if err := s.authenticated(s.HeartbeatHandler)(recorder, req); err != nil {
 		t.Fatalf("HeartbeatHandler returned error: %v", err)
 	}
 
-	if recorder.Code != http.StatusBadRequest {
-		t.Fatalf("expected status 400, got %d", recorder.Code)
+	if recorder.Code != http.StatusUnauthorized {
+		t.Fatalf("expected status 401, got %d", recorder.Code)
 	}
 }
 
 func TestHeartbeatHandlerUnknownClient(t *testing.T) {
+	s := newTestServer(t)
+
 	req := httptest.NewRequest(http.MethodPost, "/heartbeat?clientId=missing", nil)
+	req.Header.Set("Authorization", "Bearer missing.secret")
 	recorder := httptest.NewRecorder()
 
-	if err := HeartbeatHandler(recorder, req); err != nil {
+	if err := s.authenticated(s.HeartbeatHandler)(recorder, req); err != nil {
 		t.Fatalf("HeartbeatHandler returned error: %v", err)
 	}
 
-	if recorder.Code != http.StatusNotFound {
-		t.Fatalf("expected status 404, got %d", recorder.Code)
+	if recorder.Code != http.StatusUnauthorized {
+		t.Fatalf("expected status 401, got %d", recorder.Code)
+	}
+}
+
+func TestUnregisterHandlerRejectsOtherClient(t *testing.T) {
+	s := newTestServer(t)
+
+	mustRegister(t, s, "victim", nil, "203.0.113.60", 5020, "", 0)
+	attackerToken := mustRegister(t, s, "attacker", nil, "203.0.113.61", 5021, "", 0)
+
+	req := httptest.NewRequest(http.MethodPost, "/unregister?clientId=victim", nil)
+	req.Header.Set("Authorization", "Bearer "+attackerToken)
+	recorder := httptest.NewRecorder()
+
+	if err := s.authenticated(s.UnregisterHandler)(recorder, req); err != nil {
+		t.Fatalf("UnregisterHandler returned error: %v", err)
+	}
+
+	if recorder.Code != http.StatusForbidden {
+		t.Fatalf("expected status 403, got %d", recorder.Code)
+	}
+
+	if _, ok, _ := s.store.Get("victim"); !ok {
+		t.Fatal("expected victim to remain registered")
+	}
+}
+
+func ed25519Signer(t *testing.T) crypto.Signer {
+	t.Helper()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	return priv
+}
+
+// signedRegisterBody obtains a nonce from ChallengeHandler and returns a
+// register request body signed by signer.
+func signedRegisterBody(t *testing.T, s *server, signer crypto.Signer, localIP string, localPort int) []byte {
+	t.Helper()
+
+	recorder := httptest.NewRecorder()
+	if err := s.ChallengeHandler(recorder, httptest.NewRequest(http.MethodGet, "/challenge", nil)); err != nil {
+		t.Fatalf("ChallengeHandler returned error: %v", err)
+	}
+
+	var challenge api.ChallengeResponse
+	if err := json.NewDecoder(recorder.Body).Decode(&challenge); err != nil {
+		t.Fatalf("failed to decode challenge response: %v", err)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		t.Fatalf("failed to marshal public key: %v", err)
+	}
+
+	message := []byte(challenge.Nonce)
+	opts := crypto.SignerOpts(crypto.Hash(0))
+	if _, ok := signer.(*ecdsa.PrivateKey); ok {
+		digest := sha256.Sum256(message)
+		message = digest[:]
+		opts = crypto.SHA256
+	}
+
+	sig, err := signer.Sign(rand.Reader, message, opts)
+	if err != nil {
+		t.Fatalf("failed to sign nonce: %v", err)
+	}
+
+	body, err := json.Marshal(api.RegisterRequest{
+		LocalIP:   localIP,
+		LocalPort: localPort,
+		PublicKey: base64.StdEncoding.EncodeToString(der),
+		Nonce:     challenge.Nonce,
+		Signature: base64.StdEncoding.EncodeToString(sig),
+	})
+	if err != nil {
+		t.Fatalf("failed to encode register request: %v", err)
+	}
+	return body
+}
+
+func TestPunchHandler(t *testing.T) {
+	s := newTestServer(t)
+
+	register := func(id string, groups []string, reflexiveIP string, reflexivePort int) string {
+		token, err := s.RegisterClient(id, groups, "203.0.113.1", 5000, "", 0, reflexiveIP, reflexivePort)
+		if err != nil {
+			t.Fatalf("RegisterClient returned error: %v", err)
+		}
+		return token
+	}
+
+	callerToken := register("caller", []string{"alpha"}, "203.0.113.1", 61000)
+	register("target", []string{"alpha"}, "198.51.100.7", 62000)
+	register("outsider", []string{"beta"}, "198.51.100.8", 62001)
+	register("no-stun", []string{"alpha"}, "", 0)
+
+	punch := func(body string) (int, api.PunchResponse) {
+		req := httptest.NewRequest(http.MethodPost, "/punch", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+callerToken)
+		recorder := httptest.NewRecorder()
+		if err := s.authenticated(s.PunchHandler)(recorder, req); err != nil {
+			t.Fatalf("PunchHandler returned error: %v", err)
+		}
+
+		var payload api.PunchResponse
+		if err := json.NewDecoder(recorder.Body).Decode(&payload); err != nil {
+			t.Fatalf("failed to decode punch response: %v", err)
+		}
+		return recorder.Code, payload
+	}
+
+	// The target isn't subscribed to events yet, so it can't be told.
+	if code, _ := punch(`{"peerId":"target"}`); code != http.StatusConflict {
+		t.Fatalf("expected status 409 for a peer without an event stream, got %d", code)
+	}
+
+	sub := s.events.subscribe("target", []string{"alpha"})
+
+	before := time.Now()
+	code, payload := punch(`{"peerId":"target"}`)
+	if code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d (%s)", code, payload.Error)
+	}
+	if payload.Peer.ClientID != "target" || payload.Peer.ReflexiveIP != "198.51.100.7" || payload.Peer.ReflexivePort != 62000 {
+		t.Fatalf("unexpected peer in response: %+v", payload.Peer)
+	}
+	if !payload.StartAt.After(before) {
+		t.Fatalf("expected a start time in the future, got %s", payload.StartAt)
+	}
+
+	select {
+	case event := <-sub.events:
+		if event.Type != api.PunchRequested || event.Client.ClientID != "caller" || event.Client.ReflexivePort != 61000 {
+			t.Fatalf("unexpected event: %+v", event)
+		}
+		if !event.StartAt.Equal(payload.StartAt) {
+			t.Fatalf("expected both sides to share start time %s, got %s", payload.StartAt, event.StartAt)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected target to be sent a punch-requested event")
+	}
+
+	if code, _ := punch(`{}`); code != http.StatusBadRequest {
+		t.Errorf("expected status 400 without peerId, got %d", code)
+	}
+	if code, _ := punch(`{"peerId":"caller"}`); code != http.StatusBadRequest {
+		t.Errorf("expected status 400 when punching to self, got %d", code)
+	}
+	if code, _ := punch(`{"peerId":"missing"}`); code != http.StatusNotFound {
+		t.Errorf("expected status 404 for an unknown peer, got %d", code)
+	}
+	if code, _ := punch(`{"peerId":"outsider"}`); code != http.StatusForbidden {
+		t.Errorf("expected status 403 for a peer in another group, got %d", code)
+	}
+	if code, _ := punch(`{"peerId":"no-stun"}`); code != http.StatusConflict {
+		t.Errorf("expected status 409 for a peer without a reflexive address, got %d", code)
+	}
+}
+
+func TestRelayHandler(t *testing.T) {
+	s := newTestServer(t)
+	s.relayPort = 3479
+
+	register := func(id string, groups []string) string {
+		token, err := s.RegisterClient(id, groups, "203.0.113.1", 5000, "", 0, "", 0)
+		if err != nil {
+			t.Fatalf("RegisterClient returned error: %v", err)
+		}
+		return token
+	}
+
+	callerToken := register("caller", []string{"alpha"})
+	register("target", []string{"alpha"})
+	register("outsider", []string{"beta"})
+
+	relay := func(body string) (int, api.RelayResponse) {
+		req := httptest.NewRequest(http.MethodPost, "http://signalling.example:8089/relay", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+callerToken)
+		recorder := httptest.NewRecorder()
+		if err := s.authenticated(s.RelayHandler)(recorder, req); err != nil {
+			t.Fatalf("RelayHandler returned error: %v", err)
+		}
+
+		var payload api.RelayResponse
+		if err := json.NewDecoder(recorder.Body).Decode(&payload); err != nil {
+			t.Fatalf("failed to decode relay response: %v", err)
+		}
+		return recorder.Code, payload
+	}
+
+	if code, _ := relay(`{"peerId":"target"}`); code != http.StatusConflict {
+		t.Fatalf("expected status 409 for a peer without an event stream, got %d", code)
+	}
+	if n := s.relay.active(); n != 0 {
+		t.Fatalf("expected the session nobody was told about to be freed, %d still active", n)
+	}
+
+	sub := s.events.subscribe("target", []string{"alpha"})
+
+	code, payload := relay(`{"peerId":"target"}`)
+	if code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d (%s)", code, payload.Error)
+	}
+	if payload.Relay.Address != "signalling.example:3479" || payload.Relay.Ticket == "" {
+		t.Fatalf("unexpected relay in response: %+v", payload.Relay)
+	}
+
+	select {
+	case event := <-sub.events:
+		if event.Type != api.RelayRequested || event.Client.ClientID != "caller" || event.Relay == nil {
+			t.Fatalf("unexpected event: %+v", event)
+		}
+		if event.Relay.Address != payload.Relay.Address || event.Relay.Ticket == payload.Relay.Ticket {
+			t.Fatalf("expected the peer to get the same relay with its own ticket, got %+v", event.Relay)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected target to be sent a relay-requested event")
+	}
+
+	s.relayAddress = "relay.example:443"
+	if _, payload := relay(`{"peerId":"target"}`); payload.Relay.Address != "relay.example:443" {
+		t.Fatalf("expected the configured relay address, got %q", payload.Relay.Address)
+	}
+	<-sub.events
+
+	if code, _ := relay(`{}`); code != http.StatusBadRequest {
+		t.Errorf("expected status 400 without peerId, got %d", code)
+	}
+	if code, _ := relay(`{"peerId":"caller"}`); code != http.StatusBadRequest {
+		t.Errorf("expected status 400 when relaying to self, got %d", code)
+	}
+	if code, _ := relay(`{"peerId":"missing"}`); code != http.StatusNotFound {
+		t.Errorf("expected status 404 for an unknown peer, got %d", code)
+	}
+	if code, _ := relay(`{"peerId":"outsider"}`); code != http.StatusForbidden {
+		t.Errorf("expected status 403 for a peer in another group, got %d", code)
+	}
+
+	s.relay = newRelay(0, 0, 0)
+	if code, _ := relay(`{"peerId":"target"}`); code != http.StatusServiceUnavailable {
+		t.Errorf("expected status 503 once the relay is full, got %d", code)
+	}
+
+	s.relay = newRelay(8, 1, 0)
+	if code, payload := relay(`{"peerId":"target"}`); code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d (%s)", code, payload.Error)
+	}
+	<-sub.events
+	if code, _ := relay(`{"peerId":"target"}`); code != http.StatusTooManyRequests {
+		t.Errorf("expected status 429 once the caller has used its share of the relay, got %d", code)
 	}
 }
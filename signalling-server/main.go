@@ -1,8 +1,10 @@
 package main
 
 import (
+	"flag"
 	"log/slog"
 	"os"
+	"strconv"
 
 	"github.com/joho/godotenv"
 )
@@ -10,6 +12,16 @@ import (
 func main() {
 	envErr := godotenv.Load()
 
+	storeKind := flag.String("store", envOrDefault("REGISTRY_STORE", "memory"), "registry store to use: memory or bolt (env REGISTRY_STORE)")
+	storePath := flag.String("store-path", envOrDefault("REGISTRY_STORE_PATH", "registry.db"), "database file for the bolt store (env REGISTRY_STORE_PATH)")
+	stunPort := flag.Int("stun-port", envIntOrDefault("STUN_PORT", 3478), "UDP port for the STUN binding service (env STUN_PORT)")
+	relayPort := flag.Int("relay-port", envIntOrDefault("RELAY_PORT", 8090), "TCP port for the relay (env RELAY_PORT)")
+	relayAddr := flag.String("relay-addr", envOrDefault("RELAY_ADDR", ""), "host:port clients are told to reach the relay on, defaulting to the API host (env RELAY_ADDR)")
+	relaySessions := flag.Int("relay-max-sessions", envIntOrDefault("RELAY_MAX_SESSIONS", defaultRelaySessions), "maximum concurrent relay sessions (env RELAY_MAX_SESSIONS)")
+	relayClientSessions := flag.Int("relay-max-sessions-per-client", envIntOrDefault("RELAY_MAX_SESSIONS_PER_CLIENT", defaultRelaySessionsPerClient), "maximum concurrent relay sessions asked for by one client (env RELAY_MAX_SESSIONS_PER_CLIENT)")
+	relayRate := flag.Int("relay-rate", envIntOrDefault("RELAY_RATE", defaultRelayBandwidth/1024), "per-session relay bandwidth cap in KiB/s each way, 0 for none (env RELAY_RATE)")
+	flag.Parse()
+
 	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
 	slog.SetDefault(logger)
 
@@ -18,9 +30,37 @@ func main() {
 		slog.Info("No .env file found, relying on environment variables")
 	}
 
+	store, err := openStore(*storeKind, *storePath)
+	if err != nil {
+		slog.Error("Failed to open registry store", slog.String("store", *storeKind), slog.String("error", err.Error()))
+		return
+	}
+	defer store.Close()
+
+	slog.Info("Opened registry store", slog.String("store", *storeKind))
+
+	s := newServer(store)
+	s.relay = newRelay(*relaySessions, *relayClientSessions, *relayRate*1024)
+	s.relayAddress = *relayAddr
+
 	// Start the HTTP server.
-	if err := Serve(8089); err != nil {
+	cfg := serveConfig{HTTPPort: 8089, STUNPort: *stunPort, RelayPort: *relayPort}
+	if err := s.Serve(cfg); err != nil {
 		slog.Error("Failed to start server", slog.String("error", err.Error()))
 		return
 	}
 }
+
+func envOrDefault(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func envIntOrDefault(key string, fallback int) int {
+	if value, err := strconv.Atoi(os.Getenv(key)); err == nil {
+		return value
+	}
+	return fallback
+}
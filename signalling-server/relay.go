@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// The relay is the fallback for peers that can't reach each other directly or
+// through hole punching. Each side connects out to the relay over TCP and
+// presents a ticket, and once both have arrived their streams are spliced
+// together. The peer protocol's TLS runs end to end through the relay, so it
+// only ever sees ciphertext.
+
+const (
+	// relayCopyBuffer is the most that is forwarded in one go, and the burst
+	// allowed by the bandwidth cap.
+	relayCopyBuffer = 32 * 1024
+
+	defaultRelaySessions          = 32
+	defaultRelaySessionsPerClient = 4
+	defaultRelayBandwidth         = 512 * 1024
+)
+
+var (
+	// relayPairTimeout is how long a session waits for both sides to arrive
+	// before it is torn down.
+	relayPairTimeout = 30 * time.Second
+	// relayTicketTimeout bounds how long a new connection has to present its
+	// ticket.
+	relayTicketTimeout = 10 * time.Second
+
+	errRelayFull       = errors.New("relay session limit reached")
+	errRelayClientFull = errors.New("too many relay sessions requested by this client")
+)
+
+// relay allocates relay sessions and splices the connections joining them.
+type relay struct {
+	// maxSessions caps the sessions that may exist at once, whether waiting
+	// for their peers or forwarding.
+	maxSessions int
+	// maxPerClient caps the sessions any one client may have asked for at
+	// once, so that a single client can't take every slot.
+	maxPerClient int
+	// bytesPerSecond caps each direction of each session. Zero means
+	// unlimited.
+	bytesPerSecond int
+
+	mu       sync.Mutex
+	sessions map[*relaySession]struct{}
+	tickets  map[string]relayEndpoint
+	// perClient counts the sessions each client has asked for.
+	perClient map[string]int
+}
+
+type relaySession struct {
+	// owner is the client that asked for the session.
+	owner   string
+	conns   [2]net.Conn
+	readers [2]*bufio.Reader
+	expiry  *time.Timer
+}
+
+// relayEndpoint is what a ticket grants: one side of one session.
+type relayEndpoint struct {
+	session *relaySession
+	side    int
+}
+
+func newRelay(maxSessions, maxPerClient, bytesPerSecond int) *relay {
+	return &relay{
+		maxSessions:    maxSessions,
+		maxPerClient:   maxPerClient,
+		bytesPerSecond: bytesPerSecond,
+		sessions:       make(map[*relaySession]struct{}),
+		tickets:        make(map[string]relayEndpoint),
+		perClient:      make(map[string]int),
+	}
+}
+
+// allocate creates a session asked for by clientID and returns the tickets
+// for its two sides.
+func (r *relay) allocate(clientID string) (string, string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.sessions) >= r.maxSessions {
+		return "", "", errRelayFull
+	}
+	if r.perClient[clientID] >= r.maxPerClient {
+		return "", "", errRelayClientFull
+	}
+
+	first, second := newRelayTicket(), newRelayTicket()
+	session := &relaySession{owner: clientID}
+	session.expiry = time.AfterFunc(relayPairTimeout, func() { r.expire(session) })
+
+	r.sessions[session] = struct{}{}
+	r.perClient[clientID]++
+	r.tickets[first] = relayEndpoint{session: session, side: 0}
+	r.tickets[second] = relayEndpoint{session: session, side: 1}
+	return first, second, nil
+}
+
+// cancel tears down the unused session that ticket belongs to, such as one
+// whose peer couldn't be sent its ticket.
+func (r *relay) cancel(ticket string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if endpoint, ok := r.tickets[ticket]; ok {
+		endpoint.session.expiry.Stop()
+		r.teardown(endpoint.session)
+	}
+}
+
+// active returns the number of sessions currently allocated.
+func (r *relay) active() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return len(r.sessions)
+}
+
+// serve accepts relay connections on listener until it is closed.
+func (r *relay) serve(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				slog.Error("Relay accept failed", slog.String("error", err.Error()))
+			}
+			return
+		}
+		go r.join(conn)
+	}
+}
+
+// join reads the ticket a new connection presents as its first line and adds
+// the connection to that ticket's session.
+func (r *relay) join(conn net.Conn) {
+	_ = conn.SetReadDeadline(time.Now().Add(relayTicketTimeout))
+	reader := bufio.NewReaderSize(conn, relayCopyBuffer)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+
+	r.mu.Lock()
+	ticket := strings.TrimSpace(line)
+	endpoint, ok := r.tickets[ticket]
+	if !ok {
+		r.mu.Unlock()
+		slog.Info("Relay connection with unknown ticket", slog.String("remoteAddr", conn.RemoteAddr().String()))
+		conn.Close()
+		return
+	}
+	delete(r.tickets, ticket)
+
+	session := endpoint.session
+	session.conns[endpoint.side] = conn
+	session.readers[endpoint.side] = reader
+	paired := session.conns[0] != nil && session.conns[1] != nil
+	if paired {
+		session.expiry.Stop()
+	}
+	r.mu.Unlock()
+
+	if paired {
+		go r.splice(session)
+	}
+}
+
+// splice forwards data between the two sides of a session until either side
+// closes, then releases the session.
+func (r *relay) splice(session *relaySession) {
+	slog.Info("Relay session started",
+		slog.String("from", session.conns[0].RemoteAddr().String()),
+		slog.String("to", session.conns[1].RemoteAddr().String()))
+
+	var wg sync.WaitGroup
+	for side := range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.forward(session.conns[1-side], session.readers[side])
+			// Closing both ends unblocks the copy in the other direction.
+			session.conns[0].Close()
+			session.conns[1].Close()
+		}()
+	}
+	wg.Wait()
+
+	r.mu.Lock()
+	r.release(session)
+	r.mu.Unlock()
+
+	slog.Info("Relay session ended")
+}
+
+// forward copies from src to dst, holding to the per-session bandwidth cap.
+func (r *relay) forward(dst io.Writer, src io.Reader) {
+	var limiter *rate.Limiter
+	if r.bytesPerSecond > 0 {
+		limiter = rate.NewLimiter(rate.Limit(r.bytesPerSecond), relayCopyBuffer)
+	}
+
+	buf := make([]byte, relayCopyBuffer)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if limiter != nil {
+				if werr := limiter.WaitN(context.Background(), n); werr != nil {
+					return
+				}
+			}
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// expire tears down a session whose sides didn't both arrive in time.
+func (r *relay) expire(session *relaySession) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if session.conns[0] != nil && session.conns[1] != nil {
+		return
+	}
+	r.teardown(session)
+}
+
+// teardown closes whichever sides of an unpaired session have arrived and
+// releases it along with its tickets. r.mu must be held.
+func (r *relay) teardown(session *relaySession) {
+	for ticket, endpoint := range r.tickets {
+		if endpoint.session == session {
+			delete(r.tickets, ticket)
+		}
+	}
+	for _, conn := range session.conns {
+		if conn != nil {
+			conn.Close()
+		}
+	}
+	r.release(session)
+}
+
+// release frees the slot session held. r.mu must be held.
+func (r *relay) release(session *relaySession) {
+	if _, ok := r.sessions[session]; !ok {
+		return
+	}
+	delete(r.sessions, session)
+	r.perClient[session.owner]--
+	if r.perClient[session.owner] <= 0 {
+		delete(r.perClient, session.owner)
+	}
+}
+
+func newRelayTicket() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// startRelay runs r on a loopback listener and returns its address.
+func startRelay(t *testing.T, r *relay) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go r.serve(listener)
+	return listener.Addr().String()
+}
+
+// joinRelay connects to the relay at addr and presents ticket.
+func joinRelay(t *testing.T, addr, ticket string) net.Conn {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial relay: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	if _, err := io.WriteString(conn, ticket+"\n"); err != nil {
+		t.Fatalf("failed to send ticket: %v", err)
+	}
+	return conn
+}
+
+func TestRelaySplicesBothDirections(t *testing.T) {
+	r := newRelay(4, 4, 0)
+	addr := startRelay(t, r)
+
+	first, second, err := r.allocate("client-a")
+	if err != nil {
+		t.Fatalf("allocate returned error: %v", err)
+	}
+
+	a := joinRelay(t, addr, first)
+	// Data sent before the other side arrives is held until it does.
+	if _, err := io.WriteString(a, "ping\n"); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	b := joinRelay(t, addr, second)
+
+	_ = b.SetReadDeadline(time.Now().Add(2 * time.Second))
+	line, err := bufio.NewReader(b).ReadString('\n')
+	if err != nil || line != "ping\n" {
+		t.Fatalf("expected ping, got %q (%v)", line, err)
+	}
+
+	if _, err := io.WriteString(b, "pong\n"); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	_ = a.SetReadDeadline(time.Now().Add(2 * time.Second))
+	line, err = bufio.NewReader(a).ReadString('\n')
+	if err != nil || line != "pong\n" {
+		t.Fatalf("expected pong, got %q (%v)", line, err)
+	}
+
+	// Closing one side ends the session and frees its slot.
+	a.Close()
+	_ = b.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := b.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expected the other side to be closed")
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for r.active() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the session to be released, %d still active", r.active())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRelayRejectsUnknownAndReusedTickets(t *testing.T) {
+	r := newRelay(4, 4, 0)
+	addr := startRelay(t, r)
+
+	conn := joinRelay(t, addr, "not-a-ticket")
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expected a connection with an unknown ticket to be closed")
+	}
+
+	first, _, err := r.allocate("client-a")
+	if err != nil {
+		t.Fatalf("allocate returned error: %v", err)
+	}
+	joinRelay(t, addr, first)
+
+	reused := joinRelay(t, addr, first)
+	_ = reused.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := reused.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expected a ticket to be usable only once")
+	}
+}
+
+func TestRelaySessionLimit(t *testing.T) {
+	r := newRelay(2, 2, 0)
+
+	for range 2 {
+		if _, _, err := r.allocate("client-a"); err != nil {
+			t.Fatalf("allocate returned error: %v", err)
+		}
+	}
+	if _, _, err := r.allocate("client-a"); err != errRelayFull {
+		t.Fatalf("expected errRelayFull once the limit is reached, got %v", err)
+	}
+}
+
+func TestRelayPerClientLimit(t *testing.T) {
+	r := newRelay(4, 2, 0)
+
+	var tickets []string
+	for range 2 {
+		ticket, _, err := r.allocate("client-a")
+		if err != nil {
+			t.Fatalf("allocate returned error: %v", err)
+		}
+		tickets = append(tickets, ticket)
+	}
+	if _, _, err := r.allocate("client-a"); err != errRelayClientFull {
+		t.Fatalf("expected errRelayClientFull once the client's limit is reached, got %v", err)
+	}
+	if _, _, err := r.allocate("client-b"); err != nil {
+		t.Fatalf("expected another client to get a session, got %v", err)
+	}
+
+	// A cancelled session gives the client its slot back.
+	r.cancel(tickets[0])
+	if r.active() != 2 {
+		t.Fatalf("expected the cancelled session to be released, %d active", r.active())
+	}
+	if _, _, err := r.allocate("client-a"); err != nil {
+		t.Fatalf("expected a free slot after cancelling, got %v", err)
+	}
+}
+
+func TestRelayExpiresUnpairedSessions(t *testing.T) {
+	previous := relayPairTimeout
+	relayPairTimeout = 50 * time.Millisecond
+	t.Cleanup(func() { relayPairTimeout = previous })
+
+	r := newRelay(1, 1, 0)
+	addr := startRelay(t, r)
+
+	first, second, err := r.allocate("client-a")
+	if err != nil {
+		t.Fatalf("allocate returned error: %v", err)
+	}
+	a := joinRelay(t, addr, first)
+
+	_ = a.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := a.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expected the waiting side to be closed once the session expired")
+	}
+	if r.active() != 0 {
+		t.Fatalf("expected the expired session to be released, %d still active", r.active())
+	}
+
+	// The other ticket went with it, and the slot can be reused.
+	b := joinRelay(t, addr, second)
+	_ = b.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := b.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expected the expired session's other ticket to be rejected")
+	}
+	if _, _, err := r.allocate("client-a"); err != nil {
+		t.Fatalf("expected a free slot after expiry, got %v", err)
+	}
+}
+
+func TestRelayBandwidthCap(t *testing.T) {
+	const rate = 64 * 1024
+
+	r := newRelay(1, 1, rate)
+	addr := startRelay(t, r)
+
+	first, second, err := r.allocate("client-a")
+	if err != nil {
+		t.Fatalf("allocate returned error: %v", err)
+	}
+	a := joinRelay(t, addr, first)
+	b := joinRelay(t, addr, second)
+
+	// The first relayCopyBuffer bytes go out as a burst; the rest are paced.
+	payload := make([]byte, relayCopyBuffer+rate/2)
+	go a.Write(payload)
+
+	start := time.Now()
+	_ = b.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(b, make([]byte, len(payload))); err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Fatalf("expected the transfer to be held to %d bytes/s, took only %s", rate, elapsed)
+	}
+}
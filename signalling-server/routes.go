@@ -7,17 +7,21 @@ import (
 	"github.com/julienschmidt/httprouter"
 )
 
-func routes() http.Handler {
+func (s *server) routes() http.Handler {
 	router := httprouter.New()
 
 	router.NotFound = http.HandlerFunc(notFoundResponse)
 	router.MethodNotAllowed = http.HandlerFunc(methodNotAllowedResponse)
 
 	router.HandlerFunc(http.MethodGet, "/ping", handle(PingHandler))
-	router.HandlerFunc(http.MethodGet, "/discover", handle(DiscoverHandler))
-	router.HandlerFunc(http.MethodPost, "/register", handle(RegisterHandler))
-	router.HandlerFunc(http.MethodPost, "/unregister", handle(UnregisterHandler))
-	router.HandlerFunc(http.MethodPost, "/heartbeat", handle(HeartbeatHandler))
+	router.HandlerFunc(http.MethodGet, "/challenge", handle(s.ChallengeHandler))
+	router.HandlerFunc(http.MethodPost, "/register", handle(s.RegisterHandler))
+	router.HandlerFunc(http.MethodGet, "/discover", handle(s.authenticated(s.DiscoverHandler)))
+	router.HandlerFunc(http.MethodGet, "/events", handle(s.authenticated(s.EventsHandler)))
+	router.HandlerFunc(http.MethodPost, "/punch", handle(s.authenticated(s.PunchHandler)))
+	router.HandlerFunc(http.MethodPost, "/relay", handle(s.authenticated(s.RelayHandler)))
+	router.HandlerFunc(http.MethodPost, "/unregister", handle(s.authenticated(s.UnregisterHandler)))
+	router.HandlerFunc(http.MethodPost, "/heartbeat", handle(s.authenticated(s.HeartbeatHandler)))
 
 	return recoverPanic(router)
 }
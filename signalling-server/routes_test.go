@@ -7,7 +7,7 @@ import (
 )
 
 func TestRoutesPing(t *testing.T) {
-	router := routes()
+	router := newTestServer(t).routes()
 
 	req := httptest.NewRequest(http.MethodGet, "/ping", nil)
 	recorder := httptest.NewRecorder()
@@ -20,7 +20,7 @@ func TestRoutesPing(t *testing.T) {
 }
 
 func TestRoutesNotFound(t *testing.T) {
-	router := routes()
+	router := newTestServer(t).routes()
 
 	req := httptest.NewRequest(http.MethodGet, "/missing", nil)
 	recorder := httptest.NewRecorder()
@@ -33,7 +33,7 @@ func TestRoutesNotFound(t *testing.T) {
 }
 
 func TestRoutesMethodNotAllowed(t *testing.T) {
-	router := routes()
+	router := newTestServer(t).routes()
 
 	req := httptest.NewRequest(http.MethodPost, "/ping", nil)
 	recorder := httptest.NewRecorder()
@@ -44,3 +44,16 @@ func TestRoutesMethodNotAllowed(t *testing.T) {
 		t.Fatalf("expected status 405, got %d", recorder.Code)
 	}
 }
+
+func TestRoutesDiscoverRequiresToken(t *testing.T) {
+	router := newTestServer(t).routes()
+
+	req := httptest.NewRequest(http.MethodGet, "/discover", nil)
+	recorder := httptest.NewRecorder()
+
+	router.ServeHTTP(recorder, req)
+
+	if recorder.Code != http.StatusUnauthorized {
+		t.Fatalf("expected status 401, got %d", recorder.Code)
+	}
+}
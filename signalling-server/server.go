@@ -5,26 +5,109 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 )
 
-func Serve(port int) error {
+// server holds the state shared by the HTTP handlers.
+type server struct {
+	store Store
+	// registryMu serialises changes to the registry together with the events
+	// published for them, so that each change is judged against the one
+	// before it and events go out in the order the changes were made.
+	registryMu sync.Mutex
+	nonces     *nonceStore
+	events     *eventBroker
+	relay      *relay
+	clientTTL  time.Duration
+	// relayAddress is the host:port clients are told to reach the relay on.
+	// When empty, the host the client reached the API on is used with
+	// relayPort.
+	relayAddress string
+	relayPort    int
+}
+
+func newServer(store Store) *server {
+	return &server{
+		store:     store,
+		nonces:    newNonceStore(nonceTTL, maxNonces, maxNoncesPerHost),
+		events:    newEventBroker(),
+		relay:     newRelay(defaultRelaySessions, defaultRelaySessionsPerClient, defaultRelayBandwidth),
+		clientTTL: 5 * time.Minute,
+	}
+}
+
+// serveConfig holds the ports the server listens on.
+type serveConfig struct {
+	HTTPPort  int
+	STUNPort  int
+	RelayPort int
+}
+
+// openStore opens the registry store of the given kind: "memory" or "bolt".
+// path is the database file used by the bolt store.
+func openStore(kind, path string) (Store, error) {
+	switch kind {
+	case "memory":
+		return newMemoryStore(), nil
+	case "bolt":
+		return newBoltStore(path)
+	default:
+		return nil, fmt.Errorf("unknown store %q", kind)
+	}
+}
+
+// Serve runs the HTTP API, the STUN binding service and the relay until the
+// process is signalled to stop.
+func (s *server) Serve(cfg serveConfig) error {
+	// Request contexts derive from baseCtx, which is cancelled on shutdown so
+	// that long-lived event streams end instead of holding Shutdown up.
+	baseCtx, cancelBase := context.WithCancel(context.Background())
+	defer cancelBase()
+
 	// Define the server object with some sensible timeout defaults to prevent lingering connections
 	srv := &http.Server{
-		Addr:         fmt.Sprintf(":%d", port),
-		Handler:      routes(),
+		Addr:         fmt.Sprintf(":%d", cfg.HTTPPort),
+		Handler:      s.routes(),
 		IdleTimeout:  time.Minute,
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 30 * time.Second,
+		BaseContext:  func(net.Listener) context.Context { return baseCtx },
 	}
 
+	stunConn, err := net.ListenPacket("udp", fmt.Sprintf(":%d", cfg.STUNPort))
+	if err != nil {
+		return err
+	}
+	defer stunConn.Close()
+
+	slog.Info("Starting STUN service", slog.String("address", stunConn.LocalAddr().String()))
+	go serveSTUN(stunConn)
+
+	relayListener, err := net.Listen("tcp", fmt.Sprintf(":%d", cfg.RelayPort))
+	if err != nil {
+		return err
+	}
+	defer relayListener.Close()
+	s.relayPort = relayListener.Addr().(*net.TCPAddr).Port
+
+	slog.Info("Starting relay", slog.String("address", relayListener.Addr().String()), slog.String("advertisedAddress", s.relayAddress))
+	go s.relay.serve(relayListener)
+
 	// Channel to receive any errors returned by Shutdown()
 	shutdownError := make(chan error)
 
+	// Expire clients in the background so that peer-left events are sent
+	// promptly, rather than only when the next request happens to prune.
+	pruneDone := make(chan struct{})
+	defer close(pruneDone)
+	go s.pruneLoop(30*time.Second, pruneDone)
+
 	go func() {
 		quit := make(chan os.Signal, 1)
 		signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
@@ -34,6 +117,8 @@ func Serve(port int) error {
 
 		slog.Info("Shutting down server", slog.String("receivedSignal", s.String()))
 
+		cancelBase()
+
 		// Give a 5 second grace timeout for in-flight requests to finish
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
@@ -53,7 +138,7 @@ func Serve(port int) error {
 
 	// Calling Shutdown causes an ErrServerClosed error to be thrown - if the error
 	// is anything _but_ that, then we want to return. Otherwise, proceed with shutdown
-	err := srv.ListenAndServe()
+	err = srv.ListenAndServe()
 	if !errors.Is(err, http.ErrServerClosed) {
 		return err
 	}
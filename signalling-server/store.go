@@ -0,0 +1,149 @@
+package main
+
+import (
+	"maps"
+	"sync"
+	"time"
+)
+
+// Store persists the registry of clients and their group memberships.
+// Implementations must be safe for concurrent use.
+type Store interface {
+	// Register adds or replaces the entry for id.
+	Register(id string, info clientInfo) error
+	// Unregister removes id. Removing an unknown client is not an error.
+	Unregister(id string) error
+	// Touch updates the LastSeen time of id, reporting whether it exists.
+	Touch(id string, at time.Time) (bool, error)
+	// Get returns the entry for id.
+	Get(id string) (clientInfo, bool, error)
+	// List returns every registered client, or only the members of group if it
+	// is non-empty.
+	List(group string) (map[string]clientInfo, error)
+	// Prune removes every client last seen before cutoff and returns the
+	// removed entries.
+	Prune(cutoff time.Time) (map[string]clientInfo, error)
+	Close() error
+}
+
+type clientInfo struct {
+	Groups     []string
+	PublicIP   string
+	PublicPort int
+	LocalIP    string
+	LocalPort  int
+	// ReflexiveIP and ReflexivePort are the client's UDP mapping as reported
+	// by the STUN service, if the client managed to learn it.
+	ReflexiveIP   string
+	ReflexivePort int
+	LastSeen      time.Time
+	TokenHash     string
+}
+
+// memoryStore keeps the registry in process memory. Everything is lost when the
+// server restarts.
+type memoryStore struct {
+	mu      sync.Mutex
+	clients map[string]clientInfo
+	groups  map[string]map[string]struct{}
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		clients: make(map[string]clientInfo),
+		groups:  make(map[string]map[string]struct{}),
+	}
+}
+
+func (m *memoryStore) Register(id string, info clientInfo) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.removeLocked(id)
+	m.clients[id] = info
+	for _, group := range info.Groups {
+		if m.groups[group] == nil {
+			m.groups[group] = make(map[string]struct{})
+		}
+		m.groups[group][id] = struct{}{}
+	}
+	return nil
+}
+
+func (m *memoryStore) Unregister(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.removeLocked(id)
+	return nil
+}
+
+func (m *memoryStore) Touch(id string, at time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	info, ok := m.clients[id]
+	if !ok {
+		return false, nil
+	}
+	info.LastSeen = at
+	m.clients[id] = info
+	return true, nil
+}
+
+func (m *memoryStore) Get(id string) (clientInfo, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	info, ok := m.clients[id]
+	return info, ok, nil
+}
+
+func (m *memoryStore) List(group string) (map[string]clientInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if group == "" {
+		return maps.Clone(m.clients), nil
+	}
+
+	members := make(map[string]clientInfo, len(m.groups[group]))
+	for id := range m.groups[group] {
+		members[id] = m.clients[id]
+	}
+	return members, nil
+}
+
+func (m *memoryStore) Prune(cutoff time.Time) (map[string]clientInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	pruned := make(map[string]clientInfo)
+	for id, info := range m.clients {
+		if info.LastSeen.Before(cutoff) {
+			m.removeLocked(id)
+			pruned[id] = info
+		}
+	}
+	return pruned, nil
+}
+
+func (m *memoryStore) Close() error {
+	return nil
+}
+
+// removeLocked deletes id from the registry and every group index.
+func (m *memoryStore) removeLocked(id string) {
+	info, ok := m.clients[id]
+	if !ok {
+		return
+	}
+
+	for _, group := range info.Groups {
+		delete(m.groups[group], id)
+		if len(m.groups[group]) == 0 {
+			delete(m.groups, group)
+		}
+	}
+	delete(m.clients, id)
+}
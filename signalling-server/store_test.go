@@ -0,0 +1,196 @@
+package main
+
+import (
+	"maps"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// storeFactories lists every Store implementation so that each test runs
+// against all of them.
+var storeFactories = map[string]func(t *testing.T) Store{
+	"memory": func(t *testing.T) Store {
+		return newMemoryStore()
+	},
+	"bolt": func(t *testing.T) Store {
+		store, err := newBoltStore(filepath.Join(t.TempDir(), "registry.db"))
+		if err != nil {
+			t.Fatalf("newBoltStore returned error: %v", err)
+		}
+		return store
+	},
+}
+
+func forEachStore(t *testing.T, test func(t *testing.T, store Store)) {
+	for name, factory := range storeFactories {
+		t.Run(name, func(t *testing.T) {
+			store := factory(t)
+			t.Cleanup(func() { store.Close() })
+			test(t, store)
+		})
+	}
+}
+
+func TestStoreRegisterAndGet(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		info := clientInfo{
+			Groups:     []string{"alpha"},
+			PublicIP:   "203.0.113.5",
+			PublicPort: 5000,
+			LastSeen:   time.Now().UTC(),
+			TokenHash:  "hash",
+		}
+		if err := store.Register("client-a", info); err != nil {
+			t.Fatalf("Register returned error: %v", err)
+		}
+
+		got, ok, err := store.Get("client-a")
+		if err != nil || !ok {
+			t.Fatalf("Get returned ok=%v err=%v", ok, err)
+		}
+		if got.PublicIP != info.PublicIP || got.TokenHash != info.TokenHash || !got.LastSeen.Equal(info.LastSeen) {
+			t.Fatalf("expected %+v, got %+v", info, got)
+		}
+
+		if _, ok, _ := store.Get("missing"); ok {
+			t.Fatal("expected missing client not to be found")
+		}
+	})
+}
+
+func TestStoreListByGroup(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		now := time.Now().UTC()
+		store.Register("a", clientInfo{Groups: []string{"alpha"}, LastSeen: now})
+		store.Register("b", clientInfo{Groups: []string{"alpha", "beta"}, LastSeen: now})
+		store.Register("c", clientInfo{Groups: []string{"beta"}, LastSeen: now})
+
+		all, err := store.List("")
+		if err != nil {
+			t.Fatalf("List returned error: %v", err)
+		}
+		if len(all) != 3 {
+			t.Fatalf("expected 3 clients, got %d", len(all))
+		}
+
+		alpha, err := store.List("alpha")
+		if err != nil {
+			t.Fatalf("List returned error: %v", err)
+		}
+		if ids := sortedKeys(alpha); !slices.Equal(ids, []string{"a", "b"}) {
+			t.Fatalf("expected alpha members [a b], got %v", ids)
+		}
+
+		// Re-registering replaces group memberships.
+		store.Register("b", clientInfo{Groups: []string{"beta"}, LastSeen: now})
+		alpha, _ = store.List("alpha")
+		if ids := sortedKeys(alpha); !slices.Equal(ids, []string{"a"}) {
+			t.Fatalf("expected alpha members [a], got %v", ids)
+		}
+
+		if empty, _ := store.List("nobody"); len(empty) != 0 {
+			t.Fatalf("expected unknown group to be empty, got %d", len(empty))
+		}
+	})
+}
+
+func TestStoreUnregister(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		store.Register("a", clientInfo{Groups: []string{"alpha"}, LastSeen: time.Now().UTC()})
+
+		if err := store.Unregister("a"); err != nil {
+			t.Fatalf("Unregister returned error: %v", err)
+		}
+		if err := store.Unregister("a"); err != nil {
+			t.Fatalf("Unregister of unknown client returned error: %v", err)
+		}
+
+		if _, ok, _ := store.Get("a"); ok {
+			t.Fatal("expected client to be removed")
+		}
+		if alpha, _ := store.List("alpha"); len(alpha) != 0 {
+			t.Fatal("expected client to be removed from its groups")
+		}
+	})
+}
+
+func TestStoreTouch(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		store.Register("a", clientInfo{LastSeen: time.Now().UTC().Add(-time.Hour)})
+
+		at := time.Now().UTC()
+		found, err := store.Touch("a", at)
+		if err != nil || !found {
+			t.Fatalf("Touch returned found=%v err=%v", found, err)
+		}
+
+		got, _, _ := store.Get("a")
+		if !got.LastSeen.Equal(at) {
+			t.Fatalf("expected LastSeen %v, got %v", at, got.LastSeen)
+		}
+
+		if found, _ := store.Touch("missing", at); found {
+			t.Fatal("expected Touch of unknown client to report false")
+		}
+	})
+}
+
+func TestStorePrune(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		now := time.Now().UTC()
+		store.Register("stale", clientInfo{Groups: []string{"alpha"}, LastSeen: now.Add(-time.Hour)})
+		store.Register("fresh", clientInfo{Groups: []string{"alpha"}, LastSeen: now})
+
+		pruned, err := store.Prune(now.Add(-time.Minute))
+		if err != nil {
+			t.Fatalf("Prune returned error: %v", err)
+		}
+		if ids := sortedKeys(pruned); !slices.Equal(ids, []string{"stale"}) {
+			t.Fatalf("expected [stale] to be pruned, got %v", ids)
+		}
+
+		alpha, _ := store.List("alpha")
+		if ids := sortedKeys(alpha); !slices.Equal(ids, []string{"fresh"}) {
+			t.Fatalf("expected alpha members [fresh], got %v", ids)
+		}
+	})
+}
+
+func TestBoltStorePersistsAcrossReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registry.db")
+
+	store, err := newBoltStore(path)
+	if err != nil {
+		t.Fatalf("newBoltStore returned error: %v", err)
+	}
+	store.Register("a", clientInfo{Groups: []string{"alpha"}, PublicIP: "203.0.113.5", LastSeen: time.Now().UTC()})
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+
+	reopened, err := newBoltStore(path)
+	if err != nil {
+		t.Fatalf("newBoltStore returned error: %v", err)
+	}
+	t.Cleanup(func() { reopened.Close() })
+
+	alpha, err := reopened.List("alpha")
+	if err != nil {
+		t.Fatalf("List returned error: %v", err)
+	}
+	if alpha["a"].PublicIP != "203.0.113.5" {
+		t.Fatalf("expected client to survive reopening, got %+v", alpha)
+	}
+}
+
+func TestOpenStoreRejectsUnknownKind(t *testing.T) {
+	if _, err := openStore("postgres", ""); err == nil {
+		t.Fatal("expected an error for an unknown store kind")
+	}
+}
+
+func sortedKeys(m map[string]clientInfo) []string {
+	return slices.Sorted(maps.Keys(m))
+}
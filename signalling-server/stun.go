@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"net"
+)
+
+// A minimal STUN server (RFC 5389) that answers Binding requests, so that
+// clients can learn the address and port their UDP socket is mapped to by any
+// NAT in front of them. Authentication and the other STUN methods are not
+// supported; anything other than a well-formed Binding request is ignored.
+
+const (
+	stunHeaderSize  = 20
+	stunMagicCookie = 0x2112A442
+
+	stunBindingRequest  = 0x0001
+	stunBindingResponse = 0x0101
+
+	stunAttrXorMappedAddress = 0x0020
+	stunAttrSoftware         = 0x8022
+
+	stunFamilyIPv4 = 0x01
+	stunFamilyIPv6 = 0x02
+
+	stunSoftware = "syncmesh"
+)
+
+// serveSTUN answers Binding requests received on conn until it is closed.
+func serveSTUN(conn net.PacketConn) {
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				slog.Error("STUN read failed", slog.String("error", err.Error()))
+			}
+			return
+		}
+
+		addr, ok := from.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+
+		resp, ok := stunBindingReply(buf[:n], addr)
+		if !ok {
+			continue
+		}
+		if _, err := conn.WriteTo(resp, from); err != nil {
+			slog.Error("STUN write failed", slog.String("remoteAddr", from.String()), slog.String("error", err.Error()))
+		}
+	}
+}
+
+// stunBindingReply builds the Binding success response to msg, telling the
+// sender that it was seen at from. ok is false if msg is not a Binding request.
+func stunBindingReply(msg []byte, from *net.UDPAddr) ([]byte, bool) {
+	if len(msg) < stunHeaderSize || msg[0]&0xC0 != 0 {
+		return nil, false
+	}
+	if binary.BigEndian.Uint16(msg[0:2]) != stunBindingRequest ||
+		binary.BigEndian.Uint32(msg[4:8]) != stunMagicCookie ||
+		int(binary.BigEndian.Uint16(msg[2:4])) != len(msg)-stunHeaderSize {
+		return nil, false
+	}
+	transactionID := msg[8:20]
+
+	var attrs []byte
+	attrs = appendSTUNAttr(attrs, stunAttrXorMappedAddress, xorMappedAddress(from, transactionID))
+	attrs = appendSTUNAttr(attrs, stunAttrSoftware, []byte(stunSoftware))
+
+	resp := make([]byte, stunHeaderSize, stunHeaderSize+len(attrs))
+	binary.BigEndian.PutUint16(resp[0:2], stunBindingResponse)
+	binary.BigEndian.PutUint16(resp[2:4], uint16(len(attrs)))
+	binary.BigEndian.PutUint32(resp[4:8], stunMagicCookie)
+	copy(resp[8:20], transactionID)
+	return append(resp, attrs...), true
+}
+
+// xorMappedAddress encodes addr as the value of an XOR-MAPPED-ADDRESS
+// attribute: the port is XORed with the top half of the magic cookie and the
+// address with the cookie followed, for IPv6, by the transaction ID.
+func xorMappedAddress(addr *net.UDPAddr, transactionID []byte) []byte {
+	var key [16]byte
+	binary.BigEndian.PutUint32(key[0:4], stunMagicCookie)
+	copy(key[4:], transactionID)
+
+	family, ip := byte(stunFamilyIPv6), addr.IP.To16()
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		family, ip = stunFamilyIPv4, ip4
+	}
+
+	value := make([]byte, 4+len(ip))
+	value[1] = family
+	binary.BigEndian.PutUint16(value[2:4], uint16(addr.Port)^uint16(stunMagicCookie>>16))
+	for i := range ip {
+		value[4+i] = ip[i] ^ key[i]
+	}
+	return value
+}
+
+// appendSTUNAttr appends a type-length-value attribute, padded to a multiple of
+// four bytes.
+func appendSTUNAttr(b []byte, attrType uint16, value []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, attrType)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(value)))
+	b = append(b, value...)
+	if pad := (4 - len(value)%4) % 4; pad > 0 {
+		b = append(b, make([]byte, pad)...)
+	}
+	return b
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func bindingRequest(transactionID []byte) []byte {
+	msg := make([]byte, stunHeaderSize)
+	binary.BigEndian.PutUint16(msg[0:2], stunBindingRequest)
+	binary.BigEndian.PutUint32(msg[4:8], stunMagicCookie)
+	copy(msg[8:20], transactionID)
+	return msg
+}
+
+// decodeXorMappedAddress finds the XOR-MAPPED-ADDRESS attribute in a Binding
+// response and returns the address it encodes.
+func decodeXorMappedAddress(t *testing.T, resp []byte) *net.UDPAddr {
+	t.Helper()
+
+	if len(resp) < stunHeaderSize {
+		t.Fatalf("response too short: %d bytes", len(resp))
+	}
+	if got := binary.BigEndian.Uint16(resp[0:2]); got != stunBindingResponse {
+		t.Fatalf("expected binding response, got type %#04x", got)
+	}
+
+	var key [16]byte
+	binary.BigEndian.PutUint32(key[0:4], stunMagicCookie)
+	copy(key[4:], resp[8:20])
+
+	attrs := resp[stunHeaderSize:]
+	for len(attrs) >= 4 {
+		attrType := binary.BigEndian.Uint16(attrs[0:2])
+		length := int(binary.BigEndian.Uint16(attrs[2:4]))
+		value := attrs[4 : 4+length]
+
+		if attrType == stunAttrXorMappedAddress {
+			ip := make(net.IP, len(value)-4)
+			for i := range ip {
+				ip[i] = value[4+i] ^ key[i]
+			}
+			port := binary.BigEndian.Uint16(value[2:4]) ^ uint16(stunMagicCookie>>16)
+			return &net.UDPAddr{IP: ip, Port: int(port)}
+		}
+		attrs = attrs[4+(length+3)/4*4:]
+	}
+
+	t.Fatalf("response has no XOR-MAPPED-ADDRESS")
+	return nil
+}
+
+func TestStunBindingReplyIPv4(t *testing.T) {
+	transactionID := []byte("abcdefghijkl")
+	from := &net.UDPAddr{IP: net.ParseIP("203.0.113.10"), Port: 51234}
+
+	resp, ok := stunBindingReply(bindingRequest(transactionID), from)
+	if !ok {
+		t.Fatalf("expected binding request to be answered")
+	}
+	if !bytes.Equal(resp[8:20], transactionID) {
+		t.Fatalf("expected transaction ID to be echoed")
+	}
+	if got := int(binary.BigEndian.Uint16(resp[2:4])); got != len(resp)-stunHeaderSize {
+		t.Fatalf("header length %d does not match attributes length %d", got, len(resp)-stunHeaderSize)
+	}
+
+	addr := decodeXorMappedAddress(t, resp)
+	if !addr.IP.Equal(from.IP) || addr.Port != from.Port {
+		t.Fatalf("expected mapped address %s, got %s", from, addr)
+	}
+}
+
+func TestStunBindingReplyIPv6(t *testing.T) {
+	from := &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 40000}
+
+	resp, ok := stunBindingReply(bindingRequest([]byte("0123456789ab")), from)
+	if !ok {
+		t.Fatalf("expected binding request to be answered")
+	}
+
+	addr := decodeXorMappedAddress(t, resp)
+	if !addr.IP.Equal(from.IP) || addr.Port != from.Port {
+		t.Fatalf("expected mapped address %s, got %s", from, addr)
+	}
+}
+
+func TestStunBindingReplyIgnoresOtherMessages(t *testing.T) {
+	from := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1}
+
+	if _, ok := stunBindingReply([]byte("not stun"), from); ok {
+		t.Fatalf("expected short message to be ignored")
+	}
+
+	badCookie := bindingRequest([]byte("abcdefghijkl"))
+	binary.BigEndian.PutUint32(badCookie[4:8], 0)
+	if _, ok := stunBindingReply(badCookie, from); ok {
+		t.Fatalf("expected message without magic cookie to be ignored")
+	}
+
+	response := bindingRequest([]byte("abcdefghijkl"))
+	binary.BigEndian.PutUint16(response[0:2], stunBindingResponse)
+	if _, ok := stunBindingReply(response, from); ok {
+		t.Fatalf("expected binding response to be ignored")
+	}
+}
+
+func TestServeSTUNAnswersOverUDP(t *testing.T) {
+	serverConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer serverConn.Close()
+	go serveSTUN(serverConn)
+
+	client, err := net.DialUDP("udp", nil, serverConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer client.Close()
+
+	if _, err := client.Write(bindingRequest([]byte("abcdefghijkl"))); err != nil {
+		t.Fatalf("failed to send request: %v", err)
+	}
+
+	_ = client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 1500)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+
+	local := client.LocalAddr().(*net.UDPAddr)
+	addr := decodeXorMappedAddress(t, buf[:n])
+	if !addr.IP.Equal(local.IP) || addr.Port != local.Port {
+		t.Fatalf("expected mapped address %s, got %s", local, addr)
+	}
+}